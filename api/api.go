@@ -92,6 +92,7 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 			r.Get("/{vat_number}", api.VatNumberLookup)
 		})
 
+		r.Post("/payments/webhooks/{provider}", api.PaymentWebhook)
 		r.Route("/payments", func(r *router) {
 			r.Use(adminRequired)
 
@@ -99,6 +100,9 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 			r.Route("/{payment_id}", func(r *router) {
 				r.Get("/", api.PaymentView)
 				r.With(addGetBody).Post("/refund", api.PaymentRefund)
+				r.Post("/capture", api.PaymentCapture)
+				r.Post("/void", api.PaymentVoid)
+				r.Post("/paid", api.PaymentMarkPaid)
 			})
 		})
 
@@ -115,7 +119,37 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 
 		r.Route("/coupons", func(r *router) {
 			r.With(adminRequired).Get("/", api.CouponList)
+			r.With(adminRequired).Post("/", api.CouponCreate)
+			r.With(adminRequired).Post("/generate", api.CouponGenerate)
+			r.With(adminRequired).Get("/campaigns/{campaign}", api.CouponExport)
 			r.Get("/{coupon_code}", api.CouponView)
+			r.With(adminRequired).Put("/{coupon_code}", api.CouponUpdate)
+			r.With(adminRequired).Delete("/{coupon_code}", api.CouponDelete)
+		})
+
+		r.Route("/shipping", func(r *router) {
+			r.Post("/quotes", api.ShippingQuotes)
+		})
+
+		r.Route("/exchange_rates", func(r *router) {
+			r.Get("/", api.ExchangeRatesView)
+			r.With(adminRequired).Put("/", api.ExchangeRatesUpdate)
+			r.With(adminRequired).Delete("/", api.ExchangeRatesDelete)
+		})
+
+		r.Route("/giftcards", func(r *router) {
+			r.With(adminRequired).Get("/", api.GiftCardList)
+			r.With(adminRequired).Post("/", api.GiftCardCreate)
+			r.Get("/{gift_card_code}", api.GiftCardView)
+		})
+
+		r.Route("/inventory", func(r *router) {
+			r.Use(adminRequired)
+
+			r.Get("/", api.InventoryList)
+			r.Get("/{sku}", api.InventoryView)
+			r.Put("/{sku}", api.InventoryUpdate)
+			r.Delete("/{sku}", api.InventoryDelete)
 		})
 
 		r.Get("/settings", api.ViewSettings)
@@ -143,8 +177,8 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 
 	corsHandler := cors.New(cors.Options{
 		AllowedMethods:   []string{"GET", "POST", "PATCH", "PUT", "DELETE"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type"},
-		ExposedHeaders:   []string{"Link", "X-Total-Count"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", idempotencyKeyHeaderName},
+		ExposedHeaders:   []string{"Link", "X-Total-Count", idempotentReplayedHeaderName},
 		AllowCredentials: true,
 	})
 
@@ -154,7 +188,8 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 
 func (a *API) orderRoutes(r *router) {
 	r.With(authRequired).Get("/", a.OrderList)
-	r.Post("/", a.OrderCreate)
+	r.WithBypass(a.withIdempotencyKey).Post("/", a.OrderCreate)
+	r.Post("/preview", a.OrderPreview)
 
 	r.Route("/{order_id}", func(r *router) {
 		r.Use(a.withOrderID)
@@ -163,7 +198,8 @@ func (a *API) orderRoutes(r *router) {
 
 		r.Route("/payments", func(r *router) {
 			r.With(authRequired).Get("/", a.PaymentListForOrder)
-			r.With(addGetBody).Post("/", a.PaymentCreate)
+			r.WithBypass(a.withIdempotencyKey).With(addGetBody).Post("/", a.PaymentCreate)
+			r.Post("/{payment_id}/confirm", a.PaymentConfirm)
 		})
 
 		r.Get("/downloads", a.DownloadList)
@@ -187,6 +223,21 @@ func (a *API) userRoutes(r *router) {
 		r.Get("/payments", a.PaymentListForUser)
 		r.Get("/orders", a.OrderList)
 
+		r.Route("/payment_methods", func(r *router) {
+			r.Get("/", a.PaymentMethodList)
+			r.Delete("/{payment_method_id}", a.PaymentMethodDelete)
+		})
+
+		r.Route("/subscriptions", func(r *router) {
+			r.Get("/", a.SubscriptionList)
+			r.Route("/{subscription_id}", func(r *router) {
+				r.Get("/", a.SubscriptionView)
+				r.Post("/cancel", a.SubscriptionCancel)
+				r.Post("/pause", a.SubscriptionPause)
+				r.Post("/resume", a.SubscriptionResume)
+			})
+		})
+
 		r.Route("/addresses", func(r *router) {
 			r.Get("/", a.AddressList)
 			r.With(adminRequired).Post("/", a.CreateNewAddress)
@@ -1,27 +1,40 @@
 package api
 
 import (
-	"net/http"
-
 	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
 
 	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
 	gcontext "gocommerce/context"
 	"gocommerce/coupons"
 	"gocommerce/models"
 )
 
+// couponCache returns the coupon cache for the coupon source of the instance.
+// It is nil if the instance only uses a coupon URL and has none configured.
+func (a *API) couponCache(ctx context.Context) (coupons.Cache, error) {
+	config := gcontext.GetConfig(ctx)
+	dbCache := coupons.NewCouponCacheFromDB(a.db, gcontext.GetInstanceID(ctx))
+	return coupons.NewCouponCache(config.Coupons.Source, gcontext.GetCoupons(ctx), dbCache)
+}
+
 func (a *API) lookupCoupon(ctx context.Context, w http.ResponseWriter, code string) (*models.Coupon, error) {
-	couponCache := gcontext.GetCoupons(ctx)
+	couponCache, err := a.couponCache(ctx)
+	if err != nil {
+		return nil, internalServerError("Error loading coupons").WithInternalError(err)
+	}
 	if couponCache == nil {
 		return nil, notFoundError("No coupons available")
 	}
 
 	coupon, err := couponCache.Lookup(code)
 	if err != nil {
-		switch v := err.(type) {
-		case coupons.CouponNotFound:
-			return nil, notFoundError(v.Error())
+		switch err.(type) {
+		case coupons.CouponNotFound, *coupons.CouponNotFound:
+			return nil, notFoundError("%v", err)
 		default:
 			return nil, internalServerError("Error fetching coupon").WithInternalError(err)
 		}
@@ -30,7 +43,49 @@ func (a *API) lookupCoupon(ctx context.Context, w http.ResponseWriter, code stri
 	return coupon, nil
 }
 
-// CouponView returns information about a single coupon code.
+// couponUsage is a coupon with the number of times it was used.
+type couponUsage struct {
+	*models.Coupon
+	Redemptions uint64 `json:"redemptions"`
+}
+
+// checkCouponRedemptions returns an error if a coupon of an order was used
+// as often as it may be in total or by the user or email of the order.
+func checkCouponRedemptions(db *gorm.DB, order *models.Order) *HTTPError {
+	for _, coupon := range order.AllCoupons() {
+		if coupon.MaxRedemptions > 0 {
+			count, err := models.CountCouponRedemptions(db, order.InstanceID, coupon.Code, "", "")
+			if err != nil {
+				return internalServerError("Error while querying for coupon redemptions").WithInternalError(err)
+			}
+			if count >= coupon.MaxRedemptions {
+				return badRequestError("%v", &models.CouponLimitError{Code: coupon.Code})
+			}
+		}
+		if coupon.MaxRedemptionsPerUser > 0 {
+			count, err := models.CountCouponRedemptions(db, order.InstanceID, coupon.Code, order.UserID, order.Email)
+			if err != nil {
+				return internalServerError("Error while querying for coupon redemptions").WithInternalError(err)
+			}
+			if count >= coupon.MaxRedemptionsPerUser {
+				return badRequestError("%v", &models.CouponLimitError{Code: coupon.Code, PerUser: true})
+			}
+		}
+	}
+	return nil
+}
+
+// couponRedemptionError turns an error from reserving coupon redemptions into
+// an HTTP error.
+func couponRedemptionError(err error) *HTTPError {
+	if e, ok := err.(*models.CouponLimitError); ok {
+		return badRequestError("%v", e)
+	}
+	return internalServerError("Error reserving coupon redemptions").WithInternalError(err)
+}
+
+// CouponView returns information about a single coupon code. Admins also get
+// the number of times the coupon was used.
 func (a *API) CouponView(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	log := getLogEntry(r)
@@ -41,6 +96,13 @@ func (a *API) CouponView(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	if gcontext.IsAdmin(ctx) {
+		count, err := models.CountCouponRedemptions(a.db, gcontext.GetInstanceID(ctx), coupon.Code, "", "")
+		if err != nil {
+			return internalServerError("Error while querying for coupon redemptions").WithInternalError(err)
+		}
+		return sendJSON(w, http.StatusOK, &couponUsage{Coupon: coupon, Redemptions: count})
+	}
 	return sendJSON(w, http.StatusOK, coupon)
 }
 
@@ -49,7 +111,10 @@ func (a *API) CouponList(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	log := getLogEntry(r)
 
-	couponCache := gcontext.GetCoupons(ctx)
+	couponCache, err := a.couponCache(ctx)
+	if err != nil {
+		return internalServerError("Error loading coupons").WithInternalError(err)
+	}
 	if couponCache == nil {
 		return sendJSON(w, http.StatusOK, []string{})
 	}
@@ -62,3 +127,174 @@ func (a *API) CouponList(w http.ResponseWriter, r *http.Request) error {
 
 	return sendJSON(w, http.StatusOK, coupons)
 }
+
+func readCouponParams(r *http.Request) (*models.Coupon, *HTTPError) {
+	coupon := &models.Coupon{}
+	if err := json.NewDecoder(r.Body).Decode(coupon); err != nil {
+		return nil, badRequestError("Could not read params: %v", err)
+	}
+	if err := coupon.CheckAmounts(); err != nil {
+		return nil, badRequestError("%v", err)
+	}
+	return coupon, nil
+}
+
+// requireCouponsDB returns an error unless the coupons stored in the database
+// are used by the instance.
+func requireCouponsDB(ctx context.Context) *HTTPError {
+	config := gcontext.GetConfig(ctx)
+	if !coupons.UsesDB(config.Coupons.Source) {
+		return badRequestError("Coupons are stored in the database, which requires the coupon source to be '%v' or '%v'", coupons.SourceDB, coupons.SourceBoth)
+	}
+	return nil
+}
+
+// CouponCreate stores a new coupon for the instance. Requires admin permissions
+func (a *API) CouponCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instanceID := gcontext.GetInstanceID(ctx)
+	if httpErr := requireCouponsDB(ctx); httpErr != nil {
+		return httpErr
+	}
+	coupon, httpErr := readCouponParams(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if coupon.Code == "" {
+		return badRequestError("A coupon code is required")
+	}
+
+	existing, err := models.GetStoredCoupon(a.db, instanceID, coupon.Code)
+	if err != nil {
+		return internalServerError("Error while querying for coupon").WithInternalError(err)
+	}
+	if existing != nil {
+		return conflictError("A coupon with this code already exists")
+	}
+
+	stored := models.NewStoredCoupon(instanceID, coupon)
+	if rsp := a.db.Create(stored); rsp.Error != nil {
+		// a concurrent request may have created the coupon in the meantime
+		if existing, err := models.GetStoredCoupon(a.db, instanceID, coupon.Code); err == nil && existing != nil {
+			return conflictError("A coupon with this code already exists").WithInternalError(rsp.Error)
+		}
+		return internalServerError("Error saving coupon").WithInternalError(rsp.Error)
+	}
+
+	getLogEntry(r).WithField("coupon_code", coupon.Code).Info("Created coupon")
+	return sendJSON(w, http.StatusCreated, stored.Coupon)
+}
+
+// CouponUpdate replaces a coupon stored for the instance. Requires admin
+// permissions
+func (a *API) CouponUpdate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instanceID := gcontext.GetInstanceID(ctx)
+	if httpErr := requireCouponsDB(ctx); httpErr != nil {
+		return httpErr
+	}
+	code := chi.URLParam(r, "coupon_code")
+	coupon, httpErr := readCouponParams(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if coupon.Code != "" && coupon.Code != code {
+		return badRequestError("The coupon code can not be changed")
+	}
+	coupon.Code = code
+
+	stored, err := models.GetStoredCoupon(a.db, instanceID, code)
+	if err != nil {
+		return internalServerError("Error while querying for coupon").WithInternalError(err)
+	}
+	if stored == nil {
+		return notFoundError("Coupon not found")
+	}
+	stored.Coupon = coupon
+	if rsp := a.db.Save(stored); rsp.Error != nil {
+		return internalServerError("Error saving coupon").WithInternalError(rsp.Error)
+	}
+
+	getLogEntry(r).WithField("coupon_code", code).Info("Updated coupon")
+	return sendJSON(w, http.StatusOK, stored.Coupon)
+}
+
+// CouponDelete removes a coupon stored for the instance. Requires admin
+// permissions
+func (a *API) CouponDelete(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	code := chi.URLParam(r, "coupon_code")
+
+	stored, err := models.GetStoredCoupon(a.db, instanceID, code)
+	if err != nil {
+		return internalServerError("Error while querying for coupon").WithInternalError(err)
+	}
+	if stored == nil {
+		return notFoundError("Coupon not found")
+	}
+	if rsp := a.db.Delete(stored); rsp.Error != nil {
+		return internalServerError("Error deleting coupon").WithInternalError(rsp.Error)
+	}
+
+	getLogEntry(r).WithField("coupon_code", code).Info("Deleted coupon")
+	return sendJSON(w, http.StatusOK, map[string]string{})
+}
+
+type generatedCoupons struct {
+	Campaign string   `json:"campaign"`
+	Codes    []string `json:"codes"`
+}
+
+// CouponGenerate creates random coupon codes from a template for a campaign.
+// Requires admin permissions
+func (a *API) CouponGenerate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instanceID := gcontext.GetInstanceID(ctx)
+	if httpErr := requireCouponsDB(ctx); httpErr != nil {
+		return httpErr
+	}
+
+	params := &coupons.GenerateParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	if err := params.Validate(); err != nil {
+		return badRequestError("%v", err)
+	}
+
+	generated, err := coupons.Generate(a.db, instanceID, params)
+	if err != nil {
+		return internalServerError("Error generating coupons").WithInternalError(err)
+	}
+
+	result := &generatedCoupons{Campaign: params.Campaign, Codes: []string{}}
+	for _, c := range generated {
+		result.Codes = append(result.Codes, c.Code)
+	}
+	getLogEntry(r).WithField("campaign", params.Campaign).Infof("Generated %d coupons", len(generated))
+	return sendJSON(w, http.StatusCreated, result)
+}
+
+// CouponExport returns the coupons of a campaign with their usage as CSV.
+// Requires admin permissions
+func (a *API) CouponExport(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	campaign := chi.URLParam(r, "campaign")
+
+	stored, err := models.ListStoredCoupons(a.db, instanceID, campaign)
+	if err != nil {
+		return internalServerError("Error while querying for coupons").WithInternalError(err)
+	}
+	if len(stored) == 0 {
+		return notFoundError("Campaign not found")
+	}
+	redemptions, err := models.CountAllCouponRedemptions(a.db, instanceID)
+	if err != nil {
+		return internalServerError("Error while querying for coupon redemptions").WithInternalError(err)
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", campaign+".csv"))
+	w.WriteHeader(http.StatusOK)
+	return coupons.WriteCSV(w, stored, redemptions)
+}
@@ -1,13 +1,19 @@
 package api
 
 import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"gocommerce/models"
+	"gocommerce/payments"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCouponView(t *testing.T) {
@@ -30,6 +36,361 @@ func TestCouponView(t *testing.T) {
 	})
 }
 
+func TestCouponRedemptionLimits(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	couponServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"coupons": {
+			"ONCE": {"percentage": 10, "max_redemptions": 1},
+			"LAST": {"percentage": 10, "max_redemptions": 1},
+			"ONCE-EACH": {"percentage": 10, "max_redemptions_per_user": 1}
+		}}`)
+	}))
+	defer couponServer.Close()
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+	test.Config.Coupons.URL = couponServer.URL
+	test.Config.Payment.GiftCard.Enabled = true
+	adminToken := testAdminToken("magical-unicorn", "")
+
+	createOrder := func(code string) *httptest.ResponseRecorder {
+		body := strings.NewReader(`{
+			"email": "info@example.com",
+			"shipping_address": {
+				"name": "Test User",
+				"address1": "610 22nd Street",
+				"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+			},
+			"line_items": [{"path": "/simple-product", "quantity": 1}],
+			"coupon": "` + code + `"
+		}`)
+		return test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+	}
+	payWithBalance := func(order *models.Order, balance uint64) *httptest.ResponseRecorder {
+		card := issueGiftCard(t, test, &GiftCardParams{Amount: balance})
+		body, err := json.Marshal(map[string]interface{}{
+			"amount":         order.Total,
+			"currency":       order.Currency,
+			"gift_card_code": card.Code,
+			"provider":       payments.GiftCardProvider,
+		})
+		require.NoError(t, err)
+		return test.TestEndpoint(http.MethodPost, "/orders/"+order.ID+"/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+	}
+	pay := func(order *models.Order) *httptest.ResponseRecorder {
+		return payWithBalance(order, order.Total)
+	}
+	redemptions := func(code string) uint64 {
+		usage := &couponUsage{}
+		recorder := test.TestEndpoint(http.MethodGet, "/coupons/"+code, nil, adminToken)
+		extractPayload(t, http.StatusOK, recorder, usage)
+		return usage.Redemptions
+	}
+
+	t.Run("Total", func(t *testing.T) {
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, createOrder("ONCE"), order)
+		assert.EqualValues(t, 0, redemptions("ONCE"))
+
+		assert.Equal(t, http.StatusOK, pay(order).Code)
+		assert.EqualValues(t, 1, redemptions("ONCE"))
+
+		validateError(t, http.StatusBadRequest, createOrder("ONCE"), "used up")
+	})
+
+	t.Run("PerUser", func(t *testing.T) {
+		first, second := &models.Order{}, &models.Order{}
+		extractPayload(t, http.StatusCreated, createOrder("ONCE-EACH"), first)
+		extractPayload(t, http.StatusCreated, createOrder("ONCE-EACH"), second)
+
+		assert.Equal(t, http.StatusOK, pay(first).Code)
+		validateError(t, http.StatusBadRequest, pay(second), "maximum number of times")
+		assert.EqualValues(t, 1, redemptions("ONCE-EACH"))
+	})
+
+	t.Run("ReleasedOnFailedPayment", func(t *testing.T) {
+		first, second := &models.Order{}, &models.Order{}
+		extractPayload(t, http.StatusCreated, createOrder("LAST"), first)
+		extractPayload(t, http.StatusCreated, createOrder("LAST"), second)
+
+		validateError(t, http.StatusInternalServerError, payWithBalance(first, 1), "balance is too low")
+		assert.EqualValues(t, 0, redemptions("LAST"))
+
+		assert.Equal(t, http.StatusOK, pay(second).Code)
+		assert.EqualValues(t, 1, redemptions("LAST"))
+		validateError(t, http.StatusBadRequest, pay(first), "used up")
+		assert.EqualValues(t, 1, redemptions("LAST"))
+
+		usage := &models.CouponUsage{}
+		require.NoError(t, test.DB.First(usage, "coupon_code = ?", "LAST").Error)
+		assert.EqualValues(t, 1, usage.Uses)
+	})
+}
+
+func TestOrderCreateWithStackedCoupons(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	couponServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"coupons": {
+			"TEN": {"percentage": 10, "stackable": true, "priority": 1},
+			"ONE": {"fixed": [{"amount": "1.00", "currency": "USD"}], "stackable": true, "sequential": true},
+			"HALF": {"percentage": 50},
+			"QUARTER": {"percentage": 25},
+			"ALONE": {"percentage": 20, "stackable": true, "exclusive": true}
+		}}`)
+	}))
+	defer couponServer.Close()
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+	test.Config.Coupons.URL = couponServer.URL
+
+	createOrder := func(codes ...string) *httptest.ResponseRecorder {
+		data, err := json.Marshal(codes)
+		require.NoError(t, err)
+		body := strings.NewReader(`{
+			"email": "info@example.com",
+			"shipping_address": {
+				"name": "Test User",
+				"address1": "610 22nd Street",
+				"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+			},
+			"line_items": [{"path": "/simple-product", "quantity": 1}],
+			"coupons": ` + string(data) + `
+		}`)
+		return test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+	}
+
+	t.Run("Stackable", func(t *testing.T) {
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, createOrder("ONE", "TEN", "HALF"), order)
+		require.Len(t, order.Coupons, 3)
+		assert.Equal(t, "ONE", order.CouponCode)
+
+		// TEN goes first by priority, the others in the order they were given
+		assert.EqualValues(t, 700, order.Discount)
+		assert.EqualValues(t, 299, order.Total)
+		codes := []string{}
+		for _, item := range order.LineItems[0].CalculationDetail.DiscountItems {
+			codes = append(codes, item.CouponCode)
+		}
+		assert.Equal(t, []string{"TEN", "ONE", "HALF"}, codes)
+	})
+
+	t.Run("NotStackable", func(t *testing.T) {
+		validateError(t, http.StatusBadRequest, createOrder("HALF", "QUARTER"), "isn't stackable")
+	})
+
+	t.Run("Exclusive", func(t *testing.T) {
+		validateError(t, http.StatusBadRequest, createOrder("ALONE", "TEN"), "can't be combined")
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, createOrder("ALONE"), order)
+		assert.EqualValues(t, 200, order.Discount)
+	})
+}
+
+func TestOrderCreateWithOrderFixedCoupon(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	couponServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"coupons": {
+			"FIVE-PER-ITEM": {"fixed": [{"amount": "5.00", "currency": "USD"}]},
+			"FIVE-PER-ORDER": {"fixed": [{"amount": "5.00", "currency": "USD"}], "order_fixed": true}
+		}}`)
+	}))
+	defer couponServer.Close()
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+	test.Config.Coupons.URL = couponServer.URL
+
+	createOrder := func(code string) *models.Order {
+		body := strings.NewReader(`{
+			"email": "info@example.com",
+			"shipping_address": {
+				"name": "Test User",
+				"address1": "610 22nd Street",
+				"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+			},
+			"line_items": [{"path": "/simple-product", "quantity": 3}],
+			"coupon": "` + code + `"
+		}`)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken), order)
+		return order
+	}
+
+	assert.EqualValues(t, 1500, createOrder("FIVE-PER-ITEM").Discount)
+	assert.EqualValues(t, 500, createOrder("FIVE-PER-ORDER").Discount)
+}
+
+func TestCouponAdminEndpoints(t *testing.T) {
+	test := NewRouteTest(t)
+	test.Config.Coupons.Source = "db"
+	adminToken := testAdminToken("magical-unicorn", "")
+
+	t.Run("RequiresAdmin", func(t *testing.T) {
+		body := strings.NewReader(`{"code": "SPRING", "percentage": 10}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/coupons", body, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("Create", func(t *testing.T) {
+		body := strings.NewReader(`{"code": "SPRING", "percentage": 10, "product_types": ["book"]}`)
+		coupon := &models.Coupon{}
+		extractPayload(t, http.StatusCreated, test.TestEndpoint(http.MethodPost, "/coupons", body, adminToken), coupon)
+		assert.Equal(t, "SPRING", coupon.Code)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/coupons/SPRING", nil, nil)
+		extractPayload(t, http.StatusOK, recorder, coupon)
+		assert.EqualValues(t, 10, coupon.Percentage)
+		assert.Equal(t, []string{"book"}, coupon.ProductTypes)
+
+		body = strings.NewReader(`{"code": "SPRING", "percentage": 20}`)
+		validateError(t, http.StatusConflict, test.TestEndpoint(http.MethodPost, "/coupons", body, adminToken))
+
+		body = strings.NewReader(`{"percentage": 20}`)
+		validateError(t, http.StatusBadRequest, test.TestEndpoint(http.MethodPost, "/coupons", body, adminToken))
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		body := strings.NewReader(`{"percentage": 25}`)
+		coupon := &models.Coupon{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodPut, "/coupons/SPRING", body, adminToken), coupon)
+		assert.EqualValues(t, 25, coupon.Percentage)
+		assert.Empty(t, coupon.ProductTypes)
+
+		body = strings.NewReader(`{"percentage": 25}`)
+		validateError(t, http.StatusNotFound, test.TestEndpoint(http.MethodPut, "/coupons/SUMMER", body, adminToken))
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodDelete, "/coupons/SPRING", nil, adminToken)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		validateError(t, http.StatusNotFound, test.TestEndpoint(http.MethodGet, "/coupons/SPRING", nil, nil))
+		validateError(t, http.StatusNotFound, test.TestEndpoint(http.MethodDelete, "/coupons/SPRING", nil, adminToken))
+	})
+
+	t.Run("URLSource", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := strings.NewReader(`{"code": "SPRING", "percentage": 10}`)
+		validateError(t, http.StatusBadRequest, test.TestEndpoint(http.MethodPost, "/coupons", body, adminToken), "coupon source")
+
+		body = strings.NewReader(`{"percentage": 25}`)
+		validateError(t, http.StatusBadRequest, test.TestEndpoint(http.MethodPut, "/coupons/SPRING", body, adminToken), "coupon source")
+	})
+}
+
+func TestCouponSources(t *testing.T) {
+	server := startTestCouponURLs()
+	defer server.Close()
+	test := NewRouteTest(t)
+	test.Config.Coupons.URL = server.URL
+	test.Config.Coupons.Source = "db"
+	adminToken := testAdminToken("magical-unicorn", "")
+
+	body := strings.NewReader(`{"code": "db-code", "percentage": 30}`)
+	require.Equal(t, http.StatusCreated, test.TestEndpoint(http.MethodPost, "/coupons", body, adminToken).Code)
+
+	list := func() map[string]*models.Coupon {
+		coupons := map[string]*models.Coupon{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/coupons", nil, adminToken), &coupons)
+		return coupons
+	}
+
+	t.Run("URL", func(t *testing.T) {
+		test.Config.Coupons.Source = ""
+		coupons := list()
+		assert.Len(t, coupons, 1)
+		assert.Contains(t, coupons, "coupon-code")
+	})
+	t.Run("DB", func(t *testing.T) {
+		test.Config.Coupons.Source = "db"
+		coupons := list()
+		assert.Len(t, coupons, 1)
+		assert.Contains(t, coupons, "db-code")
+		validateError(t, http.StatusNotFound, test.TestEndpoint(http.MethodGet, "/coupons/coupon-code", nil, nil))
+	})
+	t.Run("Both", func(t *testing.T) {
+		test.Config.Coupons.Source = "both"
+		coupons := list()
+		assert.Len(t, coupons, 2)
+
+		coupon := &models.Coupon{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/coupons/coupon-code", nil, nil), coupon)
+		assert.EqualValues(t, 15, coupon.Percentage)
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/coupons/db-code", nil, nil), coupon)
+		assert.EqualValues(t, 30, coupon.Percentage)
+	})
+}
+
+func TestCouponGenerate(t *testing.T) {
+	test := NewRouteTest(t)
+	test.Config.Coupons.Source = "db"
+	adminToken := testAdminToken("magical-unicorn", "")
+
+	body := strings.NewReader(`{
+		"template": {"percentage": 20},
+		"count": 25,
+		"campaign": "newsletter",
+		"prefix": "NEWS-",
+		"length": 6
+	}`)
+	generated := &generatedCoupons{}
+	extractPayload(t, http.StatusCreated, test.TestEndpoint(http.MethodPost, "/coupons/generate", body, adminToken), generated)
+	assert.Equal(t, "newsletter", generated.Campaign)
+	require.Len(t, generated.Codes, 25)
+
+	unique := map[string]bool{}
+	for _, code := range generated.Codes {
+		assert.Len(t, code, 11)
+		assert.True(t, strings.HasPrefix(code, "NEWS-"))
+		unique[code] = true
+	}
+	assert.Len(t, unique, 25)
+
+	// generated coupons are single use
+	coupon := &models.Coupon{}
+	extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/coupons/"+generated.Codes[0], nil, nil), coupon)
+	assert.EqualValues(t, 20, coupon.Percentage)
+	assert.EqualValues(t, 1, coupon.MaxRedemptions)
+
+	t.Run("Export", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodGet, "/coupons/campaigns/newsletter", nil, adminToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "text/csv", recorder.Header().Get("Content-Type"))
+
+		records, err := csv.NewReader(recorder.Body).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, records, 26)
+		assert.Equal(t, []string{"code", "campaign", "max_redemptions", "redemptions", "created_at"}, records[0])
+		assert.Equal(t, "newsletter", records[1][1])
+		assert.Equal(t, "1", records[1][2])
+
+		validateError(t, http.StatusNotFound, test.TestEndpoint(http.MethodGet, "/coupons/campaigns/other", nil, adminToken))
+		validateError(t, http.StatusUnauthorized, test.TestEndpoint(http.MethodGet, "/coupons/campaigns/newsletter", nil, test.Data.testUserToken))
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		body := strings.NewReader(`{"template": {"percentage": 20}, "count": 25}`)
+		validateError(t, http.StatusBadRequest, test.TestEndpoint(http.MethodPost, "/coupons/generate", body, adminToken), "campaign")
+
+		body = strings.NewReader(`{"template": {"percentage": 150}, "count": 25, "campaign": "newsletter"}`)
+		validateError(t, http.StatusBadRequest, test.TestEndpoint(http.MethodPost, "/coupons/generate", body, adminToken), "Percentage")
+
+		body = strings.NewReader(`{"template": {"fixed": [{"amount": "ten", "currency": "USD"}]}, "count": 25, "campaign": "newsletter"}`)
+		validateError(t, http.StatusBadRequest, test.TestEndpoint(http.MethodPost, "/coupons/generate", body, adminToken), "Invalid fixed amount")
+	})
+
+	t.Run("URLSource", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := strings.NewReader(`{"template": {"percentage": 20}, "count": 25, "campaign": "newsletter"}`)
+		validateError(t, http.StatusBadRequest, test.TestEndpoint(http.MethodPost, "/coupons/generate", body, adminToken), "coupon source")
+	})
+}
+
 func startTestCouponURLs() *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
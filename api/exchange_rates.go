@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+
+	"gocommerce/calculator"
+	gcontext "gocommerce/context"
+	"gocommerce/models"
+)
+
+// ExchangeRatesView shows the exchange rates prices are converted with. These
+// are the rates set by an admin or else the ones from the site settings.
+func (a *API) ExchangeRatesView(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		return internalServerError("Error loading site settings").WithInternalError(err)
+	}
+	rates, err := exchangeRates(ctx, a.db, settings)
+	if err != nil {
+		return internalServerError("Error while querying for exchange rates").WithInternalError(err)
+	}
+	if rates == nil {
+		return notFoundError("No exchange rates configured")
+	}
+	return sendJSON(w, http.StatusOK, rates)
+}
+
+// ExchangeRatesUpdate replaces the exchange rates of the instance. It is only
+// available to admins.
+func (a *API) ExchangeRatesUpdate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instanceID := gcontext.GetInstanceID(ctx)
+
+	params := calculator.ExchangeRates{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	if err := params.Validate(); err != nil {
+		return badRequestError("Invalid exchange rates: %v", err)
+	}
+
+	table, err := models.GetExchangeRateTable(a.db, instanceID)
+	if err != nil {
+		return internalServerError("Error while querying for exchange rates").WithInternalError(err)
+	}
+	if table == nil {
+		table = models.NewExchangeRateTable(instanceID, params)
+	} else {
+		table.ExchangeRates = params
+	}
+	if rsp := a.db.Save(table); rsp.Error != nil {
+		return internalServerError("Error saving exchange rates").WithInternalError(rsp.Error)
+	}
+
+	getLogEntry(r).WithField("base", params.Base).Info("Updated exchange rates")
+	return sendJSON(w, http.StatusOK, &table.ExchangeRates)
+}
+
+// ExchangeRatesDelete removes the exchange rates set by an admin, so the ones
+// from the site settings are used again.
+func (a *API) ExchangeRatesDelete(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	if rsp := a.db.Where("instance_id = ?", instanceID).Delete(&models.ExchangeRateTable{}); rsp.Error != nil {
+		return internalServerError("Error deleting exchange rates").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, map[string]string{})
+}
+
+// exchangeRates returns the exchange rates set by an admin, falling back to
+// the ones from the site settings. It returns nil if there are none.
+func exchangeRates(ctx context.Context, db *gorm.DB, settings *calculator.Settings) (*calculator.ExchangeRates, error) {
+	table, err := models.GetExchangeRateTable(db, gcontext.GetInstanceID(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if table != nil {
+		return &table.ExchangeRates, nil
+	}
+	return settings.ExchangeRates, nil
+}
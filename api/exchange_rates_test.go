@@ -0,0 +1,98 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gocommerce/calculator"
+	"gocommerce/models"
+)
+
+const euroOrderPayload = `{
+	"email": "info@example.com",
+	"currency": "EUR",
+	"shipping_address": {
+		"name": "Test User",
+		"address1": "610 22nd Street",
+		"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+	},
+	"line_items": [{"path": "/simple-product", "quantity": 1}]
+}`
+
+func TestExchangeRates(t *testing.T) {
+	server := startTestSiteWithSettings(&calculator.Settings{
+		ExchangeRates: &calculator.ExchangeRates{
+			Base:     "USD",
+			Rates:    map[string]float64{"EUR": 0.9},
+			Rounding: map[string]*calculator.Rounding{"EUR": {Mode: "up", Increment: 5}},
+		},
+	})
+	defer server.Close()
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+	adminToken := testAdminToken("magical-unicorn", "")
+
+	createOrder := func() *models.Order {
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(euroOrderPayload), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		return order
+	}
+
+	// the USD price of 9.99 is converted from the site settings and rounded up
+	order := createOrder()
+	assert.Equal(t, "EUR", order.Currency)
+	assert.EqualValues(t, 900, order.Total)
+	assert.Equal(t, 0.9, order.ExchangeRate)
+	assert.Equal(t, "USD", order.ExchangeRateBase)
+	require.Len(t, order.LineItems, 1)
+	assert.EqualValues(t, 900, order.LineItems[0].Price)
+	assert.Equal(t, 0.9, order.LineItems[0].ExchangeRate)
+
+	body, err := json.Marshal(&calculator.ExchangeRates{Base: "USD", Rates: map[string]float64{"EUR": 0.8}})
+	require.NoError(t, err)
+	recorder := test.TestEndpoint(http.MethodPut, "/exchange_rates", bytes.NewBuffer(body), test.Data.testUserToken)
+	validateError(t, http.StatusUnauthorized, recorder)
+	recorder = test.TestEndpoint(http.MethodPut, "/exchange_rates", bytes.NewBuffer(body), adminToken)
+	assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+	// rates set by an admin take precedence over the site settings
+	order = createOrder()
+	assert.EqualValues(t, 799, order.Total)
+	assert.Equal(t, 0.8, order.ExchangeRate)
+
+	rates := &calculator.ExchangeRates{}
+	recorder = test.TestEndpoint(http.MethodGet, "/exchange_rates", nil, nil)
+	extractPayload(t, http.StatusOK, recorder, rates)
+	assert.Equal(t, 0.8, rates.Rates["EUR"])
+
+	recorder = test.TestEndpoint(http.MethodDelete, "/exchange_rates", nil, adminToken)
+	assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	recorder = test.TestEndpoint(http.MethodGet, "/exchange_rates", nil, nil)
+	extractPayload(t, http.StatusOK, recorder, rates)
+	assert.Equal(t, 0.9, rates.Rates["EUR"])
+
+	body, err = json.Marshal(&calculator.ExchangeRates{Rates: map[string]float64{"EUR": 0.8}})
+	require.NoError(t, err)
+	recorder = test.TestEndpoint(http.MethodPut, "/exchange_rates", bytes.NewBuffer(body), adminToken)
+	validateError(t, http.StatusBadRequest, recorder, "base currency")
+}
+
+func TestExchangeRatesMissing(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+
+	recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(euroOrderPayload), test.Data.testUserToken)
+	validateError(t, http.StatusInternalServerError, recorder)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/exchange_rates", nil, nil)
+	validateError(t, http.StatusNotFound, recorder)
+}
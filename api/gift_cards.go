@@ -0,0 +1,122 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+
+	gcontext "gocommerce/context"
+	"gocommerce/models"
+)
+
+const (
+	giftCardCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	giftCardCodeLength   = 16
+)
+
+// GiftCardParams holds the parameters for issuing a gift card.
+type GiftCardParams struct {
+	Code     string `json:"code"`
+	Amount   uint64 `json:"amount"`
+	Currency string `json:"currency"`
+	UserID   string `json:"user_id"`
+}
+
+// GiftCardList lists all gift cards of the site. Requires admin permissions.
+func (a *API) GiftCardList(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+
+	cards := []models.GiftCard{}
+	if rsp := a.db.Where("instance_id = ?", instanceID).Order("created_at desc").Find(&cards); rsp.Error != nil {
+		return internalServerError("Error while querying for gift cards").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, cards)
+}
+
+// GiftCardView returns the balance of a gift card. Anybody who knows the code
+// can check the balance, admins also get the ledger entries of the card.
+func (a *API) GiftCardView(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instanceID := gcontext.GetInstanceID(ctx)
+	code := chi.URLParam(r, "gift_card_code")
+
+	card, err := models.GetGiftCard(a.db, instanceID, code)
+	if err != nil {
+		return internalServerError("Error while querying for gift card").WithInternalError(err)
+	}
+	if card == nil {
+		return notFoundError("Gift card not found")
+	}
+
+	if gcontext.IsAdmin(ctx) {
+		if rsp := a.db.Where("gift_card_id = ?", card.ID).Order("created_at").Find(&card.Entries); rsp.Error != nil {
+			return internalServerError("Error while querying for gift card entries").WithInternalError(rsp.Error)
+		}
+	}
+	return sendJSON(w, http.StatusOK, card)
+}
+
+// GiftCardCreate issues a new gift card. If no code is given, a random one is
+// generated. Requires admin permissions.
+func (a *API) GiftCardCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	instanceID := gcontext.GetInstanceID(ctx)
+
+	params := GiftCardParams{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	if params.Amount == 0 {
+		return badRequestError("Gift cards require an amount")
+	}
+	if params.Currency == "" {
+		params.Currency = "USD"
+	}
+
+	code := strings.TrimSpace(params.Code)
+	if code == "" {
+		var err error
+		code, err = generateGiftCardCode()
+		if err != nil {
+			return internalServerError("Error generating gift card code").WithInternalError(err)
+		}
+	}
+
+	existing, err := models.GetGiftCard(a.db, instanceID, code)
+	if err != nil {
+		return internalServerError("Error while querying for gift card").WithInternalError(err)
+	}
+	if existing != nil {
+		return badRequestError("A gift card with the code '%s' already exists", code)
+	}
+
+	card := models.NewGiftCard(instanceID, code, params.Currency, params.Amount)
+	card.UserID = params.UserID
+
+	tx := a.db.Begin()
+	if err := card.Create(tx); err != nil {
+		tx.Rollback()
+		return internalServerError("Error creating gift card").WithInternalError(err)
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error creating gift card").WithInternalError(rsp.Error)
+	}
+
+	log.WithField("gift_card_id", card.ID).Infof("Issued gift card with a balance of %d %s", card.Balance, card.Currency)
+	return sendJSON(w, http.StatusCreated, card)
+}
+
+func generateGiftCardCode() (string, error) {
+	b := make([]byte, giftCardCodeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = giftCardCodeAlphabet[int(b[i])%len(giftCardCodeAlphabet)]
+	}
+	return string(b), nil
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gocommerce/models"
+	"gocommerce/payments"
+)
+
+func issueGiftCard(t *testing.T, test *RouteTest, params *GiftCardParams) *models.GiftCard {
+	body, err := json.Marshal(params)
+	require.NoError(t, err)
+	token := testAdminToken("magical-unicorn", "")
+	recorder := test.TestEndpoint(http.MethodPost, "/giftcards", bytes.NewBuffer(body), token)
+	card := &models.GiftCard{}
+	extractPayload(t, http.StatusCreated, recorder, card)
+	return card
+}
+
+func payWithGiftCard(t *testing.T, test *RouteTest, code string, amount uint64) *httptest.ResponseRecorder {
+	test.Config.Payment.GiftCard.Enabled = true
+	test.Data.firstOrder.PaymentState = models.PendingState
+	require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+	body, err := json.Marshal(map[string]interface{}{
+		"amount":         amount,
+		"currency":       test.Data.firstOrder.Currency,
+		"gift_card_code": code,
+		"provider":       payments.GiftCardProvider,
+	})
+	require.NoError(t, err)
+	return test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+}
+
+func TestGiftCardCreate(t *testing.T) {
+	t.Run("GeneratedCode", func(t *testing.T) {
+		test := NewRouteTest(t)
+		card := issueGiftCard(t, test, &GiftCardParams{Amount: 5000, Currency: "EUR"})
+		assert.Len(t, card.Code, giftCardCodeLength)
+		assert.EqualValues(t, 5000, card.Balance)
+		assert.Equal(t, "EUR", card.Currency)
+		require.Len(t, card.Entries, 1)
+		assert.Equal(t, models.IssueGiftCardEntryType, card.Entries[0].Type)
+	})
+
+	t.Run("DuplicateCode", func(t *testing.T) {
+		test := NewRouteTest(t)
+		issueGiftCard(t, test, &GiftCardParams{Code: "HAPPY-BIRTHDAY", Amount: 5000})
+
+		body := strings.NewReader(`{"code": "HAPPY-BIRTHDAY", "amount": 100}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/giftcards", body, testAdminToken("magical-unicorn", ""))
+		validateError(t, http.StatusBadRequest, recorder, "already exists")
+	})
+
+	t.Run("AsNonAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := strings.NewReader(`{"amount": 100}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/giftcards", body, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestGiftCardView(t *testing.T) {
+	test := NewRouteTest(t)
+	issueGiftCard(t, test, &GiftCardParams{Code: "HAPPY-BIRTHDAY", Amount: 5000})
+
+	recorder := test.TestEndpoint(http.MethodGet, "/giftcards/HAPPY-BIRTHDAY", nil, nil)
+	card := &models.GiftCard{}
+	extractPayload(t, http.StatusOK, recorder, card)
+	assert.EqualValues(t, 5000, card.Balance)
+	assert.Empty(t, card.Entries)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/giftcards/HAPPY-BIRTHDAY", nil, testAdminToken("magical-unicorn", ""))
+	extractPayload(t, http.StatusOK, recorder, card)
+	assert.Len(t, card.Entries, 1)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/giftcards/UNKNOWN", nil, nil)
+	validateError(t, http.StatusNotFound, recorder)
+}
+
+func TestGiftCardPayment(t *testing.T) {
+	t.Run("Redeem", func(t *testing.T) {
+		test := NewRouteTest(t)
+		card := issueGiftCard(t, test, &GiftCardParams{Code: "HAPPY-BIRTHDAY", Amount: 5000})
+
+		recorder := payWithGiftCard(t, test, card.Code, test.Data.firstOrder.Total)
+		trans := &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, trans)
+		assert.Equal(t, models.PaidState, trans.Status)
+
+		stored, err := models.GetGiftCard(test.DB, "", card.Code)
+		require.NoError(t, err)
+		assert.Equal(t, 5000-test.Data.firstOrder.Total, stored.Balance)
+
+		entry, _, err := models.GetGiftCardEntry(test.DB, "", trans.ProcessorID)
+		require.NoError(t, err)
+		require.NotNil(t, entry)
+		assert.Equal(t, models.RedemptionGiftCardEntryType, entry.Type)
+		assert.Equal(t, -int64(test.Data.firstOrder.Total), entry.Amount)
+		assert.Equal(t, test.Data.firstOrder.ID, entry.OrderID)
+
+		t.Run("Refund", func(t *testing.T) {
+			body, err := json.Marshal(&PaymentParams{Amount: 10, Currency: "USD"})
+			require.NoError(t, err)
+			recorder := test.TestEndpoint(http.MethodPost, "/payments/"+trans.ID+"/refund", bytes.NewBuffer(body), testAdminToken("magical-unicorn", ""))
+			refund := &models.Transaction{}
+			extractPayload(t, http.StatusOK, recorder, refund)
+			assert.Equal(t, models.PaidState, refund.Status)
+
+			stored, err := models.GetGiftCard(test.DB, "", card.Code)
+			require.NoError(t, err)
+			assert.Equal(t, 5000-test.Data.firstOrder.Total+10, stored.Balance)
+
+			entry, _, err := models.GetGiftCardEntry(test.DB, "", refund.ProcessorID)
+			require.NoError(t, err)
+			require.NotNil(t, entry)
+			assert.Equal(t, models.RefundGiftCardEntryType, entry.Type)
+		})
+	})
+
+	t.Run("InsufficientBalance", func(t *testing.T) {
+		test := NewRouteTest(t)
+		card := issueGiftCard(t, test, &GiftCardParams{Code: "HAPPY-BIRTHDAY", Amount: 1})
+
+		recorder := payWithGiftCard(t, test, card.Code, test.Data.firstOrder.Total)
+		validateError(t, http.StatusInternalServerError, recorder, "balance is too low")
+
+		stored, err := models.GetGiftCard(test.DB, "", card.Code)
+		require.NoError(t, err)
+		assert.EqualValues(t, 1, stored.Balance)
+	})
+
+	t.Run("OtherUsersCredit", func(t *testing.T) {
+		test := NewRouteTest(t)
+		card := issueGiftCard(t, test, &GiftCardParams{Code: "STORE-CREDIT", Amount: 5000, UserID: "someone-else"})
+
+		recorder := payWithGiftCard(t, test, card.Code, test.Data.firstOrder.Total)
+		validateError(t, http.StatusInternalServerError, recorder, "different user")
+	})
+}
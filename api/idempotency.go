@@ -0,0 +1,166 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+
+	gcontext "gocommerce/context"
+	"gocommerce/models"
+)
+
+const (
+	idempotencyKeyHeaderName     = "Idempotency-Key"
+	idempotentReplayedHeaderName = "Idempotent-Replayed"
+	maxIdempotencyKeyLength      = 255
+)
+
+// responseRecorder captures the status and body written by a handler while
+// still passing them through to the client.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// withIdempotencyKey makes a request replayable with an Idempotency-Key header.
+// The first request with a key is processed and its response stored, later
+// requests with the same key get the stored response back. Reusing a key for
+// a different request is rejected. Server errors are not stored, so that the
+// request can be retried with the same key, unless the handler already did
+// something that can't be undone, like charging a card.
+func (a *API) withIdempotencyKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeaderName)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			handleError(badRequestError("%s must not be longer than %d characters", idempotencyKeyHeaderName, maxIdempotencyKeyLength), w, r)
+			return
+		}
+
+		ctx := r.Context()
+		log := getLogEntry(r).WithField("idempotency_key", key)
+		instanceID := gcontext.GetInstanceID(ctx)
+
+		requestHash, err := hashIdempotentRequest(r)
+		if err != nil {
+			handleError(internalServerError("Error reading body").WithInternalError(err), w, r)
+			return
+		}
+
+		existing, err := models.GetIdempotencyKey(a.db, instanceID, key)
+		if err != nil {
+			handleError(internalServerError("Error during database query").WithInternalError(err), w, r)
+			return
+		}
+		if existing != nil && existing.Expired() {
+			log.Debug("Removing expired idempotency key")
+			if rsp := a.db.Delete(existing); rsp.Error != nil {
+				handleError(internalServerError("Error removing expired idempotency key").WithInternalError(rsp.Error), w, r)
+				return
+			}
+			existing = nil
+		}
+
+		if existing != nil {
+			if existing.RequestHash != requestHash {
+				handleError(badRequestError("%s has already been used for a different request", idempotencyKeyHeaderName), w, r)
+				return
+			}
+			if !existing.Completed() {
+				handleError(conflictError("A request with this %s is still being processed", idempotencyKeyHeaderName), w, r)
+				return
+			}
+
+			log.Info("Replaying stored response for idempotency key")
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set(idempotentReplayedHeaderName, "true")
+			w.WriteHeader(existing.ResponseCode)
+			w.Write([]byte(existing.ResponseBody))
+			return
+		}
+
+		idempotencyKey := models.NewIdempotencyKey(instanceID, key, requestHash)
+		if rsp := a.db.Create(idempotencyKey); rsp.Error != nil {
+			// most likely a concurrent request with the same key won the race
+			handleError(conflictError("A request with this %s is still being processed", idempotencyKeyHeaderName).WithInternalError(rsp.Error), w, r)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(gcontext.WithIdempotencyKey(ctx, idempotencyKey)))
+
+		failed := recorder.status == 0 || recorder.status >= http.StatusInternalServerError
+		if failed && !idempotencyKey.SideEffects {
+			if rsp := a.db.Delete(idempotencyKey); rsp.Error != nil {
+				log.WithError(rsp.Error).Error("Failed to release idempotency key")
+			}
+			return
+		}
+		if failed {
+			// a retry could repeat the side effects, so it gets the error instead
+			log.Warn("Storing failed response for idempotency key")
+			if recorder.status == 0 {
+				recorder.status = http.StatusInternalServerError
+			}
+		}
+
+		idempotencyKey.ResponseCode = recorder.status
+		idempotencyKey.ResponseBody = recorder.body.String()
+		if rsp := a.db.Save(idempotencyKey); rsp.Error != nil {
+			log.WithError(rsp.Error).Error("Failed to store response for idempotency key")
+		}
+	})
+}
+
+// markSideEffects records that a request did something that can't be undone,
+// so that an error response is stored for its idempotency key instead of
+// letting a retry do it again.
+func markSideEffects(ctx context.Context) {
+	if key := gcontext.GetIdempotencyKey(ctx); key != nil {
+		key.SideEffects = true
+	}
+}
+
+// hashIdempotentRequest fingerprints the parts of a request that must match
+// for a stored response to be replayed. The body is restored afterwards.
+func hashIdempotentRequest(r *http.Request) (string, error) {
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			return "", err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	subject := ""
+	if claims := gcontext.GetClaims(r.Context()); claims != nil {
+		subject = claims.Subject
+	}
+
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n" + subject + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"gocommerce/models"
+	"gocommerce/payments"
+)
+
+func TestIdempotentOrderCreate(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	headers := map[string]string{idempotencyKeyHeaderName: "order-key-1"}
+
+	t.Run("Replay", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		token := test.Data.testUserToken
+
+		recorder := test.TestEndpointWithHeaders(http.MethodPost, "/orders", strings.NewReader(defaultPayload), token, headers)
+		first := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, first)
+
+		recorder = test.TestEndpointWithHeaders(http.MethodPost, "/orders", strings.NewReader(defaultPayload), token, headers)
+		assert.Equal(t, "true", recorder.Header().Get(idempotentReplayedHeaderName))
+		second := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, second)
+		assert.Equal(t, first.ID, second.ID)
+
+		var count int
+		require.NoError(t, test.DB.Model(&models.Order{}).Where("email = ?", "info@example.com").Count(&count).Error)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("DifferentBody", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		token := test.Data.testUserToken
+
+		recorder := test.TestEndpointWithHeaders(http.MethodPost, "/orders", strings.NewReader(defaultPayload), token, headers)
+		extractPayload(t, http.StatusCreated, recorder, &models.Order{})
+
+		otherPayload := strings.Replace(defaultPayload, `"quantity": 1`, `"quantity": 2`, 1)
+		recorder = test.TestEndpointWithHeaders(http.MethodPost, "/orders", strings.NewReader(otherPayload), token, headers)
+		validateError(t, http.StatusBadRequest, recorder, idempotencyKeyHeaderName)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		token := test.Data.testUserToken
+
+		recorder := test.TestEndpointWithHeaders(http.MethodPost, "/orders", strings.NewReader(defaultPayload), token, headers)
+		first := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, first)
+
+		require.NoError(t, test.DB.Model(&models.IdempotencyKey{}).Where("idempotency_key = ?", "order-key-1").Update("expires_at", time.Now().Add(-time.Minute)).Error)
+
+		recorder = test.TestEndpointWithHeaders(http.MethodPost, "/orders", strings.NewReader(defaultPayload), token, headers)
+		second := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, second)
+		assert.NotEqual(t, first.ID, second.ID)
+		assert.Empty(t, recorder.Header().Get(idempotentReplayedHeaderName))
+	})
+}
+
+func TestIdempotentPaymentCreate(t *testing.T) {
+	headers := map[string]string{idempotencyKeyHeaderName: "payment-key-1"}
+
+	newTest := func(t *testing.T, charges *int) *RouteTest {
+		test := NewRouteTest(t)
+		stripe.SetBackend(stripe.APIBackend, &failingStripeBackend{
+			trackingStripeBackend: trackingStripeBackend{func(method, path, key string, params stripe.ParamsContainer, v interface{}) {
+				*charges++
+			}},
+			fail: func(path string) error {
+				return errors.New("card declined")
+			},
+		})
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		test.Data.firstTransaction.Status = models.FailedState
+		require.NoError(t, test.DB.Save(test.Data.firstTransaction).Error)
+		return test
+	}
+	pay := func(test *RouteTest, amount uint64) *httptest.ResponseRecorder {
+		body, err := json.Marshal(&stripePaymentParams{
+			Amount:      amount,
+			Currency:    test.Data.firstOrder.Currency,
+			StripeToken: "123456",
+			Provider:    payments.StripeProvider,
+		})
+		require.NoError(test.T, err)
+		return test.TestEndpointWithHeaders(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken, headers)
+	}
+
+	t.Run("KeptAfterCharge", func(t *testing.T) {
+		charges := 0
+		test := newTest(t, &charges)
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		validateError(t, http.StatusInternalServerError, pay(test, test.Data.firstOrder.Total), "card declined")
+		assert.Equal(t, 1, charges)
+
+		// the retry gets the stored error instead of charging again
+		recorder := pay(test, test.Data.firstOrder.Total)
+		assert.Equal(t, "true", recorder.Header().Get(idempotentReplayedHeaderName))
+		validateError(t, http.StatusInternalServerError, recorder, "card declined")
+		assert.Equal(t, 1, charges)
+	})
+
+	t.Run("ReleasedBeforeCharge", func(t *testing.T) {
+		charges := 0
+		test := newTest(t, &charges)
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		validateError(t, http.StatusInternalServerError, pay(test, test.Data.firstOrder.Total+1), "failed to authorize the amount")
+		assert.Equal(t, 0, charges)
+
+		var count int
+		require.NoError(t, test.DB.Model(&models.IdempotencyKey{}).Where("idempotency_key = ?", "payment-key-1").Count(&count).Error)
+		assert.Equal(t, 0, count)
+	})
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+
+	gcontext "gocommerce/context"
+	"gocommerce/models"
+)
+
+// InventoryParams holds the parameters for changing the stock of a SKU. Either
+// the new Quantity or an Adjustment to the current one is given.
+type InventoryParams struct {
+	Quantity   *int64 `json:"quantity"`
+	Adjustment int64  `json:"adjustment"`
+}
+
+// inventoryStock is an inventory item with the stock left to order.
+type inventoryStock struct {
+	*models.InventoryItem
+	Available int64 `json:"available"`
+}
+
+func newInventoryStock(item *models.InventoryItem) *inventoryStock {
+	return &inventoryStock{InventoryItem: item, Available: item.Available()}
+}
+
+// stockError turns an error from reserving stock into an HTTP error.
+func stockError(err error) *HTTPError {
+	if e, ok := err.(*models.InsufficientStockError); ok {
+		return conflictError("%v", e)
+	}
+	return internalServerError("Error reserving stock").WithInternalError(err)
+}
+
+// InventoryList lists the stock of all tracked SKUs. Requires admin
+// permissions.
+func (a *API) InventoryList(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+
+	items := []*models.InventoryItem{}
+	if rsp := a.db.Where("instance_id = ?", instanceID).Order("sku").Find(&items); rsp.Error != nil {
+		return internalServerError("Error while querying for inventory").WithInternalError(rsp.Error)
+	}
+	stock := make([]*inventoryStock, len(items))
+	for i, item := range items {
+		stock[i] = newInventoryStock(item)
+	}
+	return sendJSON(w, http.StatusOK, stock)
+}
+
+// InventoryView returns the stock of a SKU. Requires admin permissions.
+func (a *API) InventoryView(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	sku := chi.URLParam(r, "sku")
+
+	item, err := models.GetInventoryItem(a.db, instanceID, sku)
+	if err != nil {
+		return internalServerError("Error while querying for inventory").WithInternalError(err)
+	}
+	if item == nil {
+		return notFoundError("SKU %v is not tracked", sku)
+	}
+	return sendJSON(w, http.StatusOK, newInventoryStock(item))
+}
+
+// InventoryUpdate sets or adjusts the stock of a SKU and starts tracking it
+// if it isn't yet. Requires admin permissions.
+func (a *API) InventoryUpdate(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	sku := chi.URLParam(r, "sku")
+
+	params := InventoryParams{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	if params.Quantity == nil && params.Adjustment == 0 {
+		return badRequestError("Changing the stock requires a 'quantity' or an 'adjustment'")
+	}
+	if params.Quantity != nil && params.Adjustment != 0 {
+		return badRequestError("The stock can't be set and adjusted at the same time")
+	}
+	if params.Quantity != nil && *params.Quantity < 0 {
+		return badRequestError("The stock can't be negative")
+	}
+
+	tx := a.db.Begin()
+	item, err := models.GetInventoryItem(tx, instanceID, sku)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error while querying for inventory").WithInternalError(err)
+	}
+	if item == nil {
+		item = models.NewInventoryItem(instanceID, sku, 0)
+		if rsp := tx.Create(item); rsp.Error != nil {
+			tx.Rollback()
+			return internalServerError("Error creating inventory item").WithInternalError(rsp.Error)
+		}
+	}
+
+	if params.Quantity != nil {
+		if rsp := tx.Model(item).UpdateColumn("quantity", *params.Quantity); rsp.Error != nil {
+			tx.Rollback()
+			return internalServerError("Error updating inventory item").WithInternalError(rsp.Error)
+		}
+	} else {
+		// adjustments are relative so they don't undo concurrent orders
+		rsp := tx.Model(&models.InventoryItem{}).
+			Where("id = ? AND quantity + ? >= 0", item.ID, params.Adjustment).
+			UpdateColumn("quantity", gorm.Expr("quantity + ?", params.Adjustment))
+		if rsp.Error != nil {
+			tx.Rollback()
+			return internalServerError("Error updating inventory item").WithInternalError(rsp.Error)
+		}
+		if rsp.RowsAffected == 0 {
+			tx.Rollback()
+			return badRequestError("The stock can't be negative")
+		}
+	}
+
+	if rsp := tx.First(item, "id = ?", item.ID); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error while querying for inventory").WithInternalError(rsp.Error)
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error updating inventory item").WithInternalError(rsp.Error)
+	}
+
+	getLogEntry(r).WithField("sku", sku).Infof("Stock set to %d", item.Quantity)
+	return sendJSON(w, http.StatusOK, newInventoryStock(item))
+}
+
+// InventoryDelete stops tracking the stock of a SKU. Requires admin
+// permissions.
+func (a *API) InventoryDelete(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	sku := chi.URLParam(r, "sku")
+
+	item, err := models.GetInventoryItem(a.db, instanceID, sku)
+	if err != nil {
+		return internalServerError("Error while querying for inventory").WithInternalError(err)
+	}
+	if item == nil {
+		return notFoundError("SKU %v is not tracked", sku)
+	}
+	tx := a.db.Begin()
+	if err := models.DeleteInventoryItem(tx, item); err != nil {
+		tx.Rollback()
+		return internalServerError("Error deleting inventory item").WithInternalError(err)
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error deleting inventory item").WithInternalError(rsp.Error)
+	}
+
+	getLogEntry(r).WithField("sku", sku).Info("Stopped tracking stock")
+	return sendJSON(w, http.StatusOK, map[string]string{})
+}
@@ -0,0 +1,269 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"gocommerce/models"
+	"gocommerce/payments"
+)
+
+func setStock(t *testing.T, test *RouteTest, sku, body string) *httptest.ResponseRecorder {
+	token := testAdminToken("magical-unicorn", "")
+	return test.TestEndpoint(http.MethodPut, "/inventory/"+sku, strings.NewReader(body), token)
+}
+
+func getStock(t *testing.T, test *RouteTest, sku string) *models.InventoryItem {
+	item, err := models.GetInventoryItem(test.DB, "", sku)
+	require.NoError(t, err)
+	require.NotNil(t, item)
+	return item
+}
+
+func TestInventoryEndpoints(t *testing.T) {
+	test := NewRouteTest(t)
+	adminToken := testAdminToken("magical-unicorn", "")
+
+	t.Run("RequiresAdmin", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodPut, "/inventory/product-1", strings.NewReader(`{"quantity": 5}`), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("Set", func(t *testing.T) {
+		stock := &inventoryStock{}
+		extractPayload(t, http.StatusOK, setStock(t, test, "product-1", `{"quantity": 5}`), stock)
+		assert.Equal(t, "product-1", stock.Sku)
+		assert.EqualValues(t, 5, stock.Quantity)
+		assert.EqualValues(t, 5, stock.Available)
+
+		validateError(t, http.StatusBadRequest, setStock(t, test, "product-1", `{"quantity": -1}`))
+		validateError(t, http.StatusBadRequest, setStock(t, test, "product-1", `{}`))
+		validateError(t, http.StatusBadRequest, setStock(t, test, "product-1", `{"quantity": 1, "adjustment": 1}`))
+	})
+
+	t.Run("Adjust", func(t *testing.T) {
+		stock := &inventoryStock{}
+		extractPayload(t, http.StatusOK, setStock(t, test, "product-1", `{"adjustment": -2}`), stock)
+		assert.EqualValues(t, 3, stock.Quantity)
+
+		validateError(t, http.StatusBadRequest, setStock(t, test, "product-1", `{"adjustment": -4}`), "can't be negative")
+		assert.EqualValues(t, 3, getStock(t, test, "product-1").Quantity)
+
+		extractPayload(t, http.StatusOK, setStock(t, test, "product-2", `{"adjustment": 7}`), stock)
+		assert.EqualValues(t, 7, stock.Quantity)
+	})
+
+	t.Run("List", func(t *testing.T) {
+		stock := []*inventoryStock{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/inventory", nil, adminToken), &stock)
+		require.Len(t, stock, 2)
+		assert.Equal(t, "product-1", stock[0].Sku)
+		assert.Equal(t, "product-2", stock[1].Sku)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodDelete, "/inventory/product-2", nil, adminToken)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		validateError(t, http.StatusNotFound, test.TestEndpoint(http.MethodGet, "/inventory/product-2", nil, adminToken))
+		validateError(t, http.StatusNotFound, test.TestEndpoint(http.MethodDelete, "/inventory/product-2", nil, adminToken))
+	})
+}
+
+func TestOrderStockReservation(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	newTest := func(t *testing.T, quantity int) *RouteTest {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Payment.GiftCard.Enabled = true
+		assert.Equal(t, http.StatusOK, setStock(t, test, "product-1", fmt.Sprintf(`{"quantity": %d}`, quantity)).Code)
+		return test
+	}
+
+	createOrder := func(test *RouteTest, quantity int) *httptest.ResponseRecorder {
+		body := strings.NewReader(fmt.Sprintf(`{
+			"email": "info@example.com",
+			"shipping_address": {
+				"name": "Test User",
+				"address1": "610 22nd Street",
+				"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+			},
+			"line_items": [{"path": "/simple-product", "quantity": %d}]
+		}`, quantity))
+		return test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+	}
+
+	pay := func(t *testing.T, test *RouteTest, order *models.Order, balance uint64) *httptest.ResponseRecorder {
+		card := issueGiftCard(t, test, &GiftCardParams{Amount: balance})
+		body, err := json.Marshal(map[string]interface{}{
+			"amount":         order.Total,
+			"currency":       order.Currency,
+			"gift_card_code": card.Code,
+			"provider":       payments.GiftCardProvider,
+		})
+		require.NoError(t, err)
+		return test.TestEndpoint(http.MethodPost, "/orders/"+order.ID+"/payments", strings.NewReader(string(body)), test.Data.testUserToken)
+	}
+
+	reservationState := func(t *testing.T, test *RouteTest, order *models.Order) string {
+		reservation := &models.StockReservation{}
+		require.NoError(t, test.DB.First(reservation, "order_id = ?", order.ID).Error)
+		return reservation.State
+	}
+
+	t.Run("ReserveAndCommit", func(t *testing.T) {
+		test := newTest(t, 3)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, createOrder(test, 2), order)
+		item := getStock(t, test, "product-1")
+		assert.EqualValues(t, 3, item.Quantity)
+		assert.EqualValues(t, 2, item.Reserved)
+
+		validateError(t, http.StatusConflict, createOrder(test, 2), "Only 1 of product-1 are left in stock")
+
+		assert.Equal(t, http.StatusOK, pay(t, test, order, 5000).Code)
+		item = getStock(t, test, "product-1")
+		assert.EqualValues(t, 1, item.Quantity)
+		assert.EqualValues(t, 0, item.Reserved)
+		assert.Equal(t, models.CommittedStockState, reservationState(t, test, order))
+
+		extractPayload(t, http.StatusCreated, createOrder(test, 1), &models.Order{})
+		validateError(t, http.StatusConflict, createOrder(test, 1), "out of stock")
+	})
+
+	t.Run("UntrackedSku", func(t *testing.T) {
+		test := newTest(t, 0)
+		recorder := test.TestEndpoint(http.MethodDelete, "/inventory/product-1", nil, testAdminToken("magical-unicorn", ""))
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		extractPayload(t, http.StatusCreated, createOrder(test, 10), &models.Order{})
+	})
+
+	t.Run("QuantityUpdate", func(t *testing.T) {
+		test := newTest(t, 4)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, createOrder(test, 2), order)
+		update := func(quantity int) *httptest.ResponseRecorder {
+			body := strings.NewReader(fmt.Sprintf(`{"line_items": [{"sku": "product-1", "quantity": %d}]}`, quantity))
+			return test.TestEndpoint(http.MethodPut, "/orders/"+order.ID, body, testAdminToken("magical-unicorn", ""))
+		}
+
+		require.Equal(t, http.StatusOK, update(3).Code)
+		assert.EqualValues(t, 3, getStock(t, test, "product-1").Reserved)
+
+		validateError(t, http.StatusConflict, update(5), "Only 1 of product-1 are left in stock")
+		assert.EqualValues(t, 3, getStock(t, test, "product-1").Reserved)
+
+		require.Equal(t, http.StatusOK, update(1).Code)
+		assert.EqualValues(t, 1, getStock(t, test, "product-1").Reserved)
+	})
+
+	t.Run("DeleteWhileReserved", func(t *testing.T) {
+		test := newTest(t, 2)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, createOrder(test, 2), order)
+		recorder := test.TestEndpoint(http.MethodDelete, "/inventory/product-1", nil, testAdminToken("magical-unicorn", ""))
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, models.ReleasedStockState, reservationState(t, test, order))
+
+		// tracking the SKU again starts without the old reservation
+		assert.Equal(t, http.StatusOK, setStock(t, test, "product-1", `{"quantity": 2}`).Code)
+		assert.Equal(t, http.StatusOK, pay(t, test, order, 5000).Code)
+		item := getStock(t, test, "product-1")
+		assert.EqualValues(t, 0, item.Quantity)
+		assert.EqualValues(t, 0, item.Reserved)
+	})
+
+	t.Run("ReleaseOnFailedPayment", func(t *testing.T) {
+		test := newTest(t, 2)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, createOrder(test, 2), order)
+		validateError(t, http.StatusInternalServerError, pay(t, test, order, 1), "balance is too low")
+		assert.EqualValues(t, 0, getStock(t, test, "product-1").Reserved)
+		assert.Equal(t, models.ReleasedStockState, reservationState(t, test, order))
+
+		// paying again reserves the stock again
+		assert.Equal(t, http.StatusOK, pay(t, test, order, 5000).Code)
+		item := getStock(t, test, "product-1")
+		assert.EqualValues(t, 0, item.Quantity)
+		assert.EqualValues(t, 0, item.Reserved)
+	})
+
+	t.Run("AuthorizeAndVoid", func(t *testing.T) {
+		test := newTest(t, 2)
+		test.Config.Payment.DelayedCapture = true
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) {
+			if path == "/charges" {
+				v.(*stripe.Charge).ID = "ch_authorized"
+			}
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, createOrder(test, 2), order)
+		body, err := json.Marshal(&stripePaymentParams{
+			Amount:      order.Total,
+			Currency:    order.Currency,
+			StripeToken: "123456",
+			Provider:    payments.StripeProvider,
+		})
+		require.NoError(t, err)
+		trans := &models.Transaction{}
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/"+order.ID+"/payments", strings.NewReader(string(body)), test.Data.testUserToken)
+		extractPayload(t, http.StatusOK, recorder, trans)
+		require.Equal(t, models.AuthorizedState, trans.Status)
+
+		// the authorized order keeps its reservation, even past the expiry
+		expired := time.Now().Add(-time.Minute)
+		require.NoError(t, test.DB.Model(&models.StockReservation{}).Where("order_id = ?", order.ID).UpdateColumn("expires_at", expired).Error)
+		released, err := models.ReleaseExpiredStock(test.DB)
+		require.NoError(t, err)
+		assert.Equal(t, 0, released)
+		item := getStock(t, test, "product-1")
+		assert.EqualValues(t, 2, item.Quantity)
+		assert.EqualValues(t, 2, item.Reserved)
+		assert.Equal(t, models.ReservedStockState, reservationState(t, test, order))
+
+		recorder = test.TestEndpoint(http.MethodPost, "/payments/"+trans.ID+"/void", nil, testAdminToken("magical-unicorn", ""))
+		require.Equal(t, http.StatusOK, recorder.Code)
+		item = getStock(t, test, "product-1")
+		assert.EqualValues(t, 2, item.Quantity)
+		assert.EqualValues(t, 0, item.Reserved)
+		assert.Equal(t, models.ReleasedStockState, reservationState(t, test, order))
+	})
+
+	t.Run("ReleaseOnExpiry", func(t *testing.T) {
+		test := newTest(t, 2)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, createOrder(test, 2), order)
+		released, err := models.ReleaseExpiredStock(test.DB)
+		require.NoError(t, err)
+		assert.Equal(t, 0, released)
+
+		expired := time.Now().Add(-time.Minute)
+		require.NoError(t, test.DB.Model(&models.StockReservation{}).Where("order_id = ?", order.ID).UpdateColumn("expires_at", expired).Error)
+		released, err = models.ReleaseExpiredStock(test.DB)
+		require.NoError(t, err)
+		assert.Equal(t, 1, released)
+		assert.EqualValues(t, 0, getStock(t, test, "product-1").Reserved)
+
+		// the released stock was sold to another order in the meantime
+		extractPayload(t, http.StatusCreated, createOrder(test, 1), &models.Order{})
+		validateError(t, http.StatusConflict, pay(t, test, order, 5000), "Only 1 of product-1 are left in stock")
+	})
+}
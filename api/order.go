@@ -22,6 +22,9 @@ import (
 // MaxConcurrentLookups controls the number of simultaneous HTTP Order lookups
 const MaxConcurrentLookups = 10
 
+// MaxLineItemQuantity is the largest quantity a line item can be ordered in
+const MaxLineItemQuantity = 10000
+
 type orderLineItem struct {
 	Sku      string                 `json:"sku"`
 	Path     string                 `json:"path"`
@@ -57,7 +60,10 @@ type orderRequestParams struct {
 
 	FulfillmentState string `json:"fulfillment_state"`
 
-	CouponCode string `json:"coupon"`
+	CouponCode  string   `json:"coupon"`
+	CouponCodes []string `json:"coupons"`
+
+	ShippingRate string `json:"shipping_rate"`
 }
 
 type receiptParams struct {
@@ -318,18 +324,11 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 	claims := gcontext.GetClaims(ctx)
 	order := models.NewOrder(instanceID, params.SessionID, params.Email, params.Currency)
 
-	if params.CouponCode != "" {
-		coupon, err := a.lookupCoupon(ctx, w, params.CouponCode)
-		if err != nil {
-			return err
-		}
-		if !coupon.Valid() {
-			return badRequestError("This coupon is not valid at this time")
-		}
-
-		order.CouponCode = coupon.Code
-		order.Coupon = coupon
+	coupons, err := a.orderCoupons(ctx, w, couponCodes(params.CouponCode, params.CouponCodes))
+	if err != nil {
+		return err
 	}
+	order.SetCoupons(coupons)
 
 	log := logEntrySetFields(r, logrus.Fields{
 		"order_id":   order.ID,
@@ -343,6 +342,7 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 
 	order.IP = r.RemoteAddr
 	order.MetaData = params.MetaData
+	order.ShippingRate = params.ShippingRate
 	httpError := setOrderEmail(tx, order, claims, log)
 	if httpError != nil {
 		log.WithError(httpError).Info("Failed to set the order email from the token")
@@ -352,6 +352,11 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 
 	log.WithField("order_user_id", order.UserID).Debug("Successfully set the order's ID")
 
+	if httpError := checkCouponRedemptions(tx, order); httpError != nil {
+		tx.Rollback()
+		return httpError
+	}
+
 	shipping, httpError := a.processAddress(tx, order, "Shipping Address", params.ShippingAddress, params.ShippingAddressID)
 	if httpError != nil {
 		tx.Rollback()
@@ -383,14 +388,9 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	if params.VATNumber != "" {
-		valid, err := vat.IsValidVAT(params.VATNumber)
-		if err != nil {
+		if httpError := validateVATNumber(params.VATNumber); httpError != nil {
 			tx.Rollback()
-			return internalServerError("Error verifying VAT number").WithInternalError(err)
-		}
-		if !valid {
-			tx.Rollback()
-			return badRequestError("Vat number %v is not valid", order.VATNumber)
+			return httpError
 		}
 		order.VATNumber = params.VATNumber
 	}
@@ -403,6 +403,11 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 
 	log.WithField("subtotal", order.SubTotal).Debug("Successfully processed all the line items")
 
+	if err := models.ReserveStock(tx, order); err != nil {
+		tx.Rollback()
+		return stockError(err)
+	}
+
 	tx.Create(order)
 	models.LogEvent(tx, r.RemoteAddr, order.UserID, order.ID, models.EventCreated, nil)
 	if config.Webhooks.Order != "" {
@@ -418,6 +423,55 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 	return sendJSON(w, http.StatusCreated, order)
 }
 
+// OrderPreview prices a cart the same way OrderCreate does, with the claims of
+// the caller and the coupon, address and VAT number of the request. Nothing is
+// saved and no webhooks are sent.
+func (a *API) OrderPreview(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	params := &orderRequestParams{Currency: "USD"}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read Order params: %v", err)
+	}
+
+	order := models.NewOrder(gcontext.GetInstanceID(ctx), params.SessionID, params.Email, params.Currency)
+	order.ShippingRate = params.ShippingRate
+	coupons, err := a.orderCoupons(ctx, w, couponCodes(params.CouponCode, params.CouponCodes))
+	if err != nil {
+		return err
+	}
+	order.SetCoupons(coupons)
+
+	if params.ShippingAddressID != "" {
+		address := &models.Address{}
+		if rsp := a.db.First(address, "id = ?", params.ShippingAddressID); rsp.Error != nil {
+			return badRequestError("Bad Shipping Address id: %v", params.ShippingAddressID).WithInternalError(rsp.Error)
+		}
+		claims := gcontext.GetClaims(ctx)
+		if claims == nil || address.UserID != claims.Subject {
+			return badRequestError("Can't use a Shipping Address that doesn't belong to the user")
+		}
+		order.ShippingAddress = *address
+	} else if params.ShippingAddress != nil {
+		order.ShippingAddress = *params.ShippingAddress
+	}
+	if order.ShippingAddress.Country == "" {
+		return badRequestError("Shipping Address Required")
+	}
+
+	if params.VATNumber != "" {
+		if httpError := validateVATNumber(params.VATNumber); httpError != nil {
+			return httpError
+		}
+		order.VATNumber = params.VATNumber
+	}
+
+	price, httpError := a.priceLineItems(ctx, a.db, order, params.LineItems, getLogEntry(r))
+	if httpError != nil {
+		return httpError
+	}
+	return sendJSON(w, http.StatusOK, price)
+}
+
 // OrderUpdate will allow an ADMIN only to update the details of a record
 // it is also important to note that it will not let modification of an order if the
 // order is no longer pending.
@@ -437,6 +491,9 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return badRequestError("Could not read Order Parameters: %v", err)
 	}
+	if httpError := checkLineItemQuantities(orderParams.LineItems); httpError != nil {
+		return httpError
+	}
 
 	// verify that the order exists
 	existingOrder := new(models.Order)
@@ -543,6 +600,35 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 		}
 		existingOrder.FulfillmentState = orderParams.FulfillmentState
 		changes = append(changes, "fulfillment_state")
+
+		// payments that were only authorized at checkout are captured once the
+		// order ships, if they cover the whole order
+		shipping := existingOrder.FulfillmentState == models.ShippingState || existingOrder.FulfillmentState == models.ShippedState
+		capture := shipping && existingOrder.PaymentState == models.AuthorizedState
+		captured := []*models.Transaction{}
+		for _, trans := range existingOrder.Transactions {
+			if !capture || trans.Type != models.ChargeTransactionType || trans.Status != models.AuthorizedState {
+				continue
+			}
+			log.Debugf("Capturing authorized transaction %s", trans.ID)
+			if httpErr := a.capturePayment(ctx, r, existingOrder, trans, trans.Amount); httpErr != nil {
+				tx.Rollback()
+				// the provider already captured the earlier charges
+				if err := a.saveCaptures(existingOrder, captured); err != nil {
+					log.WithError(err).Error("Failed to save captured transactions")
+				}
+				return httpErr
+			}
+			tx.Save(trans)
+			captured = append(captured, trans)
+		}
+		if len(captured) > 0 {
+			if err := existingOrder.UpdatePaymentState(tx); err != nil {
+				tx.Rollback()
+				return internalServerError("Error updating the payment state").WithInternalError(err)
+			}
+			changes = append(changes, "payment_state")
+		}
 	}
 
 	//
@@ -564,6 +650,15 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 
 	if len(updatedItems) > 0 {
 		changes = append(changes, "line_items")
+
+		// the stock held for the order follows its new quantities
+		switch existingOrder.PaymentState {
+		case models.PendingState, models.PartiallyPaidState, models.AuthorizedState:
+			if err := models.ReserveStock(tx, existingOrder); err != nil {
+				tx.Rollback()
+				return stockError(err)
+			}
+		}
 	}
 
 	log.Info("Saving order updates")
@@ -589,6 +684,77 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 	return sendJSON(w, http.StatusOK, existingOrder)
 }
 
+// saveCaptures stores charges that were captured at the provider in their own
+// transaction, so they are kept when the order update fails.
+func (a *API) saveCaptures(order *models.Order, captured []*models.Transaction) error {
+	if len(captured) == 0 {
+		return nil
+	}
+	tx := a.db.Begin()
+	for _, trans := range captured {
+		if rsp := tx.Save(trans); rsp.Error != nil {
+			tx.Rollback()
+			return rsp.Error
+		}
+	}
+	if err := order.UpdatePaymentState(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// orderCoupons looks up the coupons of an order and checks that they can be
+// used together.
+func (a *API) orderCoupons(ctx context.Context, w http.ResponseWriter, codes []string) ([]*models.Coupon, error) {
+	coupons := []*models.Coupon{}
+	stackable := 0
+	for _, code := range codes {
+		coupon, err := a.lookupCoupon(ctx, w, code)
+		if err != nil {
+			return nil, err
+		}
+		if !coupon.Valid() {
+			return nil, badRequestError("The coupon %v is not valid at this time", code)
+		}
+		if coupon.Stackable {
+			stackable++
+		}
+		if coupon.Exclusive && len(codes) > 1 {
+			return nil, badRequestError("The coupon %v can't be combined with other coupons", code)
+		}
+		coupons = append(coupons, coupon)
+	}
+	if len(coupons)-stackable > 1 {
+		return nil, badRequestError("Only one coupon that isn't stackable can be used per order")
+	}
+	return coupons, nil
+}
+
+// couponCodes returns the coupon codes of a request without duplicates.
+func couponCodes(code string, codes []string) []string {
+	unique := []string{}
+	seen := map[string]bool{}
+	for _, c := range append([]string{code}, codes...) {
+		if c != "" && !seen[c] {
+			seen[c] = true
+			unique = append(unique, c)
+		}
+	}
+	return unique
+}
+
+func validateVATNumber(number string) *HTTPError {
+	valid, err := vat.IsValidVAT(number)
+	if err != nil {
+		return internalServerError("Error verifying VAT number").WithInternalError(err)
+	}
+	if !valid {
+		return badRequestError("Vat number %v is not valid", number)
+	}
+	return nil
+}
+
 // An order's email is determined by a few things. The rules guiding it are:
 // 1 - if no claims are provided then the one in the params is used (for anon orders)
 // 2 - if claims are provided they must be a valid user id
@@ -630,6 +796,83 @@ func setOrderEmail(tx *gorm.DB, order *models.Order, claims *claims.JWTClaims, l
 }
 
 func (a *API) createLineItems(ctx context.Context, tx *gorm.DB, order *models.Order, items []*orderLineItem, log logrus.FieldLogger) *HTTPError {
+	if _, httpError := a.priceLineItems(ctx, tx, order, items, log); httpError != nil {
+		return httpError
+	}
+
+	for _, item := range order.LineItems {
+		if err := tx.Save(&item).Error; err != nil {
+			return internalServerError("Error creating line item").WithInternalError(err)
+		}
+	}
+
+	for _, download := range order.Downloads {
+		if err := tx.Create(&download).Error; err != nil {
+			return internalServerError("Error creating download item").WithInternalError(err)
+		}
+	}
+	return nil
+}
+
+// priceLineItems adds the items to the order and calculates its total without
+// saving anything.
+func (a *API) priceLineItems(ctx context.Context, db *gorm.DB, order *models.Order, items []*orderLineItem, log logrus.FieldLogger) (*calculator.Price, *HTTPError) {
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		return nil, internalServerError("Error loading site settings").WithInternalError(err)
+	}
+	rates, err := exchangeRates(ctx, db, settings)
+	if err != nil {
+		return nil, internalServerError("Error while querying for exchange rates").WithInternalError(err)
+	}
+	shippingRate, err := settings.FindShippingRate(order.ShippingAddress.Country, order.Currency, order.ShippingRate)
+	if err != nil {
+		return nil, badRequestError("Invalid shipping rate: %v", err)
+	}
+	if shippingRate != nil {
+		order.ShippingRate = shippingRate.ID
+	}
+
+	if httpError := a.processLineItems(ctx, order, items, rates); httpError != nil {
+		return nil, httpError
+	}
+
+	for _, item := range order.LineItems {
+		if item.ExchangeRate != 0 {
+			order.ExchangeRate = item.ExchangeRate
+			order.ExchangeRateBase = rates.Base
+		}
+		order.SubTotal = order.SubTotal + (item.Price+item.AddonPrice)*item.Quantity
+	}
+	if err := order.CheckCoupon(); err != nil {
+		return nil, badRequestError("%v", err)
+	}
+
+	price, err := order.CalculateTotal(settings, gcontext.GetClaimsAsMap(ctx), log)
+	if err != nil {
+		return nil, internalServerError("Error looking up taxes").WithInternalError(err)
+	}
+	return price, nil
+}
+
+// checkLineItemQuantities returns an error if an item is ordered in a larger
+// quantity than MaxLineItemQuantity.
+func checkLineItemQuantities(items []*orderLineItem) *HTTPError {
+	for _, item := range items {
+		if item.Quantity > MaxLineItemQuantity {
+			return badRequestError("The quantity of a line item can't be more than %d", MaxLineItemQuantity)
+		}
+	}
+	return nil
+}
+
+// processLineItems adds the items to the order, looking up their products on
+// the site concurrently.
+func (a *API) processLineItems(ctx context.Context, order *models.Order, items []*orderLineItem, rates *calculator.ExchangeRates) *HTTPError {
+	if httpError := checkLineItemQuantities(items); httpError != nil {
+		return httpError
+	}
+
 	sem := make(chan int, MaxConcurrentLookups)
 	var wg sync.WaitGroup
 	sharedErr := verificationError{}
@@ -654,7 +897,7 @@ func (a *API) createLineItems(ctx context.Context, tx *gorm.DB, order *models.Or
 				return
 			}
 
-			if err := a.processLineItem(ctx, order, item, orderItem); err != nil {
+			if err := a.processLineItem(ctx, order, item, orderItem, rates); err != nil {
 				sharedErr.setError(err)
 			}
 		}(lineItem, orderItem)
@@ -664,26 +907,6 @@ func (a *API) createLineItems(ctx context.Context, tx *gorm.DB, order *models.Or
 	if sharedErr.err != nil {
 		return internalServerError("Error processing line item").WithInternalError(sharedErr.err)
 	}
-
-	for _, item := range order.LineItems {
-		order.SubTotal = order.SubTotal + (item.Price+item.AddonPrice)*item.Quantity
-		if err := tx.Save(&item).Error; err != nil {
-			return internalServerError("Error creating line item").WithInternalError(err)
-		}
-	}
-
-	for _, download := range order.Downloads {
-		if err := tx.Create(&download).Error; err != nil {
-			return internalServerError("Error creating download item").WithInternalError(err)
-		}
-	}
-
-	settings, err := a.loadSettings(ctx)
-	if err != nil {
-		return internalServerError(err.Error()).WithInternalError(err)
-	}
-
-	order.CalculateTotal(settings, gcontext.GetClaimsAsMap(ctx), log)
 	return nil
 }
 
@@ -702,6 +925,9 @@ func (a *API) loadSettings(ctx context.Context) (*calculator.Settings, error) {
 			return nil, fmt.Errorf("Error parsing site settings: %v", err)
 		}
 	}
+	if config.Taxes.URL != "" {
+		settings.TaxProvider = calculator.NewHTTPTaxProvider(config.Taxes.URL, config.Taxes.User, config.Taxes.Password)
+	}
 
 	return settings, nil
 }
@@ -735,7 +961,7 @@ func (a *API) processAddress(tx *gorm.DB, order *models.Order, name string, addr
 	return address, nil
 }
 
-func (a *API) processLineItem(ctx context.Context, order *models.Order, item *models.LineItem, orderItem *orderLineItem) error {
+func (a *API) processLineItem(ctx context.Context, order *models.Order, item *models.LineItem, orderItem *orderLineItem, rates *calculator.ExchangeRates) error {
 	config := gcontext.GetConfig(ctx)
 	jwtClaims := gcontext.GetClaimsAsMap(ctx)
 	resp, err := a.httpClient.Get(config.SiteURL + item.Path)
@@ -780,7 +1006,7 @@ func (a *API) processLineItem(ctx context.Context, order *models.Order, item *mo
 				})
 			}
 
-			return item.Process(jwtClaims, order, meta)
+			return item.Process(jwtClaims, order, meta, rates)
 		}
 	}
 
@@ -249,6 +249,34 @@ func TestOrderCreate(t *testing.T) {
 		assert.Equal(t, uint64(15), discountItem.Percentage)
 		assert.Equal(t, uint64(0), discountItem.Fixed)
 	})
+	t.Run("PromotionDiscount", func(t *testing.T) {
+		test := NewRouteTest(t)
+
+		settings := calculator.Settings{
+			Promotions: []*calculator.Promotion{{
+				Name:  "Volume discount",
+				Type:  calculator.PromotionTiered,
+				Tiers: []*calculator.PromotionTier{{Quantity: 1, Percentage: 10}},
+			}},
+		}
+		server := startTestSiteWithSettings(settings)
+		defer server.Close()
+		test.Config.SiteURL = server.URL
+
+		body := strings.NewReader(defaultPayload)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.EqualValues(t, 100, order.Discount)
+		assert.EqualValues(t, 899, order.Total)
+		require.Len(t, order.LineItems, 1)
+		require.Len(t, order.LineItems[0].CalculationDetail.DiscountItems, 1)
+		discountItem := order.LineItems[0].CalculationDetail.DiscountItems[0]
+		assert.Equal(t, calculator.DiscountTypePromotion, discountItem.Type)
+		assert.Equal(t, "Volume discount", discountItem.Name)
+		assert.EqualValues(t, 10, discountItem.Percentage)
+	})
 }
 
 func TestOrderCreateNewUser(t *testing.T) {
@@ -1055,6 +1083,210 @@ func validateAllOrders(t *testing.T, actual []models.Order, expected *TestData)
 	}
 }
 
+func TestOrderCreateShippingRate(t *testing.T) {
+	server := startTestSiteWithSettings(&calculator.Settings{
+		ShippingZones: []*calculator.ShippingZone{{
+			Name:      "Domestic",
+			Countries: []string{"USA"},
+			Rates: []*calculator.ShippingRate{
+				{ID: "standard", Type: calculator.FlatShippingRate, Amount: "5.00"},
+				{ID: "express", Type: calculator.FlatShippingRate, Amount: "12.00", VAT: 10},
+			},
+		}},
+	})
+	defer server.Close()
+
+	createOrder := func(t *testing.T, rate string) *httptest.ResponseRecorder {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		body := strings.NewReader(`{
+			"email": "info@example.com",
+			"shipping_rate": "` + rate + `",
+			"shipping_address": {
+				"name": "Test User",
+				"address1": "610 22nd Street",
+				"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+			},
+			"line_items": [{"path": "/simple-product", "quantity": 1}]
+		}`)
+		return test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, createOrder(t, ""), order)
+		assert.Equal(t, "standard", order.ShippingRate)
+		assert.EqualValues(t, 500, order.Shipping)
+		assert.EqualValues(t, 0, order.ShippingTaxes)
+		assert.EqualValues(t, 1499, order.Total)
+	})
+
+	t.Run("Selected", func(t *testing.T) {
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, createOrder(t, "express"), order)
+		assert.Equal(t, "express", order.ShippingRate)
+		assert.EqualValues(t, 1200, order.Shipping)
+		assert.EqualValues(t, 120, order.ShippingTaxes)
+		assert.EqualValues(t, 120, order.Taxes)
+		assert.EqualValues(t, 2319, order.Total)
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		validateError(t, http.StatusBadRequest, createOrder(t, "overnight"), "Invalid shipping rate")
+	})
+}
+
+func TestOrderCreateTaxBreakdown(t *testing.T) {
+	server := startTestSiteWithSettings(&calculator.Settings{
+		Taxes: []*calculator.Tax{
+			{Name: "State Tax", Percentage: 6, Countries: []string{"USA"}, States: []string{"CA"}},
+			{Name: "District Tax", Percentage: 2, Countries: []string{"USA"}, PostalCodes: []*calculator.PostalCodeRange{{From: "941"}}, Stack: true},
+		},
+	})
+	defer server.Close()
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+
+	recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+	order := &models.Order{}
+	extractPayload(t, http.StatusCreated, recorder, order)
+	assert.EqualValues(t, 80, order.Taxes)
+	assert.EqualValues(t, 1079, order.Total)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/orders/"+order.ID, nil, test.Data.testUserToken)
+	stored := &models.Order{}
+	extractPayload(t, http.StatusOK, recorder, stored)
+	require.Len(t, stored.LineItems, 1)
+	require.NotNil(t, stored.LineItems[0].CalculationDetail)
+	assert.Equal(t, []calculator.TaxItem{
+		{Name: "State Tax", Percentage: 6, Amount: 60},
+		{Name: "District Tax", Percentage: 2, Amount: 20},
+	}, stored.LineItems[0].TaxItems)
+}
+
+func TestOrderCreateWithTaxService(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	taxServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"taxes": [{"name": "CA Sales Tax", "percentage": 8, "states": ["CA"]}]}`))
+	}))
+	defer taxServer.Close()
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+	test.Config.Taxes.URL = taxServer.URL
+
+	recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+	order := &models.Order{}
+	extractPayload(t, http.StatusCreated, recorder, order)
+	assert.EqualValues(t, 80, order.Taxes)
+	assert.EqualValues(t, 1079, order.Total)
+}
+
+func TestOrderCreateWithFailingTaxService(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	taxServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer taxServer.Close()
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+	test.Config.Taxes.URL = taxServer.URL
+
+	before, after := 0, 0
+	require.NoError(t, test.DB.Model(&models.Order{}).Count(&before).Error)
+	recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+	validateError(t, http.StatusInternalServerError, recorder, "Error looking up taxes")
+	require.NoError(t, test.DB.Model(&models.Order{}).Count(&after).Error)
+	assert.Equal(t, before, after)
+}
+
+func TestOrderCreateCouponMinimumAmount(t *testing.T) {
+	server := startTestSiteWithSettings(&calculator.Settings{
+		ExchangeRates: &calculator.ExchangeRates{Base: "USD", Rates: map[string]float64{"EUR": 0.9}},
+	})
+	defer server.Close()
+	couponServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"coupons": {"OVER-15": {
+			"percentage": 10,
+			"minimum_amount": [{"amount": "15.00", "currency": "USD"}]
+		}}}`))
+	}))
+	defer couponServer.Close()
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+	test.Config.Coupons.URL = couponServer.URL
+
+	createOrder := func(quantity int, currency string) *httptest.ResponseRecorder {
+		body := strings.NewReader(fmt.Sprintf(`{
+			"email": "info@example.com",
+			"currency": %q,
+			"shipping_address": {
+				"name": "Test User",
+				"address1": "610 22nd Street",
+				"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+			},
+			"line_items": [{"path": "/simple-product", "quantity": %d}],
+			"coupon": "OVER-15"
+		}`, currency, quantity))
+		return test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+	}
+
+	validateError(t, http.StatusBadRequest, createOrder(1, "USD"), "at least 15.00 USD")
+	validateError(t, http.StatusBadRequest, createOrder(2, "EUR"), "not valid for orders in EUR")
+
+	order := &models.Order{}
+	extractPayload(t, http.StatusCreated, createOrder(2, "USD"), order)
+	assert.EqualValues(t, 200, order.Discount)
+	assert.EqualValues(t, 1798, order.Total)
+}
+
+func TestOrderPreview(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	couponServer := startCouponList("SPECIAL-EVENT", 10)
+	defer couponServer.Close()
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+	test.Config.Coupons.URL = couponServer.URL
+	test.Config.Webhooks.Order = "http://example.com/hooks/order"
+
+	counts := func() []int {
+		var orders, items, hooks int
+		require.NoError(t, test.DB.Model(&models.Order{}).Count(&orders).Error)
+		require.NoError(t, test.DB.Model(&models.LineItem{}).Count(&items).Error)
+		require.NoError(t, test.DB.Model(&models.Hook{}).Count(&hooks).Error)
+		return []int{orders, items, hooks}
+	}
+	before := counts()
+
+	body := strings.NewReader(`{
+		"shipping_address": {"country": "USA"},
+		"line_items": [{"path": "/simple-product", "quantity": 2}],
+		"coupon": "SPECIAL-EVENT"
+	}`)
+	recorder := test.TestEndpoint(http.MethodPost, "/orders/preview", body, test.Data.testUserToken)
+	price := &calculator.Price{}
+	extractPayload(t, http.StatusOK, recorder, price)
+	assert.EqualValues(t, 1998, price.Subtotal)
+	assert.EqualValues(t, 200, price.Discount)
+	assert.EqualValues(t, 1798, price.Total)
+	require.Len(t, price.Items, 1)
+	assert.EqualValues(t, 2, price.Items[0].Quantity)
+	require.Len(t, price.Items[0].DiscountItems, 1)
+	assert.Equal(t, calculator.DiscountTypeCoupon, price.Items[0].DiscountItems[0].Type)
+
+	assert.Equal(t, before, counts())
+
+	body = strings.NewReader(`{"line_items": [{"path": "/simple-product", "quantity": 1}]}`)
+	recorder = test.TestEndpoint(http.MethodPost, "/orders/preview", body, nil)
+	validateError(t, http.StatusBadRequest, recorder, "Shipping Address Required")
+}
+
 func validateNewUserEmail(t *testing.T, order *models.Order, claims *claims.JWTClaims, expectedUserEmail, expectedOrderEmail string) {
 	db, _, _, _ := db(t)
 	result := db.First(new(models.User), "id = ?", claims.Subject)
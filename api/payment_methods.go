@@ -0,0 +1,91 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi"
+
+	gcontext "gocommerce/context"
+	"gocommerce/models"
+	"gocommerce/payments"
+)
+
+// savedPaymentMethod is a saved payment method together with the customer it
+// belongs to.
+type savedPaymentMethod struct {
+	*payments.PaymentMethod
+	provider   payments.CustomerProvider
+	customerID string
+}
+
+// PaymentMethodList lists the payment methods a user saved with the payment
+// providers.
+func (a *API) PaymentMethodList(w http.ResponseWriter, r *http.Request) error {
+	saved, httpErr := a.savedPaymentMethods(r.Context())
+	if httpErr != nil {
+		return httpErr
+	}
+
+	methods := []*payments.PaymentMethod{}
+	for _, method := range saved {
+		methods = append(methods, method.PaymentMethod)
+	}
+	return sendJSON(w, http.StatusOK, methods)
+}
+
+// PaymentMethodDelete removes a saved payment method of a user.
+func (a *API) PaymentMethodDelete(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	methodID := chi.URLParam(r, "payment_method_id")
+
+	saved, httpErr := a.savedPaymentMethods(ctx)
+	if httpErr != nil {
+		return httpErr
+	}
+	for _, method := range saved {
+		if method.ID != methodID {
+			continue
+		}
+		if err := method.provider.DeletePaymentMethod(ctx, method.customerID, method.ID); err != nil {
+			return internalServerError("Error deleting payment method").WithInternalError(err)
+		}
+		log.WithField("payment_method_id", methodID).Info("Deleted saved payment method")
+		return sendJSON(w, http.StatusOK, map[string]string{})
+	}
+	return notFoundError("Payment method not found")
+}
+
+func (a *API) savedPaymentMethods(ctx context.Context) ([]*savedPaymentMethod, *HTTPError) {
+	instanceID := gcontext.GetInstanceID(ctx)
+	userID := gcontext.GetUserID(ctx)
+
+	saved := []*savedPaymentMethod{}
+	for name, provider := range gcontext.GetPaymentProviders(ctx) {
+		customerProvider, ok := provider.(payments.CustomerProvider)
+		if !ok {
+			continue
+		}
+		customer, err := models.GetPaymentCustomer(a.db, instanceID, userID, name)
+		if err != nil {
+			return nil, internalServerError("Error while querying for payment customers").WithInternalError(err)
+		}
+		if customer == nil {
+			continue
+		}
+
+		methods, err := customerProvider.ListPaymentMethods(ctx, customer.CustomerID)
+		if err != nil {
+			return nil, internalServerError("Error listing payment methods with %s", name).WithInternalError(err)
+		}
+		for _, method := range methods {
+			saved = append(saved, &savedPaymentMethod{
+				PaymentMethod: method,
+				provider:      customerProvider,
+				customerID:    customer.CustomerID,
+			})
+		}
+	}
+	return saved, nil
+}
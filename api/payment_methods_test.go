@@ -0,0 +1,199 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"gocommerce/models"
+	"gocommerce/payments"
+)
+
+type savedCardPaymentParams struct {
+	Amount            uint64 `json:"amount"`
+	Currency          string `json:"currency"`
+	Provider          string `json:"provider"`
+	StripeToken       string `json:"stripe_token,omitempty"`
+	PaymentMethodID   string `json:"payment_method_id,omitempty"`
+	SavePaymentMethod bool   `json:"save_payment_method,omitempty"`
+}
+
+func TestPaymentMethods(t *testing.T) {
+	test := NewRouteTest(t)
+	calls := []string{}
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) {
+		calls = append(calls, method+" "+path)
+		switch path {
+		case "/customers":
+			payload := params.(*stripe.CustomerParams)
+			assert.Equal(t, test.Data.testUser.Email, *payload.Email)
+			assert.Equal(t, test.Data.testUser.ID, payload.Metadata["user_id"])
+			v.(*stripe.Customer).ID = "cus_1"
+		case "/customers/cus_1/sources":
+			payload := params.(*stripe.CardParams)
+			assert.Equal(t, "tok_visa", *payload.Token)
+			v.(*stripe.Card).ID = "card_1"
+		case "/charges":
+			payload := params.(*stripe.ChargeParams)
+			require.NotNil(t, payload.Customer)
+			assert.Equal(t, "cus_1", *payload.Customer)
+			assert.Equal(t, "card_1", *payload.Source.Token)
+			v.(*stripe.Charge).ID = "ch_saved"
+		case "/customers/cus_1/cards":
+			v.(*stripe.CardList).Data = []*stripe.Card{
+				{ID: "card_1", Brand: "Visa", Last4: "4242", ExpMonth: 12, ExpYear: 2030},
+			}
+		case "/customers/cus_1/sources/card_1":
+			v.(*stripe.Card).ID = "card_1"
+		default:
+			t.Fatalf("unknown Stripe API call to %s", path)
+		}
+	}))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	pay := func(order *models.Order, params *savedCardPaymentParams) *httptest.ResponseRecorder {
+		order.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(order).Error)
+		require.NoError(t, test.DB.Model(&models.Transaction{}).Where("order_id = ?", order.ID).Update("status", models.FailedState).Error)
+
+		params.Amount = order.Total
+		params.Currency = order.Currency
+		params.Provider = payments.StripeProvider
+		body, err := json.Marshal(params)
+		require.NoError(t, err)
+		return test.TestEndpoint(http.MethodPost, "/orders/"+order.ID+"/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+	}
+	methodsURL := "/users/" + test.Data.testUser.ID + "/payment_methods"
+
+	// the card is saved to a new customer on the first payment
+	recorder := pay(test.Data.firstOrder, &savedCardPaymentParams{StripeToken: "tok_visa", SavePaymentMethod: true})
+	trans := &models.Transaction{}
+	extractPayload(t, http.StatusOK, recorder, trans)
+	assert.Equal(t, "ch_saved", trans.ProcessorID)
+	assert.Equal(t, []string{"POST /customers", "POST /customers/cus_1/sources", "POST /charges"}, calls)
+
+	customer, err := models.GetPaymentCustomer(test.DB, "", test.Data.testUser.ID, payments.StripeProvider)
+	require.NoError(t, err)
+	require.NotNil(t, customer)
+	assert.Equal(t, "cus_1", customer.CustomerID)
+
+	// and can be used again for the next order
+	calls = []string{}
+	recorder = pay(test.Data.secondOrder, &savedCardPaymentParams{PaymentMethodID: "card_1"})
+	extractPayload(t, http.StatusOK, recorder, trans)
+	assert.Equal(t, []string{"POST /charges"}, calls)
+
+	recorder = test.TestEndpoint(http.MethodGet, methodsURL, nil, test.Data.testUserToken)
+	methods := []*payments.PaymentMethod{}
+	extractPayload(t, http.StatusOK, recorder, &methods)
+	require.Len(t, methods, 1)
+	assert.Equal(t, "card_1", methods[0].ID)
+	assert.Equal(t, payments.StripeProvider, methods[0].Provider)
+	assert.Equal(t, "4242", methods[0].Last4)
+
+	recorder = test.TestEndpoint(http.MethodGet, methodsURL, nil, testToken("someone-else", "else@example.com"))
+	validateError(t, http.StatusUnauthorized, recorder)
+
+	calls = []string{}
+	recorder = test.TestEndpoint(http.MethodDelete, methodsURL+"/card_1", nil, test.Data.testUserToken)
+	assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	assert.Contains(t, calls, "DELETE /customers/cus_1/sources/card_1")
+
+	recorder = test.TestEndpoint(http.MethodDelete, methodsURL+"/card_unknown", nil, test.Data.testUserToken)
+	validateError(t, http.StatusNotFound, recorder)
+}
+
+func TestPaymentMethodsKeepCustomerOnFailedPayment(t *testing.T) {
+	test := NewRouteTest(t)
+	calls := []string{}
+	declined := true
+	stripe.SetBackend(stripe.APIBackend, &failingStripeBackend{
+		trackingStripeBackend: trackingStripeBackend{func(method, path, key string, params stripe.ParamsContainer, v interface{}) {
+			calls = append(calls, method+" "+path)
+			switch path {
+			case "/customers":
+				v.(*stripe.Customer).ID = "cus_1"
+			case "/customers/cus_1/sources":
+				v.(*stripe.Card).ID = "card_1"
+			case "/charges":
+				v.(*stripe.Charge).ID = "ch_saved"
+			default:
+				t.Fatalf("unknown Stripe API call to %s", path)
+			}
+		}},
+		fail: func(path string) error {
+			if path == "/charges" && declined {
+				return errors.New("card declined")
+			}
+			return nil
+		},
+	})
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	test.Data.firstOrder.PaymentState = models.PendingState
+	require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+	test.Data.firstTransaction.Status = models.FailedState
+	require.NoError(t, test.DB.Save(test.Data.firstTransaction).Error)
+
+	pay := func() *httptest.ResponseRecorder {
+		body, err := json.Marshal(&savedCardPaymentParams{
+			Amount:            test.Data.firstOrder.Total,
+			Currency:          test.Data.firstOrder.Currency,
+			Provider:          payments.StripeProvider,
+			StripeToken:       "tok_visa",
+			SavePaymentMethod: true,
+		})
+		require.NoError(t, err)
+		return test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+	}
+
+	recorder := pay()
+	assert.NotEqual(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, []string{"POST /customers", "POST /customers/cus_1/sources", "POST /charges"}, calls)
+
+	customer, err := models.GetPaymentCustomer(test.DB, "", test.Data.testUser.ID, payments.StripeProvider)
+	require.NoError(t, err)
+	require.NotNil(t, customer)
+	assert.Equal(t, "cus_1", customer.CustomerID)
+
+	// the retry reuses the customer created by the failed payment
+	calls = []string{}
+	declined = false
+	recorder = pay()
+	trans := &models.Transaction{}
+	extractPayload(t, http.StatusOK, recorder, trans)
+	assert.Equal(t, []string{"POST /customers/cus_1/sources", "POST /charges"}, calls)
+}
+
+func TestPaymentMethodsWithoutCustomer(t *testing.T) {
+	test := NewRouteTest(t)
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) {
+		t.Fatalf("unexpected Stripe API call to %s", path)
+	}))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	test.Data.firstOrder.PaymentState = models.PendingState
+	require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+	body, err := json.Marshal(&savedCardPaymentParams{
+		Amount:          test.Data.firstOrder.Total,
+		Currency:        test.Data.firstOrder.Currency,
+		Provider:        payments.StripeProvider,
+		PaymentMethodID: "card_1",
+	})
+	require.NoError(t, err)
+	recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+	validateError(t, http.StatusInternalServerError, recorder, "No saved payment methods")
+
+	recorder = test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/payment_methods", nil, test.Data.testUserToken)
+	methods := []*payments.PaymentMethod{}
+	extractPayload(t, http.StatusOK, recorder, &methods)
+	assert.Empty(t, methods)
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/pborman/uuid"
+	"github.com/sirupsen/logrus"
+
+	gcontext "gocommerce/context"
+	"gocommerce/models"
+	"gocommerce/payments"
+)
+
+// PaymentWebhook receives webhooks from a payment provider about changes made
+// on the provider's side, like refunds, disputes and reversals, and applies
+// them to the affected transaction and order. Every event is applied once.
+func (a *API) PaymentWebhook(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+	instanceID := gcontext.GetInstanceID(ctx)
+
+	providerType := strings.ToLower(chi.URLParam(r, "provider"))
+	provider := gcontext.GetPaymentProviders(ctx)[providerType]
+	if provider == nil {
+		return notFoundError("Payment provider '%s' not configured", providerType)
+	}
+	webhookProvider, ok := provider.(payments.WebhookProvider)
+	if !ok {
+		return notFoundError("Payment provider '%s' doesn't support webhooks", providerType)
+	}
+
+	event, err := webhookProvider.VerifyWebhook(ctx, r)
+	if err != nil {
+		return badRequestError("Invalid webhook: %v", err).WithInternalError(err)
+	}
+
+	log := getLogEntry(r).WithFields(logrus.Fields{
+		"provider":   provider.Name(),
+		"event_id":   event.ID,
+		"event_type": event.Type,
+	})
+	if event.Type == "" {
+		log.Debug("Ignoring webhook event that doesn't affect payments")
+		return sendJSON(w, http.StatusOK, event)
+	}
+
+	existing, err := models.GetProviderEvent(a.db, instanceID, provider.Name(), event.ID)
+	if err != nil {
+		return internalServerError("Error during database query").WithInternalError(err)
+	}
+	if existing != nil {
+		log.Info("Webhook event has already been processed")
+		return sendJSON(w, http.StatusOK, event)
+	}
+
+	tx := a.db.Begin()
+	if rsp := tx.Create(models.NewProviderEvent(instanceID, provider.Name(), event.ID, string(event.Type))); rsp.Error != nil {
+		tx.Rollback()
+		return conflictError("Webhook event is already being processed").WithInternalError(rsp.Error)
+	}
+
+	trans, err := models.GetTransactionByProcessorID(tx, instanceID, models.ChargeTransactionType, event.TransactionID)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error while querying for transactions").WithInternalError(err)
+	}
+	if trans == nil || event.TransactionID == "" {
+		log.Warnf("No charge found for processor ID '%s', ignoring webhook event", event.TransactionID)
+		if rsp := tx.Commit(); rsp.Error != nil {
+			return internalServerError("Error saving webhook event").WithInternalError(rsp.Error)
+		}
+		return sendJSON(w, http.StatusOK, event)
+	}
+
+	order, httpErr := queryForOrder(tx, trans.OrderID, log)
+	if httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+
+	changes := []string{}
+	stateChanged := false
+	refunds := []*models.Transaction{}
+	switch event.Type {
+	case payments.RefundEvent, payments.ReversalEvent:
+		for _, item := range event.AllRefunds() {
+			existing, err := models.GetTransactionByProcessorID(tx, instanceID, models.RefundTransactionType, item.ProcessorID)
+			if err != nil {
+				tx.Rollback()
+				return internalServerError("Error while querying for transactions").WithInternalError(err)
+			}
+			if existing != nil {
+				// refunds made through the API are reported back by the provider
+				log.Debugf("Refund %s is already recorded", item.ProcessorID)
+				continue
+			}
+			refund := &models.Transaction{
+				InstanceID:    instanceID,
+				ID:            uuid.NewRandom().String(),
+				OrderID:       trans.OrderID,
+				InvoiceNumber: trans.InvoiceNumber,
+				ProcessorID:   item.ProcessorID,
+				UserID:        trans.UserID,
+				Amount:        item.Amount,
+				Currency:      event.Currency,
+				Type:          models.RefundTransactionType,
+				Status:        models.PaidState,
+
+				PaymentProcessor: provider.Name(),
+				ChargeID:         trans.ID,
+			}
+			tx.Create(refund)
+			refunds = append(refunds, refund)
+		}
+
+		if len(refunds) > 0 {
+			changes = append(changes, "transactions")
+			if event.Type == payments.RefundEvent {
+				if err := order.UpdatePaymentState(tx); err != nil {
+					tx.Rollback()
+					return internalServerError("Error updating the payment state").WithInternalError(err)
+				}
+				stateChanged = true
+				changes = append(changes, "payment_state")
+			}
+		}
+
+		if event.Type == payments.ReversalEvent {
+			order.PaymentState = models.ReversedState
+			stateChanged = true
+			changes = append(changes, "payment_state")
+		}
+	case payments.DisputeEvent:
+		order.PaymentState = models.DisputedState
+		stateChanged = true
+		changes = append(changes, "payment_state")
+	}
+
+	if len(changes) > 0 {
+		log.Infof("Applying webhook event to order %s: %v", order.ID, changes)
+		tx.Save(order)
+		models.LogEvent(tx, r.RemoteAddr, "", order.ID, models.EventUpdated, changes)
+	}
+
+	for _, refund := range refunds {
+		if config.Webhooks.Refund == "" {
+			break
+		}
+		hook, err := models.NewHook("refund", config.SiteURL, config.Webhooks.Refund, refund.UserID, config.Webhooks.Secret, refund)
+		if err != nil {
+			log.WithError(err).Error("Failed to process webhook")
+		}
+		tx.Save(hook)
+	}
+	if stateChanged && config.Webhooks.Update != "" {
+		hook, err := models.NewHook("update", config.SiteURL, config.Webhooks.Update, order.UserID, config.Webhooks.Secret, order)
+		if err != nil {
+			log.WithError(err).Error("Failed to process webhook")
+		}
+		tx.Save(hook)
+	}
+
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error saving webhook event").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, event)
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/stripe-go/webhook"
+
+	"gocommerce/models"
+)
+
+const testStripeWebhookSecret = "whsec_test"
+
+func stripeWebhookHeaders(payload string) map[string]string {
+	now := time.Now()
+	sig := webhook.ComputeSignature(now, []byte(payload), testStripeWebhookSecret)
+	return map[string]string{
+		"Stripe-Signature": fmt.Sprintf("t=%d,v1=%x", now.Unix(), sig),
+	}
+}
+
+func refundTransactions(t *testing.T, test *RouteTest, orderID string) []models.Transaction {
+	trans := []models.Transaction{}
+	require.NoError(t, test.DB.Where("order_id = ? AND type = ?", orderID, models.RefundTransactionType).Find(&trans).Error)
+	return trans
+}
+
+func TestPaymentWebhook(t *testing.T) {
+	t.Run("StripeRefund", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Payment.Stripe.WebhookSecret = testStripeWebhookSecret
+
+		payload := `{"id":"evt_refund","type":"charge.refunded","data":{"object":{"id":"stripe","currency":"usd","amount_refunded":50,"refunds":{"data":[{"id":"re_1","amount":50}]}}}}`
+		for i := 0; i < 2; i++ {
+			recorder := test.TestEndpointWithHeaders(http.MethodPost, "/payments/webhooks/stripe", strings.NewReader(payload), nil, stripeWebhookHeaders(payload))
+			assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		}
+
+		refunds := refundTransactions(t, test, test.Data.firstOrder.ID)
+		require.Len(t, refunds, 1, "redelivered event must be applied once")
+		assert.Equal(t, "re_1", refunds[0].ProcessorID)
+		assert.EqualValues(t, 50, refunds[0].Amount)
+		assert.Equal(t, "USD", refunds[0].Currency)
+		assert.Equal(t, models.PaidState, refunds[0].Status)
+
+		events := []models.Event{}
+		require.NoError(t, test.DB.Where("order_id = ?", test.Data.firstOrder.ID).Find(&events).Error)
+		require.Len(t, events, 1)
+		assert.Equal(t, string(models.EventUpdated), events[0].Type)
+	})
+
+	t.Run("StripeKnownRefund", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Payment.Stripe.WebhookSecret = testStripeWebhookSecret
+
+		existing := models.NewTransaction(test.Data.firstOrder)
+		existing.Type = models.RefundTransactionType
+		existing.ProcessorID = "re_1"
+		existing.Status = models.PaidState
+		require.NoError(t, test.DB.Create(existing).Error)
+
+		payload := `{"id":"evt_refund","type":"charge.refunded","data":{"object":{"id":"stripe","currency":"usd","refunds":{"data":[{"id":"re_1","amount":50}]}}}}`
+		recorder := test.TestEndpointWithHeaders(http.MethodPost, "/payments/webhooks/stripe", strings.NewReader(payload), nil, stripeWebhookHeaders(payload))
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		assert.Len(t, refundTransactions(t, test, test.Data.firstOrder.ID), 1)
+	})
+
+	t.Run("StripeSeveralRefunds", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Payment.Stripe.WebhookSecret = testStripeWebhookSecret
+
+		payload := `{"id":"evt_refund_1","type":"charge.refunded","data":{"object":{"id":"stripe","currency":"usd","refunds":{"data":[{"id":"re_1","amount":20}]}}}}`
+		recorder := test.TestEndpointWithHeaders(http.MethodPost, "/payments/webhooks/stripe", strings.NewReader(payload), nil, stripeWebhookHeaders(payload))
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		// the second delivery lists a refund that wasn't delivered on its own
+		payload = `{"id":"evt_refund_3","type":"charge.refunded","data":{"object":{"id":"stripe","currency":"usd","refunds":{"data":[{"id":"re_3","amount":30},{"id":"re_2","amount":25},{"id":"re_1","amount":20}]}}}}`
+		recorder = test.TestEndpointWithHeaders(http.MethodPost, "/payments/webhooks/stripe", strings.NewReader(payload), nil, stripeWebhookHeaders(payload))
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		amounts := map[string]uint64{}
+		for _, refund := range refundTransactions(t, test, test.Data.firstOrder.ID) {
+			amounts[refund.ProcessorID] = refund.Amount
+		}
+		assert.Equal(t, map[string]uint64{"re_1": 20, "re_2": 25, "re_3": 30}, amounts)
+	})
+
+	t.Run("StripeDispute", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Payment.Stripe.WebhookSecret = testStripeWebhookSecret
+
+		payload := `{"id":"evt_dispute","type":"charge.dispute.created","data":{"object":{"id":"dp_1","charge":"stripe","amount":100,"currency":"usd"}}}`
+		recorder := test.TestEndpointWithHeaders(http.MethodPost, "/payments/webhooks/stripe", strings.NewReader(payload), nil, stripeWebhookHeaders(payload))
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, models.DisputedState, order.PaymentState)
+
+		// a later refund doesn't clear the dispute
+		payload = `{"id":"evt_refund","type":"charge.refunded","data":{"object":{"id":"stripe","currency":"usd","refunds":{"data":[{"id":"re_1","amount":50}]}}}}`
+		recorder = test.TestEndpointWithHeaders(http.MethodPost, "/payments/webhooks/stripe", strings.NewReader(payload), nil, stripeWebhookHeaders(payload))
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, models.DisputedState, order.PaymentState)
+		assert.EqualValues(t, 50, order.AmountRefunded)
+	})
+
+	t.Run("StripeInvalidSignature", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Payment.Stripe.WebhookSecret = testStripeWebhookSecret
+
+		payload := `{"id":"evt_dispute","type":"charge.dispute.created","data":{"object":{"id":"dp_1","charge":"stripe"}}}`
+		headers := stripeWebhookHeaders(`{"id":"evt_other"}`)
+		recorder := test.TestEndpointWithHeaders(http.MethodPost, "/payments/webhooks/stripe", strings.NewReader(payload), nil, headers)
+		validateError(t, http.StatusBadRequest, recorder, "Invalid webhook")
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, test.Data.firstOrder.PaymentState, order.PaymentState)
+	})
+
+	t.Run("UnknownProvider", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/payments/webhooks/bitcoin", strings.NewReader("{}"), nil)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+
+	t.Run("PayPalReversal", func(t *testing.T) {
+		test := NewRouteTest(t)
+		var verifyCount int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/v1/oauth2/token":
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprint(w, `{"access_token":"EEwJ6tF9x5WCIZDYzyZGaz6Khbw7raYRIBV_WxVvgmsG","expires_in":100000}`)
+			case "/v1/notifications/verify-webhook-signature":
+				params := map[string]interface{}{}
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&params))
+				assert.Equal(t, "webhook-id", params["webhook_id"])
+				assert.Equal(t, "transmission-sig", params["transmission_sig"])
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprint(w, `{"verification_status":"SUCCESS"}`)
+				verifyCount++
+			default:
+				w.WriteHeader(500)
+				t.Fatalf("unknown PayPal API call to %s", r.URL.Path)
+			}
+		}))
+		defer server.Close()
+		test.Config.Payment.PayPal.Enabled = true
+		test.Config.Payment.PayPal.ClientID = "clientid"
+		test.Config.Payment.PayPal.Secret = "secret"
+		test.Config.Payment.PayPal.Env = server.URL
+		test.Config.Payment.PayPal.WebhookID = "webhook-id"
+
+		payload := `{"id":"WH-1","event_type":"PAYMENT.SALE.REVERSED","resource":{"id":"reversal-1","sale_id":"sale-1","parent_payment":"paypal","amount":{"total":"-3.30","currency":"USD"}}}`
+		headers := map[string]string{"Paypal-Transmission-Sig": "transmission-sig"}
+		recorder := test.TestEndpointWithHeaders(http.MethodPost, "/payments/webhooks/paypal", strings.NewReader(payload), nil, headers)
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		assert.Equal(t, 1, verifyCount)
+
+		refunds := refundTransactions(t, test, test.Data.secondOrder.ID)
+		require.Len(t, refunds, 1)
+		assert.Equal(t, "reversal-1", refunds[0].ProcessorID)
+		assert.EqualValues(t, 330, refunds[0].Amount)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.secondOrder.ID).Error)
+		assert.Equal(t, models.ReversedState, order.PaymentState)
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 
@@ -20,8 +21,11 @@ import (
 	"gocommerce/claims"
 	"gocommerce/conf"
 	gcontext "gocommerce/context"
+	"gocommerce/mailer"
 	"gocommerce/models"
 	"gocommerce/payments"
+	"gocommerce/payments/giftcard"
+	"gocommerce/payments/offline"
 	"gocommerce/payments/paypal"
 	"gocommerce/payments/stripe"
 )
@@ -34,6 +38,15 @@ type PaymentParams struct {
 	Description  string `json:"description"`
 }
 
+// RefundParams holds the parameters for refunding a payment. The line items
+// break the refund down by the line items of the order and must add up to
+// its amount.
+type RefundParams struct {
+	PaymentParams
+	Reason    string                   `json:"reason"`
+	LineItems []*models.RefundLineItem `json:"line_items"`
+}
+
 // PaymentListForUser is the endpoint for listing transactions for a user.
 // The ID in the claim and the ID in the path must match (or have admin override)
 func (a *API) PaymentListForUser(w http.ResponseWriter, r *http.Request) error {
@@ -100,13 +113,19 @@ func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 	if provider == nil {
 		return badRequestError("Payment provider '%s' not configured", params.ProviderType)
 	}
-	charge, err := provider.NewCharger(ctx, r)
+
+	// providers that keep their own records, like gift cards, write them in
+	// the same transaction as the payment. Records of things that already
+	// happened at the provider, like a new Stripe customer, go to the root
+	// connection so they survive a rollback.
+	tx := a.db.Begin()
+	charge, authorizeOnly, err := newCharger(gcontext.WithRootDB(gcontext.WithDB(ctx, tx), models.OutsideTransaction(a.db, tx)), provider, r)
 	if err != nil {
+		tx.Rollback()
 		return badRequestError("Error creating payment provider: %v", err)
 	}
 
 	orderID := gcontext.GetOrderID(ctx)
-	tx := a.db.Begin()
 	order := &models.Order{}
 	loader := tx.
 		Preload("LineItems").
@@ -126,6 +145,11 @@ func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 		return badRequestError("This order has already been paid")
 	}
 
+	if order.PaymentState == models.AuthorizedState {
+		tx.Rollback()
+		return badRequestError("The payment for this order has already been authorized")
+	}
+
 	if order.Currency != params.Currency {
 		tx.Rollback()
 		return badRequestError("Currencies doesn't match - %v vs %v", order.Currency, params.Currency)
@@ -150,58 +174,265 @@ func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 
+	if order.HasSubscription() {
+		if order.UserID == "" {
+			tx.Rollback()
+			return badRequestError("You must be logged in to buy a subscription")
+		}
+		if _, ok := provider.(payments.RecurringProvider); !ok {
+			tx.Rollback()
+			return badRequestError("Payment provider '%s' doesn't support subscriptions", provider.Name())
+		}
+	}
+
 	err = a.verifyAmount(ctx, order, params.Amount)
 	if err != nil {
 		tx.Rollback()
 		return internalServerError("We failed to authorize the amount for this order: %v", err)
 	}
 
-	invoiceNumber, err := models.NextInvoiceNumber(tx, order.InstanceID)
+	// the reservation of a pending order may have expired since it was created
+	if err := models.ReserveStock(tx, order); err != nil {
+		tx.Rollback()
+		return stockError(err)
+	}
+
+	// the coupons are used before charging so concurrent payments can't
+	// exceed their limits
+	if err := models.ReserveCouponRedemptions(tx, order); err != nil {
+		tx.Rollback()
+		return couponRedemptionError(err)
+	}
+
+	// all charges of a split payment share the invoice number of the order
+	invoiceNumber := order.InvoiceNumber
+	if invoiceNumber == 0 {
+		invoiceNumber, err = models.NextInvoiceNumber(tx, order.InstanceID)
+		if err != nil {
+			tx.Rollback()
+			return internalServerError("We failed to generate a valid invoice ID, please try again later: %v", err)
+		}
+	}
+
+	// a payment that still waits for the buyer is continued instead of
+	// starting another one at the provider
+	pending, err := pendingConfirmation(tx, order, provider, params.Amount, params.Currency)
 	if err != nil {
 		tx.Rollback()
-		return internalServerError("We failed to generate a valid invoice ID, please try again later: %v", err)
+		return internalServerError("Error while querying for transactions").WithInternalError(err)
+	}
+	saveTransaction := func(tr *models.Transaction) {
+		if pending != nil {
+			tx.Save(tr)
+		} else {
+			tx.Create(tr)
+		}
 	}
 
 	tr := models.NewTransaction(order)
-	processorID, err := charge(params.Amount, params.Currency, order, invoiceNumber)
+	tr.Amount = params.Amount
+	var processorID string
+	markSideEffects(ctx)
+	if pending != nil {
+		tr = pending
+		confirm, confirmErr := provider.(payments.ConfirmationProvider).NewConfirmer(ctx, r)
+		if confirmErr != nil {
+			tx.Rollback()
+			return badRequestError("Error creating payment provider: %v", confirmErr)
+		}
+		processorID, err = confirm(pending.ProcessorID)
+	} else {
+		processorID, err = charge(params.Amount, params.Currency, order, invoiceNumber)
+	}
 	tr.ProcessorID = processorID
+	tr.PaymentProcessor = provider.Name()
 	tr.InvoiceNumber = invoiceNumber
 
+	if _, ok := provider.(payments.DeferredProvider); ok && err == nil {
+		// deferred payments are marked as paid by PaymentMarkPaid once the money arrived
+		tr.Status = models.PendingState
+		saveTransaction(tr)
+		order.PaymentProcessor = provider.Name()
+		order.InvoiceNumber = invoiceNumber
+		tx.Save(order)
+		tx.Commit()
+		return sendJSON(w, http.StatusOK, tr)
+	}
+
+	if actionErr, ok := err.(*payments.ActionRequiredError); ok {
+		// the payment is finished by PaymentConfirm once the buyer completed the action
+		tr.ProcessorID = actionErr.ProcessorID
+		tr.Status = models.PendingState
+		saveTransaction(tr)
+		order.PaymentProcessor = provider.Name()
+		order.InvoiceNumber = invoiceNumber
+		tx.Save(order)
+		tx.Commit()
+		return sendJSON(w, http.StatusOK, &paymentActionRequired{
+			Transaction:    tr,
+			RequiresAction: true,
+			ClientSecret:   actionErr.ClientSecret,
+		})
+	}
+
 	if err != nil {
 		tr.FailureCode = strconv.FormatInt(http.StatusInternalServerError, 10)
 		tr.FailureDescription = err.Error()
 		tr.Status = models.FailedState
-		tx.Create(tr)
+		saveTransaction(tr)
+		if order.PaymentState == models.PendingState {
+			if err := models.ReleaseStock(tx, order.ID); err != nil {
+				log.WithError(err).Error("Failed to release the stock of the order")
+			}
+			if err := models.ReleaseCouponRedemptions(tx, order.ID); err != nil {
+				log.WithError(err).Error("Failed to release the coupons of the order")
+			}
+		}
 		tx.Commit()
 		return internalServerError("There was an error charging your card: %v", err).WithInternalError(err)
 	}
 
-	// mark order and transaction as paid
+	// mark the transaction as paid, or as authorized if the payment is
+	// captured later. The order is paid once its charges cover the total.
 	tr.Status = models.PaidState
-	tx.Create(tr)
+	if authorizeOnly {
+		tr.Status = models.AuthorizedState
+	}
+	saveTransaction(tr)
 	order.PaymentProcessor = provider.Name()
-	order.PaymentState = models.PaidState
 	order.InvoiceNumber = invoiceNumber
 	tx.Save(order)
+	if err := order.UpdatePaymentState(tx); err != nil {
+		tx.Rollback()
+		return internalServerError("Error updating the payment state").WithInternalError(err)
+	}
 
-	if config.Webhooks.Payment != "" {
-		hook, err := models.NewHook("payment", config.SiteURL, config.Webhooks.Payment, order.UserID, config.Webhooks.Secret, order)
-		if err != nil {
-			log.WithError(err).Error("Failed to process webhook")
-		}
-		tx.Save(hook)
+	if order.PaymentState == models.PartiallyPaidState {
+		tx.Commit()
+		return sendJSON(w, http.StatusOK, tr)
+	}
+
+	if err := createSubscriptions(tx, order, provider.Name()); err != nil {
+		tx.Rollback()
+		return internalServerError("Error creating subscriptions").WithInternalError(err)
 	}
 
+	queuePaymentWebhook(tx, config, log, order)
 	tx.Commit()
+	sendOrderConfirmationMails(mailer, log, tr)
 
-	go func() {
-		err1 := mailer.OrderConfirmationMail(tr)
-		err2 := mailer.OrderReceivedMail(tr)
+	return sendJSON(w, http.StatusOK, tr)
+}
 
-		if err1 != nil || err2 != nil {
-			log.Errorf("Error sending order confirmation mails: %v %v", err1, err2)
+// PaymentConfirm finishes a payment for which the buyer had to complete an
+// additional step, like 3-D Secure authentication.
+func (a *API) PaymentConfirm(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	config := gcontext.GetConfig(ctx)
+	mailer := gcontext.GetMailer(ctx)
+	claims := gcontext.GetClaims(ctx)
+
+	orderID := gcontext.GetOrderID(ctx)
+	payID := chi.URLParam(r, "payment_id")
+	tr, httpErr := a.getTransaction(payID)
+	if httpErr != nil {
+		return httpErr
+	}
+	if tr.OrderID != orderID {
+		return notFoundError("Transaction not found")
+	}
+	if tr.Status != models.PendingState {
+		return badRequestError("Can't confirm a transaction that isn't pending")
+	}
+
+	tx := a.db.Begin()
+	order := &models.Order{}
+	loader := tx.
+		Preload("LineItems").
+		Preload("Downloads").
+		Preload("BillingAddress").
+		Preload("ShippingAddress")
+	if result := loader.First(order, "id = ?", orderID); result.Error != nil {
+		tx.Rollback()
+		if result.RecordNotFound() {
+			return notFoundError("No order with this ID found")
 		}
-	}()
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	if order.UserID != "" && (claims == nil || order.UserID != claims.Subject) {
+		tx.Rollback()
+		return unauthorizedError("You must be logged in to pay for this order")
+	}
+
+	provider, httpErr := paymentProvider(ctx, order, tr)
+	if httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	confirmationProvider, ok := provider.(payments.ConfirmationProvider)
+	if !ok {
+		tx.Rollback()
+		return badRequestError("Payment provider '%s' doesn't support confirming payments", provider.Name())
+	}
+	confirm, err := confirmationProvider.NewConfirmer(ctx, r)
+	if err != nil {
+		tx.Rollback()
+		return badRequestError("Error creating payment provider: %v", err)
+	}
+
+	processorID, err := confirm(tr.ProcessorID)
+	if actionErr, ok := err.(*payments.ActionRequiredError); ok {
+		tx.Rollback()
+		return sendJSON(w, http.StatusOK, &paymentActionRequired{
+			Transaction:    tr,
+			RequiresAction: true,
+			ClientSecret:   actionErr.ClientSecret,
+		})
+	}
+	if err != nil {
+		tr.FailureCode = strconv.FormatInt(http.StatusInternalServerError, 10)
+		tr.FailureDescription = err.Error()
+		tr.Status = models.FailedState
+		tx.Save(tr)
+		if order.PaymentState == models.PendingState {
+			if err := models.ReleaseStock(tx, order.ID); err != nil {
+				log.WithError(err).Error("Failed to release the stock of the order")
+			}
+			if err := models.ReleaseCouponRedemptions(tx, order.ID); err != nil {
+				log.WithError(err).Error("Failed to release the coupons of the order")
+			}
+		}
+		tx.Commit()
+		return internalServerError("There was an error charging your card: %v", err).WithInternalError(err)
+	}
+
+	tr.ProcessorID = processorID
+	tr.Status = models.PaidState
+	if _, ok := provider.(payments.AuthorizationProvider); ok && config.Payment.DelayedCapture {
+		tr.Status = models.AuthorizedState
+	}
+	tx.Save(tr)
+	if err := order.UpdatePaymentState(tx); err != nil {
+		tx.Rollback()
+		return internalServerError("Error updating the payment state").WithInternalError(err)
+	}
+
+	if order.PaymentState == models.PartiallyPaidState {
+		tx.Commit()
+		return sendJSON(w, http.StatusOK, tr)
+	}
+
+	if err := createSubscriptions(tx, order, provider.Name()); err != nil {
+		tx.Rollback()
+		return internalServerError("Error creating subscriptions").WithInternalError(err)
+	}
+
+	queuePaymentWebhook(tx, config, log, order)
+	tx.Commit()
+
+	tr.Order = order
+	sendOrderConfirmationMails(mailer, log, tr)
 
 	return sendJSON(w, http.StatusOK, tr)
 }
@@ -235,15 +466,21 @@ func (a *API) PaymentView(w http.ResponseWriter, r *http.Request) error {
 }
 
 // PaymentRefund refunds a transaction for a specific amount. This allows partial
-// refunds if desired. It is only available to admins.
+// refunds if desired, as long as all refunds of a charge don't add up to more
+// than was charged. It is only available to admins.
 func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	config := gcontext.GetConfig(ctx)
-	params := PaymentParams{Currency: "USD"}
+	params := RefundParams{PaymentParams: PaymentParams{Currency: "USD"}}
 	err := json.NewDecoder(r.Body).Decode(&params)
 	if err != nil {
 		return badRequestError("Could not read params: %v", err)
 	}
+	if params.Amount == 0 {
+		for _, item := range params.LineItems {
+			params.Amount += item.Amount
+		}
+	}
 
 	payID := chi.URLParam(r, "payment_id")
 	trans, httpErr := a.getTransaction(payID)
@@ -267,21 +504,49 @@ func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 		return badRequestError("Can't refund a transaction that hasn't been paid")
 	}
 
+	if trans.Type != models.ChargeTransactionType {
+		return badRequestError("Only charges can be refunded")
+	}
+
 	log := getLogEntry(r)
 	order, httpErr := queryForOrder(a.db, trans.OrderID, log)
 	if httpErr != nil {
 		return httpErr
 	}
-	if order.PaymentProcessor == "" {
-		return badRequestError("Order does not specify a payment provider")
+	provider, httpErr := paymentProvider(ctx, order, trans)
+	if httpErr != nil {
+		return httpErr
 	}
 
-	provider := gcontext.GetPaymentProviders(ctx)[order.PaymentProcessor]
-	if provider == nil {
-		return badRequestError("Payment provider '%s' not configured", order.PaymentProcessor)
+	// the charge stays locked until the refund is stored, so concurrent
+	// refunds can't both pass the checks below
+	tx := a.db.Begin()
+	trans, err = models.LockTransaction(tx, trans.ID)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error while querying for transactions").WithInternalError(err)
+	}
+	if trans.Status != models.PaidState {
+		tx.Rollback()
+		return badRequestError("Can't refund a transaction that hasn't been paid")
+	}
+	refunded, err := models.RefundedAmount(tx, trans)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error while querying for refunds").WithInternalError(err)
+	}
+	if refunded+params.Amount > trans.Amount {
+		tx.Rollback()
+		return badRequestError("The refund exceeds the amount left to refund of %d", trans.Amount-refunded)
+	}
+	if httpErr := verifyRefundLineItems(tx, order, params.Amount, params.LineItems); httpErr != nil {
+		tx.Rollback()
+		return httpErr
 	}
-	refund, err := provider.NewRefunder(ctx, r)
+
+	refund, err := provider.NewRefunder(gcontext.WithDB(ctx, tx), r)
 	if err != nil {
+		tx.Rollback()
 		return badRequestError("Error creating payment provider: %v", err)
 	}
 
@@ -295,13 +560,23 @@ func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 		OrderID:    trans.OrderID,
 		Type:       models.RefundTransactionType,
 		Status:     models.PendingState,
+
+		PaymentProcessor: provider.Name(),
+		ChargeID:         trans.ID,
+		Reason:           params.Reason,
+		RefundLineItems:  params.LineItems,
+	}
+	for _, item := range m.RefundLineItems {
+		item.InstanceID = order.InstanceID
 	}
 
-	tx := a.db.Begin()
 	tx.Create(m)
 	provID := provider.Name()
 	log.Debugf("Starting refund to %s", provID)
-	refundID, err := refund(trans.ProcessorID, params.Amount, params.Currency)
+	refundID, err := refund(trans.ProcessorID, params.Amount, params.Currency, &payments.RefundDetails{
+		Reason:    params.Reason,
+		LineItems: params.LineItems,
+	})
 	if err != nil {
 		log.WithError(err).Info("Failed to refund value")
 		m.FailureCode = strconv.FormatInt(http.StatusInternalServerError, 10)
@@ -314,6 +589,12 @@ func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 
 	log.Infof("Finished transaction with %s: %s", provID, m.ProcessorID)
 	tx.Save(m)
+	if m.Status == models.PaidState {
+		if err := order.UpdatePaymentState(tx); err != nil {
+			tx.Rollback()
+			return internalServerError("Error updating the payment state").WithInternalError(err)
+		}
+	}
 	if config.Webhooks.Refund != "" {
 		hook, err := models.NewHook("refund", config.SiteURL, config.Webhooks.Refund, m.UserID, config.Webhooks.Secret, m)
 		if err != nil {
@@ -325,6 +606,215 @@ func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 	return sendJSON(w, http.StatusOK, m)
 }
 
+// PaymentCapture captures an authorized transaction. The amount defaults to the
+// authorized amount, but a lower amount can be captured. It is only available to admins.
+func (a *API) PaymentCapture(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	config := gcontext.GetConfig(ctx)
+	claims := gcontext.GetClaims(ctx)
+
+	params := PaymentParams{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil && err != io.EOF {
+		return badRequestError("Could not read params: %v", err)
+	}
+
+	payID := chi.URLParam(r, "payment_id")
+	trans, httpErr := a.getTransaction(payID)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	if params.Currency != "" && trans.Currency != params.Currency {
+		return badRequestError("Currencies do not match - %v vs %v", trans.Currency, params.Currency)
+	}
+
+	amount := params.Amount
+	if amount == 0 {
+		amount = trans.Amount
+	}
+	if amount > trans.Amount {
+		return badRequestError("Can't capture more than the authorized amount of %d", trans.Amount)
+	}
+
+	order, httpErr := queryForOrder(a.db, trans.OrderID, log)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	if httpErr := a.capturePayment(ctx, r, order, trans, amount); httpErr != nil {
+		return httpErr
+	}
+
+	tx := a.db.Begin()
+	// saving the order also saves its preloaded transactions, so the updated
+	// transaction has to be saved last
+	tx.Save(order)
+	tx.Save(trans)
+	if err := order.UpdatePaymentState(tx); err != nil {
+		tx.Rollback()
+		return internalServerError("Error updating the payment state").WithInternalError(err)
+	}
+	models.LogEvent(tx, r.RemoteAddr, claims.Subject, order.ID, models.EventUpdated, []string{"payment_state"})
+	if config.Webhooks.Update != "" {
+		hook, err := models.NewHook("update", config.SiteURL, config.Webhooks.Update, claims.Subject, config.Webhooks.Secret, order)
+		if err != nil {
+			log.WithError(err).Error("Failed to process webhook")
+		}
+		tx.Save(hook)
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error saving captured payment").WithInternalError(rsp.Error)
+	}
+
+	return sendJSON(w, http.StatusOK, trans)
+}
+
+// PaymentVoid releases an authorized transaction without capturing it. The
+// order can be paid again afterwards. It is only available to admins.
+func (a *API) PaymentVoid(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	config := gcontext.GetConfig(ctx)
+	claims := gcontext.GetClaims(ctx)
+
+	payID := chi.URLParam(r, "payment_id")
+	trans, httpErr := a.getTransaction(payID)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	if trans.Status != models.AuthorizedState {
+		return badRequestError("Can't void a transaction that hasn't been authorized")
+	}
+
+	order, httpErr := queryForOrder(a.db, trans.OrderID, log)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	provider, httpErr := authorizationProvider(ctx, order, trans)
+	if httpErr != nil {
+		return httpErr
+	}
+	void, err := provider.NewVoider(ctx, r)
+	if err != nil {
+		return badRequestError("Error creating payment provider: %v", err)
+	}
+
+	log.Debugf("Voiding authorization %s", trans.ProcessorID)
+	if err := void(trans.ProcessorID); err != nil {
+		return internalServerError("Error voiding payment: %v", err).WithInternalError(err)
+	}
+
+	trans.Status = models.VoidedState
+
+	tx := a.db.Begin()
+	tx.Save(order)
+	tx.Save(trans)
+	if err := order.UpdatePaymentState(tx); err != nil {
+		tx.Rollback()
+		return internalServerError("Error updating the payment state").WithInternalError(err)
+	}
+	// the stock and coupons held for the authorization are given back
+	if order.PaymentState == models.PendingState {
+		if err := models.ReleaseStock(tx, order.ID); err != nil {
+			tx.Rollback()
+			return internalServerError("Error releasing the stock of the order").WithInternalError(err)
+		}
+		if err := models.ReleaseCouponRedemptions(tx, order.ID); err != nil {
+			tx.Rollback()
+			return internalServerError("Error releasing the coupons of the order").WithInternalError(err)
+		}
+	}
+	models.LogEvent(tx, r.RemoteAddr, claims.Subject, order.ID, models.EventUpdated, []string{"payment_state"})
+	if config.Webhooks.Update != "" {
+		hook, err := models.NewHook("update", config.SiteURL, config.Webhooks.Update, claims.Subject, config.Webhooks.Secret, order)
+		if err != nil {
+			log.WithError(err).Error("Failed to process webhook")
+		}
+		tx.Save(hook)
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error saving voided payment").WithInternalError(rsp.Error)
+	}
+
+	return sendJSON(w, http.StatusOK, trans)
+}
+
+// PaymentMarkPaid marks a pending payment made outside of the checkout, like a
+// bank transfer, as paid. It is only available to admins.
+func (a *API) PaymentMarkPaid(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	config := gcontext.GetConfig(ctx)
+	mailer := gcontext.GetMailer(ctx)
+	claims := gcontext.GetClaims(ctx)
+
+	payID := chi.URLParam(r, "payment_id")
+	tr, httpErr := a.getTransaction(payID)
+	if httpErr != nil {
+		return httpErr
+	}
+	if tr.Type != models.ChargeTransactionType || tr.Status != models.PendingState {
+		return badRequestError("Only pending charges can be marked as paid")
+	}
+
+	tx := a.db.Begin()
+	order := &models.Order{}
+	loader := tx.
+		Preload("LineItems").
+		Preload("Downloads").
+		Preload("BillingAddress").
+		Preload("ShippingAddress")
+	if result := loader.First(order, "id = ?", tr.OrderID); result.Error != nil {
+		tx.Rollback()
+		if result.RecordNotFound() {
+			return notFoundError("No order with this ID found")
+		}
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+
+	provider, httpErr := paymentProvider(ctx, order, tr)
+	if httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if _, ok := provider.(payments.DeferredProvider); !ok {
+		tx.Rollback()
+		return badRequestError("Payments with '%s' can't be marked as paid", provider.Name())
+	}
+	if order.PaymentState == models.PaidState {
+		tx.Rollback()
+		return badRequestError("This order has already been paid")
+	}
+
+	tr.Status = models.PaidState
+	tx.Save(tr)
+	if err := order.UpdatePaymentState(tx); err != nil {
+		tx.Rollback()
+		return internalServerError("Error updating the payment state").WithInternalError(err)
+	}
+	models.LogEvent(tx, r.RemoteAddr, claims.Subject, order.ID, models.EventUpdated, []string{"payment_state"})
+
+	if order.PaymentState == models.PartiallyPaidState {
+		if rsp := tx.Commit(); rsp.Error != nil {
+			return internalServerError("Error saving payment").WithInternalError(rsp.Error)
+		}
+		return sendJSON(w, http.StatusOK, tr)
+	}
+
+	queuePaymentWebhook(tx, config, log, order)
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error saving payment").WithInternalError(rsp.Error)
+	}
+
+	tr.Order = order
+	sendOrderConfirmationMails(mailer, log, tr)
+
+	return sendJSON(w, http.StatusOK, tr)
+}
+
 // PreauthorizePayment creates a new payment that can be authorized in the browser
 func (a *API) PreauthorizePayment(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
@@ -389,9 +879,197 @@ func (a *API) getTransaction(payID string) (*models.Transaction, *HTTPError) {
 	return trans, nil
 }
 
+// paymentActionRequired is the response for a payment that needs an
+// additional step from the buyer before it can be confirmed.
+type paymentActionRequired struct {
+	*models.Transaction
+	RequiresAction bool   `json:"requires_action"`
+	ClientSecret   string `json:"client_secret"`
+}
+
+// pendingConfirmation returns the charge of an order that waits for the buyer
+// to complete an additional step at a provider, if it is for the same amount.
+func pendingConfirmation(tx *gorm.DB, order *models.Order, provider payments.Provider, amount uint64, currency string) (*models.Transaction, error) {
+	if _, ok := provider.(payments.ConfirmationProvider); !ok {
+		return nil, nil
+	}
+	trans := &models.Transaction{}
+	rsp := tx.Where("order_id = ? AND type = ? AND status = ? AND payment_processor = ? AND amount = ? AND currency = ?",
+		order.ID, models.ChargeTransactionType, models.PendingState, provider.Name(), amount, currency).
+		Order("created_at desc").
+		First(trans)
+	if rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return trans, nil
+}
+
+// queuePaymentWebhook stores the payment webhook for a paid order.
+func queuePaymentWebhook(tx *gorm.DB, config *conf.Configuration, log logrus.FieldLogger, order *models.Order) {
+	if config.Webhooks.Payment == "" {
+		return
+	}
+	hook, err := models.NewHook("payment", config.SiteURL, config.Webhooks.Payment, order.UserID, config.Webhooks.Secret, order)
+	if err != nil {
+		log.WithError(err).Error("Failed to process webhook")
+	}
+	tx.Save(hook)
+}
+
+// sendOrderConfirmationMails sends the confirmation mails for a payment in the background.
+func sendOrderConfirmationMails(m mailer.Mailer, log logrus.FieldLogger, tr *models.Transaction) {
+	go func() {
+		err1 := m.OrderConfirmationMail(tr)
+		err2 := m.OrderReceivedMail(tr)
+
+		if err1 != nil || err2 != nil {
+			log.Errorf("Error sending order confirmation mails: %v %v", err1, err2)
+		}
+	}()
+}
+
+// newCharger returns the function used to pay for an order. If delayed capture
+// is enabled and the provider supports it, the payment is only authorized.
+func newCharger(ctx context.Context, provider payments.Provider, r *http.Request) (payments.Charger, bool, error) {
+	config := gcontext.GetConfig(ctx)
+	if authProvider, ok := provider.(payments.AuthorizationProvider); ok && config.Payment.DelayedCapture {
+		authorize, err := authProvider.NewAuthorizer(ctx, r)
+		if err != nil {
+			return nil, false, err
+		}
+		return payments.Charger(authorize), true, nil
+	}
+
+	charge, err := provider.NewCharger(ctx, r)
+	return charge, false, err
+}
+
+// paymentProvider returns the provider a transaction was made with. Older
+// transactions don't record it and use the provider of their order instead.
+func paymentProvider(ctx context.Context, order *models.Order, trans *models.Transaction) (payments.Provider, *HTTPError) {
+	name := trans.PaymentProcessor
+	if name == "" {
+		name = order.PaymentProcessor
+	}
+	if name == "" {
+		return nil, badRequestError("Order does not specify a payment provider")
+	}
+	provider := gcontext.GetPaymentProviders(ctx)[name]
+	if provider == nil {
+		return nil, badRequestError("Payment provider '%s' not configured", name)
+	}
+	return provider, nil
+}
+
+func authorizationProvider(ctx context.Context, order *models.Order, trans *models.Transaction) (payments.AuthorizationProvider, *HTTPError) {
+	provider, httpErr := paymentProvider(ctx, order, trans)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	authProvider, ok := provider.(payments.AuthorizationProvider)
+	if !ok {
+		return nil, badRequestError("Payment provider '%s' doesn't support capturing payments", provider.Name())
+	}
+	return authProvider, nil
+}
+
+// capturePayment captures an authorized transaction with the provider and
+// marks the transaction as paid. Saving it and updating the payment state of
+// the order is up to the caller.
+func (a *API) capturePayment(ctx context.Context, r *http.Request, order *models.Order, trans *models.Transaction, amount uint64) *HTTPError {
+	if trans.Status != models.AuthorizedState {
+		return badRequestError("Can't capture a transaction that hasn't been authorized")
+	}
+
+	provider, httpErr := authorizationProvider(ctx, order, trans)
+	if httpErr != nil {
+		return httpErr
+	}
+	capture, err := provider.NewCapturer(ctx, r)
+	if err != nil {
+		return badRequestError("Error creating payment provider: %v", err)
+	}
+
+	processorID, err := capture(trans.ProcessorID, amount, trans.Currency)
+	if err != nil {
+		return internalServerError("Error capturing payment: %v", err).WithInternalError(err)
+	}
+
+	trans.ProcessorID = processorID
+	trans.Amount = amount
+	trans.Status = models.PaidState
+	return nil
+}
+
+// verifyRefundLineItems checks that the line items of a refund belong to the
+// order, add up to the amount of the refund and, together with the earlier
+// refunds of the order, don't refund more of a line item than was bought.
+func verifyRefundLineItems(tx *gorm.DB, order *models.Order, amount uint64, items []*models.RefundLineItem) *HTTPError {
+	if len(items) == 0 {
+		return nil
+	}
+
+	lineItems := []models.LineItem{}
+	if rsp := tx.Where("order_id = ?", order.ID).Find(&lineItems); rsp.Error != nil {
+		return internalServerError("Error while querying for line items").WithInternalError(rsp.Error)
+	}
+	quantities := map[string]uint64{}
+	costs := map[string]uint64{}
+	for _, item := range lineItems {
+		quantities[item.Sku] += item.Quantity
+		// the calculation details hold the price of a single unit
+		if item.CalculationDetail != nil && item.CalculationDetail.Total > 0 {
+			costs[item.Sku] += uint64(item.CalculationDetail.Total) * item.Quantity
+		} else {
+			costs[item.Sku] += (item.Price + item.AddonPrice) * item.Quantity
+		}
+	}
+	refunded, err := models.RefundedLineItems(tx, order.ID)
+	if err != nil {
+		return internalServerError("Error while querying for refunds").WithInternalError(err)
+	}
+
+	var total uint64
+	for _, item := range items {
+		quantity, ok := quantities[item.Sku]
+		if !ok {
+			return badRequestError("The order has no line item with the sku '%s'", item.Sku)
+		}
+		cost := costs[item.Sku]
+		if earlier, ok := refunded[item.Sku]; ok {
+			quantity = remaining(quantity, earlier.Quantity)
+			cost = remaining(cost, earlier.Amount)
+		}
+		if item.Quantity > quantity {
+			return badRequestError("Can't refund more than %d of '%s'", quantity, item.Sku)
+		}
+		if item.Amount > cost {
+			return badRequestError("Can't refund more than %d for '%s'", cost, item.Sku)
+		}
+		total += item.Amount
+	}
+	if total != amount {
+		return badRequestError("The line items add up to %d, but the refund is %d", total, amount)
+	}
+	return nil
+}
+
+func remaining(total, used uint64) uint64 {
+	if used >= total {
+		return 0
+	}
+	return total - used
+}
+
 func (a *API) verifyAmount(ctx context.Context, order *models.Order, amount uint64) error {
-	if order.Total != amount {
-		return fmt.Errorf("Amount calculated for order didn't match amount to charge. %v vs %v", order.Total, amount)
+	if amount == 0 {
+		return fmt.Errorf("The amount to charge must be greater than 0")
+	}
+	if amount > order.AmountDue {
+		return fmt.Errorf("Amount to charge exceeds the amount due for the order. %v vs %v", amount, order.AmountDue)
 	}
 
 	return nil
@@ -426,7 +1104,8 @@ func createPaymentProviders(c *conf.Configuration) (map[string]payments.Provider
 	provs := map[string]payments.Provider{}
 	if c.Payment.Stripe.Enabled {
 		p, err := stripe.NewPaymentProvider(stripe.Config{
-			SecretKey: c.Payment.Stripe.SecretKey,
+			SecretKey:     c.Payment.Stripe.SecretKey,
+			WebhookSecret: c.Payment.Stripe.WebhookSecret,
 		})
 		if err != nil {
 			return nil, err
@@ -435,9 +1114,26 @@ func createPaymentProviders(c *conf.Configuration) (map[string]payments.Provider
 	}
 	if c.Payment.PayPal.Enabled {
 		p, err := paypal.NewPaymentProvider(paypal.Config{
-			Env:      c.Payment.PayPal.Env,
-			ClientID: c.Payment.PayPal.ClientID,
-			Secret:   c.Payment.PayPal.Secret,
+			Env:       c.Payment.PayPal.Env,
+			ClientID:  c.Payment.PayPal.ClientID,
+			Secret:    c.Payment.PayPal.Secret,
+			WebhookID: c.Payment.PayPal.WebhookID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		provs[p.Name()] = p
+	}
+	if c.Payment.GiftCard.Enabled {
+		p, err := giftcard.NewPaymentProvider()
+		if err != nil {
+			return nil, err
+		}
+		provs[p.Name()] = p
+	}
+	if c.Payment.Offline.Enabled {
+		p, err := offline.NewPaymentProvider(offline.Config{
+			ReferencePrefix: c.Payment.Offline.ReferencePrefix,
 		})
 		if err != nil {
 			return nil, err
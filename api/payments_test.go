@@ -318,6 +318,160 @@ func TestPaymentsRefund(t *testing.T) {
 	})
 }
 
+func TestPaymentsRefundLimits(t *testing.T) {
+	setup := func(t *testing.T) (*RouteTest, *memProvider, func(params interface{}) *httptest.ResponseRecorder) {
+		test := NewRouteTest(t)
+		test.Config.Payment.Stripe.Enabled = true
+		test.Config.Payment.Stripe.SecretKey = "secret"
+
+		provider := &memProvider{name: payments.StripeProvider}
+		ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+		require.NoError(t, err)
+		ctx = gcontext.WithPaymentProviders(ctx, map[string]payments.Provider{payments.StripeProvider: provider})
+		handler := NewAPIWithVersion(ctx, test.GlobalConfig, test.DB, defaultVersion).handler
+
+		refund := func(params interface{}) *httptest.ResponseRecorder {
+			body, err := json.Marshal(params)
+			require.NoError(t, err)
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/payments/"+test.Data.firstTransaction.ID+"/refund", bytes.NewBuffer(body))
+			require.NoError(t, signHTTPRequest(r, testAdminToken("magical-unicorn", ""), test.Config.JWT.Secret))
+			handler.ServeHTTP(w, r)
+			return w
+		}
+		return test, provider, refund
+	}
+	loadOrder := func(test *RouteTest) *models.Order {
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		return order
+	}
+
+	t.Run("Cumulative", func(t *testing.T) {
+		test, provider, refund := setup(t)
+
+		w := refund(&PaymentParams{Amount: 60, Currency: "USD"})
+		rsp := &models.Transaction{}
+		extractPayload(t, http.StatusOK, w, rsp)
+		assert.Equal(t, test.Data.firstTransaction.ID, rsp.ChargeID)
+		assert.Equal(t, models.PartiallyRefundedState, loadOrder(test).PaymentState)
+
+		w = refund(&PaymentParams{Amount: 60, Currency: "USD"})
+		validateError(t, http.StatusBadRequest, w, "amount left to refund of 40")
+		assert.Len(t, provider.refundCalls, 1)
+
+		w = refund(&PaymentParams{Amount: 40, Currency: "USD"})
+		extractPayload(t, http.StatusOK, w, rsp)
+		order := loadOrder(test)
+		assert.Equal(t, models.RefundedState, order.PaymentState)
+		assert.EqualValues(t, 100, order.AmountRefunded)
+	})
+
+	t.Run("LegacyRefund", func(t *testing.T) {
+		test, provider, refund := setup(t)
+
+		// refunds stored before they were linked to their charge
+		legacy := &models.Transaction{
+			ID:       "legacy-refund",
+			OrderID:  test.Data.firstOrder.ID,
+			Amount:   70,
+			Currency: "USD",
+			Type:     models.RefundTransactionType,
+			Status:   models.PaidState,
+		}
+		require.NoError(t, test.DB.Create(legacy).Error)
+
+		w := refund(&PaymentParams{Amount: 60, Currency: "USD"})
+		validateError(t, http.StatusBadRequest, w, "amount left to refund of 30")
+		assert.Empty(t, provider.refundCalls)
+
+		w = refund(&PaymentParams{Amount: 30, Currency: "USD"})
+		extractPayload(t, http.StatusOK, w, &models.Transaction{})
+		assert.Len(t, provider.refundCalls, 1)
+	})
+
+	t.Run("LineItems", func(t *testing.T) {
+		test, provider, refund := setup(t)
+
+		w := refund(&RefundParams{
+			PaymentParams: PaymentParams{Currency: "USD"},
+			Reason:        "damaged in transit",
+			LineItems:     []*models.RefundLineItem{{Sku: "123-i-can-fly-456", Quantity: 1, Amount: 12}},
+		})
+		rsp := &models.Transaction{}
+		extractPayload(t, http.StatusOK, w, rsp)
+		assert.EqualValues(t, 12, rsp.Amount)
+		assert.Equal(t, "damaged in transit", rsp.Reason)
+
+		require.Len(t, provider.refundCalls, 1)
+		details := provider.refundCalls[0].details
+		require.NotNil(t, details)
+		assert.Equal(t, "damaged in transit", details.Reason)
+		require.Len(t, details.LineItems, 1)
+		assert.Equal(t, "123-i-can-fly-456", details.LineItems[0].Sku)
+
+		items := []models.RefundLineItem{}
+		require.NoError(t, test.DB.Where("transaction_id = ?", rsp.ID).Find(&items).Error)
+		require.Len(t, items, 1)
+		assert.EqualValues(t, 12, items[0].Amount)
+
+		t.Run("Reports", func(t *testing.T) {
+			token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+			sales := []salesRow{}
+			extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/reports/sales", nil, token), &sales)
+			require.Len(t, sales, 1)
+			assert.EqualValues(t, 79, sales[0].Total)
+			assert.EqualValues(t, 12, sales[0].Refunded)
+
+			products := []productsRow{}
+			extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/reports/products", nil, token), &products)
+			for _, row := range products {
+				if row.Sku == "123-i-can-fly-456" {
+					assert.EqualValues(t, 12, row.Refunded)
+				} else {
+					assert.Zero(t, row.Refunded)
+				}
+			}
+		})
+	})
+
+	t.Run("RepeatedLineItems", func(t *testing.T) {
+		_, provider, refund := setup(t)
+		refundItem := func(quantity, amount uint64) *httptest.ResponseRecorder {
+			return refund(&RefundParams{
+				PaymentParams: PaymentParams{Currency: "USD"},
+				LineItems:     []*models.RefundLineItem{{Sku: "123-i-can-fly-456", Quantity: quantity, Amount: amount}},
+			})
+		}
+
+		extractPayload(t, http.StatusOK, refundItem(1, 12), &models.Transaction{})
+		validateError(t, http.StatusBadRequest, refundItem(2, 12), "Can't refund more than 1 of")
+		validateError(t, http.StatusBadRequest, refundItem(1, 13), "Can't refund more than 12 for")
+		extractPayload(t, http.StatusOK, refundItem(1, 12), &models.Transaction{})
+		validateError(t, http.StatusBadRequest, refundItem(1, 1), "Can't refund more than 0 of")
+		assert.Len(t, provider.refundCalls, 2)
+	})
+
+	t.Run("UnknownLineItem", func(t *testing.T) {
+		_, provider, refund := setup(t)
+		w := refund(&RefundParams{
+			PaymentParams: PaymentParams{Amount: 5, Currency: "USD"},
+			LineItems:     []*models.RefundLineItem{{Sku: "unknown", Quantity: 1, Amount: 5}},
+		})
+		validateError(t, http.StatusBadRequest, w, "no line item with the sku")
+		assert.Empty(t, provider.refundCalls)
+	})
+
+	t.Run("LineItemsMismatch", func(t *testing.T) {
+		_, _, refund := setup(t)
+		w := refund(&RefundParams{
+			PaymentParams: PaymentParams{Amount: 20, Currency: "USD"},
+			LineItems:     []*models.RefundLineItem{{Sku: "123-i-can-fly-456", Quantity: 1, Amount: 12}},
+		})
+		validateError(t, http.StatusBadRequest, w, "add up to 12")
+	})
+}
+
 func runPaymentRefund(test *RouteTest, url string, params interface{}) *httptest.ResponseRecorder {
 	body, err := json.Marshal(params)
 	require.NoError(test.T, err)
@@ -462,6 +616,436 @@ func TestPaymentCreate(t *testing.T) {
 	})
 }
 
+func TestPaymentIntents(t *testing.T) {
+	createPayment := func(test *RouteTest) *httptest.ResponseRecorder {
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(test.T, test.DB.Save(test.Data.firstOrder).Error)
+
+		body, err := json.Marshal(map[string]interface{}{
+			"amount":        test.Data.firstOrder.Total,
+			"currency":      test.Data.firstOrder.Currency,
+			"stripe_source": "src_123",
+			"provider":      payments.StripeProvider,
+		})
+		require.NoError(test.T, err)
+		return test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+	}
+
+	t.Run("Succeeded", func(t *testing.T) {
+		test := NewRouteTest(t)
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) {
+			switch path {
+			case "/payment_intents":
+				payload := params.(*stripe.PaymentIntentParams)
+				assert.Equal(t, "src_123", *payload.Source)
+				assert.Equal(t, string(stripe.PaymentIntentCaptureMethodAutomatic), *payload.CaptureMethod)
+				assert.Equal(t, test.Data.firstOrder.ID, payload.Metadata["order_id"])
+				pi := v.(*stripe.PaymentIntent)
+				pi.ID = "pi_123"
+				pi.Status = stripe.PaymentIntentStatusSucceeded
+				pi.Charges = &stripe.ChargeList{Data: []*stripe.Charge{{ID: "ch_123"}}}
+			default:
+				t.Fatalf("unknown Stripe API call to %s", path)
+			}
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		recorder := createPayment(test)
+		trans := models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, &trans)
+		assert.Equal(t, models.PaidState, trans.Status)
+		assert.Equal(t, "ch_123", trans.ProcessorID)
+	})
+
+	t.Run("RequiresAction", func(t *testing.T) {
+		test := NewRouteTest(t)
+		getCount := 0
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) {
+			pi := v.(*stripe.PaymentIntent)
+			pi.ID = "pi_123"
+			switch path {
+			case "/payment_intents":
+				pi.Status = stripe.PaymentIntentStatusRequiresSourceAction
+				pi.ClientSecret = "pi_123_secret"
+			case "/payment_intents/pi_123":
+				// the client already confirmed the intent after the action
+				assert.Equal(t, http.MethodGet, method)
+				pi.Status = stripe.PaymentIntentStatusSucceeded
+				pi.Charges = &stripe.ChargeList{Data: []*stripe.Charge{{ID: "ch_123"}}}
+				getCount++
+			default:
+				t.Fatalf("unknown Stripe API call to %s", path)
+			}
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		recorder := createPayment(test)
+		rsp := struct {
+			models.Transaction
+			RequiresAction bool   `json:"requires_action"`
+			ClientSecret   string `json:"client_secret"`
+		}{}
+		extractPayload(t, http.StatusOK, recorder, &rsp)
+		assert.True(t, rsp.RequiresAction)
+		assert.Equal(t, "pi_123_secret", rsp.ClientSecret)
+		assert.Equal(t, models.PendingState, rsp.Status)
+		assert.Equal(t, "pi_123", rsp.ProcessorID)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, models.PendingState, order.PaymentState)
+
+		url := "/orders/first-order/payments/" + rsp.ID + "/confirm"
+		recorder = test.TestEndpoint(http.MethodPost, url, nil, test.Data.testUserToken)
+		trans := models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, &trans)
+		assert.Equal(t, models.PaidState, trans.Status)
+		assert.Equal(t, "ch_123", trans.ProcessorID)
+		assert.Equal(t, 1, getCount)
+
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+
+		recorder = test.TestEndpoint(http.MethodPost, url, nil, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "isn't pending")
+	})
+
+	t.Run("RetryReusesIntent", func(t *testing.T) {
+		test := NewRouteTest(t)
+		calls := []string{}
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) {
+			calls = append(calls, path)
+			pi := v.(*stripe.PaymentIntent)
+			pi.ID = "pi_123"
+			pi.Status = stripe.PaymentIntentStatusRequiresAction
+			pi.ClientSecret = "pi_123_secret"
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		first := paymentActionRequired{Transaction: &models.Transaction{}}
+		extractPayload(t, http.StatusOK, createPayment(test), &first)
+		second := paymentActionRequired{Transaction: &models.Transaction{}}
+		extractPayload(t, http.StatusOK, createPayment(test), &second)
+		assert.True(t, second.RequiresAction)
+		assert.Equal(t, "pi_123_secret", second.ClientSecret)
+		assert.Equal(t, first.ID, second.ID)
+		assert.Equal(t, []string{"/payment_intents", "/payment_intents/pi_123"}, calls)
+
+		count := 0
+		require.NoError(t, test.DB.Model(&models.Transaction{}).Where("order_id = ? AND status = ?", test.Data.firstOrder.ID, models.PendingState).Count(&count).Error)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("ConfirmAsStranger", func(t *testing.T) {
+		test := NewRouteTest(t)
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) {
+			switch path {
+			case "/payment_intents":
+				pi := v.(*stripe.PaymentIntent)
+				pi.ID = "pi_123"
+				pi.Status = stripe.PaymentIntentStatusRequiresSourceAction
+			default:
+				t.Fatalf("unknown Stripe API call to %s", path)
+			}
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		recorder := createPayment(test)
+		trans := models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, &trans)
+
+		token := testToken("stranger-danger", "")
+		recorder = test.TestEndpoint(http.MethodPost, "/orders/first-order/payments/"+trans.ID+"/confirm", nil, token)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestPaymentOffline(t *testing.T) {
+	createPartialPayment := func(test *RouteTest, amount uint64) *models.Transaction {
+		test.Config.Payment.Offline.Enabled = true
+		test.Config.Webhooks.Payment = "http://example.com/payment"
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(test.T, test.DB.Save(test.Data.firstOrder).Error)
+
+		body, err := json.Marshal(&PaymentParams{
+			Amount:       amount,
+			Currency:     test.Data.firstOrder.Currency,
+			ProviderType: payments.OfflineProvider,
+		})
+		require.NoError(test.T, err)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+		trans := &models.Transaction{}
+		extractPayload(test.T, http.StatusOK, recorder, trans)
+		return trans
+	}
+	createPayment := func(test *RouteTest) *models.Transaction {
+		return createPartialPayment(test, test.Data.firstOrder.Total)
+	}
+
+	paymentHooks := func(test *RouteTest) int {
+		var count int
+		require.NoError(test.T, test.DB.Model(&models.Hook{}).Where("type = ?", "payment").Count(&count).Error)
+		return count
+	}
+
+	t.Run("MarkPaid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		trans := createPayment(test)
+		assert.Equal(t, models.PendingState, trans.Status)
+		assert.True(t, strings.HasPrefix(trans.ProcessorID, "GC-"), trans.ProcessorID)
+		assert.Equal(t, 0, paymentHooks(test))
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, models.PendingState, order.PaymentState)
+		assert.Equal(t, payments.OfflineProvider, order.PaymentProcessor)
+
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodPost, "/payments/"+trans.ID+"/paid", nil, token)
+		paid := &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, paid)
+		assert.Equal(t, models.PaidState, paid.Status)
+		assert.Equal(t, trans.ProcessorID, paid.ProcessorID)
+		assert.Equal(t, 1, paymentHooks(test))
+
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/payments/"+trans.ID+"/paid", nil, token)
+		validateError(t, http.StatusBadRequest, recorder, "pending charges")
+	})
+
+	t.Run("MarkPartiallyPaid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstTransaction.Status = models.FailedState
+		require.NoError(t, test.DB.Save(test.Data.firstTransaction).Error)
+		half := test.Data.firstOrder.Total / 2
+		first := createPartialPayment(test, half)
+		second := createPartialPayment(test, test.Data.firstOrder.Total-half)
+
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodPost, "/payments/"+first.ID+"/paid", nil, token)
+		extractPayload(t, http.StatusOK, recorder, &models.Transaction{})
+		assert.Equal(t, 0, paymentHooks(test))
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, models.PartiallyPaidState, order.PaymentState)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/payments/"+second.ID+"/paid", nil, token)
+		extractPayload(t, http.StatusOK, recorder, &models.Transaction{})
+		assert.Equal(t, 1, paymentHooks(test))
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+	})
+
+	t.Run("AsNonAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		trans := createPayment(test)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/payments/"+trans.ID+"/paid", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("NotOffline", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstTransaction.Status = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstTransaction).Error)
+		test.Data.firstOrder.PaymentProcessor = payments.StripeProvider
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodPost, "/payments/"+test.Data.firstTransaction.ID+"/paid", nil, token)
+		validateError(t, http.StatusBadRequest, recorder, "can't be marked as paid")
+	})
+}
+
+func TestPaymentDelayedCapture(t *testing.T) {
+	authorize := func(test *RouteTest, calls *[]string) *models.Transaction {
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) {
+			*calls = append(*calls, path)
+			switch path {
+			case "/charges":
+				payload := params.(*stripe.ChargeParams)
+				require.NotNil(test.T, payload.Capture)
+				assert.False(test.T, *payload.Capture)
+				v.(*stripe.Charge).ID = "ch_authorized"
+			case "/charges/ch_authorized/capture":
+				payload := params.(*stripe.CaptureParams)
+				assert.EqualValues(test.T, test.Data.firstOrder.Total, *payload.Amount)
+				v.(*stripe.Charge).ID = "ch_authorized"
+			case "/refunds":
+				payload := params.(*stripe.RefundParams)
+				assert.Equal(test.T, "ch_authorized", *payload.Charge)
+			default:
+				test.T.Fatalf("unknown Stripe API call to %s", path)
+			}
+		}))
+
+		test.Config.Payment.DelayedCapture = true
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(test.T, test.DB.Save(test.Data.firstOrder).Error)
+		test.Data.firstTransaction.Status = models.FailedState
+		require.NoError(test.T, test.DB.Save(test.Data.firstTransaction).Error)
+
+		params := &stripePaymentParams{
+			Amount:      test.Data.firstOrder.Total,
+			Currency:    test.Data.firstOrder.Currency,
+			StripeToken: "123456",
+			Provider:    payments.StripeProvider,
+		}
+		body, err := json.Marshal(params)
+		require.NoError(test.T, err)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+		trans := &models.Transaction{}
+		extractPayload(test.T, http.StatusOK, recorder, trans)
+		assert.Equal(test.T, models.AuthorizedState, trans.Status)
+		assert.Equal(test.T, "ch_authorized", trans.ProcessorID)
+
+		order := &models.Order{}
+		require.NoError(test.T, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(test.T, models.AuthorizedState, order.PaymentState)
+		return trans
+	}
+
+	t.Run("Capture", func(t *testing.T) {
+		test := NewRouteTest(t)
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		calls := []string{}
+		trans := authorize(test, &calls)
+
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodPost, "/payments/"+trans.ID+"/capture", nil, token)
+		captured := &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, captured)
+		assert.Equal(t, models.PaidState, captured.Status)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+		assert.Equal(t, []string{"/charges", "/charges/ch_authorized/capture"}, calls)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/payments/"+trans.ID+"/capture", nil, token)
+		validateError(t, http.StatusBadRequest, recorder, "hasn't been authorized")
+	})
+
+	t.Run("CaptureTooMuch", func(t *testing.T) {
+		test := NewRouteTest(t)
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		calls := []string{}
+		trans := authorize(test, &calls)
+
+		body, err := json.Marshal(&PaymentParams{Amount: trans.Amount + 1})
+		require.NoError(t, err)
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodPost, "/payments/"+trans.ID+"/capture", bytes.NewBuffer(body), token)
+		validateError(t, http.StatusBadRequest, recorder, "authorized amount")
+	})
+
+	t.Run("Void", func(t *testing.T) {
+		test := NewRouteTest(t)
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		calls := []string{}
+		trans := authorize(test, &calls)
+
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodPost, "/payments/"+trans.ID+"/void", nil, token)
+		voided := &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, voided)
+		assert.Equal(t, models.VoidedState, voided.Status)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, models.PendingState, order.PaymentState)
+		assert.Equal(t, []string{"/charges", "/refunds"}, calls)
+	})
+
+	t.Run("CaptureOnShipping", func(t *testing.T) {
+		test := NewRouteTest(t)
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		calls := []string{}
+		trans := authorize(test, &calls)
+
+		body := strings.NewReader(`{"fulfillment_state": "` + models.ShippingState + `"}`)
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodPut, test.Data.urlForFirstOrder, body, token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+
+		stored, err := models.GetTransaction(test.DB, trans.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.PaidState, stored.Status)
+		assert.Equal(t, []string{"/charges", "/charges/ch_authorized/capture"}, calls)
+	})
+
+	t.Run("NoCaptureWhenPartiallyAuthorized", func(t *testing.T) {
+		test := NewRouteTest(t)
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		calls := []string{}
+		trans := authorize(test, &calls)
+
+		trans.Amount = 1
+		require.NoError(t, test.DB.Save(trans).Error)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("payment_state", models.PartiallyPaidState).Error)
+
+		body := strings.NewReader(`{"fulfillment_state": "` + models.ShippingState + `"}`)
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodPut, test.Data.urlForFirstOrder, body, token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, models.PartiallyPaidState, order.PaymentState)
+
+		stored, err := models.GetTransaction(test.DB, trans.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.AuthorizedState, stored.Status)
+		assert.Equal(t, []string{"/charges"}, calls)
+	})
+
+	t.Run("CaptureOnShippingFails", func(t *testing.T) {
+		test := NewRouteTest(t)
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		calls := []string{}
+		trans := authorize(test, &calls)
+
+		second := models.NewTransaction(test.Data.firstOrder)
+		second.Order = nil
+		second.ProcessorID = "ch_second"
+		second.Status = models.AuthorizedState
+		require.NoError(t, test.DB.Create(second).Error)
+
+		// the first capture goes through, the second one fails
+		captures := 0
+		stripe.SetBackend(stripe.APIBackend, &failingStripeBackend{
+			trackingStripeBackend: trackingStripeBackend{func(method, path, key string, params stripe.ParamsContainer, v interface{}) {
+				captures++
+				v.(*stripe.Charge).ID = strings.TrimSuffix(strings.TrimPrefix(path, "/charges/"), "/capture")
+			}},
+			fail: func(path string) error {
+				if captures > 1 {
+					return errors.New("card declined")
+				}
+				return nil
+			},
+		})
+
+		body := strings.NewReader(`{"fulfillment_state": "` + models.ShippingState + `"}`)
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodPut, test.Data.urlForFirstOrder, body, token)
+		validateError(t, http.StatusInternalServerError, recorder, "Error capturing payment")
+		assert.Equal(t, 2, captures)
+
+		states := []string{}
+		for _, id := range []string{trans.ID, second.ID} {
+			stored, err := models.GetTransaction(test.DB, id)
+			require.NoError(t, err)
+			states = append(states, stored.Status)
+		}
+		assert.ElementsMatch(t, []string{models.PaidState, models.AuthorizedState}, states)
+	})
+}
+
 func TestPaymentPreauthorize(t *testing.T) {
 	t.Run("PayPal", func(t *testing.T) {
 		testURL := "/paypal"
@@ -654,6 +1238,7 @@ type refundCall struct {
 	amount   uint64
 	id       string
 	currency string
+	details  *payments.RefundDetails
 }
 
 func (mp *memProvider) Name() string {
@@ -673,7 +1258,7 @@ func (mp *memProvider) charge(amount uint64, currency string, order *models.Orde
 	return "", errors.New("Shouldn't have called this")
 }
 
-func (mp *memProvider) refund(transactionID string, amount uint64, currency string) (string, error) {
+func (mp *memProvider) refund(transactionID string, amount uint64, currency string, details *payments.RefundDetails) (string, error) {
 	if mp.refundCalls == nil {
 		mp.refundCalls = []refundCall{}
 	}
@@ -681,6 +1266,7 @@ func (mp *memProvider) refund(transactionID string, amount uint64, currency stri
 		amount:   amount,
 		id:       transactionID,
 		currency: currency,
+		details:  details,
 	})
 
 	return fmt.Sprintf("trans-%d", len(mp.refundCalls)), nil
@@ -714,3 +1300,97 @@ func (t trackingStripeBackend) CallRaw(method, path, key string, body *form.Valu
 }
 
 func (t trackingStripeBackend) SetMaxNetworkRetries(maxNetworkRetries int) {}
+
+// failingStripeBackend is a trackingStripeBackend whose calls can fail.
+type failingStripeBackend struct {
+	trackingStripeBackend
+	fail func(path string) error
+}
+
+func (f failingStripeBackend) Call(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+	f.trackingFunc(method, path, key, params, v)
+	return f.fail(path)
+}
+
+func TestPaymentSplit(t *testing.T) {
+	test := NewRouteTest(t)
+	test.Config.Payment.GiftCard.Enabled = true
+
+	stripeCharges := 0
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) {
+		switch path {
+		case "/charges":
+			payload := params.(*stripe.ChargeParams)
+			assert.EqualValues(t, 14, *payload.Amount)
+			stripeCharges++
+		default:
+			t.Fatalf("unknown Stripe API call to %s", path)
+		}
+	}))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	test.Data.firstOrder.PaymentState = models.PendingState
+	require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+	test.Data.firstTransaction.Status = models.FailedState
+	require.NoError(t, test.DB.Save(test.Data.firstTransaction).Error)
+	require.EqualValues(t, 24, test.Data.firstOrder.Total)
+
+	card := issueGiftCard(t, test, &GiftCardParams{Code: "HAPPY-BIRTHDAY", Amount: 10})
+
+	pay := func(params interface{}) *httptest.ResponseRecorder {
+		body, err := json.Marshal(params)
+		require.NoError(t, err)
+		return test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+	}
+	loadOrder := func() *models.Order {
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		return order
+	}
+
+	recorder := pay(map[string]interface{}{
+		"amount":         10,
+		"currency":       "USD",
+		"gift_card_code": card.Code,
+		"provider":       payments.GiftCardProvider,
+	})
+	giftCardCharge := &models.Transaction{}
+	extractPayload(t, http.StatusOK, recorder, giftCardCharge)
+	assert.Equal(t, models.PaidState, giftCardCharge.Status)
+	assert.Equal(t, payments.GiftCardProvider, giftCardCharge.PaymentProcessor)
+
+	order := loadOrder()
+	assert.Equal(t, models.PartiallyPaidState, order.PaymentState)
+	assert.EqualValues(t, 10, order.AmountPaid)
+	assert.EqualValues(t, 14, order.AmountDue)
+
+	recorder = pay(&stripePaymentParams{Amount: 15, Currency: "USD", StripeToken: "123456", Provider: payments.StripeProvider})
+	validateError(t, http.StatusInternalServerError, recorder, "exceeds the amount due")
+
+	recorder = pay(&stripePaymentParams{Amount: 14, Currency: "USD", StripeToken: "123456", Provider: payments.StripeProvider})
+	cardCharge := &models.Transaction{}
+	extractPayload(t, http.StatusOK, recorder, cardCharge)
+	assert.Equal(t, models.PaidState, cardCharge.Status)
+	assert.Equal(t, giftCardCharge.InvoiceNumber, cardCharge.InvoiceNumber)
+	assert.Equal(t, 1, stripeCharges)
+
+	order = loadOrder()
+	assert.Equal(t, models.PaidState, order.PaymentState)
+	assert.EqualValues(t, 24, order.AmountPaid)
+	assert.EqualValues(t, 0, order.AmountDue)
+
+	t.Run("RefundToGiftCard", func(t *testing.T) {
+		body, err := json.Marshal(&PaymentParams{Amount: 10, Currency: "USD"})
+		require.NoError(t, err)
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodPost, "/payments/"+giftCardCharge.ID+"/refund", bytes.NewBuffer(body), token)
+		refund := &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, refund)
+		assert.Equal(t, models.PaidState, refund.Status)
+		assert.Equal(t, payments.GiftCardProvider, refund.PaymentProcessor)
+
+		stored, err := models.GetGiftCard(test.DB, "", card.Code)
+		require.NoError(t, err)
+		assert.EqualValues(t, 10, stored.Balance)
+	})
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"net/http"
+	"net/url"
 
 	gcontext "gocommerce/context"
 	"gocommerce/models"
@@ -11,25 +12,32 @@ type salesRow struct {
 	Total    uint64 `json:"total"`
 	SubTotal uint64 `json:"subtotal"`
 	Taxes    uint64 `json:"taxes"`
+	Refunded uint64 `json:"refunded"`
 	Currency string `json:"currency"`
 	Orders   uint64 `json:"orders"`
 }
 
+// soldPaymentStates are the payment states of orders that count as sales.
+// Refunds are reported separately.
+var soldPaymentStates = []string{models.PaidState, models.PartiallyRefundedState, models.RefundedState}
+
 type productsRow struct {
 	Sku      string `json:"sku"`
 	Path     string `json:"path"`
 	Total    uint64 `json:"total"`
+	Refunded uint64 `json:"refunded"`
 	Currency string `json:"currency"`
 }
 
-// SalesReport lists the sales numbers for a period
+// SalesReport lists the sales numbers for a period, together with the amount
+// refunded in the period
 func (a *API) SalesReport(w http.ResponseWriter, r *http.Request) error {
 	instanceID := gcontext.GetInstanceID(r.Context())
 
 	query := a.db.
 		Model(&models.Order{}).
 		Select("sum(total) as total, sum(sub_total) as subtotal, sum(taxes) as taxes, currency, count(*) as orders").
-		Where("payment_state = 'paid' AND instance_id = ?", instanceID).
+		Where("payment_state IN (?) AND instance_id = ?", soldPaymentStates, instanceID).
 		Group("currency")
 
 	query, err := parseTimeQueryParams(query, query.NewScope(models.Order{}).QuotedTableName(), r.URL.Query())
@@ -52,9 +60,56 @@ func (a *API) SalesReport(w http.ResponseWriter, r *http.Request) error {
 		result = append(result, row)
 	}
 
+	refunds, err := a.refundsByCurrency(instanceID, r.URL.Query())
+	if err != nil {
+		return internalServerError("Database error").WithInternalError(err)
+	}
+	for currency, amount := range refunds {
+		var row *salesRow
+		for _, existing := range result {
+			if existing.Currency == currency {
+				row = existing
+			}
+		}
+		if row == nil {
+			row = &salesRow{Currency: currency}
+			result = append(result, row)
+		}
+		row.Refunded = amount
+	}
+
 	return sendJSON(w, http.StatusOK, result)
 }
 
+func (a *API) refundsByCurrency(instanceID string, params url.Values) (map[string]uint64, error) {
+	query := a.db.
+		Model(&models.Transaction{}).
+		Select("sum(amount) as refunded, currency").
+		Where("type = ? AND status = ? AND instance_id = ?", models.RefundTransactionType, models.PaidState, instanceID).
+		Group("currency")
+
+	query, err := parseTimeQueryParams(query, query.NewScope(models.Transaction{}).QuotedTableName(), params)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := query.Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	refunds := map[string]uint64{}
+	for rows.Next() {
+		var amount uint64
+		var currency string
+		if err := rows.Scan(&amount, &currency); err != nil {
+			return nil, err
+		}
+		refunds[currency] = amount
+	}
+	return refunds, nil
+}
+
 // ProductsReport list the products sold within a period
 func (a *API) ProductsReport(w http.ResponseWriter, r *http.Request) error {
 	instanceID := gcontext.GetInstanceID(r.Context())
@@ -63,7 +118,7 @@ func (a *API) ProductsReport(w http.ResponseWriter, r *http.Request) error {
 	query := a.db.
 		Model(&models.LineItem{}).
 		Select("sku, path, sum(quantity * price) as total, currency").
-		Joins("JOIN " + ordersTable + " ON " + ordersTable + ".id = " + itemsTable + ".order_id " + "AND " + ordersTable + ".payment_state = 'paid'").
+		Joins("JOIN "+ordersTable+" ON "+ordersTable+".id = "+itemsTable+".order_id "+"AND "+ordersTable+".payment_state IN (?)", soldPaymentStates).
 		Group("sku, path, currency").
 		Order("total desc")
 
@@ -94,5 +149,47 @@ func (a *API) ProductsReport(w http.ResponseWriter, r *http.Request) error {
 		result = append(result, row)
 	}
 
+	if err := a.addProductRefunds(instanceID, result, r.URL.Query()); err != nil {
+		return internalServerError("Database error").WithInternalError(err)
+	}
+
 	return sendJSON(w, http.StatusOK, result)
 }
+
+// addProductRefunds adds the line items of the refunds made in the period to
+// the products they were made for.
+func (a *API) addProductRefunds(instanceID string, result []*productsRow, params url.Values) error {
+	transTable := a.db.NewScope(models.Transaction{}).QuotedTableName()
+	itemsTable := a.db.NewScope(models.RefundLineItem{}).QuotedTableName()
+	query := a.db.
+		Model(&models.RefundLineItem{}).
+		Select("sku, sum("+itemsTable+".amount) as refunded, currency").
+		Joins("JOIN "+transTable+" ON "+transTable+".id = "+itemsTable+".transaction_id AND "+transTable+".status = ?", models.PaidState).
+		Where(transTable+".instance_id = ?", instanceID).
+		Group("sku, currency")
+
+	query, err := parseTimeQueryParams(query, transTable, params)
+	if err != nil {
+		return err
+	}
+
+	rows, err := query.Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sku, currency string
+		var refunded uint64
+		if err := rows.Scan(&sku, &refunded, &currency); err != nil {
+			return err
+		}
+		for _, row := range result {
+			if row.Sku == sku && row.Currency == currency {
+				row.Refunded = refunded
+				break
+			}
+		}
+	}
+	return nil
+}
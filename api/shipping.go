@@ -0,0 +1,94 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	gcontext "gocommerce/context"
+	"gocommerce/models"
+)
+
+type shippingQuoteParams struct {
+	ShippingAddress *models.Address  `json:"shipping_address"`
+	LineItems       []*orderLineItem `json:"line_items"`
+	Currency        string           `json:"currency"`
+	CouponCode      string           `json:"coupon"`
+	CouponCodes     []string         `json:"coupons"`
+}
+
+type shippingQuote struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Type     string `json:"type"`
+	Currency string `json:"currency"`
+
+	Shipping      uint64 `json:"shipping"`
+	ShippingTaxes uint64 `json:"shipping_taxes"`
+	Total         uint64 `json:"total"`
+}
+
+// ShippingQuotes prices every shipping rate available for a cart and
+// address. The items are priced the same way as when creating an order, so
+// the quotes match the totals at checkout.
+func (a *API) ShippingQuotes(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+
+	params := &shippingQuoteParams{Currency: "USD"}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	if params.ShippingAddress == nil || params.ShippingAddress.Country == "" {
+		return badRequestError("A shipping address with a country is required")
+	}
+	if len(params.LineItems) == 0 {
+		return badRequestError("At least one line item is required")
+	}
+
+	order := models.NewOrder(gcontext.GetInstanceID(ctx), "", "", params.Currency)
+	order.ShippingAddress = *params.ShippingAddress
+	coupons, err := a.orderCoupons(ctx, w, couponCodes(params.CouponCode, params.CouponCodes))
+	if err != nil {
+		return err
+	}
+	order.SetCoupons(coupons)
+
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		return internalServerError("Error loading site settings").WithInternalError(err)
+	}
+	rates, err := exchangeRates(ctx, a.db, settings)
+	if err != nil {
+		return internalServerError("Error while querying for exchange rates").WithInternalError(err)
+	}
+	if httpError := a.processLineItems(ctx, order, params.LineItems, rates); httpError != nil {
+		return httpError
+	}
+
+	// the taxes don't depend on the shipping rate, so they are looked up once
+	settings, err = order.ResolveTaxes(settings)
+	if err != nil {
+		return internalServerError("Error looking up taxes").WithInternalError(err)
+	}
+
+	claims := gcontext.GetClaimsAsMap(ctx)
+	quotes := []*shippingQuote{}
+	for _, rate := range settings.ShippingRates(order.ShippingAddress.Country, order.Currency) {
+		order.ShippingRate = rate.ID
+		order.Total = 0
+		if _, err := order.CalculateTotal(settings, claims, log); err != nil {
+			return internalServerError("Error calculating shipping quote").WithInternalError(err)
+		}
+		quotes = append(quotes, &shippingQuote{
+			ID:            rate.ID,
+			Title:         rate.Title,
+			Type:          rate.Type,
+			Currency:      order.Currency,
+			Shipping:      order.Shipping,
+			ShippingTaxes: order.ShippingTaxes,
+			Total:         order.Total,
+		})
+	}
+
+	return sendJSON(w, http.StatusOK, quotes)
+}
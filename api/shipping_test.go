@@ -0,0 +1,83 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gocommerce/calculator"
+	"gocommerce/models"
+)
+
+func TestShippingQuotes(t *testing.T) {
+	server := startTestSiteWithSettings(&calculator.Settings{
+		ShippingZones: []*calculator.ShippingZone{{
+			Name:      "Domestic",
+			Countries: []string{"USA"},
+			Rates: []*calculator.ShippingRate{
+				{ID: "standard", Title: "Standard", Type: calculator.FlatShippingRate, Amount: "5.00", FreeAbove: "15.00"},
+				{ID: "express", Title: "Express", Type: calculator.FlatShippingRate, Amount: "12.00", VAT: 10},
+				{ID: "euro", Type: calculator.FlatShippingRate, Amount: "4.00", Currency: "EUR"},
+			},
+		}},
+	})
+	defer server.Close()
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+
+	payload := func(country string, quantity int) *strings.Reader {
+		return strings.NewReader(fmt.Sprintf(`{
+			"shipping_address": {"country": %q},
+			"line_items": [{"path": "/simple-product", "quantity": %d}]
+		}`, country, quantity))
+	}
+
+	quotes := []*shippingQuote{}
+	recorder := test.TestEndpoint(http.MethodPost, "/shipping/quotes", payload("USA", 1), nil)
+	extractPayload(t, http.StatusOK, recorder, &quotes)
+	require.Len(t, quotes, 2)
+	assert.Equal(t, "standard", quotes[0].ID)
+	assert.Equal(t, "Standard", quotes[0].Title)
+	assert.EqualValues(t, 500, quotes[0].Shipping)
+	assert.EqualValues(t, 1499, quotes[0].Total)
+	assert.Equal(t, "express", quotes[1].ID)
+	assert.EqualValues(t, 1200, quotes[1].Shipping)
+	assert.EqualValues(t, 120, quotes[1].ShippingTaxes)
+	assert.EqualValues(t, 2319, quotes[1].Total)
+
+	// the quote agrees with the order created with the same rate
+	body := strings.NewReader(`{
+		"email": "info@example.com",
+		"shipping_rate": "express",
+		"shipping_address": {
+			"name": "Test User",
+			"address1": "610 22nd Street",
+			"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+		},
+		"line_items": [{"path": "/simple-product", "quantity": 1}]
+	}`)
+	order := &models.Order{}
+	recorder = test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+	extractPayload(t, http.StatusCreated, recorder, order)
+	assert.Equal(t, quotes[1].Total, order.Total)
+
+	recorder = test.TestEndpoint(http.MethodPost, "/shipping/quotes", payload("USA", 2), nil)
+	extractPayload(t, http.StatusOK, recorder, &quotes)
+	require.Len(t, quotes, 2)
+	assert.EqualValues(t, 0, quotes[0].Shipping)
+	assert.EqualValues(t, 1998, quotes[0].Total)
+
+	recorder = test.TestEndpoint(http.MethodPost, "/shipping/quotes", payload("Canada", 1), nil)
+	extractPayload(t, http.StatusOK, recorder, &quotes)
+	assert.Len(t, quotes, 0)
+
+	recorder = test.TestEndpoint(http.MethodPost, "/shipping/quotes", strings.NewReader(`{"line_items": [{"path": "/simple-product", "quantity": 1}]}`), nil)
+	validateError(t, http.StatusBadRequest, recorder, "shipping address")
+
+	recorder = test.TestEndpoint(http.MethodPost, "/shipping/quotes", payload("USA", MaxLineItemQuantity+1), nil)
+	validateError(t, http.StatusBadRequest, recorder, "quantity of a line item")
+}
@@ -0,0 +1,309 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	gcontext "gocommerce/context"
+	"gocommerce/models"
+	"gocommerce/payments"
+)
+
+const subscriptionRenewalPeriod = time.Minute
+
+// maxRenewalAttempts is the number of failed renewal charges after which a
+// past due subscription is canceled.
+const maxRenewalAttempts = 4
+
+const renewalRetryPeriod = 24 * time.Hour
+
+// RunSubscriptions creates a goroutine that renews due subscriptions every
+// minute. In single instance mode ctx carries the instance config, otherwise
+// it is loaded for every subscription.
+func (a *API) RunSubscriptions(ctx context.Context, db *gorm.DB, log *logrus.Entry) {
+	go func() {
+		id := uuid.NewRandom().String()
+		table := models.Subscription{}.TableName()
+		for {
+			subs := []*models.Subscription{}
+			tx := db.Begin()
+			now := time.Now()
+
+			tx.Table(table).
+				Where("state IN (?) AND next_renewal_at < ? AND (locked_at IS NULL OR locked_at < ?)", []string{models.ActiveState, models.PastDueState}, now, now.Add(-5*time.Minute)).
+				Updates(map[string]interface{}{"locked_at": now, "locked_by": id})
+
+			tx.Where("locked_by = ?", id).Find(&subs)
+			if rsp := tx.Commit(); rsp.Error != nil {
+				log.WithError(rsp.Error).Error("Error querying for subscriptions")
+			}
+
+			for _, sub := range subs {
+				subLog := log.WithField("subscription_id", sub.ID)
+				subCtx, err := a.renewalContext(ctx, db, sub.InstanceID)
+				if err == nil {
+					err = renewSubscription(subCtx, db, subLog, sub)
+				}
+				if err != nil {
+					subLog.WithError(err).Error("Error renewing subscription")
+				}
+			}
+
+			time.Sleep(subscriptionRenewalPeriod)
+		}
+	}()
+}
+
+func (a *API) renewalContext(ctx context.Context, db *gorm.DB, instanceID string) (context.Context, error) {
+	if !a.config.MultiInstanceMode {
+		return ctx, nil
+	}
+	instance, err := models.GetInstance(db, instanceID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error loading instance")
+	}
+	config, err := instance.Config()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error loading environment config")
+	}
+	return WithInstanceConfig(ctx, a.config.SMTP, config, instanceID)
+}
+
+// renewSubscription charges the saved payment method of the user for the next
+// period of a subscription. Failed charges are retried a few days in a row
+// before the subscription is canceled.
+//
+// The renewal order and a pending transaction are stored before charging. The
+// ID of the transaction is the idempotency key of the charge, so a renewal
+// that fails after the customer was charged is picked up again once the lock
+// expires without charging twice.
+func renewSubscription(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, sub *models.Subscription) error {
+	config := gcontext.GetConfig(ctx)
+	mailer := gcontext.GetMailer(ctx)
+
+	tx := db.Begin()
+	order, err := renewalOrder(tx, sub)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	tr, err := renewalTransaction(tx, sub, order)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	sub.RenewalOrderID = order.ID
+	if rsp := tx.Save(sub); rsp.Error != nil {
+		tx.Rollback()
+		return rsp.Error
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return rsp.Error
+	}
+
+	processorID, err := chargeSubscription(ctx, db, sub, order, tr.ID)
+	tr.ProcessorID = processorID
+
+	now := time.Now()
+	sub.LockedAt = nil
+	sub.LockedBy = nil
+	tx = db.Begin()
+	if err != nil {
+		tr.FailureCode = strconv.FormatInt(http.StatusInternalServerError, 10)
+		tr.FailureDescription = err.Error()
+		tr.Status = models.FailedState
+		tx.Save(tr)
+
+		sub.RenewalAttempts++
+		if sub.RenewalAttempts >= maxRenewalAttempts {
+			log.WithError(err).Errorf("Renewal failed %d times, canceling subscription", sub.RenewalAttempts)
+			sub.State = models.CanceledState
+			sub.CanceledAt = &now
+		} else {
+			sub.State = models.PastDueState
+			sub.NextRenewalAt = now.Add(time.Duration(sub.RenewalAttempts) * renewalRetryPeriod)
+			log.WithError(err).Infof("Renewal failed, retrying at %v", sub.NextRenewalAt)
+		}
+		if rsp := tx.Save(sub); rsp.Error != nil {
+			tx.Rollback()
+			return rsp.Error
+		}
+		return tx.Commit().Error
+	}
+
+	// the customer has been charged, errors from here on leave the renewal
+	// locked and pending so it is recorded on the next attempt
+	paidLog := log.WithField("transaction_id", tr.ID).WithField("processor_id", processorID)
+	tr.Status = models.PaidState
+	if rsp := tx.Save(tr); rsp.Error != nil {
+		tx.Rollback()
+		paidLog.WithError(rsp.Error).Error("Error saving the paid renewal transaction")
+		return rsp.Error
+	}
+	if err := order.UpdatePaymentState(tx); err != nil {
+		tx.Rollback()
+		paidLog.WithError(err).Error("Error updating the payment state of the renewal order")
+		return err
+	}
+
+	sub.State = models.ActiveState
+	sub.RenewalOrderID = ""
+	sub.RenewalAttempts = 0
+	sub.CurrentPeriodEnd = sub.AddInterval(sub.CurrentPeriodEnd)
+	sub.NextRenewalAt = sub.CurrentPeriodEnd
+	if rsp := tx.Save(sub); rsp.Error != nil {
+		tx.Rollback()
+		paidLog.WithError(rsp.Error).Error("Error saving the renewed subscription")
+		return rsp.Error
+	}
+
+	queuePaymentWebhook(tx, config, log, order)
+	if rsp := tx.Commit(); rsp.Error != nil {
+		paidLog.WithError(rsp.Error).Error("Error saving the renewed subscription")
+		return rsp.Error
+	}
+	log.WithField("order_id", order.ID).Info("Renewed subscription")
+
+	tr.Order = order
+	sendOrderConfirmationMails(mailer, log, tr)
+	return nil
+}
+
+// renewalTransaction returns the pending transaction of a renewal order. A
+// new one is created for every attempt, unless the last attempt stopped
+// before its outcome was recorded.
+func renewalTransaction(tx *gorm.DB, sub *models.Subscription, order *models.Order) (*models.Transaction, error) {
+	tr := &models.Transaction{}
+	rsp := tx.Where("order_id = ? AND status = ?", order.ID, models.PendingState).First(tr)
+	if rsp.Error == nil {
+		return tr, nil
+	}
+	if !rsp.RecordNotFound() {
+		return nil, errors.Wrap(rsp.Error, "Error loading renewal transaction")
+	}
+
+	tr = models.NewTransaction(order)
+	tr.PaymentProcessor = sub.PaymentProcessor
+	tr.InvoiceNumber = order.InvoiceNumber
+	tr.Status = models.PendingState
+	if rsp := tx.Create(tr); rsp.Error != nil {
+		return nil, errors.Wrap(rsp.Error, "Error creating renewal transaction")
+	}
+	return tr, nil
+}
+
+// renewalOrder creates the order for the next period of a subscription. It is
+// priced like the line item that started the subscription. Failed renewals
+// are retried with the same order.
+func renewalOrder(tx *gorm.DB, sub *models.Subscription) (*models.Order, error) {
+	if sub.RenewalOrderID != "" {
+		order := &models.Order{}
+		loader := tx.
+			Preload("LineItems").
+			Preload("BillingAddress").
+			Preload("ShippingAddress")
+		if rsp := loader.First(order, "id = ?", sub.RenewalOrderID); rsp.Error != nil {
+			return nil, errors.Wrap(rsp.Error, "Error loading renewal order")
+		}
+		return order, nil
+	}
+
+	original := &models.Order{}
+	loader := tx.
+		Preload("LineItems").
+		Preload("BillingAddress").
+		Preload("ShippingAddress")
+	if rsp := loader.First(original, "id = ?", sub.OrderID); rsp.Error != nil {
+		return nil, errors.Wrap(rsp.Error, "Error loading subscription order")
+	}
+	var item *models.LineItem
+	for _, i := range original.LineItems {
+		if i.ID == sub.LineItemID {
+			item = i
+		}
+	}
+	if item == nil {
+		return nil, fmt.Errorf("Line item %d of order %s not found", sub.LineItemID, sub.OrderID)
+	}
+
+	order := models.NewOrder(sub.InstanceID, "", sub.Email, sub.Currency)
+	order.UserID = sub.UserID
+	order.SubscriptionID = sub.ID
+	order.ShippingAddress = original.ShippingAddress
+	order.ShippingAddressID = original.ShippingAddressID
+	order.BillingAddress = original.BillingAddress
+	order.BillingAddressID = original.BillingAddressID
+	order.VATNumber = original.VATNumber
+
+	detail := &models.CalculationDetail{}
+	if item.CalculationDetail != nil {
+		detail.Subtotal = item.Subtotal
+		detail.Discount = item.Discount
+		detail.NetTotal = item.NetTotal
+		detail.Taxes = item.Taxes
+		detail.Total = item.Total
+	}
+	order.LineItems = []*models.LineItem{{
+		Title:             item.Title,
+		Sku:               item.Sku,
+		Type:              item.Type,
+		Description:       item.Description,
+		Path:              item.Path,
+		Price:             item.Price,
+		VAT:               item.VAT,
+		AddonPrice:        item.AddonPrice,
+		Quantity:          item.Quantity,
+		Interval:          item.Interval,
+		IntervalCount:     item.IntervalCount,
+		MetaData:          item.MetaData,
+		CalculationDetail: detail,
+	}}
+	order.SubTotal = detail.Subtotal * item.Quantity
+	order.Discount = detail.Discount * item.Quantity
+	order.NetTotal = detail.NetTotal * item.Quantity
+	order.Taxes = detail.Taxes * item.Quantity
+	order.Total = sub.Amount
+
+	invoiceNumber, err := models.NextInvoiceNumber(tx, sub.InstanceID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating invoice number")
+	}
+	order.InvoiceNumber = invoiceNumber
+	order.PaymentProcessor = sub.PaymentProcessor
+
+	if rsp := tx.Create(order); rsp.Error != nil {
+		return nil, errors.Wrap(rsp.Error, "Error creating renewal order")
+	}
+	return order, nil
+}
+
+// chargeSubscription charges the customer the user has with the provider of
+// the subscription.
+func chargeSubscription(ctx context.Context, db *gorm.DB, sub *models.Subscription, order *models.Order, idempotencyKey string) (string, error) {
+	provider := gcontext.GetPaymentProviders(ctx)[sub.PaymentProcessor]
+	recurringProvider, ok := provider.(payments.RecurringProvider)
+	if !ok {
+		return "", fmt.Errorf("Payment provider '%s' doesn't support recurring payments", sub.PaymentProcessor)
+	}
+	customer, err := models.GetPaymentCustomer(db, sub.InstanceID, sub.UserID, sub.PaymentProcessor)
+	if err != nil {
+		return "", err
+	}
+	if customer == nil {
+		return "", errors.New("No saved payment method to charge")
+	}
+
+	charge, err := recurringProvider.NewRecurringCharger(gcontext.WithDB(ctx, db), customer.CustomerID, idempotencyKey)
+	if err != nil {
+		return "", err
+	}
+	return charge(order.Total, order.Currency, order, order.InvoiceNumber)
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+
+	gcontext "gocommerce/context"
+	"gocommerce/models"
+)
+
+// SubscriptionList lists the subscriptions of a user.
+func (a *API) SubscriptionList(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instanceID := gcontext.GetInstanceID(ctx)
+	userID := gcontext.GetUserID(ctx)
+
+	subs := []*models.Subscription{}
+	if rsp := a.db.Where("instance_id = ? AND user_id = ?", instanceID, userID).Order("created_at desc").Find(&subs); rsp.Error != nil {
+		return internalServerError("Error while querying for subscriptions").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, subs)
+}
+
+// SubscriptionView shows a single subscription of a user.
+func (a *API) SubscriptionView(w http.ResponseWriter, r *http.Request) error {
+	sub, httpErr := a.getSubscription(r.Context(), chi.URLParam(r, "subscription_id"))
+	if httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, sub)
+}
+
+// SubscriptionCancel stops all future renewals of a subscription.
+func (a *API) SubscriptionCancel(w http.ResponseWriter, r *http.Request) error {
+	sub, httpErr := a.getSubscription(r.Context(), chi.URLParam(r, "subscription_id"))
+	if httpErr != nil {
+		return httpErr
+	}
+	if sub.State == models.CanceledState {
+		return badRequestError("This subscription has already been canceled")
+	}
+
+	now := time.Now()
+	sub.State = models.CanceledState
+	sub.CanceledAt = &now
+	return a.saveSubscription(w, r, sub, "Canceled subscription")
+}
+
+// SubscriptionPause stops the renewals of an active subscription until it is
+// resumed.
+func (a *API) SubscriptionPause(w http.ResponseWriter, r *http.Request) error {
+	sub, httpErr := a.getSubscription(r.Context(), chi.URLParam(r, "subscription_id"))
+	if httpErr != nil {
+		return httpErr
+	}
+	if sub.State != models.ActiveState {
+		return badRequestError("Only active subscriptions can be paused")
+	}
+
+	sub.State = models.PausedState
+	return a.saveSubscription(w, r, sub, "Paused subscription")
+}
+
+// SubscriptionResume continues the renewals of a paused subscription. If the
+// period ended while it was paused, the next period starts right away.
+func (a *API) SubscriptionResume(w http.ResponseWriter, r *http.Request) error {
+	sub, httpErr := a.getSubscription(r.Context(), chi.URLParam(r, "subscription_id"))
+	if httpErr != nil {
+		return httpErr
+	}
+	if sub.State != models.PausedState {
+		return badRequestError("Only paused subscriptions can be resumed")
+	}
+
+	now := time.Now()
+	if sub.CurrentPeriodEnd.Before(now) {
+		sub.CurrentPeriodEnd = now
+		sub.NextRenewalAt = now
+	}
+	sub.State = models.ActiveState
+	return a.saveSubscription(w, r, sub, "Resumed subscription")
+}
+
+func (a *API) getSubscription(ctx context.Context, id string) (*models.Subscription, *HTTPError) {
+	sub, err := models.GetSubscription(a.db, id)
+	if err != nil {
+		return nil, internalServerError("Error while querying for subscriptions").WithInternalError(err)
+	}
+	if sub == nil || sub.InstanceID != gcontext.GetInstanceID(ctx) || sub.UserID != gcontext.GetUserID(ctx) {
+		return nil, notFoundError("Subscription not found")
+	}
+	return sub, nil
+}
+
+func (a *API) saveSubscription(w http.ResponseWriter, r *http.Request, sub *models.Subscription, msg string) error {
+	if rsp := a.db.Save(sub); rsp.Error != nil {
+		return internalServerError("Error saving subscription").WithInternalError(rsp.Error)
+	}
+	getLogEntry(r).WithField("subscription_id", sub.ID).Info(msg)
+	return sendJSON(w, http.StatusOK, sub)
+}
+
+// createSubscriptions starts a subscription for every subscription line item
+// of a paid order. Renewal orders belong to an existing subscription already.
+func createSubscriptions(tx *gorm.DB, order *models.Order, processor string) error {
+	if order.SubscriptionID != "" {
+		return nil
+	}
+	for _, item := range order.LineItems {
+		if !item.IsSubscription() {
+			continue
+		}
+		if rsp := tx.Create(models.NewSubscription(order, item, processor)); rsp.Error != nil {
+			return rsp.Error
+		}
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"gocommerce/conf"
+	"gocommerce/models"
+	"gocommerce/payments"
+)
+
+// subscribe turns the line item of the first order into a monthly
+// subscription and pays for it with a new card.
+func subscribe(t *testing.T, test *RouteTest) *models.Subscription {
+	require.NoError(t, test.DB.Model(test.Data.firstLineItem).UpdateColumns(map[string]interface{}{
+		"interval":       "month",
+		"interval_count": 1,
+	}).Error)
+	test.Data.firstOrder.PaymentState = models.PendingState
+	require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+	test.Data.firstTransaction.Status = models.FailedState
+	require.NoError(t, test.DB.Save(test.Data.firstTransaction).Error)
+
+	body, err := json.Marshal(&savedCardPaymentParams{
+		Amount:      test.Data.firstOrder.Total,
+		Currency:    test.Data.firstOrder.Currency,
+		Provider:    payments.StripeProvider,
+		StripeToken: "tok_visa",
+	})
+	require.NoError(t, err)
+	recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+	extractPayload(t, http.StatusOK, recorder, &models.Transaction{})
+
+	sub := &models.Subscription{}
+	require.NoError(t, test.DB.First(sub, "order_id = ?", test.Data.firstOrder.ID).Error)
+	return sub
+}
+
+func subscriptionStripeBackend(t *testing.T, calls *[]string) stripe.Backend {
+	return NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) {
+		*calls = append(*calls, method+" "+path)
+		switch path {
+		case "/customers":
+			v.(*stripe.Customer).ID = "cus_1"
+		case "/customers/cus_1/sources":
+			v.(*stripe.Card).ID = "card_1"
+		case "/charges":
+			payload := params.(*stripe.ChargeParams)
+			require.NotNil(t, payload.Customer)
+			assert.Equal(t, "cus_1", *payload.Customer)
+			v.(*stripe.Charge).ID = "ch_sub"
+		default:
+			t.Fatalf("unknown Stripe API call to %s", path)
+		}
+	})
+}
+
+func TestSubscriptionCreate(t *testing.T) {
+	test := NewRouteTest(t)
+	calls := []string{}
+	stripe.SetBackend(stripe.APIBackend, subscriptionStripeBackend(t, &calls))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	sub := subscribe(t, test)
+	assert.Equal(t, []string{"POST /customers", "POST /customers/cus_1/sources", "POST /charges"}, calls)
+	assert.Equal(t, models.ActiveState, sub.State)
+	assert.Equal(t, test.Data.testUser.ID, sub.UserID)
+	assert.Equal(t, test.Data.firstLineItem.Sku, sub.Sku)
+	assert.Equal(t, "month", sub.Interval)
+	assert.EqualValues(t, 24, sub.Amount)
+	assert.Equal(t, payments.StripeProvider, sub.PaymentProcessor)
+	assert.WithinDuration(t, time.Now().AddDate(0, 1, 0), sub.NextRenewalAt, time.Minute)
+
+	recorder := test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/subscriptions", nil, test.Data.testUserToken)
+	subs := []*models.Subscription{}
+	extractPayload(t, http.StatusOK, recorder, &subs)
+	require.Len(t, subs, 1)
+	assert.Equal(t, sub.ID, subs[0].ID)
+}
+
+func TestSubscriptionCreateUnsupportedProvider(t *testing.T) {
+	test := NewRouteTest(t)
+	test.Config.Payment.Offline.Enabled = true
+
+	require.NoError(t, test.DB.Model(test.Data.firstLineItem).UpdateColumn("interval", "month").Error)
+	test.Data.firstOrder.PaymentState = models.PendingState
+	require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+	body, err := json.Marshal(&PaymentParams{Amount: 24, Currency: "USD", ProviderType: payments.OfflineProvider})
+	require.NoError(t, err)
+	recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+	validateError(t, http.StatusBadRequest, recorder, "doesn't support subscriptions")
+}
+
+func TestSubscriptionRenewal(t *testing.T) {
+	test := NewRouteTest(t)
+	calls := []string{}
+	stripe.SetBackend(stripe.APIBackend, subscriptionStripeBackend(t, &calls))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	sub := subscribe(t, test)
+	periodEnd := sub.CurrentPeriodEnd
+	ctx, err := WithInstanceConfig(context.Background(), conf.SMTPConfiguration{}, test.Config, "")
+	require.NoError(t, err)
+
+	customer, err := models.GetPaymentCustomer(test.DB, "", test.Data.testUser.ID, payments.StripeProvider)
+	require.NoError(t, err)
+	require.NotNil(t, customer)
+
+	t.Run("Failed", func(t *testing.T) {
+		require.NoError(t, test.DB.Delete(customer).Error)
+
+		require.NoError(t, renewSubscription(ctx, test.DB, testLogger, sub))
+		assert.Equal(t, models.PastDueState, sub.State)
+		assert.Equal(t, 1, sub.RenewalAttempts)
+		assert.NotEmpty(t, sub.RenewalOrderID)
+		assert.True(t, sub.NextRenewalAt.After(time.Now()))
+		assert.Equal(t, periodEnd, sub.CurrentPeriodEnd)
+	})
+
+	t.Run("Retried", func(t *testing.T) {
+		require.NoError(t, test.DB.Create(customer).Error)
+		renewalOrderID := sub.RenewalOrderID
+		calls = []string{}
+
+		require.NoError(t, renewSubscription(ctx, test.DB, testLogger, sub))
+		assert.Equal(t, []string{"POST /charges"}, calls)
+		assert.Equal(t, models.ActiveState, sub.State)
+		assert.Equal(t, 0, sub.RenewalAttempts)
+		assert.Empty(t, sub.RenewalOrderID)
+		assert.Equal(t, periodEnd.AddDate(0, 1, 0), sub.CurrentPeriodEnd)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.Preload("LineItems").First(order, "id = ?", renewalOrderID).Error)
+		assert.Equal(t, sub.ID, order.SubscriptionID)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+		assert.EqualValues(t, 24, order.Total)
+		require.Len(t, order.LineItems, 1)
+		assert.Equal(t, test.Data.firstLineItem.Sku, order.LineItems[0].Sku)
+
+		count := 0
+		require.NoError(t, test.DB.Model(&models.Subscription{}).Where("user_id = ?", test.Data.testUser.ID).Count(&count).Error)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("CanceledAfterRetries", func(t *testing.T) {
+		require.NoError(t, test.DB.Delete(customer).Error)
+		for i := 0; i < maxRenewalAttempts; i++ {
+			require.NoError(t, renewSubscription(ctx, test.DB, testLogger, sub))
+		}
+		assert.Equal(t, models.CanceledState, sub.State)
+		assert.NotNil(t, sub.CanceledAt)
+	})
+}
+
+func TestSubscriptionRenewalResumed(t *testing.T) {
+	test := NewRouteTest(t)
+	calls := []string{}
+	stripe.SetBackend(stripe.APIBackend, subscriptionStripeBackend(t, &calls))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	sub := subscribe(t, test)
+	ctx, err := WithInstanceConfig(context.Background(), conf.SMTPConfiguration{}, test.Config, "")
+	require.NoError(t, err)
+
+	// a renewal that stopped after charging left its transaction pending
+	customer, err := models.GetPaymentCustomer(test.DB, "", test.Data.testUser.ID, payments.StripeProvider)
+	require.NoError(t, err)
+	require.NoError(t, test.DB.Delete(customer).Error)
+	require.NoError(t, renewSubscription(ctx, test.DB, testLogger, sub))
+	require.NoError(t, test.DB.Create(customer).Error)
+
+	order := &models.Order{}
+	require.NoError(t, test.DB.First(order, "id = ?", sub.RenewalOrderID).Error)
+	pending := models.NewTransaction(order)
+	pending.Order = nil
+	pending.Status = models.PendingState
+	require.NoError(t, test.DB.Create(pending).Error)
+
+	keys := []string{}
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) {
+		require.Equal(t, "/charges", path)
+		require.NotNil(t, params.GetParams().IdempotencyKey)
+		keys = append(keys, *params.GetParams().IdempotencyKey)
+		v.(*stripe.Charge).ID = "ch_sub"
+	}))
+
+	require.NoError(t, renewSubscription(ctx, test.DB, testLogger, sub))
+	assert.Equal(t, []string{pending.ID}, keys)
+	assert.Equal(t, models.ActiveState, sub.State)
+
+	trans, err := models.GetTransaction(test.DB, pending.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.PaidState, trans.Status)
+	assert.Equal(t, "ch_sub", trans.ProcessorID)
+
+	count := 0
+	require.NoError(t, test.DB.Model(&models.Transaction{}).Where("order_id = ?", order.ID).Count(&count).Error)
+	assert.Equal(t, 2, count)
+}
+
+func TestSubscriptionStateChanges(t *testing.T) {
+	test := NewRouteTest(t)
+	calls := []string{}
+	stripe.SetBackend(stripe.APIBackend, subscriptionStripeBackend(t, &calls))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	sub := subscribe(t, test)
+	url := "/users/" + test.Data.testUser.ID + "/subscriptions/" + sub.ID
+	change := func(action string) *models.Subscription {
+		recorder := test.TestEndpoint(http.MethodPost, url+"/"+action, nil, test.Data.testUserToken)
+		changed := &models.Subscription{}
+		extractPayload(t, http.StatusOK, recorder, changed)
+		return changed
+	}
+
+	assert.Equal(t, models.PausedState, change("pause").State)
+	recorder := test.TestEndpoint(http.MethodPost, url+"/pause", nil, test.Data.testUserToken)
+	validateError(t, http.StatusBadRequest, recorder, "Only active subscriptions")
+
+	assert.Equal(t, models.ActiveState, change("resume").State)
+
+	canceled := change("cancel")
+	assert.Equal(t, models.CanceledState, canceled.State)
+	assert.NotNil(t, canceled.CanceledAt)
+	recorder = test.TestEndpoint(http.MethodPost, url+"/resume", nil, test.Data.testUserToken)
+	validateError(t, http.StatusBadRequest, recorder, "Only paused subscriptions")
+
+	recorder = test.TestEndpoint(http.MethodPost, url+"/cancel", nil, testToken("someone-else", "else@example.com"))
+	validateError(t, http.StatusUnauthorized, recorder)
+}
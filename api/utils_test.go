@@ -377,8 +377,15 @@ func NewRouteTest(t *testing.T) *RouteTest {
 }
 
 func (r *RouteTest) TestEndpoint(method string, url string, body io.Reader, token *jwt.Token) *httptest.ResponseRecorder {
+	return r.TestEndpointWithHeaders(method, url, body, token, nil)
+}
+
+func (r *RouteTest) TestEndpointWithHeaders(method string, url string, body io.Reader, token *jwt.Token, headers map[string]string) *httptest.ResponseRecorder {
 	recorder := httptest.NewRecorder()
 	req := httptest.NewRequest(method, baseURL+url, body)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
 
 	if token != nil {
 		require.NoError(r.T, signHTTPRequest(req, token, r.Config.JWT.Secret))
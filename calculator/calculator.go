@@ -13,30 +13,45 @@ type DiscountItem struct {
 	Type       DiscountType `json:"type"`
 	Percentage uint64       `json:"percentage"`
 	Fixed      uint64       `json:"fixed"`
+
+	// Name is the name of the promotion for promotion discounts and
+	// CouponCode the code of the coupon for coupon discounts.
+	Name       string `json:"name,omitempty"`
+	CouponCode string `json:"coupon_code,omitempty"`
 }
 
 // Price represents the total price of all line items.
 type Price struct {
-	Items []ItemPrice
-
-	Subtotal uint64
-	Discount uint64
-	NetTotal uint64
-	Taxes    uint64
-	Total    int64
+	Items []ItemPrice `json:"items"`
+
+	Subtotal uint64 `json:"subtotal"`
+	Discount uint64 `json:"discount"`
+	NetTotal uint64 `json:"net_total"`
+	Taxes    uint64 `json:"taxes"`
+	Total    int64  `json:"total"`
+
+	// Shipping is the shipping cost before taxes. Its taxes are included in
+	// Taxes.
+	Shipping      uint64 `json:"shipping"`
+	ShippingTaxes uint64 `json:"shipping_taxes"`
+
+	// ReverseCharge is set when no VAT was charged because the buyer
+	// accounts for it.
+	ReverseCharge bool `json:"reverse_charge"`
 }
 
 // ItemPrice is the price of a single line item.
 type ItemPrice struct {
-	Quantity uint64
+	Quantity uint64 `json:"quantity"`
 
-	Subtotal uint64
-	Discount uint64
-	NetTotal uint64
-	Taxes    uint64
-	Total    int64
+	Subtotal uint64 `json:"subtotal"`
+	Discount uint64 `json:"discount"`
+	NetTotal uint64 `json:"net_total"`
+	Taxes    uint64 `json:"taxes"`
+	Total    int64  `json:"total"`
 
-	DiscountItems []DiscountItem
+	DiscountItems []DiscountItem `json:"discount_items"`
+	TaxItems      []TaxItem      `json:"tax_items"`
 }
 
 // PaymentMethods settings
@@ -55,21 +70,39 @@ type PaymentMethods struct {
 // Settings represent the site-wide settings for price calculation.
 type Settings struct {
 	PricesIncludeTaxes bool              `json:"prices_include_taxes"`
-	Taxes              []*Tax            `json:"taxes,omitempty"`
+	Taxes              TaxList           `json:"taxes,omitempty"`
 	MemberDiscounts    []*MemberDiscount `json:"member_discounts,omitempty"`
 	PaymentMethods     *PaymentMethods   `json:"payment_methods,omitempty"`
+	ExchangeRates      *ExchangeRates    `json:"exchange_rates,omitempty"`
+	ShippingZones      []*ShippingZone   `json:"shipping_zones,omitempty"`
+	SellerCountry      string            `json:"seller_country,omitempty"`
+	Promotions         []*Promotion      `json:"promotions,omitempty"`
+
+	// TaxProvider looks up the taxes instead of the Taxes list if it is set.
+	// The taxes are looked up with ResolveTaxes before calculating a price.
+	TaxProvider TaxProvider `json:"-"`
 }
 
-// Tax represents a tax, potentially specific to countries and product types.
+// Tax represents a tax, potentially specific to countries, regions and
+// product types.
 type Tax struct {
-	Percentage   uint64   `json:"percentage"`
-	ProductTypes []string `json:"product_types"`
-	Countries    []string `json:"countries"`
+	Name         string             `json:"name,omitempty"`
+	Percentage   uint64             `json:"percentage"`
+	ProductTypes []string           `json:"product_types"`
+	Countries    []string           `json:"countries"`
+	States       []string           `json:"states,omitempty"`
+	PostalCodes  []*PostalCodeRange `json:"postal_codes,omitempty"`
+
+	// Stack charges the tax in addition to the matching taxes before it.
+	// Compound taxes stack too, but are charged on the price including the
+	// taxes before them.
+	Stack    bool `json:"stack,omitempty"`
+	Compound bool `json:"compound,omitempty"`
 }
 
 type taxAmount struct {
-	price      uint64
-	percentage uint64
+	price uint64
+	taxes []*Tax
 }
 
 // FixedMemberDiscount represents a fixed discount given to members.
@@ -90,10 +123,25 @@ type MemberDiscount struct {
 
 // PriceParameters represents the order information to calculate prices.
 type PriceParameters struct {
-	Country  string
-	Currency string
-	Coupon   Coupon
-	Items    []Item
+	Country    string
+	State      string
+	PostalCode string
+	Currency   string
+	Coupon     Coupon
+	Items      []Item
+
+	// Coupons are applied together with Coupon according to their
+	// CouponRules.
+	Coupons []Coupon
+
+	// ShippingRate is the ID of the chosen shipping rate. The first rate of
+	// the shipping zone is used if it is empty.
+	ShippingRate string
+
+	// VATNumber is the validated VAT number of a business buyer and
+	// SellerCountry the country the seller charges VAT in.
+	VATNumber     string
+	SellerCountry string
 }
 
 // ValidForType returns whether a member discount is valid for a product type.
@@ -182,21 +230,36 @@ func (t *Tax) AppliesTo(country, productType string) bool {
 	return applies
 }
 
-func calculateAmountsForSingleItem(settings *Settings, lineLogger logrus.FieldLogger, jwtClaims map[string]interface{}, params PriceParameters, item Item, multiplier uint64) ItemPrice {
+func calculateAmountsForSingleItem(settings *Settings, lineLogger logrus.FieldLogger, jwtClaims map[string]interface{}, params PriceParameters, item Item, orderFixed []uint64, promotions []DiscountItem, multiplier uint64) ItemPrice {
 	itemPrice := ItemPrice{Quantity: item.GetQuantity()}
 
 	singlePrice := item.PriceInLowestUnit() * multiplier
-	_, itemPrice.Subtotal = calculateTaxes(singlePrice, item, params, settings)
+	_, itemPrice.Subtotal, _ = calculateTaxes(singlePrice, item, params, settings)
 
-	// apply discount to original price
-	coupon := params.Coupon
-	if coupon != nil && coupon.ValidForType(item.ProductType()) && coupon.ValidForProduct(item.ProductSku()) {
+	// apply coupons to the original price, or what is left of it for
+	// sequential coupons
+	for c, coupon := range params.Coupons {
+		if !coupon.ValidForType(item.ProductType()) || !coupon.ValidForProduct(item.ProductSku()) {
+			continue
+		}
+		amountToDiscount := singlePrice
+		if couponRules(coupon).Sequential {
+			amountToDiscount = 0
+			if itemPrice.Discount < singlePrice {
+				amountToDiscount = singlePrice - itemPrice.Discount
+			}
+		}
 		discountItem := DiscountItem{
 			Type:       DiscountTypeCoupon,
 			Percentage: coupon.PercentageDiscount(),
 			Fixed:      coupon.FixedDiscount(params.Currency) * multiplier,
+			CouponCode: couponCode(coupon),
 		}
-		itemPrice.Discount = calculateDiscount(singlePrice, discountItem.Percentage, discountItem.Fixed)
+		if couponRules(coupon).OrderFixed {
+			// the share of the order discount is for the whole quantity
+			discountItem.Fixed = rint(float64(orderFixed[c]) * float64(multiplier) / float64(item.GetQuantity()))
+		}
+		itemPrice.Discount += capDiscount(calculateDiscount(amountToDiscount, discountItem.Percentage, discountItem.Fixed), singlePrice, itemPrice.Discount)
 		itemPrice.DiscountItems = append(itemPrice.DiscountItems, discountItem)
 	}
 	if settings != nil && settings.MemberDiscounts != nil {
@@ -209,18 +272,24 @@ func calculateAmountsForSingleItem(settings *Settings, lineLogger logrus.FieldLo
 					Percentage: discount.Percentage,
 					Fixed:      discount.FixedDiscount(params.Currency) * multiplier,
 				}
-				itemPrice.Discount += calculateDiscount(singlePrice, discountItem.Percentage, discountItem.Fixed)
+				itemPrice.Discount += capDiscount(calculateDiscount(singlePrice, discountItem.Percentage, discountItem.Fixed), singlePrice, itemPrice.Discount)
 				itemPrice.DiscountItems = append(itemPrice.DiscountItems, discountItem)
 			}
 		}
 	}
+	for _, discountItem := range promotions {
+		// promotion amounts are for the whole quantity of the item
+		discountItem.Fixed = rint(float64(discountItem.Fixed) * float64(multiplier) / float64(item.GetQuantity()))
+		itemPrice.Discount += capDiscount(calculateDiscount(singlePrice, discountItem.Percentage, discountItem.Fixed), singlePrice, itemPrice.Discount)
+		itemPrice.DiscountItems = append(itemPrice.DiscountItems, discountItem)
+	}
 
 	discountedPrice := uint64(0)
 	if itemPrice.Discount < singlePrice {
 		discountedPrice = singlePrice - itemPrice.Discount
 	}
 
-	itemPrice.Taxes, itemPrice.NetTotal = calculateTaxes(discountedPrice, item, params, settings)
+	itemPrice.Taxes, itemPrice.NetTotal, itemPrice.TaxItems = calculateTaxes(discountedPrice, item, params, settings)
 	itemPrice.Total = int64(itemPrice.NetTotal + itemPrice.Taxes)
 
 	return itemPrice
@@ -240,13 +309,18 @@ func CalculatePrice(settings *Settings, jwtClaims map[string]interface{}, params
 		}
 	}
 
-	for _, item := range params.Items {
+	params.Coupons = stackCoupons(params, priceLogger)
+	params.Coupon = nil
+
+	orderFixed := orderFixedDiscounts(params)
+	promotions := promotionDiscounts(settings, params)
+	for i, item := range params.Items {
 		lineLogger := priceLogger.WithFields(logrus.Fields{
 			"product_type": item.ProductType(),
 			"product_sku":  item.ProductSku(),
 		})
 
-		itemPrice := calculateAmountsForSingleItem(settings, lineLogger, jwtClaims, params, item, 1)
+		itemPrice := calculateAmountsForSingleItem(settings, lineLogger, jwtClaims, params, item, orderFixed[i], promotions[i], 1)
 
 		lineLogger.WithFields(
 			logrus.Fields{
@@ -260,7 +334,7 @@ func CalculatePrice(settings *Settings, jwtClaims map[string]interface{}, params
 		price.Items = append(price.Items, itemPrice)
 
 		// avoid issues with rounding when multiplying by quantity before taxation
-		itemPriceMultiple := calculateAmountsForSingleItem(settings, lineLogger, jwtClaims, params, item, item.GetQuantity())
+		itemPriceMultiple := calculateAmountsForSingleItem(settings, lineLogger, jwtClaims, params, item, orderFixed[i], promotions[i], item.GetQuantity())
 		price.Subtotal += itemPriceMultiple.Subtotal
 		price.Discount += itemPriceMultiple.Discount
 		price.NetTotal += itemPriceMultiple.NetTotal
@@ -268,18 +342,58 @@ func CalculatePrice(settings *Settings, jwtClaims map[string]interface{}, params
 		price.Total += itemPriceMultiple.Total
 	}
 
-	price.Total = int64(price.NetTotal + price.Taxes)
+	shipping, shippingTaxes, err := calculateShipping(settings, params, price.NetTotal+price.Taxes)
+	if err != nil {
+		priceLogger.WithError(err).Warn("Failed to calculate shipping")
+	}
+	price.Shipping = shipping
+	price.ShippingTaxes = shippingTaxes
+	price.Taxes += shippingTaxes
+
+	price.ReverseCharge = params.ReverseCharge()
+	price.Total = int64(price.NetTotal + price.Shipping + price.Taxes)
 	priceLogger.WithFields(
 		logrus.Fields{
 			"total_price":    price.Total,
 			"total_discount": price.Discount,
 			"total_net":      price.NetTotal,
 			"total_taxes":    price.Taxes,
+			"total_shipping": price.Shipping,
+			"reverse_charge": price.ReverseCharge,
 		}).Info("calculated total price")
 
 	return price
 }
 
+// CouponSubtotal returns the price before discounts of the items a coupon
+// applies to. The order amount limits of coupons are checked against it.
+func CouponSubtotal(coupon Coupon, items []Item) uint64 {
+	var subtotal uint64
+	for _, item := range items {
+		if coupon.ValidForType(item.ProductType()) && coupon.ValidForProduct(item.ProductSku()) {
+			subtotal += item.PriceInLowestUnit() * item.GetQuantity()
+		}
+	}
+	return subtotal
+}
+
+// ResolveTaxes returns settings with the taxes the tax provider looked up for
+// the price parameters in place of the Taxes list. Settings without a tax
+// provider are returned as they are.
+func ResolveTaxes(settings *Settings, params PriceParameters) (*Settings, error) {
+	if settings == nil || settings.TaxProvider == nil {
+		return settings, nil
+	}
+	taxes, err := settings.TaxProvider.Taxes(params)
+	if err != nil {
+		return nil, err
+	}
+	resolved := *settings
+	resolved.Taxes = taxes
+	resolved.TaxProvider = nil
+	return &resolved, nil
+}
+
 func calculateDiscount(amountToDiscount, percentage, fixed uint64) uint64 {
 	var discount uint64
 	if percentage > 0 {
@@ -293,33 +407,35 @@ func calculateDiscount(amountToDiscount, percentage, fixed uint64) uint64 {
 	return discount
 }
 
-func calculateTaxes(amountToTax uint64, item Item, params PriceParameters, settings *Settings) (taxes uint64, subtotal uint64) {
+// capDiscount limits a discount to what is left of the price after the
+// discounts applied before it.
+func capDiscount(discount, price, discounted uint64) uint64 {
+	if discounted >= price {
+		return 0
+	}
+	if discount > price-discounted {
+		return price - discounted
+	}
+	return discount
+}
+
+func calculateTaxes(amountToTax uint64, item Item, params PriceParameters, settings *Settings) (taxes uint64, subtotal uint64, taxItems []TaxItem) {
 	includeTaxes := settings != nil && settings.PricesIncludeTaxes
 	originalPrice := item.PriceInLowestUnit()
 
 	taxAmounts := []taxAmount{}
 	if item.FixedVAT() != 0 {
-		taxAmounts = append(taxAmounts, taxAmount{price: amountToTax, percentage: item.FixedVAT()})
+		taxAmounts = append(taxAmounts, taxAmount{price: amountToTax, taxes: []*Tax{{Name: "VAT", Percentage: item.FixedVAT()}}})
 	} else if settings != nil && item.TaxableItems() != nil && len(item.TaxableItems()) > 0 {
 		for _, item := range item.TaxableItems() {
 			// because a discount may have been applied we need to determine the real price of this sub-item
 			priceShare := float64(item.PriceInLowestUnit()) / float64(originalPrice)
 			itemPrice := rint(float64(amountToTax) * priceShare)
-			amount := taxAmount{price: itemPrice}
-			for _, t := range settings.Taxes {
-				if t.AppliesTo(params.Country, item.ProductType()) {
-					amount.percentage = t.Percentage
-					break
-				}
-			}
-			taxAmounts = append(taxAmounts, amount)
+			taxAmounts = append(taxAmounts, taxAmount{price: itemPrice, taxes: applicableTaxes(settings, params, item.ProductType())})
 		}
 	} else if settings != nil {
-		for _, t := range settings.Taxes {
-			if t.AppliesTo(params.Country, item.ProductType()) {
-				taxAmounts = append(taxAmounts, taxAmount{price: amountToTax, percentage: t.Percentage})
-				break
-			}
+		if applicable := applicableTaxes(settings, params, item.ProductType()); len(applicable) > 0 {
+			taxAmounts = append(taxAmounts, taxAmount{price: amountToTax, taxes: applicable})
 		}
 	}
 
@@ -329,18 +445,45 @@ func calculateTaxes(amountToTax uint64, item Item, params PriceParameters, setti
 		return
 	}
 
+	reverseCharge := params.ReverseCharge()
 	subtotal = 0
-	for _, tax := range taxAmounts {
+	for _, amount := range taxAmounts {
 		if includeTaxes {
-			tax.price = rint(float64(tax.price) / (100 + float64(tax.percentage)) * 100)
+			amount.price = rint(float64(amount.price) / (100 + taxPercentage(amount.taxes)) * 100)
+		}
+		subtotal += amount.price
+		if reverseCharge {
+			continue
+		}
+
+		var charged uint64
+		for _, tax := range amount.taxes {
+			base := amount.price
+			if tax.Compound {
+				base += charged
+			}
+			value := rint(float64(base) * float64(tax.Percentage) / 100)
+			charged += value
+			taxItems = addTaxItem(taxItems, tax, value)
 		}
-		subtotal += tax.price
-		taxes += rint(float64(tax.price) * float64(tax.percentage) / 100)
+		taxes += charged
 	}
 
 	return
 }
 
+// addTaxItem adds the amount of a tax to the breakdown, merging it with the
+// amounts of the same tax on other sub-items.
+func addTaxItem(items []TaxItem, tax *Tax, amount uint64) []TaxItem {
+	for i := range items {
+		if items[i].Name == tax.Name && items[i].Percentage == tax.Percentage && items[i].Compound == tax.Compound {
+			items[i].Amount += amount
+			return items
+		}
+	}
+	return append(items, TaxItem{Name: tax.Name, Percentage: tax.Percentage, Compound: tax.Compound, Amount: amount})
+}
+
 // Nopes - no `round` method in go
 // See https://github.com/golang/go/blob/master/src/math/floor.go#L58
 
@@ -88,7 +88,7 @@ func validatePrice(t *testing.T, actual Price, expected Price) {
 }
 
 func TestNoItems(t *testing.T) {
-	params := PriceParameters{"USA", "USD", nil, nil}
+	params := PriceParameters{Country: "USA", Currency: "USD"}
 	price := CalculatePrice(nil, nil, params, testLogger)
 	validatePrice(t, price, Price{
 		Subtotal: 0,
@@ -100,7 +100,7 @@ func TestNoItems(t *testing.T) {
 }
 
 func TestNoTaxes(t *testing.T) {
-	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test"}}}
+	params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test"}}}
 	price := CalculatePrice(nil, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -113,7 +113,7 @@ func TestNoTaxes(t *testing.T) {
 }
 
 func TestFixedVAT(t *testing.T) {
-	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
+	params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
 	price := CalculatePrice(nil, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -126,7 +126,7 @@ func TestFixedVAT(t *testing.T) {
 }
 
 func TestFixedVATWhenPricesIncludeTaxes(t *testing.T) {
-	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
+	params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
 	price := CalculatePrice(&Settings{PricesIncludeTaxes: true}, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -147,7 +147,7 @@ func TestCountryBasedVAT(t *testing.T) {
 		}},
 	}
 
-	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test"}}}
+	params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test"}}}
 	price := CalculatePrice(settings, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -161,7 +161,7 @@ func TestCountryBasedVAT(t *testing.T) {
 
 func TestCouponWithNoTaxes(t *testing.T) {
 	coupon := &TestCoupon{itemType: "test", percentage: 10}
-	params := PriceParameters{"USA", "USD", coupon, []Item{&TestItem{price: 100, itemType: "test"}}}
+	params := PriceParameters{Country: "USA", Currency: "USD", Coupon: coupon, Items: []Item{&TestItem{price: 100, itemType: "test"}}}
 	price := CalculatePrice(nil, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -175,7 +175,7 @@ func TestCouponWithNoTaxes(t *testing.T) {
 
 func TestCouponWithVAT(t *testing.T) {
 	coupon := &TestCoupon{itemType: "test", percentage: 10}
-	params := PriceParameters{"USA", "USD", coupon, []Item{&TestItem{price: 100, itemType: "test", vat: 10}}}
+	params := PriceParameters{Country: "USA", Currency: "USD", Coupon: coupon, Items: []Item{&TestItem{price: 100, itemType: "test", vat: 10}}}
 	price := CalculatePrice(nil, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -187,10 +187,40 @@ func TestCouponWithVAT(t *testing.T) {
 	})
 }
 
+func TestCouponWithMinimumAmount(t *testing.T) {
+	coupon := &TestCoupon{itemType: "test", percentage: 10, moreThan: 150}
+	items := []Item{
+		&TestItem{price: 100, itemType: "test", quantity: 1},
+		&TestItem{price: 100, itemType: "other", quantity: 1},
+	}
+	params := PriceParameters{Country: "USA", Currency: "USD", Coupon: coupon, Items: items}
+	assert.Equal(t, uint64(100), CouponSubtotal(coupon, items))
+
+	// only the items the coupon applies to count towards the minimum
+	price := CalculatePrice(nil, nil, params, testLogger)
+	validatePrice(t, price, Price{
+		Subtotal: 200,
+		Discount: 0,
+		NetTotal: 200,
+		Taxes:    0,
+		Total:    200,
+	})
+
+	params.Items[0].(*TestItem).quantity = 2
+	price = CalculatePrice(nil, nil, params, testLogger)
+	validatePrice(t, price, Price{
+		Subtotal: 300,
+		Discount: 20,
+		NetTotal: 280,
+		Taxes:    0,
+		Total:    280,
+	})
+}
+
 func TestCouponWithVATWhenPRiceIncludeTaxes(t *testing.T) {
 	coupon := &TestCoupon{itemType: "test", percentage: 10}
 	settings := &Settings{PricesIncludeTaxes: true}
-	params := PriceParameters{"USA", "USD", coupon, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
+	params := PriceParameters{Country: "USA", Currency: "USD", Coupon: coupon, Items: []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
 	price := CalculatePrice(settings, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -205,7 +235,7 @@ func TestCouponWithVATWhenPRiceIncludeTaxes(t *testing.T) {
 func TestCouponWithVATWhenPRiceIncludeTaxesWithQuantity(t *testing.T) {
 	coupon := &TestCoupon{itemType: "test", percentage: 10}
 	settings := &Settings{PricesIncludeTaxes: true}
-	params := PriceParameters{"USA", "USD", coupon, []Item{&TestItem{quantity: 2, price: 100, itemType: "test", vat: 9}}}
+	params := PriceParameters{Country: "USA", Currency: "USD", Coupon: coupon, Items: []Item{&TestItem{quantity: 2, price: 100, itemType: "test", vat: 9}}}
 	price := CalculatePrice(settings, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -238,7 +268,7 @@ func TestPricingItems(t *testing.T) {
 			itemType: "ebook",
 		}},
 	}
-	params := PriceParameters{"DE", "USD", nil, []Item{item}}
+	params := PriceParameters{Country: "DE", Currency: "USD", Items: []Item{item}}
 	price := CalculatePrice(settings, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -255,7 +285,7 @@ func TestMemberDiscounts(t *testing.T) {
 		Claims:     map[string]string{"app_metadata.plan": "member"},
 		Percentage: 10,
 	}}}
-	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
+	params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
 	price := CalculatePrice(settings, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -269,7 +299,7 @@ func TestMemberDiscounts(t *testing.T) {
 	claims := map[string]interface{}{}
 	require.NoError(t, json.Unmarshal([]byte(`{"app_metadata": {"plan": "member"}}`), &claims))
 
-	params = PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
+	params = PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
 	price = CalculatePrice(settings, claims, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -290,7 +320,7 @@ func TestFixedMemberDiscounts(t *testing.T) {
 		}},
 	}}}
 
-	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
+	params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
 	price := CalculatePrice(settings, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -304,7 +334,7 @@ func TestFixedMemberDiscounts(t *testing.T) {
 	claims := map[string]interface{}{}
 	require.NoError(t, json.Unmarshal([]byte(`{"app_metadata": {"plan": "member"}}`), &claims))
 
-	params = PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
+	params = PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
 	price = CalculatePrice(settings, claims, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -331,7 +361,7 @@ func TestMixedDiscounts(t *testing.T) {
 		price:    3490,
 	}
 
-	params := PriceParameters{"USA", "USD", nil, []Item{item}}
+	params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{item}}
 	price := CalculatePrice(&settings, nil, params, testLogger)
 	assert.Equal(t, 3490, int(price.Total))
 
@@ -382,7 +412,7 @@ func TestRealWorldTaxCalculations(t *testing.T) {
 			itemType: "E-Book",
 		}},
 	}
-	params := PriceParameters{"USA", "USD", nil, []Item{item1, item2}}
+	params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{item1, item2}}
 	price := CalculatePrice(settings, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -421,7 +451,7 @@ func TestRealWorldRelativeDiscountWithTaxes(t *testing.T) {
 	}
 
 	coupon := &TestCoupon{itemType: "book", percentage: 25}
-	params := PriceParameters{"Germany", "EUR", coupon, []Item{item}}
+	params := PriceParameters{Country: "Germany", Currency: "EUR", Coupon: coupon, Items: []Item{item}}
 	price := CalculatePrice(settings, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -476,7 +506,7 @@ func TestRealWorldFixedDiscountWithTaxes(t *testing.T) {
 			},
 		},
 	}
-	params := PriceParameters{"Germany", "EUR", nil, []Item{item}}
+	params := PriceParameters{Country: "Germany", Currency: "EUR", Items: []Item{item}}
 	price := CalculatePrice(settings, claims, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -0,0 +1,92 @@
+package calculator
+
+import (
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CouponRules configure how a coupon is combined with the other coupons of
+// an order and how its discount is applied.
+type CouponRules struct {
+	// Stackable coupons are combined with the other coupons of an order. Of
+	// the coupons that aren't stackable, only the first one is applied.
+	Stackable bool `json:"stackable,omitempty"`
+
+	// Exclusive coupons are applied alone, without any other coupon.
+	Exclusive bool `json:"exclusive,omitempty"`
+
+	// Priority sets the order coupons are applied in, highest first.
+	Priority int `json:"priority,omitempty"`
+
+	// Sequential coupons discount the price left after the coupons applied
+	// before them instead of the original price.
+	Sequential bool `json:"sequential,omitempty"`
+
+	// OrderFixed makes the fixed discount an amount off the whole order. It
+	// is spread over the items the coupon applies to in proportion to their
+	// price, instead of being taken off every unit.
+	OrderFixed bool `json:"order_fixed,omitempty"`
+}
+
+// StackableCoupon is a Coupon with rules for combining it with other
+// coupons. Coupons that don't implement it are not stackable.
+type StackableCoupon interface {
+	Coupon
+	CouponCode() string
+	StackingRules() CouponRules
+}
+
+func couponRules(coupon Coupon) CouponRules {
+	if c, ok := coupon.(StackableCoupon); ok {
+		return c.StackingRules()
+	}
+	return CouponRules{}
+}
+
+func couponCode(coupon Coupon) string {
+	if c, ok := coupon.(StackableCoupon); ok {
+		return c.CouponCode()
+	}
+	return ""
+}
+
+// stackCoupons returns the coupons of the order that apply to its amount, in
+// the order they are applied.
+func stackCoupons(params PriceParameters, log logrus.FieldLogger) []Coupon {
+	coupons := params.Coupons
+	if params.Coupon != nil {
+		coupons = append([]Coupon{params.Coupon}, coupons...)
+	}
+
+	valid := []Coupon{}
+	for _, coupon := range coupons {
+		if !coupon.ValidForPrice(params.Currency, CouponSubtotal(coupon, params.Items)) {
+			log.WithField("coupon", couponCode(coupon)).Info("Coupon is not valid for the order amount")
+			continue
+		}
+		valid = append(valid, coupon)
+	}
+	sort.SliceStable(valid, func(i, j int) bool {
+		return couponRules(valid[i]).Priority > couponRules(valid[j]).Priority
+	})
+
+	for _, coupon := range valid {
+		if couponRules(coupon).Exclusive {
+			return []Coupon{coupon}
+		}
+	}
+
+	applied := []Coupon{}
+	single := false
+	for _, coupon := range valid {
+		if !couponRules(coupon).Stackable {
+			if single {
+				continue
+			}
+			single = true
+		}
+		applied = append(applied, coupon)
+	}
+	return applied
+}
@@ -0,0 +1,105 @@
+package calculator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type TestStackableCoupon struct {
+	TestCoupon
+	code  string
+	rules CouponRules
+}
+
+func (c *TestStackableCoupon) CouponCode() string {
+	return c.code
+}
+
+func (c *TestStackableCoupon) StackingRules() CouponRules {
+	return c.rules
+}
+
+func stackableCoupon(code string, percentage, fixed uint64, rules CouponRules) *TestStackableCoupon {
+	return &TestStackableCoupon{
+		TestCoupon: TestCoupon{itemType: "book", itemSku: "novel", percentage: percentage, fixed: fixed},
+		code:       code,
+		rules:      rules,
+	}
+}
+
+func couponCodes(items []DiscountItem) []string {
+	codes := []string{}
+	for _, item := range items {
+		codes = append(codes, item.CouponCode)
+	}
+	return codes
+}
+
+func TestStackedCoupons(t *testing.T) {
+	items := []Item{&TestItem{sku: "novel", price: 1000, itemType: "book", quantity: 1}}
+
+	t.Run("OriginalPrice", func(t *testing.T) {
+		params := PriceParameters{Currency: "USD", Items: items, Coupons: []Coupon{
+			stackableCoupon("TEN", 10, 0, CouponRules{Stackable: true}),
+			stackableCoupon("TWENTY", 20, 0, CouponRules{Stackable: true}),
+		}}
+		price := CalculatePrice(nil, nil, params, testLogger)
+		validatePrice(t, price, Price{Subtotal: 1000, Discount: 300, NetTotal: 700, Taxes: 0, Total: 700})
+		assert.Equal(t, []string{"TEN", "TWENTY"}, couponCodes(price.Items[0].DiscountItems))
+	})
+
+	t.Run("CappedAtPrice", func(t *testing.T) {
+		params := PriceParameters{Currency: "USD", Items: items, Coupons: []Coupon{
+			stackableCoupon("SIXTY", 60, 0, CouponRules{Stackable: true}),
+			stackableCoupon("SEVENTY", 70, 0, CouponRules{Stackable: true}),
+		}}
+		price := CalculatePrice(nil, nil, params, testLogger)
+		validatePrice(t, price, Price{Subtotal: 1000, Discount: 1000, NetTotal: 0, Taxes: 0, Total: 0})
+		assert.EqualValues(t, 1000, price.Items[0].Discount)
+	})
+
+	t.Run("Sequential", func(t *testing.T) {
+		params := PriceParameters{Currency: "USD", Items: items, Coupons: []Coupon{
+			stackableCoupon("HALF", 50, 0, CouponRules{Stackable: true, Sequential: true, Priority: 1}),
+			stackableCoupon("TWO", 0, 200, CouponRules{Stackable: true, Priority: 2}),
+		}}
+		price := CalculatePrice(nil, nil, params, testLogger)
+		validatePrice(t, price, Price{Subtotal: 1000, Discount: 600, NetTotal: 400, Taxes: 0, Total: 400})
+		assert.Equal(t, []string{"TWO", "HALF"}, couponCodes(price.Items[0].DiscountItems))
+	})
+
+	t.Run("NotStackable", func(t *testing.T) {
+		params := PriceParameters{Currency: "USD", Items: items, Coupons: []Coupon{
+			stackableCoupon("TEN", 10, 0, CouponRules{}),
+			stackableCoupon("TWENTY", 20, 0, CouponRules{Priority: 1}),
+			stackableCoupon("FIVE", 5, 0, CouponRules{Stackable: true}),
+		}}
+		price := CalculatePrice(nil, nil, params, testLogger)
+		assert.EqualValues(t, 250, price.Discount)
+		assert.Equal(t, []string{"TWENTY", "FIVE"}, couponCodes(price.Items[0].DiscountItems))
+	})
+
+	t.Run("Exclusive", func(t *testing.T) {
+		params := PriceParameters{Currency: "USD", Items: items, Coupons: []Coupon{
+			stackableCoupon("TEN", 10, 0, CouponRules{Stackable: true, Priority: 2}),
+			stackableCoupon("ONLY", 15, 0, CouponRules{Exclusive: true}),
+		}}
+		price := CalculatePrice(nil, nil, params, testLogger)
+		assert.EqualValues(t, 150, price.Discount)
+		assert.Equal(t, []string{"ONLY"}, couponCodes(price.Items[0].DiscountItems))
+	})
+
+	t.Run("InvalidForPrice", func(t *testing.T) {
+		large := stackableCoupon("LARGE", 30, 0, CouponRules{Stackable: true, Priority: 1})
+		large.moreThan = 5000
+		params := PriceParameters{Currency: "USD", Items: items, Coupons: []Coupon{
+			large,
+			stackableCoupon("TEN", 10, 0, CouponRules{Stackable: true}),
+		}}
+		price := CalculatePrice(nil, nil, params, testLogger)
+		require.Len(t, price.Items[0].DiscountItems, 1)
+		assert.Equal(t, "TEN", price.Items[0].DiscountItems[0].CouponCode)
+	})
+}
@@ -12,6 +12,7 @@ type DiscountType int
 const (
 	DiscountTypeCoupon DiscountType = iota + 1
 	DiscountTypeMember
+	DiscountTypePromotion
 )
 
 func (t DiscountType) String() string {
@@ -20,6 +21,8 @@ func (t DiscountType) String() string {
 		return "coupon"
 	case DiscountTypeMember:
 		return "member"
+	case DiscountTypePromotion:
+		return "promotion"
 	}
 	return "unknown"
 }
@@ -45,6 +48,8 @@ func (t *DiscountType) UnmarshalJSON(b []byte) error {
 		*t = DiscountTypeCoupon
 	case "member":
 		*t = DiscountTypeMember
+	case "promotion":
+		*t = DiscountTypePromotion
 	default:
 		*t = 0
 	}
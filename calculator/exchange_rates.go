@@ -0,0 +1,91 @@
+package calculator
+
+import (
+	"fmt"
+	"math"
+)
+
+// RoundingModes are the supported values for Rounding.Mode.
+var RoundingModes = []string{"", "nearest", "up", "down"}
+
+// ExchangeRates converts prices from a base currency into currencies a
+// product has no price in. Rates holds how much of a currency one unit of the
+// base currency is worth.
+type ExchangeRates struct {
+	Base     string               `json:"base"`
+	Rates    map[string]float64   `json:"rates"`
+	Rounding map[string]*Rounding `json:"rounding,omitempty"`
+}
+
+// Rounding is the rounding rule for converted prices in a currency.
+type Rounding struct {
+	// Mode is one of nearest (the default), up or down.
+	Mode string `json:"mode"`
+	// Increment rounds to multiples of this many cents, like 5 or 100.
+	Increment uint64 `json:"increment"`
+}
+
+// Validate checks that the table has a base currency, positive rates and
+// known rounding modes.
+func (e *ExchangeRates) Validate() error {
+	if e.Base == "" {
+		return fmt.Errorf("Exchange rates require a base currency")
+	}
+	for currency, rate := range e.Rates {
+		if rate <= 0 {
+			return fmt.Errorf("Exchange rate for %v must be positive", currency)
+		}
+	}
+	for currency, rounding := range e.Rounding {
+		if rounding == nil {
+			continue
+		}
+		valid := false
+		for _, mode := range RoundingModes {
+			if rounding.Mode == mode {
+				valid = true
+			}
+		}
+		if !valid {
+			return fmt.Errorf("Unknown rounding mode %v for %v", rounding.Mode, currency)
+		}
+	}
+	return nil
+}
+
+// Rate returns the exchange rate from the base currency into currency.
+func (e *ExchangeRates) Rate(currency string) (float64, bool) {
+	if currency == e.Base {
+		return 1, true
+	}
+	rate, ok := e.Rates[currency]
+	return rate, ok && rate > 0
+}
+
+// Convert converts an amount in the base currency into currency and rounds it
+// according to the rounding rule of the currency.
+func (e *ExchangeRates) Convert(amount uint64, currency string) (uint64, bool) {
+	rate, ok := e.Rate(currency)
+	if !ok {
+		return 0, false
+	}
+	// drop the noise of the float multiplication before rounding up or down
+	converted := math.Round(float64(amount)*rate*1e6) / 1e6
+
+	rounding := e.Rounding[currency]
+	if rounding == nil {
+		return rint(converted), true
+	}
+	increment := float64(rounding.Increment)
+	if increment == 0 {
+		increment = 1
+	}
+	switch rounding.Mode {
+	case "up":
+		return uint64(math.Ceil(converted/increment) * increment), true
+	case "down":
+		return uint64(math.Floor(converted/increment) * increment), true
+	default:
+		return uint64(math.Round(converted/increment) * increment), true
+	}
+}
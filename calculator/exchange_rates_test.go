@@ -0,0 +1,50 @@
+package calculator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExchangeRatesConvert(t *testing.T) {
+	rates := &ExchangeRates{
+		Base: "USD",
+		Rates: map[string]float64{
+			"EUR": 0.9,
+			"JPY": 151.37,
+			"GBP": 0.7834,
+		},
+		Rounding: map[string]*Rounding{
+			"JPY": {Increment: 100},
+			"GBP": {Mode: "up", Increment: 5},
+		},
+	}
+
+	tests := []struct {
+		currency string
+		amount   uint64
+		expected uint64
+	}{
+		{"USD", 1099, 1099},
+		{"EUR", 1000, 900},
+		{"EUR", 1099, 989},
+		{"JPY", 1099, 166400},
+		{"GBP", 1000, 785},
+		{"GBP", 1100, 865},
+	}
+	for _, test := range tests {
+		converted, ok := rates.Convert(test.amount, test.currency)
+		assert.True(t, ok, test.currency)
+		assert.Equal(t, test.expected, converted, "%v %v", test.amount, test.currency)
+	}
+
+	_, ok := rates.Convert(1000, "CHF")
+	assert.False(t, ok)
+}
+
+func TestExchangeRatesValidate(t *testing.T) {
+	assert.NoError(t, (&ExchangeRates{Base: "USD", Rates: map[string]float64{"EUR": 0.9}}).Validate())
+	assert.Error(t, (&ExchangeRates{Rates: map[string]float64{"EUR": 0.9}}).Validate())
+	assert.Error(t, (&ExchangeRates{Base: "USD", Rates: map[string]float64{"EUR": 0}}).Validate())
+	assert.Error(t, (&ExchangeRates{Base: "USD", Rounding: map[string]*Rounding{"EUR": {Mode: "sideways"}}}).Validate())
+}
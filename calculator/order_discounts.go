@@ -0,0 +1,86 @@
+package calculator
+
+import "sort"
+
+// orderFixedDiscounts spreads the fixed discounts of order coupons over the
+// items they apply to. It returns the share of each item for each coupon,
+// for the whole quantity of the item. The shares are weighted by what is left
+// of the price of each item after the coupons before, so every item can take
+// its whole share.
+func orderFixedDiscounts(params PriceParameters) [][]uint64 {
+	shares := make([][]uint64, len(params.Items))
+	for i := range shares {
+		shares[i] = make([]uint64, len(params.Coupons))
+	}
+
+	// the discount of the coupons applied so far, like
+	// calculateAmountsForSingleItem applies them to the whole quantity
+	discounted := make([]uint64, len(params.Items))
+	for c, coupon := range params.Coupons {
+		rules := couponRules(coupon)
+		weights := make([]uint64, len(params.Items))
+		for i, item := range params.Items {
+			if !coupon.ValidForType(item.ProductType()) || !coupon.ValidForProduct(item.ProductSku()) {
+				continue
+			}
+			price := item.PriceInLowestUnit() * item.GetQuantity()
+			amountToDiscount := price
+			if rules.Sequential {
+				amountToDiscount = capDiscount(price, price, discounted[i])
+			}
+			fixed := coupon.FixedDiscount(params.Currency) * item.GetQuantity()
+			if rules.OrderFixed {
+				fixed = 0
+			}
+			discounted[i] += capDiscount(calculateDiscount(amountToDiscount, coupon.PercentageDiscount(), fixed), price, discounted[i])
+			if rules.OrderFixed {
+				weights[i] = price - discounted[i]
+			}
+		}
+		if !rules.OrderFixed {
+			continue
+		}
+		for i, share := range spreadAmount(coupon.FixedDiscount(params.Currency), weights) {
+			shares[i][c] = share
+			discounted[i] += share
+		}
+	}
+	return shares
+}
+
+// spreadAmount splits an amount in proportion to the weights. The amount is
+// capped at the total weight. Rounding remainders go to the largest
+// fractions so the parts add up to the amount exactly.
+func spreadAmount(amount uint64, weights []uint64) []uint64 {
+	parts := make([]uint64, len(weights))
+	var total uint64
+	for _, w := range weights {
+		total += w
+	}
+	if total == 0 {
+		return parts
+	}
+	if amount > total {
+		amount = total
+	}
+
+	remainders := make([]uint64, len(weights))
+	var spread uint64
+	for i, w := range weights {
+		parts[i] = amount * w / total
+		remainders[i] = amount * w % total
+		spread += parts[i]
+	}
+
+	order := make([]int, len(weights))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return remainders[order[a]] > remainders[order[b]]
+	})
+	for _, i := range order[:amount-spread] {
+		parts[i]++
+	}
+	return parts
+}
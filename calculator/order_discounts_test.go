@@ -0,0 +1,97 @@
+package calculator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type TestOrderCoupon struct {
+	fixed        uint64
+	excludedType string
+}
+
+func (c *TestOrderCoupon) ValidForType(productType string) bool {
+	return productType != c.excludedType
+}
+
+func (c *TestOrderCoupon) ValidForProduct(productSku string) bool {
+	return true
+}
+
+func (c *TestOrderCoupon) ValidForPrice(currency string, price uint64) bool {
+	return true
+}
+
+func (c *TestOrderCoupon) PercentageDiscount() uint64 {
+	return 0
+}
+
+func (c *TestOrderCoupon) FixedDiscount(currency string) uint64 {
+	return c.fixed
+}
+
+func (c *TestOrderCoupon) CouponCode() string {
+	return "ORDER"
+}
+
+func (c *TestOrderCoupon) StackingRules() CouponRules {
+	return CouponRules{OrderFixed: true}
+}
+
+func TestSpreadAmount(t *testing.T) {
+	assert.Equal(t, []uint64{334, 333, 333}, spreadAmount(1000, []uint64{1000, 1000, 1000}))
+	assert.Equal(t, []uint64{667, 0, 333}, spreadAmount(1000, []uint64{2000, 0, 1000}))
+	assert.Equal(t, []uint64{3, 5, 2}, spreadAmount(10, []uint64{333, 500, 167}))
+	assert.Equal(t, []uint64{100, 50}, spreadAmount(1000, []uint64{100, 50}))
+	assert.Equal(t, []uint64{0, 0}, spreadAmount(1000, []uint64{0, 0}))
+}
+
+func TestOrderFixedCoupon(t *testing.T) {
+	params := PriceParameters{
+		Currency: "USD",
+		Coupons:  []Coupon{&TestOrderCoupon{fixed: 1000, excludedType: "gift"}},
+		Items: []Item{
+			&TestItem{sku: "book", price: 1999, itemType: "book", quantity: 1},
+			&TestItem{sku: "pen", price: 333, itemType: "office", quantity: 3},
+			&TestItem{sku: "card", price: 5000, itemType: "gift", quantity: 1},
+		},
+	}
+
+	price := CalculatePrice(nil, nil, params, testLogger)
+	validatePrice(t, price, Price{Subtotal: 7998, Discount: 1000, NetTotal: 6998, Taxes: 0, Total: 6998})
+	assert.EqualValues(t, 667, price.Items[0].Discount)
+	assert.EqualValues(t, 111, price.Items[1].Discount)
+	assert.EqualValues(t, 0, price.Items[2].Discount)
+	assert.Equal(t, "ORDER", price.Items[0].DiscountItems[0].CouponCode)
+}
+
+func TestOrderFixedCouponLargerThanOrder(t *testing.T) {
+	params := PriceParameters{
+		Currency: "USD",
+		Coupons:  []Coupon{&TestOrderCoupon{fixed: 5000}},
+		Items:    []Item{&TestItem{sku: "book", price: 1500, itemType: "book", quantity: 2}},
+	}
+
+	price := CalculatePrice(nil, nil, params, testLogger)
+	validatePrice(t, price, Price{Subtotal: 3000, Discount: 3000, NetTotal: 0, Taxes: 0, Total: 0})
+}
+
+func TestOrderFixedCouponAfterOtherCoupons(t *testing.T) {
+	params := PriceParameters{
+		Currency: "USD",
+		Coupons: []Coupon{
+			stackableCoupon("FREE", 100, 0, CouponRules{Stackable: true, Priority: 1}),
+			&TestOrderCoupon{fixed: 600},
+		},
+		Items: []Item{
+			&TestItem{sku: "novel", price: 1000, itemType: "book", quantity: 1},
+			&TestItem{sku: "pen", price: 1000, itemType: "office", quantity: 1},
+		},
+	}
+
+	price := CalculatePrice(nil, nil, params, testLogger)
+	validatePrice(t, price, Price{Subtotal: 2000, Discount: 1600, NetTotal: 400, Taxes: 0, Total: 400})
+	assert.EqualValues(t, 1000, price.Items[0].Discount)
+	assert.EqualValues(t, 600, price.Items[1].Discount)
+}
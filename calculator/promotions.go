@@ -0,0 +1,230 @@
+package calculator
+
+import "sort"
+
+// Kinds of automatic promotions.
+const (
+	PromotionBuyXGetY     = "buy_x_get_y"
+	PromotionTiered       = "tiered"
+	PromotionBundle       = "bundle"
+	PromotionCheapestFree = "cheapest_free"
+)
+
+// Promotion is a discount that applies to matching orders without a coupon
+// code.
+type Promotion struct {
+	Name         string   `json:"name"`
+	Type         string   `json:"type"`
+	ProductTypes []string `json:"product_types,omitempty"`
+	Products     []string `json:"products,omitempty"`
+
+	// Buy and Get configure a buy_x_get_y promotion: for every Buy units of
+	// a product, Get more units of the same product are free.
+	Buy uint64 `json:"buy,omitempty"`
+	Get uint64 `json:"get,omitempty"`
+
+	// Tiers configure a tiered promotion. The tier with the highest quantity
+	// reached by the matching items gives its percentage off all of them.
+	Tiers []*PromotionTier `json:"tiers,omitempty"`
+
+	// BundlePrice is the price of one of each of the Products in a bundle
+	// promotion, per currency.
+	BundlePrice []*FixedMemberDiscount `json:"bundle_price,omitempty"`
+
+	// Quantity configures a cheapest_free promotion: for every Quantity
+	// matching units in the order, the cheapest one is free.
+	Quantity uint64 `json:"quantity,omitempty"`
+}
+
+// PromotionTier is a percentage discount from a quantity of items on.
+type PromotionTier struct {
+	Quantity   uint64 `json:"quantity"`
+	Percentage uint64 `json:"percentage"`
+}
+
+// ValidForItem returns whether a promotion applies to an item.
+func (p *Promotion) ValidForItem(item Item) bool {
+	if len(p.ProductTypes) > 0 && !containsString(p.ProductTypes, item.ProductType()) {
+		return false
+	}
+	if len(p.Products) > 0 && !containsString(p.Products, item.ProductSku()) {
+		return false
+	}
+	return true
+}
+
+// bundlePrice returns the bundle price in a currency and whether there is one.
+func (p *Promotion) bundlePrice(currency string) (uint64, bool) {
+	for _, price := range p.BundlePrice {
+		if price.Currency == currency {
+			return parseAmount(price.Amount), true
+		}
+	}
+	return 0, false
+}
+
+// promotionDiscounts returns the discounts of the promotions in the settings
+// for each item. Fixed amounts are for the whole quantity of an item.
+func promotionDiscounts(settings *Settings, params PriceParameters) [][]DiscountItem {
+	discounts := make([][]DiscountItem, len(params.Items))
+	if settings == nil {
+		return discounts
+	}
+
+	for _, promotion := range settings.Promotions {
+		var fixed []uint64
+		switch promotion.Type {
+		case PromotionBuyXGetY:
+			fixed = buyXGetYDiscounts(promotion, params.Items)
+		case PromotionTiered:
+			if percentage := tierPercentage(promotion, params.Items); percentage > 0 {
+				for i, item := range params.Items {
+					if promotion.ValidForItem(item) {
+						discounts[i] = append(discounts[i], DiscountItem{Type: DiscountTypePromotion, Name: promotion.Name, Percentage: percentage})
+					}
+				}
+			}
+		case PromotionBundle:
+			fixed = bundleDiscounts(promotion, params.Items, params.Currency)
+		case PromotionCheapestFree:
+			fixed = cheapestFreeDiscounts(promotion, params.Items)
+		}
+
+		for i, amount := range fixed {
+			if amount > 0 {
+				discounts[i] = append(discounts[i], DiscountItem{Type: DiscountTypePromotion, Name: promotion.Name, Fixed: amount})
+			}
+		}
+	}
+	return discounts
+}
+
+func buyXGetYDiscounts(promotion *Promotion, items []Item) []uint64 {
+	fixed := make([]uint64, len(items))
+	if promotion.Buy == 0 || promotion.Get == 0 {
+		return fixed
+	}
+	for i, item := range items {
+		if promotion.ValidForItem(item) {
+			free := item.GetQuantity() / (promotion.Buy + promotion.Get) * promotion.Get
+			fixed[i] = free * item.PriceInLowestUnit()
+		}
+	}
+	return fixed
+}
+
+func tierPercentage(promotion *Promotion, items []Item) uint64 {
+	var quantity uint64
+	for _, item := range items {
+		if promotion.ValidForItem(item) {
+			quantity += item.GetQuantity()
+		}
+	}
+
+	var best *PromotionTier
+	for _, tier := range promotion.Tiers {
+		if tier.Quantity <= quantity && (best == nil || tier.Quantity > best.Quantity) {
+			best = tier
+		}
+	}
+	if best == nil {
+		return 0
+	}
+	return best.Percentage
+}
+
+// bundleDiscounts spreads the savings of each complete bundle over its items
+// in proportion to their prices.
+func bundleDiscounts(promotion *Promotion, items []Item, currency string) []uint64 {
+	fixed := make([]uint64, len(items))
+	bundlePrice, ok := promotion.bundlePrice(currency)
+	if !ok || len(promotion.Products) == 0 {
+		return fixed
+	}
+
+	var regularPrice uint64
+	var bundles uint64
+	for n, sku := range promotion.Products {
+		var quantity, price uint64
+		for _, item := range items {
+			if item.ProductSku() == sku {
+				if quantity == 0 {
+					price = item.PriceInLowestUnit()
+				}
+				quantity += item.GetQuantity()
+			}
+		}
+		if quantity == 0 {
+			return fixed
+		}
+		if n == 0 || quantity < bundles {
+			bundles = quantity
+		}
+		regularPrice += price
+	}
+	if regularPrice <= bundlePrice {
+		return fixed
+	}
+
+	savings := float64(regularPrice - bundlePrice)
+	for _, sku := range promotion.Products {
+		remaining := bundles
+		for i, item := range items {
+			if item.ProductSku() != sku || remaining == 0 {
+				continue
+			}
+			quantity := item.GetQuantity()
+			if quantity > remaining {
+				quantity = remaining
+			}
+			remaining -= quantity
+			share := float64(item.PriceInLowestUnit()) / float64(regularPrice)
+			fixed[i] += rint(float64(quantity) * share * savings)
+		}
+	}
+	return fixed
+}
+
+func cheapestFreeDiscounts(promotion *Promotion, items []Item) []uint64 {
+	fixed := make([]uint64, len(items))
+	if promotion.Quantity == 0 {
+		return fixed
+	}
+
+	// the items are walked by unit price instead of unit by unit, so the
+	// work doesn't grow with the quantities
+	valid := []int{}
+	var units uint64
+	for i, item := range items {
+		if promotion.ValidForItem(item) {
+			valid = append(valid, i)
+			units += item.GetQuantity()
+		}
+	}
+	sort.SliceStable(valid, func(a, b int) bool {
+		return items[valid[a]].PriceInLowestUnit() < items[valid[b]].PriceInLowestUnit()
+	})
+
+	remainingFree := units / promotion.Quantity
+	for _, i := range valid {
+		if remainingFree == 0 {
+			break
+		}
+		free := items[i].GetQuantity()
+		if free > remainingFree {
+			free = remainingFree
+		}
+		fixed[i] += free * items[i].PriceInLowestUnit()
+		remainingFree -= free
+	}
+	return fixed
+}
+
+func containsString(list []string, value string) bool {
+	for _, s := range list {
+		if s == value {
+			return true
+		}
+	}
+	return false
+}
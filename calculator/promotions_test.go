@@ -0,0 +1,118 @@
+package calculator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuyXGetYPromotion(t *testing.T) {
+	settings := &Settings{Promotions: []*Promotion{{Name: "3 for 2", Type: PromotionBuyXGetY, Products: []string{"mug"}, Buy: 2, Get: 1}}}
+	params := PriceParameters{Currency: "USD", Items: []Item{
+		&TestItem{sku: "mug", price: 1000, itemType: "merch", quantity: 7},
+		&TestItem{sku: "shirt", price: 2000, itemType: "merch", quantity: 3},
+	}}
+
+	price := CalculatePrice(settings, nil, params, testLogger)
+	validatePrice(t, price, Price{Subtotal: 13000, Discount: 2000, NetTotal: 11000, Taxes: 0, Total: 11000})
+	require.Len(t, price.Items[0].DiscountItems, 1)
+	assert.Equal(t, DiscountItem{Type: DiscountTypePromotion, Name: "3 for 2", Fixed: 286}, price.Items[0].DiscountItems[0])
+	assert.Empty(t, price.Items[1].DiscountItems)
+}
+
+func TestTieredPromotion(t *testing.T) {
+	settings := &Settings{Promotions: []*Promotion{{
+		Name:         "Book tiers",
+		Type:         PromotionTiered,
+		ProductTypes: []string{"book"},
+		Tiers:        []*PromotionTier{{Quantity: 3, Percentage: 10}, {Quantity: 5, Percentage: 20}},
+	}}}
+	items := func(quantity uint64) []Item {
+		return []Item{
+			&TestItem{sku: "novel", price: 1000, itemType: "book", quantity: quantity},
+			&TestItem{sku: "atlas", price: 2000, itemType: "book", quantity: 1},
+			&TestItem{sku: "poster", price: 500, itemType: "print", quantity: 4},
+		}
+	}
+
+	price := CalculatePrice(settings, nil, PriceParameters{Currency: "USD", Items: items(1)}, testLogger)
+	assert.EqualValues(t, 0, price.Discount)
+
+	price = CalculatePrice(settings, nil, PriceParameters{Currency: "USD", Items: items(2)}, testLogger)
+	assert.EqualValues(t, 400, price.Discount)
+	assert.Equal(t, []DiscountItem{{Type: DiscountTypePromotion, Name: "Book tiers", Percentage: 10}}, price.Items[0].DiscountItems)
+
+	price = CalculatePrice(settings, nil, PriceParameters{Currency: "USD", Items: items(4)}, testLogger)
+	assert.EqualValues(t, 1200, price.Discount)
+	assert.Empty(t, price.Items[2].DiscountItems)
+}
+
+func TestBundlePromotion(t *testing.T) {
+	settings := &Settings{Promotions: []*Promotion{{
+		Name:        "Starter kit",
+		Type:        PromotionBundle,
+		Products:    []string{"camera", "lens"},
+		BundlePrice: []*FixedMemberDiscount{{Amount: "90.00", Currency: "USD"}},
+	}}}
+
+	params := PriceParameters{Currency: "USD", Items: []Item{
+		&TestItem{sku: "camera", price: 8000, itemType: "photo", quantity: 2},
+		&TestItem{sku: "lens", price: 2000, itemType: "photo", quantity: 1},
+	}}
+	price := CalculatePrice(settings, nil, params, testLogger)
+	validatePrice(t, price, Price{Subtotal: 18000, Discount: 1000, NetTotal: 17000, Taxes: 0, Total: 17000})
+	assert.EqualValues(t, 400, price.Items[0].DiscountItems[0].Fixed)
+	assert.EqualValues(t, 200, price.Items[1].DiscountItems[0].Fixed)
+
+	// no bundle without all products or a price in the currency
+	params.Items = params.Items[:1]
+	assert.EqualValues(t, 0, CalculatePrice(settings, nil, params, testLogger).Discount)
+	params.Currency = "EUR"
+	assert.EqualValues(t, 0, CalculatePrice(settings, nil, params, testLogger).Discount)
+}
+
+func TestCheapestFreePromotion(t *testing.T) {
+	settings := &Settings{Promotions: []*Promotion{{Name: "Cheapest free", Type: PromotionCheapestFree, ProductTypes: []string{"shirt"}, Quantity: 3}}}
+	params := PriceParameters{Currency: "USD", Items: []Item{
+		&TestItem{sku: "red", price: 3000, itemType: "shirt", quantity: 3},
+		&TestItem{sku: "blue", price: 2000, itemType: "shirt", quantity: 2},
+		&TestItem{sku: "hat", price: 500, itemType: "hat", quantity: 1},
+	}}
+
+	price := CalculatePrice(settings, nil, params, testLogger)
+	validatePrice(t, price, Price{Subtotal: 13500, Discount: 2000, NetTotal: 11500, Taxes: 0, Total: 11500})
+	assert.Empty(t, price.Items[0].DiscountItems)
+	require.Len(t, price.Items[1].DiscountItems, 1)
+	assert.EqualValues(t, 1000, price.Items[1].DiscountItems[0].Fixed)
+	assert.Empty(t, price.Items[2].DiscountItems)
+}
+
+func TestCheapestFreePromotionLargeQuantity(t *testing.T) {
+	promotion := &Promotion{Type: PromotionCheapestFree, ProductTypes: []string{"shirt"}, Quantity: 2}
+	items := []Item{
+		&TestItem{sku: "red", price: 30, itemType: "shirt", quantity: 1 << 40},
+		&TestItem{sku: "blue", price: 20, itemType: "shirt", quantity: 3},
+	}
+
+	fixed := cheapestFreeDiscounts(promotion, items)
+	assert.Equal(t, []uint64{(1<<39 - 2) * 30, 3 * 20}, fixed)
+}
+
+func TestPromotionWithCoupon(t *testing.T) {
+	settings := &Settings{
+		Taxes:      TaxList{{Percentage: 10}},
+		Promotions: []*Promotion{{Name: "Tiers", Type: PromotionTiered, Tiers: []*PromotionTier{{Quantity: 2, Percentage: 10}}}},
+	}
+	params := PriceParameters{
+		Currency: "USD",
+		Coupon:   &TestCoupon{itemType: "book", itemSku: "novel", percentage: 5},
+		Items:    []Item{&TestItem{sku: "novel", price: 1000, itemType: "book", quantity: 2}},
+	}
+
+	price := CalculatePrice(settings, nil, params, testLogger)
+	validatePrice(t, price, Price{Subtotal: 2000, Discount: 300, NetTotal: 1700, Taxes: 170, Total: 1870})
+	require.Len(t, price.Items[0].DiscountItems, 2)
+	assert.Equal(t, DiscountTypeCoupon, price.Items[0].DiscountItems[0].Type)
+	assert.Equal(t, DiscountTypePromotion, price.Items[0].DiscountItems[1].Type)
+}
@@ -0,0 +1,65 @@
+package calculator
+
+import "strings"
+
+// euCountries maps the member states of the EU VAT area to their ISO codes.
+var euCountries = map[string]string{
+	"austria":        "at",
+	"belgium":        "be",
+	"bulgaria":       "bg",
+	"croatia":        "hr",
+	"cyprus":         "cy",
+	"czech republic": "cz",
+	"czechia":        "cz",
+	"denmark":        "dk",
+	"estonia":        "ee",
+	"finland":        "fi",
+	"france":         "fr",
+	"germany":        "de",
+	"greece":         "gr",
+	"hungary":        "hu",
+	"ireland":        "ie",
+	"italy":          "it",
+	"latvia":         "lv",
+	"lithuania":      "lt",
+	"luxembourg":     "lu",
+	"malta":          "mt",
+	"netherlands":    "nl",
+	"poland":         "pl",
+	"portugal":       "pt",
+	"romania":        "ro",
+	"slovakia":       "sk",
+	"slovenia":       "si",
+	"spain":          "es",
+	"sweden":         "se",
+}
+
+// IsEUCountry returns whether a country, by name or ISO code, is in the EU
+// VAT area.
+func IsEUCountry(country string) bool {
+	return euCountryCode(country) != ""
+}
+
+func euCountryCode(country string) string {
+	country = strings.ToLower(strings.TrimSpace(country))
+	if code, ok := euCountries[country]; ok {
+		return code
+	}
+	for _, code := range euCountries {
+		if code == country {
+			return code
+		}
+	}
+	return ""
+}
+
+// ReverseCharge returns whether the buyer accounts for the VAT instead of the
+// seller. This is the case for sales to businesses with a valid VAT number in
+// another EU country than the seller.
+func (p PriceParameters) ReverseCharge() bool {
+	if p.VATNumber == "" || p.SellerCountry == "" {
+		return false
+	}
+	buyer, seller := euCountryCode(p.Country), euCountryCode(p.SellerCountry)
+	return buyer != "" && seller != "" && buyer != seller
+}
@@ -0,0 +1,63 @@
+package calculator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReverseCharge(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   PriceParameters
+		expected bool
+	}{
+		{"IntraEU", PriceParameters{Country: "Austria", SellerCountry: "Germany", VATNumber: "ATU12345678"}, true},
+		{"ISOCodes", PriceParameters{Country: "AT", SellerCountry: "de", VATNumber: "ATU12345678"}, true},
+		{"NoVATNumber", PriceParameters{Country: "Austria", SellerCountry: "Germany"}, false},
+		{"SameCountry", PriceParameters{Country: "Germany", SellerCountry: "DE", VATNumber: "DE123456789"}, false},
+		{"OutsideEU", PriceParameters{Country: "USA", SellerCountry: "Germany", VATNumber: "123"}, false},
+		{"NoSellerCountry", PriceParameters{Country: "Austria", VATNumber: "ATU12345678"}, false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.params.ReverseCharge(), test.name)
+	}
+}
+
+func TestReverseChargeTaxes(t *testing.T) {
+	settings := &Settings{
+		Taxes: []*Tax{{
+			Percentage:   20,
+			ProductTypes: []string{"test"},
+			Countries:    []string{"Austria"},
+		}},
+	}
+	params := PriceParameters{
+		Country:       "Austria",
+		Currency:      "USD",
+		VATNumber:     "ATU12345678",
+		SellerCountry: "Germany",
+		Items:         []Item{&TestItem{price: 100, itemType: "test", quantity: 1}, &TestItem{price: 100, itemType: "test", quantity: 1, vat: 9}},
+	}
+
+	price := CalculatePrice(settings, nil, params, testLogger)
+	validatePrice(t, price, Price{
+		Subtotal: 200,
+		Discount: 0,
+		NetTotal: 200,
+		Taxes:    0,
+		Total:    200,
+	})
+	assert.True(t, price.ReverseCharge)
+
+	// the VAT included in prices is not charged either
+	settings.PricesIncludeTaxes = true
+	price = CalculatePrice(settings, nil, params, testLogger)
+	assert.EqualValues(t, 0, price.Taxes)
+	assert.EqualValues(t, 175, price.Total)
+
+	params.VATNumber = ""
+	price = CalculatePrice(settings, nil, params, testLogger)
+	assert.EqualValues(t, 200, price.Total)
+	assert.False(t, price.ReverseCharge)
+}
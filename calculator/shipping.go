@@ -0,0 +1,186 @@
+package calculator
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	// FlatShippingRate costs the same for every order.
+	FlatShippingRate = "flat"
+	// WeightShippingRate is priced by the total weight of the order.
+	WeightShippingRate = "weight"
+	// PriceShippingRate is priced by the total of the items in the order.
+	PriceShippingRate = "price"
+)
+
+// ShippingProductType is the product type shipping is taxed as, unless the
+// shipping rate has a fixed VAT.
+const ShippingProductType = "shipping"
+
+// ShippingZone groups the countries that share the same shipping rates. A
+// zone without countries applies to every country no other zone lists.
+type ShippingZone struct {
+	Name      string          `json:"name"`
+	Countries []string        `json:"countries"`
+	Rates     []*ShippingRate `json:"rates"`
+}
+
+// ShippingRate is a shipping option buyers can choose in a zone.
+type ShippingRate struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Type     string `json:"type"`
+	Currency string `json:"currency"`
+
+	// Amount is the price of flat rates, and of weight and price based rates
+	// for orders below their first tier.
+	Amount string          `json:"amount"`
+	Tiers  []*ShippingTier `json:"tiers,omitempty"`
+
+	// FreeAbove waives the shipping costs for orders whose items cost at
+	// least this amount.
+	FreeAbove string `json:"free_above,omitempty"`
+
+	VAT uint64 `json:"vat"`
+}
+
+// ShippingTier is the price of a weight or price based rate for orders that
+// weigh (in grams) or cost at least Min.
+type ShippingTier struct {
+	Min    float64 `json:"min"`
+	Amount string  `json:"amount"`
+}
+
+// WeightedItem is implemented by items that have a shipping weight in grams.
+type WeightedItem interface {
+	ShippingWeight() uint64
+}
+
+// ShippingRates returns the rates available for orders to a country in a
+// currency.
+func (s *Settings) ShippingRates(country, currency string) []*ShippingRate {
+	if s == nil {
+		return nil
+	}
+	zone := s.shippingZone(country)
+	if zone == nil {
+		return nil
+	}
+
+	rates := []*ShippingRate{}
+	for _, rate := range zone.Rates {
+		if rate.Currency == "" || rate.Currency == currency {
+			rates = append(rates, rate)
+		}
+	}
+	return rates
+}
+
+// FindShippingRate returns the rate with the ID for orders to a country in a
+// currency. Without an ID the first rate of the zone is chosen. It returns nil
+// if no shipping zone applies to the country.
+func (s *Settings) FindShippingRate(country, currency, id string) (*ShippingRate, error) {
+	if s == nil || s.shippingZone(country) == nil {
+		if id != "" {
+			return nil, fmt.Errorf("No shipping to %v", country)
+		}
+		return nil, nil
+	}
+
+	for _, rate := range s.ShippingRates(country, currency) {
+		if id == "" || rate.ID == id {
+			return rate, nil
+		}
+	}
+	if id != "" {
+		return nil, fmt.Errorf("Shipping rate %v is not available for %v in %v", id, country, currency)
+	}
+	return nil, fmt.Errorf("No shipping rate available for %v in %v", country, currency)
+}
+
+func (s *Settings) shippingZone(country string) *ShippingZone {
+	var fallback *ShippingZone
+	for _, zone := range s.ShippingZones {
+		if len(zone.Countries) == 0 {
+			if fallback == nil {
+				fallback = zone
+			}
+			continue
+		}
+		for _, c := range zone.Countries {
+			if c == country {
+				return zone
+			}
+		}
+	}
+	return fallback
+}
+
+// Cost returns the shipping costs for items of the given weight and total.
+func (r *ShippingRate) Cost(weight, itemsTotal uint64) uint64 {
+	if r.FreeAbove != "" && itemsTotal >= parseAmount(r.FreeAbove) {
+		return 0
+	}
+
+	amount := r.Amount
+	var measure float64
+	switch r.Type {
+	case WeightShippingRate:
+		measure = float64(weight)
+	case PriceShippingRate:
+		measure = float64(itemsTotal) / 100
+	default:
+		return parseAmount(amount)
+	}
+
+	var reached *ShippingTier
+	for _, tier := range r.Tiers {
+		if measure >= tier.Min && (reached == nil || tier.Min > reached.Min) {
+			reached = tier
+		}
+	}
+	if reached != nil {
+		amount = reached.Amount
+	}
+	return parseAmount(amount)
+}
+
+// shippingItem lets shipping costs be taxed like a line item.
+type shippingItem struct {
+	rate *ShippingRate
+	cost uint64
+}
+
+func (s *shippingItem) ProductSku() string        { return s.rate.ID }
+func (s *shippingItem) PriceInLowestUnit() uint64 { return s.cost }
+func (s *shippingItem) ProductType() string       { return ShippingProductType }
+func (s *shippingItem) FixedVAT() uint64          { return s.rate.VAT }
+func (s *shippingItem) TaxableItems() []Item      { return nil }
+func (s *shippingItem) GetQuantity() uint64       { return 1 }
+
+// calculateShipping returns the shipping costs before taxes and the taxes on
+// them. Shipping is taxed with the VAT of its rate or the taxes that apply to
+// the shipping product type in the country.
+func calculateShipping(settings *Settings, params PriceParameters, itemsTotal uint64) (uint64, uint64, error) {
+	rate, err := settings.FindShippingRate(params.Country, params.Currency, params.ShippingRate)
+	if err != nil || rate == nil {
+		return 0, 0, err
+	}
+
+	var weight uint64
+	for _, item := range params.Items {
+		if weighted, ok := item.(WeightedItem); ok {
+			weight += weighted.ShippingWeight() * item.GetQuantity()
+		}
+	}
+
+	cost := rate.Cost(weight, itemsTotal)
+	taxes, net, _ := calculateTaxes(cost, &shippingItem{rate, cost}, params, settings)
+	return net, taxes, nil
+}
+
+func parseAmount(amount string) uint64 {
+	value, _ := strconv.ParseFloat(amount, 64)
+	return rint(value * 100)
+}
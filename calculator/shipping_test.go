@@ -0,0 +1,139 @@
+package calculator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type weightedTestItem struct {
+	TestItem
+	weight uint64
+}
+
+func (t *weightedTestItem) ShippingWeight() uint64 {
+	return t.weight
+}
+
+func testShippingSettings() *Settings {
+	return &Settings{
+		ShippingZones: []*ShippingZone{{
+			Name:      "Domestic",
+			Countries: []string{"USA"},
+			Rates: []*ShippingRate{
+				{ID: "standard", Type: FlatShippingRate, Amount: "5.00", FreeAbove: "50.00"},
+				{ID: "freight", Type: WeightShippingRate, Amount: "4.00", Tiers: []*ShippingTier{
+					{Min: 1000, Amount: "8.00"},
+					{Min: 5000, Amount: "15.00"},
+				}},
+				{ID: "tiered", Type: PriceShippingRate, Amount: "9.00", Tiers: []*ShippingTier{
+					{Min: 10, Amount: "6.00"},
+					{Min: 20, Amount: "3.00"},
+				}},
+			},
+		}, {
+			Name: "International",
+			Rates: []*ShippingRate{
+				{ID: "international", Type: FlatShippingRate, Amount: "20.00", Currency: "USD", VAT: 10},
+			},
+		}},
+	}
+}
+
+func TestShippingFlatRate(t *testing.T) {
+	settings := testShippingSettings()
+	params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 1000, itemType: "test", quantity: 1}}}
+	price := CalculatePrice(settings, nil, params, testLogger)
+
+	assert.Equal(t, uint64(1000), price.NetTotal)
+	assert.Equal(t, uint64(500), price.Shipping)
+	assert.Equal(t, int64(1500), price.Total)
+
+	// free above the threshold
+	params.Items = []Item{&TestItem{price: 5000, itemType: "test", quantity: 1}}
+	price = CalculatePrice(settings, nil, params, testLogger)
+	assert.Equal(t, uint64(0), price.Shipping)
+	assert.Equal(t, int64(5000), price.Total)
+}
+
+func TestShippingWeightRate(t *testing.T) {
+	settings := testShippingSettings()
+	tests := []struct {
+		weight   uint64
+		quantity uint64
+		expected uint64
+	}{
+		{200, 1, 400},
+		{600, 2, 800},
+		{3000, 2, 1500},
+	}
+	for _, test := range tests {
+		item := &weightedTestItem{TestItem{price: 100, itemType: "test", quantity: test.quantity}, test.weight}
+		params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{item}, ShippingRate: "freight"}
+		price := CalculatePrice(settings, nil, params, testLogger)
+		assert.Equal(t, test.expected, price.Shipping, "weight %v x %v", test.weight, test.quantity)
+	}
+}
+
+func TestShippingPriceRate(t *testing.T) {
+	settings := testShippingSettings()
+	tests := []struct {
+		price    uint64
+		expected uint64
+	}{
+		{500, 900},
+		{1000, 600},
+		{2500, 300},
+	}
+	for _, test := range tests {
+		params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: test.price, itemType: "test", quantity: 1}}, ShippingRate: "tiered"}
+		price := CalculatePrice(settings, nil, params, testLogger)
+		assert.Equal(t, test.expected, price.Shipping, "price %v", test.price)
+	}
+}
+
+func TestShippingTaxes(t *testing.T) {
+	settings := testShippingSettings()
+	settings.Taxes = []*Tax{{Percentage: 20, ProductTypes: []string{ShippingProductType}, Countries: []string{"USA"}}}
+
+	params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 1000, itemType: "test", quantity: 1}}}
+	price := CalculatePrice(settings, nil, params, testLogger)
+	assert.Equal(t, uint64(500), price.Shipping)
+	assert.Equal(t, uint64(100), price.ShippingTaxes)
+	assert.Equal(t, uint64(100), price.Taxes)
+	assert.Equal(t, int64(1600), price.Total)
+
+	settings.PricesIncludeTaxes = true
+	price = CalculatePrice(settings, nil, params, testLogger)
+	assert.Equal(t, uint64(417), price.Shipping)
+	assert.Equal(t, uint64(83), price.ShippingTaxes)
+	assert.Equal(t, int64(1500), price.Total)
+
+	// the fixed VAT of a rate takes precedence
+	params.Country = "Germany"
+	price = CalculatePrice(settings, nil, params, testLogger)
+	assert.Equal(t, uint64(1818), price.Shipping)
+	assert.Equal(t, uint64(182), price.ShippingTaxes)
+}
+
+func TestFindShippingRate(t *testing.T) {
+	settings := testShippingSettings()
+
+	rate, err := settings.FindShippingRate("USA", "USD", "")
+	require.NoError(t, err)
+	assert.Equal(t, "standard", rate.ID)
+
+	rate, err = settings.FindShippingRate("France", "USD", "")
+	require.NoError(t, err)
+	assert.Equal(t, "international", rate.ID)
+
+	_, err = settings.FindShippingRate("USA", "USD", "international")
+	assert.Error(t, err)
+	_, err = settings.FindShippingRate("France", "EUR", "")
+	assert.Error(t, err)
+
+	rate, err = (&Settings{}).FindShippingRate("USA", "USD", "")
+	require.NoError(t, err)
+	assert.Nil(t, rate)
+}
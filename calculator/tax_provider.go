@@ -0,0 +1,124 @@
+package calculator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TaxProvider looks up the taxes that apply to an order. The taxes are
+// matched against the items and address like the taxes in the site settings.
+type TaxProvider interface {
+	Taxes(params PriceParameters) ([]*Tax, error)
+}
+
+// TaxList is a fixed list of taxes. It is the tax provider used when the
+// settings have no other one.
+type TaxList []*Tax
+
+// Taxes implements the TaxProvider interface.
+func (l TaxList) Taxes(params PriceParameters) ([]*Tax, error) {
+	return l, nil
+}
+
+// HTTPTaxProvider looks up taxes from an external tax service. It posts the
+// cart and address as JSON to the URL and reads back a list of taxes.
+type HTTPTaxProvider struct {
+	URL      string
+	User     string
+	Password string
+	Client   *http.Client
+}
+
+// taxRequestTimeout is how long the tax service has to answer before the
+// price calculation fails.
+const taxRequestTimeout = 10 * time.Second
+
+type taxRequest struct {
+	Country    string            `json:"country"`
+	State      string            `json:"state,omitempty"`
+	PostalCode string            `json:"postal_code,omitempty"`
+	Currency   string            `json:"currency"`
+	VATNumber  string            `json:"vatnumber,omitempty"`
+	Items      []*taxRequestItem `json:"items"`
+}
+
+type taxRequestItem struct {
+	Sku          string            `json:"sku"`
+	Type         string            `json:"type"`
+	Price        uint64            `json:"price"`
+	Quantity     uint64            `json:"quantity,omitempty"`
+	TaxableItems []*taxRequestItem `json:"taxable_items,omitempty"`
+}
+
+type taxResponse struct {
+	Taxes []*Tax `json:"taxes"`
+}
+
+// NewHTTPTaxProvider creates a tax provider for the tax service at the URL.
+func NewHTTPTaxProvider(url, user, password string) *HTTPTaxProvider {
+	return &HTTPTaxProvider{
+		URL:      url,
+		User:     user,
+		Password: password,
+		Client:   &http.Client{Timeout: taxRequestTimeout},
+	}
+}
+
+// Taxes implements the TaxProvider interface.
+func (p *HTTPTaxProvider) Taxes(params PriceParameters) ([]*Tax, error) {
+	body := &taxRequest{
+		Country:    params.Country,
+		State:      params.State,
+		PostalCode: params.PostalCode,
+		Currency:   params.Currency,
+		VATNumber:  params.VATNumber,
+		Items:      newTaxRequestItems(params.Items),
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.User != "" {
+		req.SetBasicAuth(p.User, p.Password)
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to make request for tax information")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Tax URL returned %v", resp.StatusCode)
+	}
+
+	taxes := &taxResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(taxes); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse response.")
+	}
+	return taxes.Taxes, nil
+}
+
+func newTaxRequestItems(items []Item) []*taxRequestItem {
+	requestItems := []*taxRequestItem{}
+	for _, item := range items {
+		requestItems = append(requestItems, &taxRequestItem{
+			Sku:          item.ProductSku(),
+			Type:         item.ProductType(),
+			Price:        item.PriceInLowestUnit(),
+			Quantity:     item.GetQuantity(),
+			TaxableItems: newTaxRequestItems(item.TaxableItems()),
+		})
+	}
+	return requestItems
+}
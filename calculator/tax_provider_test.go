@@ -0,0 +1,80 @@
+package calculator
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startTaxService(t *testing.T, requests *[]*taxRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "taxes" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		req := &taxRequest{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(req))
+		*requests = append(*requests, req)
+
+		taxes := []*Tax{}
+		if req.State == "CA" {
+			taxes = append(taxes, &Tax{Name: "CA Sales Tax", Percentage: 8})
+		}
+		json.NewEncoder(w).Encode(&taxResponse{Taxes: taxes})
+	}))
+}
+
+func TestHTTPTaxProvider(t *testing.T) {
+	requests := []*taxRequest{}
+	server := startTaxService(t, &requests)
+	defer server.Close()
+
+	settings := &Settings{
+		Taxes:       TaxList{{Percentage: 20}},
+		TaxProvider: NewHTTPTaxProvider(server.URL, "taxes", "secret"),
+	}
+	params := PriceParameters{
+		Country:    "USA",
+		State:      "CA",
+		PostalCode: "94107",
+		Currency:   "USD",
+		Items:      []Item{&TestItem{sku: "book", price: 1000, itemType: "book", quantity: 2}},
+	}
+
+	resolved, err := ResolveTaxes(settings, params)
+	require.NoError(t, err)
+	assert.Nil(t, resolved.TaxProvider)
+	price := CalculatePrice(resolved, nil, params, testLogger)
+	validatePrice(t, price, Price{Subtotal: 2000, NetTotal: 2000, Taxes: 160, Total: 2160})
+	require.Len(t, requests, 1)
+	assert.Equal(t, "94107", requests[0].PostalCode)
+	require.Len(t, requests[0].Items, 1)
+	assert.Equal(t, &taxRequestItem{Sku: "book", Type: "book", Price: 1000, Quantity: 2}, requests[0].Items[0])
+
+	params.State = "NY"
+	resolved, err = ResolveTaxes(settings, params)
+	require.NoError(t, err)
+	price = CalculatePrice(resolved, nil, params, testLogger)
+	assert.EqualValues(t, 0, price.Taxes)
+}
+
+func TestHTTPTaxProviderFailure(t *testing.T) {
+	requests := []*taxRequest{}
+	server := startTaxService(t, &requests)
+	defer server.Close()
+
+	settings := &Settings{
+		Taxes:       TaxList{{Percentage: 20}},
+		TaxProvider: NewHTTPTaxProvider(server.URL, "taxes", "wrong"),
+	}
+	params := PriceParameters{Country: "USA", State: "CA", Currency: "USD", Items: []Item{&TestItem{price: 1000, itemType: "book", quantity: 1}}}
+
+	_, err := ResolveTaxes(settings, params)
+	assert.EqualError(t, err, "Tax URL returned 401")
+	assert.Empty(t, requests)
+}
@@ -0,0 +1,101 @@
+package calculator
+
+import "strings"
+
+// PostalCodeRange matches the postal codes from From to To. Codes are
+// compared by their leading characters, so "94000" to "94999" matches
+// "94107-1234" and "V5K" to "V5Z" matches "V5L 1A1". Without To it only
+// matches codes starting with From.
+type PostalCodeRange struct {
+	From string `json:"from"`
+	To   string `json:"to,omitempty"`
+}
+
+// TaxItem is the amount of a single tax charged on an item.
+type TaxItem struct {
+	Name       string `json:"name,omitempty"`
+	Percentage uint64 `json:"percentage"`
+	Compound   bool   `json:"compound,omitempty"`
+	Amount     uint64 `json:"amount"`
+}
+
+// Contains returns whether the postal code is in the range.
+func (r *PostalCodeRange) Contains(postalCode string) bool {
+	code := normalizePostalCode(postalCode)
+	from := normalizePostalCode(r.From)
+	to := normalizePostalCode(r.To)
+	if to == "" {
+		to = from
+	}
+	return code >= from && postalCodePrefix(code, len(to)) <= to
+}
+
+func normalizePostalCode(code string) string {
+	return strings.ToUpper(strings.Replace(code, " ", "", -1))
+}
+
+func postalCodePrefix(code string, length int) string {
+	if len(code) > length {
+		return code[:length]
+	}
+	return code
+}
+
+// AppliesToRegion determines if the tax applies to the state AND postal code
+// provided.
+func (t *Tax) AppliesToRegion(state, postalCode string) bool {
+	if len(t.States) > 0 {
+		applies := false
+		for _, s := range t.States {
+			if strings.EqualFold(s, state) {
+				applies = true
+				break
+			}
+		}
+		if !applies {
+			return false
+		}
+	}
+	if len(t.PostalCodes) > 0 {
+		for _, r := range t.PostalCodes {
+			if r.Contains(postalCode) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// applicableTaxes returns the taxes charged on a product type. The first
+// matching tax applies, and the matching taxes after it only if they stack.
+func applicableTaxes(settings *Settings, params PriceParameters, productType string) []*Tax {
+	taxes := []*Tax{}
+	if settings == nil {
+		return taxes
+	}
+	for _, t := range settings.Taxes {
+		if !t.AppliesTo(params.Country, productType) || !t.AppliesToRegion(params.State, params.PostalCode) {
+			continue
+		}
+		if len(taxes) > 0 && !t.Stack && !t.Compound {
+			continue
+		}
+		taxes = append(taxes, t)
+	}
+	return taxes
+}
+
+// taxPercentage returns the combined percentage of stacked taxes, including
+// the taxes compound taxes are charged on.
+func taxPercentage(taxes []*Tax) float64 {
+	var total float64
+	for _, t := range taxes {
+		if t.Compound {
+			total += (100 + total) * float64(t.Percentage) / 100
+		} else {
+			total += float64(t.Percentage)
+		}
+	}
+	return total
+}
@@ -0,0 +1,94 @@
+package calculator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostalCodeRange(t *testing.T) {
+	tests := []struct {
+		r        PostalCodeRange
+		code     string
+		expected bool
+	}{
+		{PostalCodeRange{From: "94000", To: "94999"}, "94107", true},
+		{PostalCodeRange{From: "94000", To: "94999"}, "94107-1234", true},
+		{PostalCodeRange{From: "94000", To: "94999"}, "95107", false},
+		{PostalCodeRange{From: "941"}, "94107", true},
+		{PostalCodeRange{From: "941"}, "94207", false},
+		{PostalCodeRange{From: "V5K", To: "V5Z"}, "v5l 1a1", true},
+		{PostalCodeRange{From: "V5K", To: "V5Z"}, "V6A 1A1", false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.r.Contains(test.code), "%v in %v-%v", test.code, test.r.From, test.r.To)
+	}
+}
+
+func TestStateTax(t *testing.T) {
+	settings := &Settings{Taxes: []*Tax{{
+		Name:       "CA Sales Tax",
+		Percentage: 7,
+		Countries:  []string{"USA"},
+		States:     []string{"CA"},
+	}, {
+		Name:        "NYC Sales Tax",
+		Percentage:  9,
+		Countries:   []string{"USA"},
+		PostalCodes: []*PostalCodeRange{{From: "10001", To: "10299"}},
+	}}}
+	items := []Item{&TestItem{price: 1000, itemType: "test", quantity: 1}}
+
+	price := CalculatePrice(settings, nil, PriceParameters{Country: "USA", State: "ca", Currency: "USD", Items: items}, testLogger)
+	assert.EqualValues(t, 70, price.Taxes)
+	require.Len(t, price.Items[0].TaxItems, 1)
+	assert.Equal(t, TaxItem{Name: "CA Sales Tax", Percentage: 7, Amount: 70}, price.Items[0].TaxItems[0])
+
+	price = CalculatePrice(settings, nil, PriceParameters{Country: "USA", State: "NY", PostalCode: "10012", Currency: "USD", Items: items}, testLogger)
+	assert.EqualValues(t, 90, price.Taxes)
+
+	price = CalculatePrice(settings, nil, PriceParameters{Country: "USA", State: "NY", PostalCode: "14201", Currency: "USD", Items: items}, testLogger)
+	assert.EqualValues(t, 0, price.Taxes)
+	assert.Empty(t, price.Items[0].TaxItems)
+}
+
+func TestStackedTaxes(t *testing.T) {
+	gst := &Tax{Name: "GST", Percentage: 5, Countries: []string{"Canada"}}
+	pst := &Tax{Name: "PST", Percentage: 7, Countries: []string{"Canada"}, States: []string{"BC"}, Stack: true}
+	qst := &Tax{Name: "QST", Percentage: 10, Countries: []string{"Canada"}, States: []string{"QC"}, Compound: true}
+	other := &Tax{Name: "Other", Percentage: 20, Countries: []string{"Canada"}}
+	settings := &Settings{Taxes: []*Tax{gst, pst, qst, other}}
+	items := []Item{&TestItem{price: 1000, itemType: "test", quantity: 1}}
+
+	price := CalculatePrice(settings, nil, PriceParameters{Country: "Canada", State: "BC", Currency: "CAD", Items: items}, testLogger)
+	validatePrice(t, price, Price{Subtotal: 1000, NetTotal: 1000, Taxes: 120, Total: 1120})
+	assert.Equal(t, []TaxItem{
+		{Name: "GST", Percentage: 5, Amount: 50},
+		{Name: "PST", Percentage: 7, Amount: 70},
+	}, price.Items[0].TaxItems)
+
+	price = CalculatePrice(settings, nil, PriceParameters{Country: "Canada", State: "QC", Currency: "CAD", Items: items}, testLogger)
+	validatePrice(t, price, Price{Subtotal: 1000, NetTotal: 1000, Taxes: 155, Total: 1155})
+	assert.Equal(t, []TaxItem{
+		{Name: "GST", Percentage: 5, Amount: 50},
+		{Name: "QST", Percentage: 10, Compound: true, Amount: 105},
+	}, price.Items[0].TaxItems)
+
+	price = CalculatePrice(settings, nil, PriceParameters{Country: "Canada", State: "ON", Currency: "CAD", Items: items}, testLogger)
+	validatePrice(t, price, Price{Subtotal: 1000, NetTotal: 1000, Taxes: 50, Total: 1050})
+}
+
+func TestStackedTaxesWhenPricesIncludeTaxes(t *testing.T) {
+	settings := &Settings{
+		PricesIncludeTaxes: true,
+		Taxes: []*Tax{
+			{Name: "GST", Percentage: 5, Countries: []string{"Canada"}},
+			{Name: "QST", Percentage: 10, Countries: []string{"Canada"}, Compound: true},
+		},
+	}
+	items := []Item{&TestItem{price: 1155, itemType: "test", quantity: 1}}
+
+	price := CalculatePrice(settings, nil, PriceParameters{Country: "Canada", Currency: "CAD", Items: items}, testLogger)
+	validatePrice(t, price, Price{Subtotal: 1000, NetTotal: 1000, Taxes: 155, Total: 1155})
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"gocommerce/conf"
+	"gocommerce/coupons"
+	"gocommerce/models"
+)
+
+var couponsCmd = cobra.Command{
+	Use:  "coupons",
+	Long: "Manage the coupons stored in the database",
+}
+
+var generateParams = coupons.GenerateParams{}
+var generateInstanceID, generateTemplate, generateOutput string
+
+var generateCouponsCmd = cobra.Command{
+	Use:  "generate",
+	Long: "Generate random coupon codes from a template and write them as CSV",
+	Run:  generateCoupons,
+}
+
+func init() {
+	flags := generateCouponsCmd.Flags()
+	flags.StringVar(&generateInstanceID, "instance-id", "", "The instance to create the coupons for in multi-instance mode")
+	flags.StringVar(&generateTemplate, "template", "{}", "The coupon the codes are created from as JSON")
+	flags.StringVar(&generateOutput, "output", "", "The CSV file to write the codes to instead of stdout")
+	flags.StringVar(&generateParams.Campaign, "campaign", "", "The campaign the codes are for")
+	flags.IntVar(&generateParams.Count, "count", 0, "The number of codes to generate")
+	flags.StringVar(&generateParams.Prefix, "prefix", "", "The prefix of every code")
+	flags.IntVar(&generateParams.Length, "length", coupons.DefaultCodeLength, "The number of random characters of every code")
+	flags.StringVar(&generateParams.Alphabet, "alphabet", coupons.DefaultCodeAlphabet, "The characters codes are made of")
+	couponsCmd.AddCommand(&generateCouponsCmd)
+}
+
+func generateCoupons(cmd *cobra.Command, args []string) {
+	globalConfig, err := conf.LoadGlobal(configFile)
+	if err != nil {
+		logrus.Fatalf("Failed to load configuration: %+v", err)
+	}
+
+	generateParams.Template = &models.Coupon{}
+	if err := json.Unmarshal([]byte(generateTemplate), generateParams.Template); err != nil {
+		logrus.Fatalf("Invalid coupon template: %+v", err)
+	}
+	if err := generateParams.Validate(); err != nil {
+		logrus.Fatalf("Invalid parameters: %v", err)
+	}
+
+	// the output file is opened first, so the coupons aren't stored without
+	// a way to hand out their codes
+	var out io.Writer = os.Stdout
+	if generateOutput != "" {
+		f, err := os.Create(generateOutput)
+		if err != nil {
+			logrus.Fatalf("Error creating output file: %+v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	db, err := models.Connect(globalConfig)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+
+	warnUnusableCoupons(db, generateInstanceID)
+
+	generated, err := coupons.Generate(db, generateInstanceID, &generateParams)
+	if err != nil {
+		logrus.Fatalf("Error generating coupons: %+v", err)
+	}
+
+	if err := coupons.WriteCSV(out, generated, nil); err != nil {
+		logrus.Fatalf("Error writing coupons: %+v", err)
+	}
+	logrus.Infof("Generated %d coupons for campaign %v", len(generated), generateParams.Campaign)
+}
+
+// warnUnusableCoupons warns if the coupons of the instance aren't looked up
+// in the database, since the generated codes couldn't be used then.
+func warnUnusableCoupons(db *gorm.DB, instanceID string) {
+	var config *conf.Configuration
+	if instanceID == "" {
+		c, err := conf.LoadConfig(configFile)
+		if err != nil {
+			logrus.Fatalf("Failed to load configuration: %+v", err)
+		}
+		config = c
+	} else {
+		instance, err := models.GetInstance(db, instanceID)
+		if err != nil {
+			logrus.Fatalf("Error loading instance: %+v", err)
+		}
+		config = instance.BaseConfig
+	}
+	if config == nil || !coupons.UsesDB(config.Coupons.Source) {
+		logrus.Warnf("Coupons are not looked up in the database, so the generated codes can't be used until the coupon source is '%v' or '%v'", coupons.SourceDB, coupons.SourceBoth)
+	}
+}
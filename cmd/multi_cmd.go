@@ -45,6 +45,8 @@ func multi(cmd *cobra.Command, args []string) {
 	logrus.Infof("GoCommerce API started on: %s", l)
 
 	models.RunHooks(bgDB, logrus.WithField("component", "hooks"))
+	models.RunStockExpiry(bgDB, logrus.WithField("component", "inventory"))
+	api.RunSubscriptions(context.Background(), bgDB, logrus.WithField("component", "subscriptions"))
 
 	api.ListenAndServe(l)
 }
@@ -21,7 +21,7 @@ var rootCmd = cobra.Command{
 // RootCmd will add flags and subcommands to the different commands
 func RootCmd() *cobra.Command {
 	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", "", "The configuration file")
-	rootCmd.AddCommand(&serveCmd, &migrateCmd, &multiCmd, &versionCmd)
+	rootCmd.AddCommand(&serveCmd, &migrateCmd, &multiCmd, &couponsCmd, &versionCmd)
 	return &rootCmd
 }
 
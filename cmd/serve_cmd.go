@@ -42,6 +42,8 @@ func serve(globalConfig *conf.GlobalConfiguration, config *conf.Configuration) {
 	logrus.Infof("GoCommerce API started on: %s", l)
 
 	models.RunHooks(bgDB, logrus.WithField("component", "hooks"))
+	models.RunStockExpiry(bgDB, logrus.WithField("component", "inventory"))
+	api.RunSubscriptions(ctx, bgDB, logrus.WithField("component", "subscriptions"))
 
 	api.ListenAndServe(l)
 }
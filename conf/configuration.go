@@ -64,17 +64,28 @@ type Configuration struct {
 	} `json:"mailer"`
 
 	Payment struct {
+		DelayedCapture bool `json:"delayed_capture" split_words:"true"`
+
 		Stripe struct {
-			Enabled   bool   `json:"enabled"`
-			PublicKey string `json:"public_key" split_words:"true"`
-			SecretKey string `json:"secret_key" split_words:"true"`
+			Enabled       bool   `json:"enabled"`
+			PublicKey     string `json:"public_key" split_words:"true"`
+			SecretKey     string `json:"secret_key" split_words:"true"`
+			WebhookSecret string `json:"webhook_secret" split_words:"true"`
 		} `json:"stripe"`
 		PayPal struct {
-			Enabled  bool   `json:"enabled"`
-			ClientID string `json:"client_id" split_words:"true"`
-			Secret   string `json:"secret"`
-			Env      string `json:"env"`
+			Enabled   bool   `json:"enabled"`
+			ClientID  string `json:"client_id" split_words:"true"`
+			Secret    string `json:"secret"`
+			Env       string `json:"env"`
+			WebhookID string `json:"webhook_id" split_words:"true"`
 		} `json:"paypal"`
+		Offline struct {
+			Enabled         bool   `json:"enabled"`
+			ReferencePrefix string `json:"reference_prefix" split_words:"true"`
+		} `json:"offline"`
+		GiftCard struct {
+			Enabled bool `json:"enabled"`
+		} `json:"gift_card" split_words:"true"`
 	} `json:"payment"`
 
 	Downloads struct {
@@ -86,8 +97,18 @@ type Configuration struct {
 		URL      string `json:"url"`
 		User     string `json:"user"`
 		Password string `json:"password"`
+
+		// Source selects where coupons come from: "url" (the default), "db"
+		// or "both", which merges the two with database coupons first.
+		Source string `json:"source"`
 	} `json:"coupons"`
 
+	Taxes struct {
+		URL      string `json:"url"`
+		User     string `json:"user"`
+		Password string `json:"password"`
+	} `json:"taxes"`
+
 	Webhooks struct {
 		Order   string `json:"order"`
 		Payment string `json:"payment"`
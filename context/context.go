@@ -6,6 +6,7 @@ import (
 	"context"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/jinzhu/gorm"
 
 	"gocommerce/assetstores"
 	"gocommerce/claims"
@@ -36,6 +37,9 @@ const (
 	orderIDKey         = contextKey("order_id")
 	instanceIDKey      = contextKey("instance_id")
 	instanceKey        = contextKey("instance")
+	dbKey              = contextKey("db")
+	rootDBKey          = contextKey("root_db")
+	idempotencyKeyKey  = contextKey("idempotency_key")
 )
 
 // WithConfig adds the tenant configuration to the context.
@@ -252,3 +256,46 @@ func GetInstance(ctx context.Context) *models.Instance {
 	}
 	return obj.(*models.Instance)
 }
+
+// WithDB adds the database transaction of a request to the context.
+func WithDB(ctx context.Context, db *gorm.DB) context.Context {
+	return context.WithValue(ctx, dbKey, db)
+}
+
+// GetDB reads the database transaction of a request from the context.
+func GetDB(ctx context.Context) *gorm.DB {
+	obj := ctx.Value(dbKey)
+	if obj == nil {
+		return nil
+	}
+	return obj.(*gorm.DB)
+}
+
+// WithRootDB adds the database connection outside of the request
+// transaction to the context. Records written through it are kept when the
+// transaction rolls back.
+func WithRootDB(ctx context.Context, db *gorm.DB) context.Context {
+	return context.WithValue(ctx, rootDBKey, db)
+}
+
+// GetRootDB reads the database connection outside of the request
+// transaction from the context.
+func GetRootDB(ctx context.Context) *gorm.DB {
+	obj := ctx.Value(rootDBKey)
+	if obj == nil {
+		return nil
+	}
+	return obj.(*gorm.DB)
+}
+
+// WithIdempotencyKey adds the idempotency key of the request to the context.
+func WithIdempotencyKey(ctx context.Context, key *models.IdempotencyKey) context.Context {
+	return context.WithValue(ctx, idempotencyKeyKey, key)
+}
+
+// GetIdempotencyKey reads the idempotency key of the request from the
+// context. It returns nil if the request has none.
+func GetIdempotencyKey(ctx context.Context) *models.IdempotencyKey {
+	key, _ := ctx.Value(idempotencyKeyKey).(*models.IdempotencyKey)
+	return key
+}
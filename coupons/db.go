@@ -0,0 +1,105 @@
+package coupons
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+
+	"gocommerce/models"
+)
+
+// Coupon sources an instance can be configured with.
+const (
+	SourceURL  = "url"
+	SourceDB   = "db"
+	SourceBoth = "both"
+)
+
+// UsesDB returns whether coupons are looked up in the database with a source.
+func UsesDB(source string) bool {
+	return source == SourceDB || source == SourceBoth
+}
+
+type couponCacheFromDB struct {
+	db         *gorm.DB
+	instanceID string
+}
+
+// NewCouponCacheFromDB creates a coupon cache for the coupons admins stored
+// for an instance. Coupons are read from the database on every lookup.
+func NewCouponCacheFromDB(db *gorm.DB, instanceID string) Cache {
+	return &couponCacheFromDB{db: db, instanceID: instanceID}
+}
+
+func (c *couponCacheFromDB) Lookup(code string) (*models.Coupon, error) {
+	stored, err := models.GetStoredCoupon(c.db, c.instanceID, code)
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil {
+		return nil, &CouponNotFound{}
+	}
+	return stored.Coupon, nil
+}
+
+func (c *couponCacheFromDB) List() (map[string]*models.Coupon, error) {
+	stored, err := models.ListStoredCoupons(c.db, c.instanceID, "")
+	if err != nil {
+		return nil, err
+	}
+	coupons := map[string]*models.Coupon{}
+	for _, s := range stored {
+		coupons[s.Code] = s.Coupon
+	}
+	return coupons, nil
+}
+
+type mergedCache []Cache
+
+// Lookup returns the coupon from the first cache that has it.
+func (m mergedCache) Lookup(code string) (*models.Coupon, error) {
+	for _, cache := range m {
+		coupon, err := cache.Lookup(code)
+		if err == nil {
+			return coupon, nil
+		}
+		if _, ok := err.(*CouponNotFound); !ok {
+			return nil, err
+		}
+	}
+	return nil, &CouponNotFound{}
+}
+
+// List returns the coupons of all caches. A code in an earlier cache hides
+// the same code in later ones.
+func (m mergedCache) List() (map[string]*models.Coupon, error) {
+	coupons := map[string]*models.Coupon{}
+	for i := len(m) - 1; i >= 0; i-- {
+		list, err := m[i].List()
+		if err != nil {
+			return nil, err
+		}
+		for code, coupon := range list {
+			coupons[code] = coupon
+		}
+	}
+	return coupons, nil
+}
+
+// NewCouponCache selects the coupon cache for a coupon source. The URL cache
+// may be nil if the instance has no coupon URL.
+func NewCouponCache(source string, urlCache, dbCache Cache) (Cache, error) {
+	switch source {
+	case "", SourceURL:
+		return urlCache, nil
+	case SourceDB:
+		return dbCache, nil
+	case SourceBoth:
+		if urlCache == nil {
+			return dbCache, nil
+		}
+		return mergedCache{dbCache, urlCache}, nil
+	default:
+		return nil, fmt.Errorf("Unknown coupon source: %v", source)
+	}
+}
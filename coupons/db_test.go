@@ -0,0 +1,78 @@
+package coupons
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gocommerce/models"
+)
+
+type testCache map[string]*models.Coupon
+
+func (c testCache) Lookup(code string) (*models.Coupon, error) {
+	if coupon, ok := c[code]; ok {
+		return coupon, nil
+	}
+	return nil, &CouponNotFound{}
+}
+
+func (c testCache) List() (map[string]*models.Coupon, error) {
+	return c, nil
+}
+
+func TestNewCouponCache(t *testing.T) {
+	urlCache := testCache{
+		"shared": {Code: "shared", Percentage: 10},
+		"url":    {Code: "url", Percentage: 15},
+	}
+	dbCache := testCache{
+		"shared": {Code: "shared", Percentage: 20},
+		"db":     {Code: "db", Percentage: 25},
+	}
+
+	cache, err := NewCouponCache("", urlCache, dbCache)
+	require.NoError(t, err)
+	assert.Equal(t, urlCache, cache)
+
+	cache, err = NewCouponCache(SourceDB, urlCache, dbCache)
+	require.NoError(t, err)
+	assert.Equal(t, dbCache, cache)
+
+	cache, err = NewCouponCache(SourceBoth, nil, dbCache)
+	require.NoError(t, err)
+	assert.Equal(t, dbCache, cache)
+
+	_, err = NewCouponCache("file", urlCache, dbCache)
+	assert.Error(t, err)
+}
+
+func TestMergedCache(t *testing.T) {
+	urlCache := testCache{
+		"shared": {Code: "shared", Percentage: 10},
+		"url":    {Code: "url", Percentage: 15},
+	}
+	dbCache := testCache{
+		"shared": {Code: "shared", Percentage: 20},
+		"db":     {Code: "db", Percentage: 25},
+	}
+	cache, err := NewCouponCache(SourceBoth, urlCache, dbCache)
+	require.NoError(t, err)
+
+	coupon, err := cache.Lookup("shared")
+	require.NoError(t, err)
+	assert.EqualValues(t, 20, coupon.Percentage)
+
+	coupon, err = cache.Lookup("url")
+	require.NoError(t, err)
+	assert.EqualValues(t, 15, coupon.Percentage)
+
+	_, err = cache.Lookup("missing")
+	assert.IsType(t, &CouponNotFound{}, err)
+
+	coupons, err := cache.List()
+	require.NoError(t, err)
+	assert.Len(t, coupons, 3)
+	assert.EqualValues(t, 20, coupons["shared"].Percentage)
+}
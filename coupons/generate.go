@@ -0,0 +1,172 @@
+package coupons
+
+import (
+	"crypto/rand"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"unicode"
+
+	"github.com/jinzhu/gorm"
+
+	"gocommerce/models"
+)
+
+// Defaults and limits for generated coupon codes.
+const (
+	DefaultCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	DefaultCodeLength   = 8
+	MaxCodeLength       = 64
+	MaxGeneratedCodes   = 10000
+)
+
+// GenerateParams configure the generation of coupon codes from a template.
+// Generated coupons are single use unless the template sets MaxRedemptions.
+type GenerateParams struct {
+	Template *models.Coupon `json:"template"`
+	Count    int            `json:"count"`
+	Campaign string         `json:"campaign"`
+	Prefix   string         `json:"prefix"`
+	Length   int            `json:"length"`
+	Alphabet string         `json:"alphabet"`
+}
+
+// Validate checks the parameters and fills in the defaults.
+func (p *GenerateParams) Validate() error {
+	if p.Template == nil {
+		return errors.New("A coupon template is required")
+	}
+	if err := p.Template.CheckAmounts(); err != nil {
+		return err
+	}
+	if p.Count < 1 || p.Count > MaxGeneratedCodes {
+		return fmt.Errorf("The number of codes must be between 1 and %d", MaxGeneratedCodes)
+	}
+	if p.Campaign == "" {
+		return errors.New("A campaign name is required")
+	}
+	if p.Length < 0 || p.Length > MaxCodeLength {
+		return fmt.Errorf("The code length must be between 0 and %d", MaxCodeLength)
+	}
+	if p.Length == 0 {
+		p.Length = DefaultCodeLength
+	}
+	if p.Alphabet == "" {
+		p.Alphabet = DefaultCodeAlphabet
+	}
+	if len(p.Alphabet) < 2 {
+		return errors.New("The alphabet needs at least two characters")
+	}
+	seen := map[rune]bool{}
+	for _, r := range p.Alphabet {
+		if r > unicode.MaxASCII {
+			return errors.New("The alphabet can only contain ASCII characters")
+		}
+		if seen[r] {
+			return fmt.Errorf("The alphabet contains '%c' more than once", r)
+		}
+		seen[r] = true
+	}
+
+	// leave room for random codes to rarely collide
+	var space float64 = 1
+	for i := 0; i < p.Length && space < float64(MaxGeneratedCodes)*100; i++ {
+		space *= float64(len(p.Alphabet))
+	}
+	if space < float64(p.Count)*100 {
+		return errors.New("The code length and alphabet allow too few codes")
+	}
+	return nil
+}
+
+// Generate creates random coupon codes from a template and stores them for
+// an instance. The codes are unique among the coupons stored for it.
+func Generate(db *gorm.DB, instanceID string, params *GenerateParams) ([]*models.StoredCoupon, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+
+	existing, err := models.StoredCouponCodes(db, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	taken := map[string]bool{}
+	for _, code := range existing {
+		taken[code] = true
+	}
+
+	maxRedemptions := params.Template.MaxRedemptions
+	if maxRedemptions == 0 {
+		maxRedemptions = 1
+	}
+
+	generated := []*models.StoredCoupon{}
+	tx := db.Begin()
+	for len(generated) < params.Count {
+		code, err := randomCode(params.Prefix, params.Length, params.Alphabet)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if taken[code] {
+			continue
+		}
+		taken[code] = true
+
+		coupon := *params.Template
+		coupon.Code = code
+		coupon.MaxRedemptions = maxRedemptions
+		stored := models.NewStoredCoupon(instanceID, &coupon)
+		stored.Campaign = params.Campaign
+		if rsp := tx.Create(stored); rsp.Error != nil {
+			tx.Rollback()
+			return nil, rsp.Error
+		}
+		generated = append(generated, stored)
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return generated, nil
+}
+
+// randomCode picks every character with rand.Int so each character of the
+// alphabet is equally likely.
+func randomCode(prefix string, length int, alphabet string) (string, error) {
+	b := make([]byte, length)
+	max := big.NewInt(int64(len(alphabet)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = alphabet[n.Int64()]
+	}
+	return prefix + string(b), nil
+}
+
+// WriteCSV writes coupons with their campaign, usage limit and the number of
+// times they were used as CSV.
+func WriteCSV(w io.Writer, coupons []*models.StoredCoupon, redemptions map[string]uint64) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"code", "campaign", "max_redemptions", "redemptions", "created_at"}); err != nil {
+		return err
+	}
+	for _, c := range coupons {
+		record := []string{
+			c.Code,
+			c.Campaign,
+			strconv.FormatUint(c.Coupon.MaxRedemptions, 10),
+			strconv.FormatUint(redemptions[c.Code], 10),
+			c.CreatedAt.UTC().Format("2006-01-02T15:04:05Z"),
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,59 @@
+package coupons
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gocommerce/models"
+)
+
+func TestGenerateParamsValidate(t *testing.T) {
+	params := &GenerateParams{Template: &models.Coupon{Percentage: 10}, Count: 100, Campaign: "spring"}
+	require.NoError(t, params.Validate())
+	assert.Equal(t, DefaultCodeLength, params.Length)
+	assert.Equal(t, DefaultCodeAlphabet, params.Alphabet)
+
+	invalid := []*GenerateParams{
+		{Count: 100, Campaign: "spring"},
+		{Template: &models.Coupon{}, Count: 0, Campaign: "spring"},
+		{Template: &models.Coupon{}, Count: MaxGeneratedCodes + 1, Campaign: "spring"},
+		{Template: &models.Coupon{}, Count: 100},
+		{Template: &models.Coupon{}, Count: 100, Campaign: "spring", Alphabet: "A"},
+		{Template: &models.Coupon{}, Count: 100, Campaign: "spring", Alphabet: "ÄÖÜ"},
+		{Template: &models.Coupon{}, Count: 100, Campaign: "spring", Alphabet: "AB", Length: 4},
+		{Template: &models.Coupon{}, Count: 100, Campaign: "spring", Alphabet: "ABCA"},
+		{Template: &models.Coupon{}, Count: 100, Campaign: "spring", Length: MaxCodeLength + 1},
+		{Template: &models.Coupon{}, Count: 100, Campaign: "spring", Length: -1},
+		{Template: &models.Coupon{Percentage: 150}, Count: 100, Campaign: "spring"},
+	}
+	for _, p := range invalid {
+		assert.Error(t, p.Validate(), "%+v", p)
+	}
+}
+
+func TestRandomCode(t *testing.T) {
+	code, err := randomCode("SPRING-", 6, "AB")
+	require.NoError(t, err)
+	assert.Len(t, code, 13)
+	assert.True(t, strings.HasPrefix(code, "SPRING-"))
+	assert.Empty(t, strings.Trim(code[7:], "AB"))
+}
+
+func TestWriteCSV(t *testing.T) {
+	created := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	stored := []*models.StoredCoupon{
+		{Code: "SPRING-A", Campaign: "spring", Coupon: &models.Coupon{MaxRedemptions: 1}, CreatedAt: created},
+		{Code: "SPRING-B", Campaign: "spring", Coupon: &models.Coupon{MaxRedemptions: 1}, CreatedAt: created},
+	}
+
+	out := &bytes.Buffer{}
+	require.NoError(t, WriteCSV(out, stored, map[string]uint64{"SPRING-B": 1}))
+	assert.Equal(t, "code,campaign,max_redemptions,redemptions,created_at\n"+
+		"SPRING-A,spring,1,0,2018-03-01T12:00:00Z\n"+
+		"SPRING-B,spring,1,1,2018-03-01T12:00:00Z\n", out.String())
+}
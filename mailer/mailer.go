@@ -105,6 +105,9 @@ const defaultConfirmationTemplate = `<h2>Thank you for your order!</h2>
 </ul>
 
 <p>Total amount: <strong>{{ .Order.Total }}</strong></p>
+{{ if .Order.ReverseCharge }}
+<p>VAT reverse charge: VAT is to be accounted for by the customer ({{ .Order.VATNumber }}).</p>
+{{ end }}
 `
 
 // OrderConfirmationMail sends an order confirmation to the user
@@ -132,6 +135,9 @@ const defaultReceivedTemplate = `<h2>Order Received From {{ .Order.Email }}</h2>
 </ul>
 
 <p>Total amount: <strong>{{ .Order.Total }}</strong></p>
+{{ if .Order.ReverseCharge }}
+<p>VAT reverse charge: VAT is to be accounted for by the customer ({{ .Order.VATNumber }}).</p>
+{{ end }}
 `
 
 // OrderReceivedMail sends a notification to the shop admin
@@ -74,6 +74,39 @@ func AutoMigrate(db *gorm.DB) error {
 		Event{},
 		Instance{},
 		InvoiceNumber{},
+		IdempotencyKey{},
+		ProviderEvent{},
+		GiftCard{},
+		GiftCardEntry{},
+		RefundLineItem{},
+		PaymentCustomer{},
+		Subscription{},
+		ExchangeRateTable{},
+		CouponRedemption{},
+		CouponUsage{},
+		StoredCoupon{},
+		InventoryItem{},
+		StockReservation{},
 	)
 	return db.Error
 }
+
+// forUpdate locks the rows read by a query until the database transaction
+// ends. SQLite has no row locks and locks the whole database on writes
+// instead.
+func forUpdate(tx *gorm.DB) *gorm.DB {
+	if tx.Dialect().GetName() == "sqlite3" {
+		return tx
+	}
+	return tx.Set("gorm:query_option", "FOR UPDATE")
+}
+
+// OutsideTransaction returns the connection to write records that must be
+// kept when tx rolls back. SQLite allows only one writer at a time, so there
+// the records are written in tx.
+func OutsideTransaction(db, tx *gorm.DB) *gorm.DB {
+	if db.Dialect().GetName() == "sqlite3" {
+		return tx
+	}
+	return db
+}
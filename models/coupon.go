@@ -1,9 +1,13 @@
 package models
 
 import (
+	"errors"
+	"fmt"
 	"math"
 	"strconv"
 	"time"
+
+	"gocommerce/calculator"
 )
 
 // FixedAmount represents an amount and currency pair
@@ -22,9 +26,24 @@ type Coupon struct {
 	Percentage  uint64         `json:"percentage,omitempty"`
 	FixedAmount []*FixedAmount `json:"fixed,omitempty"`
 
+	// MinimumAmount and MaximumAmount limit the coupon to orders whose
+	// eligible items cost at least or at most the amount in the currency of
+	// the order. A coupon with a limit is not valid in other currencies.
+	MinimumAmount []*FixedAmount `json:"minimum_amount,omitempty"`
+	MaximumAmount []*FixedAmount `json:"maximum_amount,omitempty"`
+
+	// MaxRedemptions limits how often the coupon can be used by paid orders,
+	// and MaxRedemptionsPerUser how often by the same user or email. A use
+	// is reserved when the payment of an order starts.
+	MaxRedemptions        uint64 `json:"max_redemptions,omitempty"`
+	MaxRedemptionsPerUser uint64 `json:"max_redemptions_per_user,omitempty"`
+
 	ProductTypes []string               `json:"product_types,omitempty"`
 	Products     []string               `json:"products,omitempty"`
 	Claims       map[string]interface{} `json:"claims,omitempty"`
+
+	// CouponRules configure how the coupon combines with other coupons.
+	calculator.CouponRules
 }
 
 // Valid returns whether a coupon is valid or not.
@@ -78,8 +97,58 @@ func (c *Coupon) ValidForType(productType string) bool {
 
 // ValidForPrice returns whether a coupon applies to a specific amount.
 func (c *Coupon) ValidForPrice(currency string, price uint64) bool {
-	// TODO: Support for coupons based on amount
-	return true
+	return c != nil && c.CheckPrice(currency, price) == nil
+}
+
+// CheckPrice returns an error explaining why a coupon doesn't apply to an
+// amount, or nil if it does.
+func (c *Coupon) CheckPrice(currency string, price uint64) error {
+	if len(c.MinimumAmount) > 0 {
+		min := findAmount(c.MinimumAmount, currency)
+		if min == nil {
+			return fmt.Errorf("This coupon is not valid for orders in %v", currency)
+		}
+		if price < parseAmount(min.Amount) {
+			return fmt.Errorf("This coupon requires an order of at least %v %v", min.Amount, currency)
+		}
+	}
+	if len(c.MaximumAmount) > 0 {
+		max := findAmount(c.MaximumAmount, currency)
+		if max == nil {
+			return fmt.Errorf("This coupon is not valid for orders in %v", currency)
+		}
+		if price > parseAmount(max.Amount) {
+			return fmt.Errorf("This coupon is only valid for orders of up to %v %v", max.Amount, currency)
+		}
+	}
+	return nil
+}
+
+// CheckAmounts returns an error if the percentage or a fixed amount of the
+// coupon is invalid.
+func (c *Coupon) CheckAmounts() error {
+	if c.Percentage > 100 {
+		return errors.New("Percentage must be between 0 and 100")
+	}
+	for _, amount := range c.FixedAmount {
+		if amount.Currency == "" {
+			return errors.New("Fixed amounts require a currency")
+		}
+		if _, err := strconv.ParseFloat(amount.Amount, 64); err != nil {
+			return fmt.Errorf("Invalid fixed amount: %v", amount.Amount)
+		}
+	}
+	return nil
+}
+
+// CouponCode returns the code of a Coupon.
+func (c *Coupon) CouponCode() string {
+	return c.Code
+}
+
+// StackingRules returns the rules for combining a Coupon with other coupons.
+func (c *Coupon) StackingRules() calculator.CouponRules {
+	return c.CouponRules
 }
 
 // PercentageDiscount returns the percentage discount of a Coupon.
@@ -89,18 +158,27 @@ func (c *Coupon) PercentageDiscount() uint64 {
 
 // FixedDiscount returns the amount of fixed discount for a Coupon.
 func (c *Coupon) FixedDiscount(currency string) uint64 {
-	if c.FixedAmount != nil {
-		for _, discount := range c.FixedAmount {
-			if discount.Currency == currency {
-				amount, _ := strconv.ParseFloat(discount.Amount, 64)
-				return rint(amount * 100)
-			}
-		}
+	if discount := findAmount(c.FixedAmount, currency); discount != nil {
+		return parseAmount(discount.Amount)
 	}
 
 	return 0
 }
 
+func findAmount(amounts []*FixedAmount, currency string) *FixedAmount {
+	for _, amount := range amounts {
+		if amount.Currency == currency {
+			return amount
+		}
+	}
+	return nil
+}
+
+func parseAmount(amount string) uint64 {
+	value, _ := strconv.ParseFloat(amount, 64)
+	return rint(value * 100)
+}
+
 // Nopes - no `round` method in go
 // See https://gist.github.com/siddontang/1806573b9a8574989ccb
 func rint(x float64) uint64 {
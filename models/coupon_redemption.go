@@ -0,0 +1,251 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// CouponRedemption records the use of a coupon by an order that is paid or
+// being paid.
+type CouponRedemption struct {
+	ID         string `json:"id"`
+	InstanceID string `json:"-" sql:"index"`
+	CouponCode string `json:"coupon_code" gorm:"unique_index:idx_coupon_redemptions_order_coupon"`
+	OrderID    string `json:"order_id" gorm:"unique_index:idx_coupon_redemptions_order_coupon"`
+	UserID     string `json:"user_id,omitempty"`
+	Email      string `json:"email"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the CouponRedemption model.
+func (CouponRedemption) TableName() string {
+	return tableName("coupon_redemptions")
+}
+
+// CouponUsage counts the redemptions of a coupon. Its row is locked by the
+// payments using the coupon, so they check the limits of the coupon one
+// after another.
+type CouponUsage struct {
+	ID         string
+	InstanceID string `gorm:"unique_index:idx_coupon_usages_instance_coupon"`
+	CouponCode string `gorm:"unique_index:idx_coupon_usages_instance_coupon"`
+	Uses       uint64
+}
+
+// TableName returns the database table name for the CouponUsage model.
+func (CouponUsage) TableName() string {
+	return tableName("coupon_usages")
+}
+
+// ensureCouponUsage creates the usage counter of a coupon from its recorded
+// redemptions if it doesn't exist yet.
+func ensureCouponUsage(tx *gorm.DB, instanceID, code string) error {
+	usage := &CouponUsage{}
+	rsp := tx.Where("instance_id = ? AND coupon_code = ?", instanceID, code).First(usage)
+	if rsp.Error == nil || !rsp.RecordNotFound() {
+		return rsp.Error
+	}
+
+	uses, err := CountCouponRedemptions(tx, instanceID, code, "", "")
+	if err != nil {
+		return err
+	}
+	usage = &CouponUsage{
+		ID:         uuid.NewRandom().String(),
+		InstanceID: instanceID,
+		CouponCode: code,
+		Uses:       uses,
+	}
+	return tx.Create(usage).Error
+}
+
+// addCouponUse changes the usage counter of a coupon by delta.
+func addCouponUse(tx *gorm.DB, instanceID, code string, delta int) error {
+	query := tx.Model(&CouponUsage{}).Where("instance_id = ? AND coupon_code = ?", instanceID, code)
+	if delta < 0 {
+		query = query.Where("uses >= ?", -delta)
+	}
+	return query.UpdateColumn("uses", gorm.Expr("uses + ?", delta)).Error
+}
+
+// RedeemCoupons records the use of the coupons of a paid order. Uses that
+// were already recorded are skipped.
+func RedeemCoupons(tx *gorm.DB, order *Order) error {
+	for _, coupon := range order.AllCoupons() {
+		var count int
+		if rsp := tx.Model(&CouponRedemption{}).Where("order_id = ? AND coupon_code = ?", order.ID, coupon.Code).Count(&count); rsp.Error != nil {
+			return rsp.Error
+		}
+		if count > 0 {
+			continue
+		}
+		if err := ensureCouponUsage(tx, order.InstanceID, coupon.Code); err != nil {
+			return err
+		}
+
+		redemption := &CouponRedemption{
+			ID:         uuid.NewRandom().String(),
+			InstanceID: order.InstanceID,
+			CouponCode: coupon.Code,
+			OrderID:    order.ID,
+			UserID:     order.UserID,
+			Email:      order.Email,
+		}
+		if rsp := tx.Create(redemption); rsp.Error != nil {
+			return rsp.Error
+		}
+		if err := addCouponUse(tx, order.InstanceID, coupon.Code, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CouponLimitError is returned when a coupon was used as often as it may be in
+// total, or by the user or email of an order if PerUser is set.
+type CouponLimitError struct {
+	Code    string
+	PerUser bool
+}
+
+func (e *CouponLimitError) Error() string {
+	if e.PerUser {
+		return fmt.Sprintf("The coupon %v has already been used the maximum number of times", e.Code)
+	}
+	return fmt.Sprintf("The coupon %v has been used up", e.Code)
+}
+
+// userRedemptions returns the condition matching the redemptions by a user ID
+// or email. Without either it matches every redemption.
+func userRedemptions(userID, email string) (string, []interface{}) {
+	switch {
+	case userID != "" && email != "":
+		return "(user_id = ? OR email = ?)", []interface{}{userID, email}
+	case userID != "":
+		return "user_id = ?", []interface{}{userID}
+	case email != "":
+		return "email = ?", []interface{}{email}
+	}
+	return "1 = 1", nil
+}
+
+// ReserveCouponRedemptions records the use of the coupons of an order before
+// it is charged, so concurrent payments can't use a coupon more often than it
+// may be. Uses that were already recorded are skipped. It returns a
+// CouponLimitError if a coupon was used up, the transaction must be rolled
+// back then.
+func ReserveCouponRedemptions(tx *gorm.DB, order *Order) error {
+	table := CouponRedemption{}.TableName()
+	userCondition, userArgs := userRedemptions(order.UserID, order.Email)
+
+	for _, coupon := range order.AllCoupons() {
+		var count int
+		if rsp := tx.Model(&CouponRedemption{}).Where("order_id = ? AND coupon_code = ?", order.ID, coupon.Code).Count(&count); rsp.Error != nil {
+			return rsp.Error
+		}
+		if count > 0 {
+			continue
+		}
+		if err := ensureCouponUsage(tx, order.InstanceID, coupon.Code); err != nil {
+			return err
+		}
+
+		// the total uses are checked and counted in a single statement,
+		// which also locks the counter until the transaction ends
+		rsp := tx.Model(&CouponUsage{}).
+			Where("instance_id = ? AND coupon_code = ? AND (? = 0 OR uses < ?)", order.InstanceID, coupon.Code, coupon.MaxRedemptions, coupon.MaxRedemptions).
+			UpdateColumn("uses", gorm.Expr("uses + 1"))
+		if rsp.Error != nil {
+			return rsp.Error
+		}
+		if rsp.RowsAffected == 0 {
+			return &CouponLimitError{Code: coupon.Code}
+		}
+
+		// concurrent payments with the coupon wait for the lock on the
+		// counter, so the uses of the user are counted after theirs were
+		// recorded
+		query := "INSERT INTO " + table + " (id, instance_id, coupon_code, order_id, user_id, email, created_at)" +
+			" SELECT ?, ?, ?, ?, ?, ?, ? FROM" +
+			" (SELECT count(*) AS uses FROM " + table + " WHERE instance_id = ? AND coupon_code = ? AND " + userCondition + ") AS per_user" +
+			" WHERE ? = 0 OR per_user.uses < ?"
+		args := []interface{}{
+			uuid.NewRandom().String(), order.InstanceID, coupon.Code, order.ID, order.UserID, order.Email, time.Now(),
+			order.InstanceID, coupon.Code,
+		}
+		args = append(args, userArgs...)
+		args = append(args, coupon.MaxRedemptionsPerUser, coupon.MaxRedemptionsPerUser)
+
+		rsp = tx.Exec(query, args...)
+		if rsp.Error != nil {
+			return rsp.Error
+		}
+		if rsp.RowsAffected == 0 {
+			return &CouponLimitError{Code: coupon.Code, PerUser: true}
+		}
+	}
+	return nil
+}
+
+// ReleaseCouponRedemptions removes the uses of coupons recorded for an order
+// whose payment failed.
+func ReleaseCouponRedemptions(tx *gorm.DB, orderID string) error {
+	redemptions := []*CouponRedemption{}
+	if rsp := tx.Where("order_id = ?", orderID).Find(&redemptions); rsp.Error != nil {
+		return rsp.Error
+	}
+	for _, redemption := range redemptions {
+		if rsp := tx.Delete(redemption); rsp.Error != nil {
+			return rsp.Error
+		}
+		if err := addCouponUse(tx, redemption.InstanceID, redemption.CouponCode, -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CountCouponRedemptions counts the uses of a coupon. If a user ID or email
+// is given, only the uses by that user or email are counted.
+func CountCouponRedemptions(db *gorm.DB, instanceID, code, userID, email string) (uint64, error) {
+	query := db.Model(&CouponRedemption{}).Where("instance_id = ? AND coupon_code = ?", instanceID, code)
+	if userID != "" || email != "" {
+		condition, args := userRedemptions(userID, email)
+		query = query.Where(condition, args...)
+	}
+
+	var count uint64
+	if rsp := query.Count(&count); rsp.Error != nil {
+		return 0, rsp.Error
+	}
+	return count, nil
+}
+
+// CountAllCouponRedemptions counts the uses of every coupon of an instance by
+// code.
+func CountAllCouponRedemptions(db *gorm.DB, instanceID string) (map[string]uint64, error) {
+	rows, err := db.Model(&CouponRedemption{}).
+		Select("coupon_code, count(*)").
+		Where("instance_id = ?", instanceID).
+		Group("coupon_code").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]uint64{}
+	for rows.Next() {
+		var code string
+		var count uint64
+		if err := rows.Scan(&code, &count); err != nil {
+			return nil, err
+		}
+		counts[code] = count
+	}
+	return counts, rows.Err()
+}
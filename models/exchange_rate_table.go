@@ -0,0 +1,68 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+
+	"gocommerce/calculator"
+)
+
+// ExchangeRateTable holds the exchange rates an admin set for an instance.
+// They take precedence over the exchange rates in the site settings.
+type ExchangeRateTable struct {
+	ID         string `json:"-"`
+	InstanceID string `json:"-" gorm:"unique_index"`
+
+	calculator.ExchangeRates `sql:"-"`
+	RawRates                 string `json:"-" sql:"type:text"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the ExchangeRateTable model.
+func (ExchangeRateTable) TableName() string {
+	return tableName("exchange_rate_tables")
+}
+
+// NewExchangeRateTable creates an ExchangeRateTable for an instance.
+func NewExchangeRateTable(instanceID string, rates calculator.ExchangeRates) *ExchangeRateTable {
+	return &ExchangeRateTable{
+		ID:            uuid.NewRandom().String(),
+		InstanceID:    instanceID,
+		ExchangeRates: rates,
+	}
+}
+
+// BeforeSave database callback.
+func (t *ExchangeRateTable) BeforeSave() error {
+	data, err := json.Marshal(t.ExchangeRates)
+	if err != nil {
+		return err
+	}
+	t.RawRates = string(data)
+	return nil
+}
+
+// AfterFind database callback.
+func (t *ExchangeRateTable) AfterFind() error {
+	if t.RawRates != "" {
+		return json.Unmarshal([]byte(t.RawRates), &t.ExchangeRates)
+	}
+	return nil
+}
+
+// GetExchangeRateTable finds the exchange rates of an instance. It returns nil
+// if no exchange rates were set.
+func GetExchangeRateTable(db *gorm.DB, instanceID string) (*ExchangeRateTable, error) {
+	t := &ExchangeRateTable{}
+	if rsp := db.Where("instance_id = ?", instanceID).First(t); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return t, nil
+}
@@ -0,0 +1,168 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// IssueGiftCardEntryType is the ledger entry type when a gift card is issued.
+const IssueGiftCardEntryType = "issue"
+
+// RedemptionGiftCardEntryType is the ledger entry type when a gift card pays for an order.
+const RedemptionGiftCardEntryType = "redemption"
+
+// RefundGiftCardEntryType is the ledger entry type when a payment is refunded to a gift card.
+const RefundGiftCardEntryType = "refund"
+
+// ErrInsufficientBalance is returned when a gift card doesn't cover a redemption.
+var ErrInsufficientBalance = errors.New("The gift card balance is too low")
+
+// GiftCard is a gift card or store credit with a balance in a single currency.
+// All changes to the balance are recorded as GiftCardEntry rows.
+type GiftCard struct {
+	InstanceID string `json:"-" gorm:"unique_index:idx_gift_cards_instance_code"`
+	ID         string `json:"id"`
+	Code       string `json:"code" gorm:"unique_index:idx_gift_cards_instance_code"`
+
+	// UserID restricts store credit to orders of a single user.
+	UserID string `json:"user_id,omitempty"`
+
+	Currency string `json:"currency"`
+	Balance  uint64 `json:"balance"`
+
+	Entries []*GiftCardEntry `json:"entries,omitempty"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"-"`
+}
+
+// TableName returns the database table name for the GiftCard model.
+func (GiftCard) TableName() string {
+	return tableName("gift_cards")
+}
+
+// GiftCardEntry is a change to the balance of a gift card.
+type GiftCardEntry struct {
+	InstanceID string `json:"-"`
+	ID         string `json:"id"`
+	GiftCardID string `json:"-" sql:"index"`
+
+	Type string `json:"type"`
+
+	// Amount is positive for credits and negative for redemptions.
+	Amount  int64  `json:"amount"`
+	Balance uint64 `json:"balance"`
+
+	OrderID string `json:"order_id,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the GiftCardEntry model.
+func (GiftCardEntry) TableName() string {
+	return tableName("gift_card_entries")
+}
+
+// NewGiftCard issues a new gift card with an initial balance.
+func NewGiftCard(instanceID, code, currency string, amount uint64) *GiftCard {
+	return &GiftCard{
+		InstanceID: instanceID,
+		ID:         uuid.NewRandom().String(),
+		Code:       code,
+		Currency:   currency,
+		Balance:    amount,
+	}
+}
+
+// Create stores a newly issued gift card together with its issue entry.
+func (c *GiftCard) Create(tx *gorm.DB) error {
+	if rsp := tx.Create(c); rsp.Error != nil {
+		return rsp.Error
+	}
+	return c.addEntry(tx, IssueGiftCardEntryType, int64(c.Balance), "")
+}
+
+// Redeem takes an amount off the balance of the gift card. The balance can
+// never become negative, also not with concurrent redemptions.
+func (c *GiftCard) Redeem(tx *gorm.DB, amount uint64, orderID string) (*GiftCardEntry, error) {
+	rsp := tx.Model(c).
+		Where("balance >= ?", amount).
+		UpdateColumn("balance", gorm.Expr("balance - ?", amount))
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	if rsp.RowsAffected == 0 {
+		return nil, ErrInsufficientBalance
+	}
+	return c.reloadWithEntry(tx, RedemptionGiftCardEntryType, -int64(amount), orderID)
+}
+
+// Credit adds an amount to the balance of the gift card.
+func (c *GiftCard) Credit(tx *gorm.DB, entryType string, amount uint64, orderID string) (*GiftCardEntry, error) {
+	rsp := tx.Model(c).UpdateColumn("balance", gorm.Expr("balance + ?", amount))
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return c.reloadWithEntry(tx, entryType, int64(amount), orderID)
+}
+
+func (c *GiftCard) reloadWithEntry(tx *gorm.DB, entryType string, amount int64, orderID string) (*GiftCardEntry, error) {
+	if rsp := tx.First(c, "id = ?", c.ID); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	if err := c.addEntry(tx, entryType, amount, orderID); err != nil {
+		return nil, err
+	}
+	return c.Entries[len(c.Entries)-1], nil
+}
+
+func (c *GiftCard) addEntry(tx *gorm.DB, entryType string, amount int64, orderID string) error {
+	entry := &GiftCardEntry{
+		InstanceID: c.InstanceID,
+		ID:         uuid.NewRandom().String(),
+		GiftCardID: c.ID,
+		Type:       entryType,
+		Amount:     amount,
+		Balance:    c.Balance,
+		OrderID:    orderID,
+	}
+	if rsp := tx.Create(entry); rsp.Error != nil {
+		return rsp.Error
+	}
+	c.Entries = append(c.Entries, entry)
+	return nil
+}
+
+// GetGiftCard finds a gift card of an instance by its code. It returns nil if
+// no such gift card exists.
+func GetGiftCard(db *gorm.DB, instanceID, code string) (*GiftCard, error) {
+	card := &GiftCard{}
+	if rsp := db.Where("instance_id = ? AND code = ?", instanceID, code).First(card); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return card, nil
+}
+
+// GetGiftCardEntry finds a ledger entry together with its gift card. It
+// returns nil if no such entry exists.
+func GetGiftCardEntry(db *gorm.DB, instanceID, id string) (*GiftCardEntry, *GiftCard, error) {
+	entry := &GiftCardEntry{}
+	if rsp := db.Where("instance_id = ? AND id = ?", instanceID, id).First(entry); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil, nil
+		}
+		return nil, nil, rsp.Error
+	}
+	card := &GiftCard{}
+	if rsp := db.First(card, "id = ?", entry.GiftCardID); rsp.Error != nil {
+		return nil, nil, rsp.Error
+	}
+	return entry, card, nil
+}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// IdempotencyKeyTTL is how long a stored idempotency key is honored.
+const IdempotencyKeyTTL = 24 * time.Hour
+
+// IdempotencyKey stores the response of a request made with an
+// Idempotency-Key header, so retries of that request can be replayed.
+type IdempotencyKey struct {
+	ID         string `gorm:"primary_key"`
+	InstanceID string `gorm:"unique_index:idx_idempotency_keys_instance_key"`
+	Key        string `gorm:"column:idempotency_key;unique_index:idx_idempotency_keys_instance_key"`
+
+	RequestHash string
+
+	ResponseCode int
+	ResponseBody string `sql:"type:text"`
+
+	// SideEffects is set once the request did something that can't be
+	// undone, like charging a card. It isn't stored.
+	SideEffects bool `sql:"-"`
+
+	CreatedAt time.Time
+	ExpiresAt time.Time `sql:"index"`
+}
+
+// TableName returns the database table name for the IdempotencyKey model.
+func (IdempotencyKey) TableName() string {
+	return tableName("idempotency_keys")
+}
+
+// NewIdempotencyKey creates a pending IdempotencyKey for a request.
+func NewIdempotencyKey(instanceID, key, requestHash string) *IdempotencyKey {
+	return &IdempotencyKey{
+		ID:          uuid.NewRandom().String(),
+		InstanceID:  instanceID,
+		Key:         key,
+		RequestHash: requestHash,
+		ExpiresAt:   time.Now().Add(IdempotencyKeyTTL),
+	}
+}
+
+// Expired returns whether the key is no longer honored.
+func (k *IdempotencyKey) Expired() bool {
+	return time.Now().After(k.ExpiresAt)
+}
+
+// Completed returns whether a response has been stored for the key.
+func (k *IdempotencyKey) Completed() bool {
+	return k.ResponseCode != 0
+}
+
+// GetIdempotencyKey finds an idempotency key for an instance. It returns nil
+// if the key has not been used yet.
+func GetIdempotencyKey(db *gorm.DB, instanceID, key string) (*IdempotencyKey, error) {
+	k := &IdempotencyKey{}
+	if rsp := db.Where("instance_id = ? AND idempotency_key = ?", instanceID, key).First(k); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return k, nil
+}
@@ -119,8 +119,21 @@ func (i *Instance) BeforeDelete(tx *gorm.DB) error {
 	}
 
 	delModels := map[string]interface{}{
-		"transaction":    Transaction{},
-		"invoice number": InvoiceNumber{},
+		"transaction":         Transaction{},
+		"invoice number":      InvoiceNumber{},
+		"idempotency key":     IdempotencyKey{},
+		"provider event":      ProviderEvent{},
+		"gift card":           GiftCard{},
+		"gift card entry":     GiftCardEntry{},
+		"refund line item":    RefundLineItem{},
+		"payment customer":    PaymentCustomer{},
+		"subscription":        Subscription{},
+		"exchange rate table": ExchangeRateTable{},
+		"coupon redemption":   CouponRedemption{},
+		"coupon usage":        CouponUsage{},
+		"stored coupon":       StoredCoupon{},
+		"inventory item":      InventoryItem{},
+		"stock reservation":   StockReservation{},
 	}
 
 	for name, dm := range delModels {
@@ -0,0 +1,335 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// StockReservationTTL is how long stock stays reserved for an unpaid order.
+const StockReservationTTL = 30 * time.Minute
+
+const stockExpiryPeriod = time.Minute
+
+// ReservedStockState is the state of stock held for an unpaid order.
+const ReservedStockState = "reserved"
+
+// CommittedStockState is the state of stock taken out of the inventory by a
+// paid order.
+const CommittedStockState = "committed"
+
+// ReleasedStockState is the state of stock given back to the inventory
+// because the order expired or its payment failed.
+const ReleasedStockState = "released"
+
+// InventoryItem is the stock of a product SKU. SKUs without an InventoryItem
+// are not tracked and never run out of stock.
+type InventoryItem struct {
+	ID         string `json:"id"`
+	InstanceID string `json:"-" gorm:"unique_index:idx_inventory_items_instance_sku"`
+	Sku        string `json:"sku" gorm:"unique_index:idx_inventory_items_instance_sku"`
+
+	// Quantity is the stock on hand. Reserved is the part of it that is
+	// held for unpaid orders.
+	Quantity int64 `json:"quantity"`
+	Reserved int64 `json:"reserved"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the InventoryItem model.
+func (InventoryItem) TableName() string {
+	return tableName("inventory_items")
+}
+
+// Available returns the stock that can still be ordered.
+func (i *InventoryItem) Available() int64 {
+	return i.Quantity - i.Reserved
+}
+
+// NewInventoryItem creates an InventoryItem for a SKU of an instance.
+func NewInventoryItem(instanceID, sku string, quantity int64) *InventoryItem {
+	return &InventoryItem{
+		ID:         uuid.NewRandom().String(),
+		InstanceID: instanceID,
+		Sku:        sku,
+		Quantity:   quantity,
+	}
+}
+
+// StockReservation is the stock of a SKU held or taken by an order.
+type StockReservation struct {
+	ID         string `json:"id"`
+	InstanceID string `json:"-" sql:"index"`
+	OrderID    string `json:"order_id" gorm:"unique_index:idx_stock_reservations_order_sku"`
+	Sku        string `json:"sku" gorm:"unique_index:idx_stock_reservations_order_sku"`
+
+	Quantity int64  `json:"quantity"`
+	State    string `json:"state"`
+
+	ExpiresAt time.Time `json:"expires_at" sql:"index"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the StockReservation model.
+func (StockReservation) TableName() string {
+	return tableName("stock_reservations")
+}
+
+// InsufficientStockError is returned when there is not enough stock of a
+// SKU for an order.
+type InsufficientStockError struct {
+	Sku       string
+	Available int64
+}
+
+func (e *InsufficientStockError) Error() string {
+	if e.Available <= 0 {
+		return fmt.Sprintf("%v is out of stock", e.Sku)
+	}
+	return fmt.Sprintf("Only %d of %v are left in stock", e.Available, e.Sku)
+}
+
+// GetInventoryItem finds the stock of a SKU. It returns nil if the SKU isn't
+// tracked.
+func GetInventoryItem(db *gorm.DB, instanceID, sku string) (*InventoryItem, error) {
+	item := &InventoryItem{}
+	if rsp := db.Where("instance_id = ? AND sku = ?", instanceID, sku).First(item); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return item, nil
+}
+
+func getStockReservation(tx *gorm.DB, orderID, sku string) (*StockReservation, error) {
+	reservation := &StockReservation{}
+	if rsp := tx.Where("order_id = ? AND sku = ?", orderID, sku).First(reservation); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return reservation, nil
+}
+
+// orderQuantities sums up the quantities of the line items of an order by
+// SKU. The line items are loaded if the order doesn't have them.
+func orderQuantities(tx *gorm.DB, order *Order) ([]string, map[string]int64, error) {
+	items := order.LineItems
+	if len(items) == 0 {
+		if rsp := tx.Where("order_id = ?", order.ID).Find(&items); rsp.Error != nil {
+			return nil, nil, rsp.Error
+		}
+	}
+
+	skus := []string{}
+	quantities := map[string]int64{}
+	for _, item := range items {
+		if _, ok := quantities[item.Sku]; !ok {
+			skus = append(skus, item.Sku)
+		}
+		quantities[item.Sku] += int64(item.Quantity)
+	}
+	return skus, quantities, nil
+}
+
+// ReserveStock holds the stock of the tracked SKUs of an order until it is
+// paid or the reservation expires. Reservations are changed by the difference
+// if the quantity of the order changed, SKUs that were taken by the order are
+// skipped. It returns an InsufficientStockError if a SKU doesn't have enough
+// stock left.
+func ReserveStock(tx *gorm.DB, order *Order) error {
+	skus, quantities, err := orderQuantities(tx, order)
+	if err != nil {
+		return err
+	}
+	for _, sku := range skus {
+		quantity := quantities[sku]
+		item, err := GetInventoryItem(tx, order.InstanceID, sku)
+		if err != nil {
+			return err
+		}
+		if item == nil {
+			continue
+		}
+		reservation, err := getStockReservation(tx, order.ID, sku)
+		if err != nil {
+			return err
+		}
+		if reservation != nil && reservation.State == CommittedStockState {
+			continue
+		}
+		reserve := quantity
+		if reservation != nil && reservation.State == ReservedStockState {
+			if reservation.Quantity == quantity {
+				continue
+			}
+			reserve = quantity - reservation.Quantity
+		}
+
+		// the stock is checked and reserved in a single statement so
+		// concurrent orders can't both take the last items
+		query := tx.Model(&InventoryItem{}).Where("id = ?", item.ID)
+		if reserve > 0 {
+			query = query.Where("quantity - reserved >= ?", reserve)
+		}
+		rsp := query.UpdateColumn("reserved", gorm.Expr("reserved + ?", reserve))
+		if rsp.Error != nil {
+			return rsp.Error
+		}
+		if rsp.RowsAffected == 0 {
+			return &InsufficientStockError{Sku: sku, Available: item.Available()}
+		}
+
+		if reservation == nil {
+			reservation = &StockReservation{
+				ID:         uuid.NewRandom().String(),
+				InstanceID: order.InstanceID,
+				OrderID:    order.ID,
+				Sku:        sku,
+			}
+		}
+		reservation.Quantity = quantity
+		reservation.State = ReservedStockState
+		reservation.ExpiresAt = time.Now().Add(StockReservationTTL)
+		if rsp := tx.Save(reservation); rsp.Error != nil {
+			return rsp.Error
+		}
+	}
+	return nil
+}
+
+// CommitStock takes the stock of a paid order out of the inventory. Stock
+// whose reservation expired is taken as well, even if that leaves the
+// inventory below zero, since the order was paid for.
+func CommitStock(tx *gorm.DB, order *Order) error {
+	skus, quantities, err := orderQuantities(tx, order)
+	if err != nil {
+		return err
+	}
+	for _, sku := range skus {
+		quantity := quantities[sku]
+		item, err := GetInventoryItem(tx, order.InstanceID, sku)
+		if err != nil {
+			return err
+		}
+		if item == nil {
+			continue
+		}
+		reservation, err := getStockReservation(tx, order.ID, sku)
+		if err != nil {
+			return err
+		}
+		if reservation != nil && reservation.State == CommittedStockState {
+			continue
+		}
+
+		updates := map[string]interface{}{"quantity": gorm.Expr("quantity - ?", quantity)}
+		if reservation != nil && reservation.State == ReservedStockState {
+			updates["reserved"] = gorm.Expr("reserved - ?", reservation.Quantity)
+		}
+		if rsp := tx.Model(item).UpdateColumns(updates); rsp.Error != nil {
+			return rsp.Error
+		}
+
+		if reservation == nil {
+			reservation = &StockReservation{
+				ID:         uuid.NewRandom().String(),
+				InstanceID: order.InstanceID,
+				OrderID:    order.ID,
+				Sku:        sku,
+			}
+		}
+		reservation.Quantity = quantity
+		reservation.State = CommittedStockState
+		if rsp := tx.Save(reservation); rsp.Error != nil {
+			return rsp.Error
+		}
+	}
+	return nil
+}
+
+// DeleteInventoryItem stops tracking the stock of a SKU. The open
+// reservations of the SKU are released with it, so they aren't taken from the
+// stock if the SKU is tracked again.
+func DeleteInventoryItem(tx *gorm.DB, item *InventoryItem) error {
+	rsp := tx.Model(&StockReservation{}).
+		Where("instance_id = ? AND sku = ? AND state = ?", item.InstanceID, item.Sku, ReservedStockState).
+		UpdateColumn("state", ReleasedStockState)
+	if rsp.Error != nil {
+		return rsp.Error
+	}
+	return tx.Delete(item).Error
+}
+
+// ReleaseStock gives the stock reserved for an order back to the inventory.
+func ReleaseStock(tx *gorm.DB, orderID string) error {
+	reservations := []*StockReservation{}
+	if rsp := tx.Where("order_id = ? AND state = ?", orderID, ReservedStockState).Find(&reservations); rsp.Error != nil {
+		return rsp.Error
+	}
+	return releaseReservations(tx, reservations)
+}
+
+func releaseReservations(tx *gorm.DB, reservations []*StockReservation) error {
+	for _, reservation := range reservations {
+		rsp := tx.Model(&InventoryItem{}).
+			Where("instance_id = ? AND sku = ?", reservation.InstanceID, reservation.Sku).
+			UpdateColumn("reserved", gorm.Expr("reserved - ?", reservation.Quantity))
+		if rsp.Error != nil {
+			return rsp.Error
+		}
+		if rsp := tx.Model(reservation).UpdateColumn("state", ReleasedStockState); rsp.Error != nil {
+			return rsp.Error
+		}
+	}
+	return nil
+}
+
+// ReleaseExpiredStock releases the reservations that expired, unless their
+// order is partially paid or authorized. It returns the number of released
+// reservations.
+func ReleaseExpiredStock(db *gorm.DB) (int, error) {
+	held := db.Table(Order{}.TableName()).Select("id").Where("payment_state IN (?)", []string{PartiallyPaidState, AuthorizedState}).QueryExpr()
+
+	tx := db.Begin()
+	reservations := []*StockReservation{}
+	rsp := tx.Where("state = ? AND expires_at < ?", ReservedStockState, time.Now()).
+		Where("order_id NOT IN (?)", held).
+		Find(&reservations)
+	if rsp.Error != nil {
+		tx.Rollback()
+		return 0, rsp.Error
+	}
+	if err := releaseReservations(tx, reservations); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return 0, rsp.Error
+	}
+	return len(reservations), nil
+}
+
+// RunStockExpiry creates a goroutine that releases expired stock reservations
+// every minute.
+func RunStockExpiry(db *gorm.DB, log *logrus.Entry) {
+	go func() {
+		for {
+			released, err := ReleaseExpiredStock(db)
+			if err != nil {
+				log.WithError(err).Error("Error releasing expired stock reservations")
+			} else if released > 0 {
+				log.Infof("Released %d expired stock reservations", released)
+			}
+			time.Sleep(stockExpiryPeriod)
+		}
+	}()
+}
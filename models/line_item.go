@@ -36,6 +36,9 @@ type CalculationDetail struct {
 	NetTotal uint64 `json:"net_total"`
 	Taxes    uint64 `json:"taxes"`
 	Total    int64  `json:"total"`
+
+	TaxItems    []calculator.TaxItem `json:"tax_items" sql:"-"`
+	RawTaxItems string               `json:"-" sql:"type:text"`
 }
 
 // LineItem is a single item in an Order.
@@ -61,6 +64,16 @@ type LineItem struct {
 
 	Quantity uint64 `json:"quantity"`
 
+	// Weight is the shipping weight of a single item in grams.
+	Weight uint64 `json:"weight,omitempty"`
+
+	// ExchangeRate is set when the price was converted from the base currency
+	// of the exchange rates.
+	ExchangeRate float64 `json:"exchange_rate,omitempty"`
+
+	Interval      string `json:"interval,omitempty"`
+	IntervalCount uint64 `json:"interval_count,omitempty"`
+
 	MetaData    map[string]interface{} `sql:"-" json:"meta"`
 	RawMetaData string                 `json:"-" sql:"type:text"`
 
@@ -73,8 +86,21 @@ func (LineItem) TableName() string {
 	return tableName("line_items")
 }
 
+// IsSubscription checks if the line item is renewed periodically.
+func (i *LineItem) IsSubscription() bool {
+	return i.Interval != ""
+}
+
 // BeforeSave database callback.
 func (i *LineItem) BeforeSave() error {
+	if i.CalculationDetail != nil && len(i.TaxItems) > 0 {
+		data, err := json.Marshal(i.TaxItems)
+		if err != nil {
+			return err
+		}
+		i.RawTaxItems = string(data)
+	}
+
 	if len(i.MetaData) == 0 {
 		i.RawMetaData = ""
 		return nil
@@ -89,6 +115,11 @@ func (i *LineItem) BeforeSave() error {
 
 // AfterFind database callback.
 func (i *LineItem) AfterFind() error {
+	if i.CalculationDetail != nil && i.RawTaxItems != "" {
+		if err := json.Unmarshal([]byte(i.RawTaxItems), &i.TaxItems); err != nil {
+			return err
+		}
+	}
 	if i.RawMetaData != "" {
 		return json.Unmarshal([]byte(i.RawMetaData), &i.MetaData)
 	}
@@ -178,6 +209,7 @@ type PriceMetadata struct {
 	Claims   map[string]string `json:"claims"`
 
 	cents uint64
+	rate  float64
 }
 
 // PriceMetaItem model
@@ -203,11 +235,17 @@ type LineItemMetadata struct {
 	VAT         uint64          `json:"vat"`
 	Prices      []PriceMetadata `json:"prices"`
 	Type        string          `json:"type"`
+	Weight      uint64          `json:"weight"`
 
 	Downloads []Download      `json:"downloads"`
 	Addons    []AddonMetaItem `json:"addons"`
 
 	Webhook string `json:"webhook"`
+
+	// Interval makes the product a subscription that is renewed every
+	// IntervalCount days, weeks, months or years.
+	Interval      string `json:"interval"`
+	IntervalCount uint64 `json:"interval_count"`
 }
 
 // ProductSku returns the Sku of the line item to match the calculator.Item interface
@@ -247,13 +285,31 @@ func (i *LineItem) GetQuantity() uint64 {
 	return i.Quantity
 }
 
-// Process calculates the price of a LineItem.
-func (i *LineItem) Process(userClaims map[string]interface{}, order *Order, meta *LineItemMetadata) error {
+// ShippingWeight implements the calculator.WeightedItem interface.
+func (i *LineItem) ShippingWeight() uint64 {
+	return i.Weight
+}
+
+// Process calculates the price of a LineItem. Prices missing in the currency
+// of the order are converted with the exchange rates, if there are any.
+func (i *LineItem) Process(userClaims map[string]interface{}, order *Order, meta *LineItemMetadata, rates *calculator.ExchangeRates) error {
 	i.Sku = meta.Sku
 	i.Title = meta.Title
 	i.Description = meta.Description
 	i.VAT = meta.VAT
 	i.Type = meta.Type
+	i.Weight = meta.Weight
+
+	if meta.Interval != "" {
+		if !IsValidSubscriptionInterval(meta.Interval) {
+			return fmt.Errorf("Unknown subscription interval %v for item %v", meta.Interval, i.Sku)
+		}
+		i.Interval = meta.Interval
+		i.IntervalCount = meta.IntervalCount
+		if i.IntervalCount == 0 {
+			i.IntervalCount = 1
+		}
+	}
 
 	for index, addon := range i.AddonItems {
 		var metaAddon *AddonMetaItem
@@ -267,7 +323,7 @@ func (i *LineItem) Process(userClaims map[string]interface{}, order *Order, meta
 			return fmt.Errorf("Unkown addon %v for item %v", addon.Sku, i.Sku)
 		}
 
-		lowestPrice, err := determineLowestPrice(userClaims, metaAddon.Prices, order.Currency)
+		lowestPrice, err := determineLowestPrice(userClaims, metaAddon.Prices, order.Currency, rates)
 		if err != nil {
 			return err
 		}
@@ -295,22 +351,27 @@ func (i *LineItem) Process(userClaims map[string]interface{}, order *Order, meta
 		order.Downloads = append(order.Downloads, download)
 	}
 
-	return i.calculatePrice(userClaims, meta.Prices, order.Currency)
+	return i.calculatePrice(userClaims, meta.Prices, order.Currency, rates)
 }
 
-func (i *LineItem) calculatePrice(userClaims map[string]interface{}, prices []PriceMetadata, currency string) error {
-	lowestPrice, err := determineLowestPrice(userClaims, prices, currency)
+func (i *LineItem) calculatePrice(userClaims map[string]interface{}, prices []PriceMetadata, currency string, rates *calculator.ExchangeRates) error {
+	lowestPrice, err := determineLowestPrice(userClaims, prices, currency, rates)
 	if err != nil {
 		return err
 	}
 	i.Price = lowestPrice.cents
+	i.ExchangeRate = lowestPrice.rate
 	i.PriceItems = make([]*PriceItem, len(lowestPrice.Items))
 	for index, item := range lowestPrice.Items {
 		amount, err := strconv.ParseFloat(item.Amount, 64)
 		if err != nil {
 			return err
 		}
-		i.PriceItems[index] = &PriceItem{Amount: uint64(amount * 100), Type: item.Type, VAT: item.VAT}
+		cents := uint64(amount * 100)
+		if lowestPrice.rate != 0 {
+			cents, _ = rates.Convert(cents, currency)
+		}
+		i.PriceItems[index] = &PriceItem{Amount: cents, Type: item.Type, VAT: item.VAT}
 	}
 	for _, addon := range i.AddonItems {
 		i.AddonPrice += addon.Price
@@ -319,7 +380,29 @@ func (i *LineItem) calculatePrice(userClaims map[string]interface{}, prices []Pr
 	return nil
 }
 
-func determineLowestPrice(userClaims map[string]interface{}, prices []PriceMetadata, currency string) (PriceMetadata, error) {
+// determineLowestPrice finds the lowest price the user is eligible for in
+// currency. Without such a price, the lowest price in the base currency of
+// the exchange rates is converted.
+func determineLowestPrice(userClaims map[string]interface{}, prices []PriceMetadata, currency string, rates *calculator.ExchangeRates) (PriceMetadata, error) {
+	lowestPrice, err := lowestPriceIn(userClaims, prices, currency)
+	if err == nil || rates == nil || rates.Base == currency {
+		return lowestPrice, err
+	}
+	rate, ok := rates.Rate(currency)
+	if !ok {
+		return lowestPrice, err
+	}
+
+	lowestPrice, err = lowestPriceIn(userClaims, prices, rates.Base)
+	if err != nil {
+		return lowestPrice, err
+	}
+	lowestPrice.cents, _ = rates.Convert(lowestPrice.cents, currency)
+	lowestPrice.rate = rate
+	return lowestPrice, nil
+}
+
+func lowestPriceIn(userClaims map[string]interface{}, prices []PriceMetadata, currency string) (PriceMetadata, error) {
 	lowestPrice := PriceMetadata{}
 	found := false
 	for _, price := range prices {
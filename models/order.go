@@ -18,6 +18,28 @@ const PendingState = "pending"
 // PaidState is the paid state of an Order
 const PaidState = "paid"
 
+// PartiallyPaidState is the state of an Order whose charges don't cover the total yet
+const PartiallyPaidState = "partially_paid"
+
+// RefundedState is the state of an Order whose payments have been refunded in full
+const RefundedState = "refunded"
+
+// PartiallyRefundedState is the state of an Order with some of its payments refunded
+const PartiallyRefundedState = "partially_refunded"
+
+// AuthorizedState is the state of an Order whose payment has been authorized,
+// but not captured yet
+const AuthorizedState = "authorized"
+
+// VoidedState is the state of a Transaction whose authorization was released
+const VoidedState = "voided"
+
+// DisputedState is the state of an Order whose payment was disputed by the buyer
+const DisputedState = "disputed"
+
+// ReversedState is the state of an Order whose payment was reversed by the provider
+const ReversedState = "reversed"
+
 // ShippingState is the shipping state of an order
 const ShippingState = "shipping"
 
@@ -30,8 +52,14 @@ const FailedState = "failed"
 // PaymentState are the possible values for the PaymentState field
 var PaymentStates = []string{
 	PendingState,
+	PartiallyPaidState,
+	AuthorizedState,
 	PaidState,
 	FailedState,
+	DisputedState,
+	ReversedState,
+	RefundedState,
+	PartiallyRefundedState,
 }
 
 // FulfillmentStates are the possible values for the FulfillmentState field
@@ -67,20 +95,39 @@ type Order struct {
 	Downloads []Download `json:"downloads"`
 
 	Currency string `json:"currency"`
+
+	// ExchangeRate is the rate prices were converted with from the
+	// ExchangeRateBase currency, if the products had no price in Currency.
+	ExchangeRate     float64 `json:"exchange_rate,omitempty"`
+	ExchangeRateBase string  `json:"exchange_rate_base,omitempty"`
+
 	Taxes    uint64 `json:"taxes"`
 	Shipping uint64 `json:"shipping"`
+
+	// ShippingRate is the ID of the chosen shipping rate. The taxes on
+	// shipping are included in Taxes.
+	ShippingRate  string `json:"shipping_rate,omitempty"`
+	ShippingTaxes uint64 `json:"shipping_taxes"`
+
 	SubTotal uint64 `json:"subtotal"`
 	Discount uint64 `json:"discount"`
 	NetTotal uint64 `json:"net_total"`
 
 	Total uint64 `json:"total"`
 
+	AmountPaid     uint64 `json:"amount_paid"`
+	AmountDue      uint64 `json:"amount_due" sql:"-"`
+	AmountRefunded uint64 `json:"amount_refunded"`
+
 	PaymentState     string `json:"payment_state"`
 	FulfillmentState string `json:"fulfillment_state"`
 	State            string `json:"state"`
 
 	PaymentProcessor string `json:"payment_processor"`
 
+	// SubscriptionID is set on the orders created to renew a subscription.
+	SubscriptionID string `json:"subscription_id,omitempty" sql:"index"`
+
 	Transactions []*Transaction `json:"transactions"`
 	Notes        []*OrderNote   `json:"notes"`
 
@@ -92,6 +139,10 @@ type Order struct {
 
 	VATNumber string `json:"vatnumber"`
 
+	// ReverseCharge is set when the order is exempt from VAT because the
+	// business buyer accounts for it.
+	ReverseCharge bool `json:"reverse_charge"`
+
 	MetaData    map[string]interface{} `sql:"-" json:"meta"`
 	RawMetaData string                 `json:"-" sql:"type:text"`
 
@@ -100,6 +151,11 @@ type Order struct {
 	Coupon    *Coupon `json:"coupon,omitempty" sql:"-"`
 	RawCoupon string  `json:"-" sql:"type:text"`
 
+	// Coupons are all the coupons of the order. Coupon and CouponCode hold
+	// the first of them.
+	Coupons    []*Coupon `json:"coupons,omitempty" sql:"-"`
+	RawCoupons string    `json:"-" sql:"type:text"`
+
 	CreatedAt time.Time  `json:"created_at" sql:"index"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	DeletedAt *time.Time `json:"-" sql:"index"`
@@ -125,6 +181,13 @@ func (o *Order) AfterFind() error {
 			return err
 		}
 	}
+	if o.RawCoupons != "" {
+		err := json.Unmarshal([]byte(o.RawCoupons), &o.Coupons)
+		if err != nil {
+			return err
+		}
+	}
+	o.AmountDue = o.amountDue()
 
 	return nil
 }
@@ -145,10 +208,100 @@ func (o *Order) BeforeSave() error {
 		}
 		o.RawCoupon = string(data)
 	}
+	if o.Coupons != nil {
+		data, err := json.Marshal(o.Coupons)
+		if err != nil {
+			return err
+		}
+		o.RawCoupons = string(data)
+	}
+	o.AmountDue = o.amountDue()
 
 	return nil
 }
 
+// HasSubscription checks if any line item of the order is a subscription.
+func (o *Order) HasSubscription() bool {
+	for _, item := range o.LineItems {
+		if item.IsSubscription() {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *Order) amountDue() uint64 {
+	if o.AmountPaid >= o.Total {
+		return 0
+	}
+	return o.Total - o.AmountPaid
+}
+
+// UpdatePaymentState sums up the paid and authorized charges and the refunds of
+// the order and sets the payment state accordingly. The order is only paid once
+// its charges cover the total. Disputed and reversed orders keep their state.
+func (o *Order) UpdatePaymentState(tx *gorm.DB) error {
+	trans := []Transaction{}
+	rsp := tx.Where("order_id = ? AND status IN (?)", o.ID, []string{PaidState, AuthorizedState}).Find(&trans)
+	if rsp.Error != nil {
+		return rsp.Error
+	}
+
+	var paid, refunded uint64
+	authorized := false
+	for _, t := range trans {
+		switch t.Type {
+		case ChargeTransactionType:
+			paid += t.Amount
+			if t.Status == AuthorizedState {
+				authorized = true
+			}
+		case RefundTransactionType:
+			refunded += t.Amount
+		}
+	}
+
+	switch {
+	case o.PaymentState == DisputedState || o.PaymentState == ReversedState:
+		// disputes and reversals are settled with the provider, not by the
+		// transactions of the order
+	case refunded > 0 && refunded >= paid:
+		o.PaymentState = RefundedState
+	case refunded > 0:
+		o.PaymentState = PartiallyRefundedState
+	case paid == 0:
+		o.PaymentState = PendingState
+	case paid < o.Total:
+		o.PaymentState = PartiallyPaidState
+	case authorized:
+		o.PaymentState = AuthorizedState
+	default:
+		o.PaymentState = PaidState
+	}
+	o.AmountPaid = paid
+	o.AmountDue = o.amountDue()
+	o.AmountRefunded = refunded
+
+	// only the columns are updated, so preloaded transactions aren't saved again
+	rsp = tx.Model(o).UpdateColumns(map[string]interface{}{
+		"amount_paid":     o.AmountPaid,
+		"amount_refunded": o.AmountRefunded,
+		"payment_state":   o.PaymentState,
+	})
+	if rsp.Error != nil {
+		return rsp.Error
+	}
+
+	// authorized orders keep their stock reserved until they are captured
+	if o.PaymentState == PaidState {
+		if err := CommitStock(tx, o); err != nil {
+			return err
+		}
+		return RedeemCoupons(tx, o)
+	}
+	return nil
+}
+
 // NewOrder creates a new pending Order.
 func NewOrder(instanceID, sessionID, email, currency string) *Order {
 	order := &Order{
@@ -164,20 +317,90 @@ func NewOrder(instanceID, sessionID, email, currency string) *Order {
 	return order
 }
 
-// CalculateTotal calculates the total price of an Order.
-func (o *Order) CalculateTotal(settings *calculator.Settings, claims map[string]interface{}, log logrus.FieldLogger) {
+// SetCoupons sets the coupons of the order.
+func (o *Order) SetCoupons(coupons []*Coupon) {
+	o.Coupons = coupons
+	o.Coupon = nil
+	o.CouponCode = ""
+	if len(coupons) > 0 {
+		o.Coupon = coupons[0]
+		o.CouponCode = coupons[0].Code
+	}
+}
+
+// AllCoupons returns the coupons of the order, including the single coupon
+// of orders created before orders could have several.
+func (o *Order) AllCoupons() []*Coupon {
+	if len(o.Coupons) > 0 {
+		return o.Coupons
+	}
+	if o.Coupon != nil {
+		return []*Coupon{o.Coupon}
+	}
+	return nil
+}
+
+// CheckCoupon returns an error if a coupon of the order is not valid for the
+// amount of the order.
+func (o *Order) CheckCoupon() error {
+	items := o.calculatorItems()
+	for _, coupon := range o.AllCoupons() {
+		if err := coupon.CheckPrice(o.Currency, calculator.CouponSubtotal(coupon, items)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *Order) calculatorItems() []calculator.Item {
 	items := make([]calculator.Item, len(o.LineItems))
 	for i, item := range o.LineItems {
 		items[i] = item
 	}
+	return items
+}
 
-	params := calculator.PriceParameters{o.ShippingAddress.Country, o.Currency, o.Coupon, items}
-	price := calculator.CalculatePrice(settings, claims, params, log)
+func (o *Order) priceParameters(settings *calculator.Settings) calculator.PriceParameters {
+	params := calculator.PriceParameters{
+		Country:      o.ShippingAddress.Country,
+		State:        o.ShippingAddress.State,
+		PostalCode:   o.ShippingAddress.Zip,
+		Currency:     o.Currency,
+		Items:        o.calculatorItems(),
+		ShippingRate: o.ShippingRate,
+		VATNumber:    o.VATNumber,
+	}
+	for _, coupon := range o.AllCoupons() {
+		params.Coupons = append(params.Coupons, coupon)
+	}
+	if settings != nil {
+		params.SellerCountry = settings.SellerCountry
+	}
+	return params
+}
+
+// ResolveTaxes looks up the taxes of the Order with the tax provider of the
+// settings and returns settings with those taxes.
+func (o *Order) ResolveTaxes(settings *calculator.Settings) (*calculator.Settings, error) {
+	return calculator.ResolveTaxes(settings, o.priceParameters(settings))
+}
+
+// CalculateTotal calculates the total price of an Order and returns the price
+// breakdown it was calculated from. It fails if the taxes can't be looked up.
+func (o *Order) CalculateTotal(settings *calculator.Settings, claims map[string]interface{}, log logrus.FieldLogger) (*calculator.Price, error) {
+	settings, err := o.ResolveTaxes(settings)
+	if err != nil {
+		return nil, err
+	}
+	price := calculator.CalculatePrice(settings, claims, o.priceParameters(settings), log)
 
 	o.SubTotal = price.Subtotal
 	o.Taxes = price.Taxes
 	o.Discount = price.Discount
 	o.NetTotal = price.NetTotal
+	o.Shipping = price.Shipping
+	o.ShippingTaxes = price.ShippingTaxes
+	o.ReverseCharge = price.ReverseCharge
 
 	// apply price details to line items
 	for i, item := range price.Items {
@@ -186,6 +409,7 @@ func (o *Order) CalculateTotal(settings *calculator.Settings, claims map[string]
 			Subtotal: item.Subtotal,
 			NetTotal: item.NetTotal,
 			Taxes:    item.Taxes,
+			TaxItems: item.TaxItems,
 			Total:    item.Total,
 		}
 
@@ -200,6 +424,7 @@ func (o *Order) CalculateTotal(settings *calculator.Settings, claims map[string]
 	if price.Total > 0 {
 		o.Total = uint64(price.Total)
 	}
+	return &price, nil
 }
 
 func (o *Order) BeforeDelete(tx *gorm.DB) error {
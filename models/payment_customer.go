@@ -0,0 +1,49 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// PaymentCustomer links a user to the customer the payment provider keeps the
+// saved payment methods of the user with.
+type PaymentCustomer struct {
+	ID         string `gorm:"primary_key"`
+	InstanceID string `gorm:"unique_index:idx_payment_customers_instance_user"`
+	UserID     string `gorm:"unique_index:idx_payment_customers_instance_user"`
+	Provider   string `gorm:"unique_index:idx_payment_customers_instance_user"`
+	CustomerID string
+
+	CreatedAt time.Time
+}
+
+// TableName returns the database table name for the PaymentCustomer model.
+func (PaymentCustomer) TableName() string {
+	return tableName("payment_customers")
+}
+
+// NewPaymentCustomer creates a PaymentCustomer for a customer of a provider.
+func NewPaymentCustomer(instanceID, userID, provider, customerID string) *PaymentCustomer {
+	return &PaymentCustomer{
+		ID:         uuid.NewRandom().String(),
+		InstanceID: instanceID,
+		UserID:     userID,
+		Provider:   provider,
+		CustomerID: customerID,
+	}
+}
+
+// GetPaymentCustomer finds the customer of a user with a provider. It returns
+// nil if the user has no customer with the provider yet.
+func GetPaymentCustomer(db *gorm.DB, instanceID, userID, provider string) (*PaymentCustomer, error) {
+	c := &PaymentCustomer{}
+	if rsp := db.Where("instance_id = ? AND user_id = ? AND provider = ?", instanceID, userID, provider).First(c); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return c, nil
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// ProviderEvent records a webhook event received from a payment provider, so
+// that redelivered events are only applied once.
+type ProviderEvent struct {
+	ID         string `gorm:"primary_key"`
+	InstanceID string `gorm:"unique_index:idx_provider_events_instance_event"`
+	Provider   string `gorm:"unique_index:idx_provider_events_instance_event"`
+	EventID    string `gorm:"unique_index:idx_provider_events_instance_event"`
+	Type       string
+
+	CreatedAt time.Time
+}
+
+// TableName returns the database table name for the ProviderEvent model.
+func (ProviderEvent) TableName() string {
+	return tableName("provider_events")
+}
+
+// NewProviderEvent creates a ProviderEvent for a webhook event.
+func NewProviderEvent(instanceID, provider, eventID, eventType string) *ProviderEvent {
+	return &ProviderEvent{
+		ID:         uuid.NewRandom().String(),
+		InstanceID: instanceID,
+		Provider:   provider,
+		EventID:    eventID,
+		Type:       eventType,
+	}
+}
+
+// GetProviderEvent finds a processed webhook event. It returns nil if the
+// event has not been received yet.
+func GetProviderEvent(db *gorm.DB, instanceID, provider, eventID string) (*ProviderEvent, error) {
+	e := &ProviderEvent{}
+	if rsp := db.Where("instance_id = ? AND provider = ? AND event_id = ?", instanceID, provider, eventID).First(e); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return e, nil
+}
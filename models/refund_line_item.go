@@ -0,0 +1,45 @@
+package models
+
+import "github.com/jinzhu/gorm"
+
+// RefundLineItem is the part of a refund that belongs to a line item of the
+// order.
+type RefundLineItem struct {
+	InstanceID    string `json:"-"`
+	ID            int64  `json:"-"`
+	TransactionID string `json:"-" sql:"index"`
+
+	Sku      string `json:"sku"`
+	Quantity uint64 `json:"quantity"`
+	Amount   uint64 `json:"amount"`
+}
+
+// TableName returns the database table name for the RefundLineItem model.
+func (RefundLineItem) TableName() string {
+	return tableName("refund_line_items")
+}
+
+// RefundedLineItems sums up the quantities and amounts refunded for the line
+// items of an order by SKU. Failed refunds are left out.
+func RefundedLineItems(db *gorm.DB, orderID string) (map[string]*RefundLineItem, error) {
+	rows, err := db.Table(RefundLineItem{}.TableName()+" AS r").
+		Select("r.sku, sum(r.quantity), sum(r.amount)").
+		Joins("JOIN "+Transaction{}.TableName()+" AS t ON t.id = r.transaction_id").
+		Where("t.order_id = ? AND t.type = ? AND t.status <> ?", orderID, RefundTransactionType, FailedState).
+		Group("r.sku").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refunded := map[string]*RefundLineItem{}
+	for rows.Next() {
+		item := &RefundLineItem{}
+		if err := rows.Scan(&item.Sku, &item.Quantity, &item.Amount); err != nil {
+			return nil, err
+		}
+		refunded[item.Sku] = item
+	}
+	return refunded, rows.Err()
+}
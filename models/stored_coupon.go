@@ -0,0 +1,100 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// StoredCoupon is a coupon an admin created for an instance. The coupon is
+// stored as JSON so it keeps the same format as the coupons from a URL.
+type StoredCoupon struct {
+	ID         string `json:"-"`
+	InstanceID string `json:"-" gorm:"unique_index:idx_stored_coupons_instance_code"`
+	Code       string `json:"-" gorm:"unique_index:idx_stored_coupons_instance_code"`
+
+	// Campaign groups coupons that were generated together.
+	Campaign string `json:"-" sql:"index"`
+
+	Coupon    *Coupon `json:"-" sql:"-"`
+	RawCoupon string  `json:"-" sql:"type:text"`
+
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+// TableName returns the database table name for the StoredCoupon model.
+func (StoredCoupon) TableName() string {
+	return tableName("stored_coupons")
+}
+
+// NewStoredCoupon creates a StoredCoupon for an instance.
+func NewStoredCoupon(instanceID string, coupon *Coupon) *StoredCoupon {
+	return &StoredCoupon{
+		ID:         uuid.NewRandom().String(),
+		InstanceID: instanceID,
+		Code:       coupon.Code,
+		Coupon:     coupon,
+	}
+}
+
+// BeforeSave database callback.
+func (c *StoredCoupon) BeforeSave() error {
+	data, err := json.Marshal(c.Coupon)
+	if err != nil {
+		return err
+	}
+	c.RawCoupon = string(data)
+	return nil
+}
+
+// AfterFind database callback.
+func (c *StoredCoupon) AfterFind() error {
+	c.Coupon = &Coupon{}
+	if c.RawCoupon != "" {
+		if err := json.Unmarshal([]byte(c.RawCoupon), c.Coupon); err != nil {
+			return err
+		}
+	}
+	c.Coupon.Code = c.Code
+	return nil
+}
+
+// GetStoredCoupon finds the coupon of an instance with the code. It returns
+// nil if there is no such coupon.
+func GetStoredCoupon(db *gorm.DB, instanceID, code string) (*StoredCoupon, error) {
+	c := &StoredCoupon{}
+	if rsp := db.Where("instance_id = ? AND code = ?", instanceID, code).First(c); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return c, nil
+}
+
+// ListStoredCoupons returns all the coupons stored for an instance, or only
+// the ones of a campaign if one is given.
+func ListStoredCoupons(db *gorm.DB, instanceID, campaign string) ([]*StoredCoupon, error) {
+	query := db.Where("instance_id = ?", instanceID)
+	if campaign != "" {
+		query = query.Where("campaign = ?", campaign)
+	}
+	coupons := []*StoredCoupon{}
+	if rsp := query.Order("code").Find(&coupons); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return coupons, nil
+}
+
+// StoredCouponCodes returns the codes of all the coupons stored for an
+// instance.
+func StoredCouponCodes(db *gorm.DB, instanceID string) ([]string, error) {
+	codes := []string{}
+	if rsp := db.Model(&StoredCoupon{}).Where("instance_id = ?", instanceID).Pluck("code", &codes); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return codes, nil
+}
@@ -0,0 +1,136 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// ActiveState is the state of a Subscription that is renewed at the end of its period
+const ActiveState = "active"
+
+// PastDueState is the state of a Subscription whose renewal payment failed and is retried
+const PastDueState = "past_due"
+
+// PausedState is the state of a Subscription that isn't renewed until it is resumed
+const PausedState = "paused"
+
+// CanceledState is the state of a Subscription that won't be renewed anymore
+const CanceledState = "canceled"
+
+// SubscriptionIntervals are the billing periods subscription products can be
+// renewed in.
+var SubscriptionIntervals = []string{"day", "week", "month", "year"}
+
+// Subscription is a line item that is paid for again at the end of every
+// billing period.
+type Subscription struct {
+	InstanceID string `json:"-" sql:"index"`
+	ID         string `json:"id"`
+
+	UserID string `json:"user_id" sql:"index"`
+	Email  string `json:"email"`
+
+	OrderID    string `json:"order_id"`
+	LineItemID int64  `json:"line_item_id"`
+	Sku        string `json:"sku"`
+	Title      string `json:"title"`
+
+	Interval      string `json:"interval"`
+	IntervalCount uint64 `json:"interval_count"`
+
+	Amount           uint64 `json:"amount"`
+	Currency         string `json:"currency"`
+	PaymentProcessor string `json:"payment_processor"`
+
+	State            string    `json:"state"`
+	CurrentPeriodEnd time.Time `json:"current_period_end"`
+	NextRenewalAt    time.Time `json:"next_renewal_at" sql:"index"`
+
+	// RenewalOrderID is the order of a failed renewal that is being retried.
+	RenewalOrderID  string `json:"renewal_order_id,omitempty"`
+	RenewalAttempts int    `json:"renewal_attempts"`
+
+	LockedAt *time.Time `json:"-"`
+	LockedBy *string    `json:"-"`
+
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	CanceledAt *time.Time `json:"canceled_at,omitempty"`
+}
+
+// TableName returns the database table name for the Subscription model.
+func (Subscription) TableName() string {
+	return tableName("subscriptions")
+}
+
+// NewSubscription creates an active Subscription for a paid subscription line
+// item of an order. Its first period starts now.
+func NewSubscription(order *Order, item *LineItem, processor string) *Subscription {
+	now := time.Now()
+	s := &Subscription{
+		InstanceID:       order.InstanceID,
+		ID:               uuid.NewRandom().String(),
+		UserID:           order.UserID,
+		Email:            order.Email,
+		OrderID:          order.ID,
+		LineItemID:       item.ID,
+		Sku:              item.Sku,
+		Title:            item.Title,
+		Interval:         item.Interval,
+		IntervalCount:    item.IntervalCount,
+		Currency:         order.Currency,
+		PaymentProcessor: processor,
+		State:            ActiveState,
+	}
+	// the calculation details of line items are for a single unit
+	if item.CalculationDetail != nil && item.Total > 0 {
+		s.Amount = uint64(item.Total) * item.Quantity
+	}
+	s.CurrentPeriodEnd = s.AddInterval(now)
+	s.NextRenewalAt = s.CurrentPeriodEnd
+	return s
+}
+
+// AddInterval returns the time one billing period after t.
+func (s *Subscription) AddInterval(t time.Time) time.Time {
+	count := int(s.IntervalCount)
+	if count == 0 {
+		count = 1
+	}
+	switch s.Interval {
+	case "day":
+		return t.AddDate(0, 0, count)
+	case "week":
+		return t.AddDate(0, 0, 7*count)
+	case "year":
+		return t.AddDate(count, 0, 0)
+	default:
+		return t.AddDate(0, count, 0)
+	}
+}
+
+// IsValidSubscriptionInterval checks if interval is one of the
+// SubscriptionIntervals.
+func IsValidSubscriptionInterval(interval string) bool {
+	for _, i := range SubscriptionIntervals {
+		if i == interval {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSubscription finds a subscription by ID. It returns nil if the
+// subscription doesn't exist.
+func GetSubscription(db *gorm.DB, id string) (*Subscription, error) {
+	s := &Subscription{}
+	if rsp := db.Where("id = ?", id).First(s); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return s, nil
+}
@@ -21,7 +21,11 @@ type Transaction struct {
 	OrderID       string `json:"order_id"`
 	InvoiceNumber int64  `json:"invoice_number"`
 
-	ProcessorID string `json:"processor_id"`
+	ProcessorID      string `json:"processor_id"`
+	PaymentProcessor string `json:"payment_processor,omitempty"`
+
+	// ChargeID is the charge a refund belongs to.
+	ChargeID string `json:"charge_id,omitempty" sql:"index"`
 
 	User   *User  `json:"-"`
 	UserID string `json:"user_id,omitempty"`
@@ -35,6 +39,9 @@ type Transaction struct {
 	Status string `json:"status"`
 	Type   string `json:"type"`
 
+	Reason          string            `json:"reason,omitempty" sql:"type:text"`
+	RefundLineItems []*RefundLineItem `json:"line_items,omitempty"`
+
 	CreatedAt time.Time  `json:"created_at"`
 	DeletedAt *time.Time `json:"-"`
 }
@@ -69,3 +76,45 @@ func GetTransaction(db *gorm.DB, id string) (*Transaction, error) {
 	}
 	return trans, nil
 }
+
+// GetTransactionByProcessorID finds a transaction of the given type by the ID
+// the payment provider assigned to it.
+func GetTransactionByProcessorID(db *gorm.DB, instanceID, transactionType, processorID string) (*Transaction, error) {
+	trans := &Transaction{}
+	if rsp := db.Where("instance_id = ? AND type = ? AND processor_id = ?", instanceID, transactionType, processorID).First(trans); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return trans, nil
+}
+
+// LockTransaction loads a transaction and locks it until the database
+// transaction ends, so concurrent changes to it run one after another.
+func LockTransaction(tx *gorm.DB, id string) (*Transaction, error) {
+	trans := &Transaction{}
+	if rsp := forUpdate(tx).First(trans, "id = ?", id); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return trans, nil
+}
+
+// RefundedAmount sums up the refunds of a charge that didn't fail. Refunds
+// stored before they were linked to their charge count for every charge of
+// their order, since orders only had a single charge back then.
+func RefundedAmount(db *gorm.DB, charge *Transaction) (uint64, error) {
+	refunds := []Transaction{}
+	rsp := db.Where("type = ? AND status <> ?", RefundTransactionType, FailedState).
+		Where("charge_id = ? OR ((charge_id IS NULL OR charge_id = '') AND order_id = ?)", charge.ID, charge.OrderID).
+		Find(&refunds)
+	if rsp.Error != nil {
+		return 0, rsp.Error
+	}
+
+	var amount uint64
+	for _, refund := range refunds {
+		amount += refund.Amount
+	}
+	return amount, nil
+}
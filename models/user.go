@@ -107,10 +107,12 @@ func (u *User) BeforeDelete(tx *gorm.DB) error {
 	}
 
 	delModels := map[string]interface{}{
-		"address":     Address{},
-		"hook":        Hook{},
-		"transaction": Transaction{},
-		"order note":  OrderNote{},
+		"address":          Address{},
+		"hook":             Hook{},
+		"transaction":      Transaction{},
+		"order note":       OrderNote{},
+		"payment customer": PaymentCustomer{},
+		"subscription":     Subscription{},
 	}
 	for name, dm := range delModels {
 		if result := tx.Delete(dm, "user_id = ?", u.ID); result.Error != nil {
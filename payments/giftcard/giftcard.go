@@ -0,0 +1,123 @@
+package giftcard
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+
+	gcontext "gocommerce/context"
+	"gocommerce/models"
+	"gocommerce/payments"
+)
+
+type giftCardPaymentProvider struct{}
+
+type giftCardBodyParams struct {
+	GiftCardCode string `json:"gift_card_code"`
+}
+
+// NewPaymentProvider creates a new payment provider that pays with the balance
+// of gift cards and store credit.
+func NewPaymentProvider() (payments.Provider, error) {
+	return &giftCardPaymentProvider{}, nil
+}
+
+func (g *giftCardPaymentProvider) Name() string {
+	return payments.GiftCardProvider
+}
+
+func (g *giftCardPaymentProvider) NewCharger(ctx context.Context, r *http.Request) (payments.Charger, error) {
+	var bp giftCardBodyParams
+	bod, err := r.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	err = json.NewDecoder(bod).Decode(&bp)
+	if err != nil {
+		return nil, err
+	}
+	if bp.GiftCardCode == "" {
+		return nil, errors.New("Gift card payments require a gift_card_code")
+	}
+
+	db, err := getDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	instanceID := gcontext.GetInstanceID(ctx)
+	return func(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+		return g.charge(db, instanceID, bp.GiftCardCode, amount, currency, order)
+	}, nil
+}
+
+// charge redeems an amount from a gift card and returns the ID of the ledger
+// entry, which is used as the processor ID of the transaction. The db is the
+// transaction of the payment, so the redemption is rolled back with it.
+func (g *giftCardPaymentProvider) charge(db *gorm.DB, instanceID, code string, amount uint64, currency string, order *models.Order) (string, error) {
+	card, err := models.GetGiftCard(db, instanceID, code)
+	if err != nil {
+		return "", err
+	}
+	if card == nil {
+		return "", fmt.Errorf("Gift card %v not found", code)
+	}
+	if card.Currency != currency {
+		return "", fmt.Errorf("The gift card is in %v, but the payment in %v", card.Currency, currency)
+	}
+	if card.UserID != "" && card.UserID != order.UserID {
+		return "", errors.New("The gift card belongs to a different user")
+	}
+
+	entry, err := card.Redeem(db, amount, order.ID)
+	if err != nil {
+		return "", err
+	}
+	return entry.ID, nil
+}
+
+func (g *giftCardPaymentProvider) NewRefunder(ctx context.Context, r *http.Request) (payments.Refunder, error) {
+	db, err := getDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	instanceID := gcontext.GetInstanceID(ctx)
+	return func(transactionID string, amount uint64, currency string, details *payments.RefundDetails) (string, error) {
+		return g.refund(db, instanceID, transactionID, amount, currency)
+	}, nil
+}
+
+// refund credits an amount back to the gift card the payment was made with.
+func (g *giftCardPaymentProvider) refund(db *gorm.DB, instanceID, transactionID string, amount uint64, currency string) (string, error) {
+	redemption, card, err := models.GetGiftCardEntry(db, instanceID, transactionID)
+	if err != nil {
+		return "", err
+	}
+	if redemption == nil || redemption.Type != models.RedemptionGiftCardEntryType {
+		return "", fmt.Errorf("Gift card redemption %v not found", transactionID)
+	}
+	if card.Currency != currency {
+		return "", fmt.Errorf("The gift card is in %v, but the refund in %v", card.Currency, currency)
+	}
+
+	entry, err := card.Credit(db, models.RefundGiftCardEntryType, amount, redemption.OrderID)
+	if err != nil {
+		return "", err
+	}
+	return entry.ID, nil
+}
+
+func (g *giftCardPaymentProvider) NewPreauthorizer(ctx context.Context, r *http.Request) (payments.Preauthorizer, error) {
+	return nil, errors.New("Gift cards do not require preauthorization")
+}
+
+func getDB(ctx context.Context) (*gorm.DB, error) {
+	db := gcontext.GetDB(ctx)
+	if db == nil {
+		return nil, errors.New("Gift cards require a database transaction")
+	}
+	return db, nil
+}
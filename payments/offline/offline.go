@@ -0,0 +1,79 @@
+package offline
+
+import (
+	"context"
+	"crypto/rand"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"gocommerce/models"
+	"gocommerce/payments"
+)
+
+const (
+	referenceAlphabet      = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	referenceLength        = 10
+	defaultReferencePrefix = "GC-"
+)
+
+type offlinePaymentProvider struct {
+	referencePrefix string
+}
+
+// Config contains the configuration for the offline payment provider.
+type Config struct {
+	ReferencePrefix string `mapstructure:"reference_prefix" json:"reference_prefix"`
+}
+
+// NewPaymentProvider creates a new offline payment provider using the provided configuration.
+func NewPaymentProvider(config Config) (payments.Provider, error) {
+	prefix := config.ReferencePrefix
+	if prefix == "" {
+		prefix = defaultReferencePrefix
+	}
+	return &offlinePaymentProvider{
+		referencePrefix: prefix,
+	}, nil
+}
+
+func (o *offlinePaymentProvider) Name() string {
+	return payments.OfflineProvider
+}
+
+// Deferred marks offline payments as pending until they are marked as paid.
+func (o *offlinePaymentProvider) Deferred() {}
+
+func (o *offlinePaymentProvider) NewCharger(ctx context.Context, r *http.Request) (payments.Charger, error) {
+	return o.charge, nil
+}
+
+// charge doesn't move any money, it only generates the reference the buyer
+// has to include with the payment.
+func (o *offlinePaymentProvider) charge(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+	return o.newReference()
+}
+
+func (o *offlinePaymentProvider) newReference() (string, error) {
+	b := make([]byte, referenceLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "Error generating payment reference")
+	}
+	for i := range b {
+		b[i] = referenceAlphabet[int(b[i])%len(referenceAlphabet)]
+	}
+	return o.referencePrefix + string(b), nil
+}
+
+func (o *offlinePaymentProvider) NewRefunder(ctx context.Context, r *http.Request) (payments.Refunder, error) {
+	return o.refund, nil
+}
+
+// refund records a refund that was paid back to the buyer manually.
+func (o *offlinePaymentProvider) refund(transactionID string, amount uint64, currency string, details *payments.RefundDetails) (string, error) {
+	return o.newReference()
+}
+
+func (o *offlinePaymentProvider) NewPreauthorizer(ctx context.Context, r *http.Request) (payments.Preauthorizer, error) {
+	return nil, errors.New("Offline payments do not require preauthorization")
+}
@@ -2,6 +2,7 @@ package payments
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 
 	"gocommerce/models"
@@ -12,6 +13,10 @@ const (
 	StripeProvider = "stripe"
 	// PayPalProvider is the string identifier for the PayPal payment provider.
 	PayPalProvider = "paypal"
+	// OfflineProvider is the string identifier for the offline payment provider.
+	OfflineProvider = "offline"
+	// GiftCardProvider is the string identifier for the gift card payment provider.
+	GiftCardProvider = "giftcard"
 )
 
 // Provider represents a payment provider that can optionally charge, refund,
@@ -23,11 +28,145 @@ type Provider interface {
 	NewPreauthorizer(ctx context.Context, r *http.Request) (Preauthorizer, error)
 }
 
+// AuthorizationProvider is implemented by providers that can authorize a
+// payment first, and capture or void it at a later point.
+type AuthorizationProvider interface {
+	NewAuthorizer(ctx context.Context, r *http.Request) (Authorizer, error)
+	NewCapturer(ctx context.Context, r *http.Request) (Capturer, error)
+	NewVoider(ctx context.Context, r *http.Request) (Voider, error)
+}
+
+// DeferredProvider is implemented by providers for payments made outside of
+// the checkout, like bank transfers, invoices or cash on delivery. Their
+// charges stay pending until an admin marks them as paid.
+type DeferredProvider interface {
+	Deferred()
+}
+
+// ConfirmationProvider is implemented by providers that can require the buyer
+// to complete an additional step, like 3-D Secure authentication, before a
+// payment succeeds.
+type ConfirmationProvider interface {
+	NewConfirmer(ctx context.Context, r *http.Request) (Confirmer, error)
+}
+
+// WebhookProvider is implemented by providers that notify us about changes
+// made to payments on their side, like refunds and disputes.
+type WebhookProvider interface {
+	VerifyWebhook(ctx context.Context, r *http.Request) (*WebhookEvent, error)
+}
+
+// WebhookEventType is the kind of change reported by a provider webhook.
+type WebhookEventType string
+
+const (
+	// RefundEvent is reported when a charge was refunded with the provider.
+	RefundEvent WebhookEventType = "refund"
+	// DisputeEvent is reported when the buyer disputed a charge.
+	DisputeEvent WebhookEventType = "dispute"
+	// ReversalEvent is reported when the funds of a charge were reversed.
+	ReversalEvent WebhookEventType = "reversal"
+)
+
+// WebhookEvent is a verified provider webhook. Events that don't affect
+// payments have an empty Type.
+type WebhookEvent struct {
+	ID   string           `json:"id"`
+	Type WebhookEventType `json:"type"`
+
+	// TransactionID is the processor ID of the affected charge.
+	TransactionID string `json:"transaction_id"`
+	// ProcessorID is the provider's ID of the refund or dispute.
+	ProcessorID string `json:"processor_id"`
+
+	Amount   uint64 `json:"amount"`
+	Currency string `json:"currency"`
+
+	// Refunds lists all refunds of the charge for providers that report
+	// them together. ProcessorID and Amount are those of the latest one.
+	Refunds []*WebhookRefund `json:"refunds,omitempty"`
+}
+
+// WebhookRefund is a refund reported by a provider webhook.
+type WebhookRefund struct {
+	ProcessorID string `json:"processor_id"`
+	Amount      uint64 `json:"amount"`
+}
+
+// AllRefunds returns the refunds of a refund or reversal event.
+func (e *WebhookEvent) AllRefunds() []*WebhookRefund {
+	if len(e.Refunds) > 0 {
+		return e.Refunds
+	}
+	return []*WebhookRefund{{ProcessorID: e.ProcessorID, Amount: e.Amount}}
+}
+
+// CustomerProvider is implemented by providers that can save the payment
+// methods of returning customers.
+type CustomerProvider interface {
+	ListPaymentMethods(ctx context.Context, customerID string) ([]*PaymentMethod, error)
+	DeletePaymentMethod(ctx context.Context, customerID, paymentMethodID string) error
+}
+
+// RecurringProvider is implemented by providers that can charge the saved
+// payment methods of a customer while the buyer isn't present, like for the
+// renewal of a subscription. Charges with the same idempotency key are only
+// made once by the provider.
+type RecurringProvider interface {
+	NewRecurringCharger(ctx context.Context, customerID, idempotencyKey string) (Charger, error)
+}
+
+// PaymentMethod is a payment method a customer saved with a provider.
+type PaymentMethod struct {
+	ID       string `json:"id"`
+	Provider string `json:"provider"`
+	Brand    string `json:"brand"`
+	Last4    string `json:"last4"`
+	ExpMonth uint8  `json:"exp_month"`
+	ExpYear  uint16 `json:"exp_year"`
+}
+
 // Charger wraps the Charge method which creates new payments with the provider.
 type Charger func(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error)
 
 // Refunder wraps the Refund method which refunds payments with the provider.
-type Refunder func(transactionID string, amount uint64, currency string) (string, error)
+type Refunder func(transactionID string, amount uint64, currency string, details *RefundDetails) (string, error)
+
+// RefundDetails describes why a payment is refunded and which line items of
+// the order the refund is for.
+type RefundDetails struct {
+	Reason    string
+	LineItems []*models.RefundLineItem
+}
+
+// Authorizer wraps the Authorize method which reserves a payment with the
+// provider without capturing it.
+type Authorizer func(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error)
+
+// Capturer wraps the Capture method which captures a previously authorized
+// payment with the provider.
+type Capturer func(transactionID string, amount uint64, currency string) (string, error)
+
+// Voider wraps the Void method which releases a previously authorized payment
+// with the provider.
+type Voider func(transactionID string) error
+
+// Confirmer wraps the Confirm method which completes a payment once the buyer
+// finished the action requested by an ActionRequiredError.
+type Confirmer func(transactionID string) (string, error)
+
+// ActionRequiredError is returned by a Charger, Authorizer or Confirmer when
+// the buyer has to complete an additional step for the payment to succeed.
+type ActionRequiredError struct {
+	// ProcessorID identifies the pending payment with the provider.
+	ProcessorID string
+	// ClientSecret is handed to the client to complete the action.
+	ClientSecret string
+}
+
+func (e *ActionRequiredError) Error() string {
+	return fmt.Sprintf("payment %s requires additional action from the buyer", e.ProcessorID)
+}
 
 // Preauthorizer wraps the Preauthorize method which pre-authorizes a payment
 // with the provider.
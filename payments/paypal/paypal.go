@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
@@ -24,6 +25,7 @@ type paypalPaymentProvider struct {
 	client       *paypalsdk.Client
 	profile      *paypalsdk.WebProfile
 	profileMutex sync.Mutex
+	webhookID    string
 }
 
 type paypalBodyParams struct {
@@ -33,9 +35,10 @@ type paypalBodyParams struct {
 
 // Config contains PayPal-specific configuration for payment providers.
 type Config struct {
-	ClientID string `mapstructure:"client_id" json:"client_id"`
-	Secret   string `mapstructure:"secret" json:"secret"`
-	Env      string `mapstructure:"env" json:"env"`
+	ClientID  string `mapstructure:"client_id" json:"client_id"`
+	Secret    string `mapstructure:"secret" json:"secret"`
+	Env       string `mapstructure:"env" json:"env"`
+	WebhookID string `mapstructure:"webhook_id" json:"webhook_id"`
 }
 
 // NewPaymentProvider creates a new PayPal payment provider using the provided configuration.
@@ -68,7 +71,8 @@ func NewPaymentProvider(config Config) (payments.Provider, error) {
 	}
 
 	return &paypalPaymentProvider{
-		client: paypal,
+		client:    paypal,
+		webhookID: config.WebhookID,
 	}, nil
 }
 
@@ -77,6 +81,28 @@ func (p *paypalPaymentProvider) Name() string {
 }
 
 func (p *paypalPaymentProvider) NewCharger(ctx context.Context, r *http.Request) (payments.Charger, error) {
+	bp, err := parseBodyParams(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+		return p.charge(bp.PaypalID, bp.PaypalUserID, amount, currency, order, invoiceNumber)
+	}, nil
+}
+
+func (p *paypalPaymentProvider) NewAuthorizer(ctx context.Context, r *http.Request) (payments.Authorizer, error) {
+	bp, err := parseBodyParams(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+		return p.authorize(bp.PaypalID, bp.PaypalUserID, amount, currency, order, invoiceNumber)
+	}, nil
+}
+
+func parseBodyParams(r *http.Request) (*paypalBodyParams, error) {
 	var bp paypalBodyParams
 	bod, err := r.GetBody()
 	if err != nil {
@@ -89,10 +115,7 @@ func (p *paypalPaymentProvider) NewCharger(ctx context.Context, r *http.Request)
 	if bp.PaypalID == "" || bp.PaypalUserID == "" {
 		return nil, errors.New("Payments requires a paypal_payment_id and paypal_user_id pair")
 	}
-
-	return func(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
-		return p.charge(bp.PaypalID, bp.PaypalUserID, amount, currency, order, invoiceNumber)
-	}, nil
+	return &bp, nil
 }
 
 func prepareItemsFromOrder(order *models.Order) []paypalsdk.Item {
@@ -163,49 +186,124 @@ func (p *paypalPaymentProvider) updatePaymentWithOrder(paymentID string, order *
 }
 
 func (p *paypalPaymentProvider) charge(paymentID string, userID string, amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
-	payment, err := p.client.GetPayment(paymentID)
+	executeResult, err := p.execute(paymentID, userID, amount, currency, order, invoiceNumber)
 	if err != nil {
 		return "", err
 	}
+
+	return executeResult.ID, nil
+}
+
+func (p *paypalPaymentProvider) authorize(paymentID string, userID string, amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+	executeResult, err := p.execute(paymentID, userID, amount, currency, order, invoiceNumber)
+	if err != nil {
+		return "", err
+	}
+
+	for _, t := range executeResult.Transactions {
+		for _, related := range t.RelatedResources {
+			if related.Authorization != nil {
+				return related.Authorization.ID, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("The paypal payment %v has no authorization, it must be created with the authorize intent", paymentID)
+}
+
+func (p *paypalPaymentProvider) execute(paymentID string, userID string, amount uint64, currency string, order *models.Order, invoiceNumber int64) (*paypalsdk.ExecuteResponse, error) {
+	payment, err := p.client.GetPayment(paymentID)
+	if err != nil {
+		return nil, err
+	}
 	if len(payment.Transactions) != 1 {
-		return "", fmt.Errorf("The paypal payment must have exactly 1 transaction, had %v", len(payment.Transactions))
+		return nil, fmt.Errorf("The paypal payment must have exactly 1 transaction, had %v", len(payment.Transactions))
 	}
 
 	if payment.Transactions[0].Amount == nil {
-		return "", fmt.Errorf("No amount in this transaction %v", payment.Transactions[0])
+		return nil, fmt.Errorf("No amount in this transaction %v", payment.Transactions[0])
 	}
 
 	transactionValue := fmt.Sprintf("%.2f", float64(amount)/100)
 
 	if transactionValue != payment.Transactions[0].Amount.Total || payment.Transactions[0].Amount.Currency != currency {
-		return "", fmt.Errorf("The Amount in the transaction doesn't match the amount for the order: %v", payment.Transactions[0].Amount)
+		return nil, fmt.Errorf("The Amount in the transaction doesn't match the amount for the order: %v", payment.Transactions[0].Amount)
 	}
 
 	if err := p.updatePaymentWithOrder(paymentID, order, invoiceNumber); err != nil {
-		return "", errors.Wrap(err, "Updating the PayPal payment with order details failed")
+		return nil, errors.Wrap(err, "Updating the PayPal payment with order details failed")
 	}
 
-	executeResult, err := p.client.ExecuteApprovedPayment(paymentID, userID)
+	return p.client.ExecuteApprovedPayment(paymentID, userID)
+}
+
+func (p *paypalPaymentProvider) NewCapturer(ctx context.Context, r *http.Request) (payments.Capturer, error) {
+	return p.capture, nil
+}
+
+func (p *paypalPaymentProvider) capture(transactionID string, amount uint64, currency string) (string, error) {
+	amt := &paypalsdk.Amount{
+		Total:    formatAmount(amount),
+		Currency: currency,
+	}
+	capture, err := p.client.CaptureAuthorization(transactionID, amt, true)
 	if err != nil {
 		return "", err
 	}
+	return capture.ID, nil
+}
 
-	return executeResult.ID, nil
+func (p *paypalPaymentProvider) NewVoider(ctx context.Context, r *http.Request) (payments.Voider, error) {
+	return p.void, nil
+}
+
+func (p *paypalPaymentProvider) void(transactionID string) error {
+	_, err := p.client.VoidAuthorization(transactionID)
+	return err
 }
 
 func (p *paypalPaymentProvider) NewRefunder(ctx context.Context, r *http.Request) (payments.Refunder, error) {
 	return p.refund, nil
 }
 
-func (p *paypalPaymentProvider) refund(transactionID string, amount uint64, currency string) (string, error) {
-	amt := &paypalsdk.Amount{
-		Total:    formatAmount(amount),
-		Currency: currency,
+func (p *paypalPaymentProvider) refund(transactionID string, amount uint64, currency string, details *payments.RefundDetails) (string, error) {
+	refund := &paypalRefundRequest{
+		Amount: &paypalsdk.Amount{
+			Total:    formatAmount(amount),
+			Currency: currency,
+		},
+	}
+	if details != nil {
+		refund.Reason = details.Reason
+	}
+
+	id, err := p.refundResource("sale", transactionID, refund)
+	if err != nil {
+		// captured authorizations are not sales and have to be refunded
+		// through the capture resource instead
+		if errResp, ok := err.(*paypalsdk.ErrorResponse); ok && errResp.Response != nil && errResp.Response.StatusCode == http.StatusNotFound {
+			return p.refundResource("capture", transactionID, refund)
+		}
+		return "", err
 	}
-	ref, err := p.client.RefundSale(transactionID, amt)
+	return id, nil
+}
+
+type paypalRefundRequest struct {
+	Amount *paypalsdk.Amount `json:"amount"`
+	Reason string            `json:"reason,omitempty"`
+}
+
+func (p *paypalPaymentProvider) refundResource(resource, id string, refund *paypalRefundRequest) (string, error) {
+	req, err := p.client.NewRequest("POST", fmt.Sprintf("%s/v1/payments/%s/%s/refund", p.client.APIBase, resource, id), refund)
 	if err != nil {
 		return "", err
 	}
+
+	ref := &paypalsdk.Refund{}
+	if err := p.client.SendWithAuth(req, ref); err != nil {
+		return "", err
+	}
 	return ref.ID, nil
 }
 
@@ -224,8 +322,12 @@ func (p *paypalPaymentProvider) preauthorize(config *conf.Configuration, amount
 
 	redirectURI := config.SiteURL + "/gocommerce/paypal"
 	cancelURI := config.SiteURL + "/gocommerce/paypal/cancel"
+	intent := "sale"
+	if config.Payment.DelayedCapture {
+		intent = "authorize"
+	}
 	paymentResult, err := p.client.CreatePayment(paypalsdk.Payment{
-		Intent: "sale",
+		Intent: intent,
 		Payer: &paypalsdk.Payer{
 			PaymentMethod: "paypal",
 		},
@@ -275,6 +377,106 @@ func (p *paypalPaymentProvider) getExperience() (*paypalsdk.WebProfile, error) {
 	return profile, nil
 }
 
+type paypalWebhookEvent struct {
+	ID        string `json:"id"`
+	EventType string `json:"event_type"`
+	Resource  struct {
+		ID            string           `json:"id"`
+		SaleID        string           `json:"sale_id"`
+		CaptureID     string           `json:"capture_id"`
+		ParentPayment string           `json:"parent_payment"`
+		Amount        paypalsdk.Amount `json:"amount"`
+	} `json:"resource"`
+}
+
+type paypalVerifyWebhookRequest struct {
+	AuthAlgo         string          `json:"auth_algo"`
+	CertURL          string          `json:"cert_url"`
+	TransmissionID   string          `json:"transmission_id"`
+	TransmissionSig  string          `json:"transmission_sig"`
+	TransmissionTime string          `json:"transmission_time"`
+	WebhookID        string          `json:"webhook_id"`
+	WebhookEvent     json.RawMessage `json:"webhook_event"`
+}
+
+type paypalVerifyWebhookResponse struct {
+	VerificationStatus string `json:"verification_status"`
+}
+
+func (p *paypalPaymentProvider) VerifyWebhook(ctx context.Context, r *http.Request) (*payments.WebhookEvent, error) {
+	if p.webhookID == "" {
+		return nil, errors.New("PayPal configuration missing webhook_id")
+	}
+
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.verifyWebhookSignature(r.Header, payload); err != nil {
+		return nil, err
+	}
+
+	event := paypalWebhookEvent{}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, errors.Wrap(err, "Error parsing webhook event")
+	}
+
+	result := &payments.WebhookEvent{ID: event.ID}
+	switch event.EventType {
+	case "PAYMENT.SALE.REFUNDED", "PAYMENT.CAPTURE.REFUNDED":
+		result.Type = payments.RefundEvent
+	case "PAYMENT.SALE.REVERSED", "PAYMENT.CAPTURE.REVERSED":
+		result.Type = payments.ReversalEvent
+	default:
+		return result, nil
+	}
+
+	// charges store the payment ID, captured authorizations the capture ID
+	result.TransactionID = event.Resource.ParentPayment
+	if event.Resource.CaptureID != "" {
+		result.TransactionID = event.Resource.CaptureID
+	}
+	result.ProcessorID = event.Resource.ID
+	result.Currency = event.Resource.Amount.Currency
+	result.Amount, err = parseAmount(strings.TrimPrefix(event.Resource.Amount.Total, "-"))
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (p *paypalPaymentProvider) verifyWebhookSignature(header http.Header, payload []byte) error {
+	req, err := p.client.NewRequest("POST", fmt.Sprintf("%s/v1/notifications/verify-webhook-signature", p.client.APIBase), &paypalVerifyWebhookRequest{
+		AuthAlgo:         header.Get("Paypal-Auth-Algo"),
+		CertURL:          header.Get("Paypal-Cert-Url"),
+		TransmissionID:   header.Get("Paypal-Transmission-Id"),
+		TransmissionSig:  header.Get("Paypal-Transmission-Sig"),
+		TransmissionTime: header.Get("Paypal-Transmission-Time"),
+		WebhookID:        p.webhookID,
+		WebhookEvent:     json.RawMessage(payload),
+	})
+	if err != nil {
+		return err
+	}
+
+	verification := &paypalVerifyWebhookResponse{}
+	if err := p.client.SendWithAuth(req, verification); err != nil {
+		return err
+	}
+	if verification.VerificationStatus != "SUCCESS" {
+		return fmt.Errorf("PayPal webhook verification failed: %v", verification.VerificationStatus)
+	}
+	return nil
+}
+
+func parseAmount(total string) (uint64, error) {
+	amount, err := strconv.ParseFloat(total, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "Error parsing amount")
+	}
+	return uint64(amount*100 + 0.5), nil
+}
+
 func formatAmount(amount uint64) string {
 	return strconv.FormatFloat(float64(amount)/100, 'f', 2, 64)
 }
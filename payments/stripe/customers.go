@@ -0,0 +1,116 @@
+package stripe
+
+import (
+	"context"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	stripe "github.com/stripe/stripe-go"
+
+	"gocommerce/models"
+	"gocommerce/payments"
+)
+
+// chargeSource returns the source and customer to charge. Saved cards are
+// charged through the Stripe customer of the user, new cards are saved to it
+// first if the buyer asked for it or the order starts a subscription.
+func (s *stripePaymentProvider) chargeSource(db *gorm.DB, instanceID string, bp *stripeBodyParams, order *models.Order) (string, string, error) {
+	if bp.PaymentMethodID == "" && !bp.SavePaymentMethod && !order.HasSubscription() {
+		return bp.StripeToken, "", nil
+	}
+	if order.UserID == "" {
+		return "", "", errors.New("Saved payment methods require a logged in user")
+	}
+	if db == nil {
+		return "", "", errors.New("Saved payment methods require a database transaction")
+	}
+
+	if bp.PaymentMethodID != "" {
+		customer, err := models.GetPaymentCustomer(db, instanceID, order.UserID, payments.StripeProvider)
+		if err != nil {
+			return "", "", err
+		}
+		if customer == nil {
+			return "", "", errors.New("No saved payment methods found")
+		}
+		return bp.PaymentMethodID, customer.CustomerID, nil
+	}
+
+	customerID, err := s.customerID(db, instanceID, order)
+	if err != nil {
+		return "", "", errors.Wrap(err, "Error creating Stripe customer")
+	}
+	card, err := s.client.Cards.New(&stripe.CardParams{
+		Customer: &customerID,
+		Token:    &bp.StripeToken,
+	})
+	if err != nil {
+		return "", "", errors.Wrap(err, "Error saving card")
+	}
+	return card.ID, customerID, nil
+}
+
+// customerID returns the Stripe customer of the user that placed the order,
+// creating it on first use. The mapping must be written outside of the
+// payment transaction, otherwise a failed payment leaves an orphaned customer
+// behind and the next attempt creates another one.
+func (s *stripePaymentProvider) customerID(db *gorm.DB, instanceID string, order *models.Order) (string, error) {
+	existing, err := models.GetPaymentCustomer(db, instanceID, order.UserID, payments.StripeProvider)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil {
+		return existing.CustomerID, nil
+	}
+
+	params := &stripe.CustomerParams{
+		Email: &order.Email,
+	}
+	params.AddMetadata("user_id", order.UserID)
+	customer, err := s.client.Customers.New(params)
+	if err != nil {
+		return "", err
+	}
+
+	if rsp := db.Create(models.NewPaymentCustomer(instanceID, order.UserID, payments.StripeProvider, customer.ID)); rsp.Error != nil {
+		// a concurrent payment of the same user created the customer first
+		existing, err := models.GetPaymentCustomer(db, instanceID, order.UserID, payments.StripeProvider)
+		if err != nil || existing == nil {
+			return "", rsp.Error
+		}
+		return existing.CustomerID, nil
+	}
+	return customer.ID, nil
+}
+
+// NewRecurringCharger charges the default card of a Stripe customer.
+func (s *stripePaymentProvider) NewRecurringCharger(ctx context.Context, customerID, idempotencyKey string) (payments.Charger, error) {
+	return func(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+		return s.charge("", customerID, idempotencyKey, amount, currency, order, invoiceNumber, true)
+	}, nil
+}
+
+func (s *stripePaymentProvider) ListPaymentMethods(ctx context.Context, customerID string) ([]*payments.PaymentMethod, error) {
+	methods := []*payments.PaymentMethod{}
+	iter := s.client.Cards.List(&stripe.CardListParams{Customer: &customerID})
+	for iter.Next() {
+		card := iter.Card()
+		methods = append(methods, &payments.PaymentMethod{
+			ID:       card.ID,
+			Provider: payments.StripeProvider,
+			Brand:    string(card.Brand),
+			Last4:    card.Last4,
+			ExpMonth: card.ExpMonth,
+			ExpYear:  card.ExpYear,
+		})
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return methods, nil
+}
+
+func (s *stripePaymentProvider) DeletePaymentMethod(ctx context.Context, customerID, paymentMethodID string) error {
+	_, err := s.client.Cards.Del(paymentMethodID, &stripe.CardParams{Customer: &customerID})
+	return err
+}
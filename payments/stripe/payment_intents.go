@@ -0,0 +1,110 @@
+package stripe
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	stripe "github.com/stripe/stripe-go"
+
+	"gocommerce/models"
+	"gocommerce/payments"
+)
+
+const paymentIntentPrefix = "pi_"
+
+// isPaymentIntent returns whether a processor ID refers to a PaymentIntent
+// rather than a charge.
+func isPaymentIntent(processorID string) bool {
+	return strings.HasPrefix(processorID, paymentIntentPrefix)
+}
+
+// createPaymentIntent pays with a PaymentIntent, which supports Strong
+// Customer Authentication. If the card requires 3-D Secure, an
+// ActionRequiredError with the client secret of the intent is returned.
+func (s *stripePaymentProvider) createPaymentIntent(source string, amount uint64, currency string, order *models.Order, invoiceNumber int64, capture bool) (string, error) {
+	stripeAmount := int64(amount)
+	stripeDescription := fmt.Sprintf("Invoice No. %d", invoiceNumber)
+	captureMethod := string(stripe.PaymentIntentCaptureMethodAutomatic)
+	if !capture {
+		captureMethod = string(stripe.PaymentIntentCaptureMethodManual)
+	}
+
+	pi, err := s.client.PaymentIntents.New(&stripe.PaymentIntentParams{
+		Amount:             &stripeAmount,
+		AllowedSourceTypes: stripe.StringSlice([]string{"card"}),
+		CaptureMethod:      &captureMethod,
+		Confirm:            stripe.Bool(true),
+		Currency:           &currency,
+		Description:        &stripeDescription,
+		Shipping:           prepareShippingAddress(order.ShippingAddress),
+		Source:             &source,
+		Params: stripe.Params{
+			Metadata: map[string]string{
+				"order_id":       order.ID,
+				"invoice_number": fmt.Sprintf("%d", invoiceNumber),
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return paymentIntentResult(pi)
+}
+
+func (s *stripePaymentProvider) NewConfirmer(ctx context.Context, r *http.Request) (payments.Confirmer, error) {
+	return s.confirmPaymentIntent, nil
+}
+
+// confirmPaymentIntent checks the outcome of an intent after the buyer
+// completed the action. The client confirms the intent itself, so it is only
+// read here.
+func (s *stripePaymentProvider) confirmPaymentIntent(transactionID string) (string, error) {
+	if !isPaymentIntent(transactionID) {
+		return "", fmt.Errorf("Stripe payment %v is not a payment intent", transactionID)
+	}
+
+	pi, err := s.client.PaymentIntents.Get(transactionID, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return paymentIntentResult(pi)
+}
+
+func (s *stripePaymentProvider) capturePaymentIntent(transactionID string, amount uint64) (string, error) {
+	stripeAmount := int64(amount)
+	pi, err := s.client.PaymentIntents.Capture(transactionID, &stripe.PaymentIntentCaptureParams{
+		AmountToCapture: &stripeAmount,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return paymentIntentResult(pi)
+}
+
+// paymentIntentResult maps the status of an intent to the ID that is stored on
+// the transaction. Succeeded intents are tracked by their charge, so that
+// refunds and webhooks work as they do for plain charges. Intents that still
+// need to be captured are tracked by the intent itself.
+func paymentIntentResult(pi *stripe.PaymentIntent) (string, error) {
+	switch pi.Status {
+	case stripe.PaymentIntentStatusSucceeded:
+		if pi.Charges == nil || len(pi.Charges.Data) == 0 {
+			return "", fmt.Errorf("Stripe payment intent %v succeeded without a charge", pi.ID)
+		}
+		return pi.Charges.Data[0].ID, nil
+	case stripe.PaymentIntentStatusRequiresCapture:
+		return pi.ID, nil
+	case stripe.PaymentIntentStatusRequiresAction, stripe.PaymentIntentStatusRequiresSourceAction:
+		return "", &payments.ActionRequiredError{
+			ProcessorID:  pi.ID,
+			ClientSecret: pi.ClientSecret,
+		}
+	default:
+		return "", fmt.Errorf("Stripe payment intent %v failed with status %v", pi.ID, pi.Status)
+	}
+}
@@ -3,28 +3,38 @@ package stripe
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"encoding/json"
 
+	gcontext "gocommerce/context"
 	"gocommerce/models"
 	"gocommerce/payments"
 	"github.com/pkg/errors"
 	stripe "github.com/stripe/stripe-go"
 	"github.com/stripe/stripe-go/client"
+	"github.com/stripe/stripe-go/webhook"
 )
 
 type stripePaymentProvider struct {
-	client *client.API
+	client        *client.API
+	webhookSecret string
 }
 
 type stripeBodyParams struct {
-	StripeToken string `json:"stripe_token"`
+	StripeToken  string `json:"stripe_token"`
+	StripeSource string `json:"stripe_source"`
+
+	PaymentMethodID   string `json:"payment_method_id"`
+	SavePaymentMethod bool   `json:"save_payment_method"`
 }
 
 // Config contains the Stripe-specific configuration for payment providers.
 type Config struct {
-	SecretKey string `mapstructure:"secret_key" json:"secret_key"`
+	SecretKey     string `mapstructure:"secret_key" json:"secret_key"`
+	WebhookSecret string `mapstructure:"webhook_secret" json:"webhook_secret"`
 }
 
 // NewPaymentProvider creates a new Stripe payment provider using the provided configuration.
@@ -34,7 +44,8 @@ func NewPaymentProvider(config Config) (payments.Provider, error) {
 	}
 
 	s := stripePaymentProvider{
-		client: &client.API{},
+		client:        &client.API{},
+		webhookSecret: config.WebhookSecret,
 	}
 	s.client.Init(config.SecretKey, nil)
 	return &s, nil
@@ -45,24 +56,61 @@ func (s *stripePaymentProvider) Name() string {
 }
 
 func (s *stripePaymentProvider) NewCharger(ctx context.Context, r *http.Request) (payments.Charger, error) {
-	var bp stripeBodyParams
-	bod, err := r.GetBody()
+	return s.newCharger(ctx, r, true)
+}
+
+func (s *stripePaymentProvider) NewAuthorizer(ctx context.Context, r *http.Request) (payments.Authorizer, error) {
+	charge, err := s.newCharger(ctx, r, false)
 	if err != nil {
 		return nil, err
 	}
-	err = json.NewDecoder(bod).Decode(&bp)
+	return payments.Authorizer(charge), nil
+}
+
+func (s *stripePaymentProvider) newCharger(ctx context.Context, r *http.Request, capture bool) (payments.Charger, error) {
+	bp, err := parseBodyParams(r)
 	if err != nil {
 		return nil, err
 	}
-	if bp.StripeToken == "" {
-		return nil, errors.New("Stripe requires a stripe_token for creating a payment")
+	// the customer mapping is written outside of the payment transaction,
+	// the Stripe customer exists even if the payment fails
+	db := gcontext.GetRootDB(ctx)
+	if db == nil {
+		db = gcontext.GetDB(ctx)
 	}
+	instanceID := gcontext.GetInstanceID(ctx)
 
 	return func(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
-		return s.charge(bp.StripeToken, amount, currency, order, invoiceNumber)
+		if bp.StripeSource != "" {
+			if order.HasSubscription() {
+				return "", errors.New("Subscriptions can't be paid with a stripe_source")
+			}
+			return s.createPaymentIntent(bp.StripeSource, amount, currency, order, invoiceNumber, capture)
+		}
+		source, customerID, err := s.chargeSource(db, instanceID, bp, order)
+		if err != nil {
+			return "", err
+		}
+		return s.charge(source, customerID, "", amount, currency, order, invoiceNumber, capture)
 	}, nil
 }
 
+func parseBodyParams(r *http.Request) (*stripeBodyParams, error) {
+	var bp stripeBodyParams
+	bod, err := r.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	err = json.NewDecoder(bod).Decode(&bp)
+	if err != nil {
+		return nil, err
+	}
+	if bp.StripeToken == "" && bp.StripeSource == "" && bp.PaymentMethodID == "" {
+		return nil, errors.New("Stripe requires a stripe_token, stripe_source or payment_method_id for creating a payment")
+	}
+	return &bp, nil
+}
+
 func prepareShippingAddress(addr models.Address) *stripe.ShippingDetailsParams {
 	return &stripe.ShippingDetailsParams{
 		Address: &stripe.AddressParams{
@@ -77,13 +125,13 @@ func prepareShippingAddress(addr models.Address) *stripe.ShippingDetailsParams {
 	}
 }
 
-func (s *stripePaymentProvider) charge(token string, amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+func (s *stripePaymentProvider) charge(source, customerID, idempotencyKey string, amount uint64, currency string, order *models.Order, invoiceNumber int64, capture bool) (string, error) {
 	stripeAmount := int64(amount)
 	stripeDescription := fmt.Sprintf("Invoice No. %d", invoiceNumber)
-	ch, err := s.client.Charges.New(&stripe.ChargeParams{
+	params := &stripe.ChargeParams{
 		Amount:      &stripeAmount,
-		Source:      &stripe.SourceParams{Token: &token},
 		Currency:    &currency,
+		Capture:     &capture,
 		Description: &stripeDescription,
 		Shipping:    prepareShippingAddress(order.ShippingAddress),
 		Params: stripe.Params{
@@ -92,8 +140,18 @@ func (s *stripePaymentProvider) charge(token string, amount uint64, currency str
 				"invoice_number": fmt.Sprintf("%d", invoiceNumber),
 			},
 		},
-	})
+	}
+	if source != "" {
+		params.Source = &stripe.SourceParams{Token: &source}
+	}
+	if customerID != "" {
+		params.Customer = &customerID
+	}
+	if idempotencyKey != "" {
+		params.IdempotencyKey = &idempotencyKey
+	}
 
+	ch, err := s.client.Charges.New(params)
 	if err != nil {
 		return "", err
 	}
@@ -105,12 +163,16 @@ func (s *stripePaymentProvider) NewRefunder(ctx context.Context, r *http.Request
 	return s.refund, nil
 }
 
-func (s *stripePaymentProvider) refund(transactionID string, amount uint64, currency string) (string, error) {
+func (s *stripePaymentProvider) refund(transactionID string, amount uint64, currency string, details *payments.RefundDetails) (string, error) {
 	stripeAmount := int64(amount)
-	ref, err := s.client.Refunds.New(&stripe.RefundParams{
+	params := &stripe.RefundParams{
 		Charge: &transactionID,
 		Amount: &stripeAmount,
-	})
+	}
+	if details != nil && details.Reason != "" {
+		params.AddMetadata("reason", details.Reason)
+	}
+	ref, err := s.client.Refunds.New(params)
 	if err != nil {
 		return "", err
 	}
@@ -118,6 +180,104 @@ func (s *stripePaymentProvider) refund(transactionID string, amount uint64, curr
 	return ref.ID, err
 }
 
+func (s *stripePaymentProvider) NewCapturer(ctx context.Context, r *http.Request) (payments.Capturer, error) {
+	return s.capture, nil
+}
+
+func (s *stripePaymentProvider) capture(transactionID string, amount uint64, currency string) (string, error) {
+	if isPaymentIntent(transactionID) {
+		return s.capturePaymentIntent(transactionID, amount)
+	}
+
+	stripeAmount := int64(amount)
+	ch, err := s.client.Charges.Capture(transactionID, &stripe.CaptureParams{
+		Amount: &stripeAmount,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return ch.ID, nil
+}
+
+func (s *stripePaymentProvider) NewVoider(ctx context.Context, r *http.Request) (payments.Voider, error) {
+	return s.void, nil
+}
+
+// void releases an uncaptured charge. Stripe does this by refunding the
+// full amount of the charge.
+func (s *stripePaymentProvider) void(transactionID string) error {
+	if isPaymentIntent(transactionID) {
+		_, err := s.client.PaymentIntents.Cancel(transactionID, nil)
+		return err
+	}
+
+	_, err := s.client.Refunds.New(&stripe.RefundParams{
+		Charge: &transactionID,
+	})
+	return err
+}
+
 func (s *stripePaymentProvider) NewPreauthorizer(ctx context.Context, r *http.Request) (payments.Preauthorizer, error) {
 	return nil, errors.New("Stripe does not require preauthorization")
 }
+
+func (s *stripePaymentProvider) VerifyWebhook(ctx context.Context, r *http.Request) (*payments.WebhookEvent, error) {
+	if s.webhookSecret == "" {
+		return nil, errors.New("Stripe configuration missing webhook_secret")
+	}
+
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	event, err := webhook.ConstructEvent(payload, r.Header.Get("Stripe-Signature"), s.webhookSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &payments.WebhookEvent{ID: event.ID}
+	if event.Data == nil {
+		return result, nil
+	}
+
+	switch event.Type {
+	case "charge.refunded":
+		ch := stripe.Charge{}
+		if err := json.Unmarshal(event.Data.Raw, &ch); err != nil {
+			return nil, errors.Wrap(err, "Error parsing charge")
+		}
+		// the most recent refund is listed first
+		if ch.Refunds == nil || len(ch.Refunds.Data) == 0 {
+			return nil, fmt.Errorf("Refunded charge %v has no refunds", ch.ID)
+		}
+		latest := ch.Refunds.Data[0]
+		result.Type = payments.RefundEvent
+		result.TransactionID = ch.ID
+		result.ProcessorID = latest.ID
+		result.Amount = uint64(latest.Amount)
+		result.Currency = strings.ToUpper(string(ch.Currency))
+		// earlier refunds may not have been delivered yet
+		for _, refund := range ch.Refunds.Data {
+			result.Refunds = append(result.Refunds, &payments.WebhookRefund{
+				ProcessorID: refund.ID,
+				Amount:      uint64(refund.Amount),
+			})
+		}
+	case "charge.dispute.created":
+		dispute := stripe.Dispute{}
+		if err := json.Unmarshal(event.Data.Raw, &dispute); err != nil {
+			return nil, errors.Wrap(err, "Error parsing dispute")
+		}
+		if dispute.Charge == nil {
+			return nil, fmt.Errorf("Dispute %v has no charge", dispute.ID)
+		}
+		result.Type = payments.DisputeEvent
+		result.TransactionID = dispute.Charge.ID
+		result.ProcessorID = dispute.ID
+		result.Amount = uint64(dispute.Amount)
+		result.Currency = strings.ToUpper(string(dispute.Currency))
+	}
+
+	return result, nil
+}